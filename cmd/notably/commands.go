@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/term"
+
+	"notably/pkg/client"
+)
+
+func cmdLogin(a *app, ctx context.Context, args []string) error {
+	server := defaultServer
+	if cfg, err := loadConfig(a.configPath); err == nil {
+		server = cfg.Server
+	}
+
+	fs := a.flagSet("login")
+	fs.StringVar(&server, "server", server, "the URL of the Notably server")
+	userID := fs.String("user", "", "the user ID (an email address), prompted for if not given")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var err error
+	if *userID == "" {
+		fmt.Fprint(a.stderr, "User ID: ")
+		if *userID, err = a.readLine(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprint(a.stderr, "Password: ")
+	var password string
+	if a.stdinFile != nil && term.IsTerminal(int(a.stdinFile.Fd())) {
+		var pw []byte
+		pw, err = term.ReadPassword(int(a.stdinFile.Fd()))
+		fmt.Fprintln(a.stderr)
+		password = string(pw)
+	} else {
+		// Not a terminal, so the password is being piped in.
+		password, err = a.readLine()
+	}
+	if err != nil {
+		return fmt.Errorf("error reading password: %s", err.Error())
+	}
+
+	c, err := client.New(server)
+	if err != nil {
+		return err
+	}
+	user, err := c.Login(ctx, *userID, password)
+	if err != nil {
+		return err
+	}
+
+	err = saveConfig(a.configPath, &config{Server: server, UserID: user.UserID, Password: password})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.stdout, "Logged in to %s as %s\n", server, user.UserID)
+	return nil
+}
+
+func cmdLogout(a *app, ctx context.Context, args []string) error {
+	if err := parseFlags(a.flagSet("logout"), args); err != nil {
+		return err
+	}
+
+	err := os.Remove(a.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("not logged in")
+	}
+	if err != nil {
+		return fmt.Errorf("error removing config file '%s': %s", a.configPath, err.Error())
+	}
+
+	fmt.Fprintln(a.stdout, "Logged out")
+	return nil
+}
+
+// noteText gets the text for a new note: from -m, or else piped into stdin, or else
+// from the editor.
+func (a *app) noteText(message string, messageSet bool) (string, error) {
+	if messageSet {
+		return message, nil
+	}
+
+	if a.stdinFile == nil || !term.IsTerminal(int(a.stdinFile.Fd())) {
+		data, err := io.ReadAll(a.stdin)
+		if err != nil {
+			return "", fmt.Errorf("error reading note from stdin: %s", err.Error())
+		}
+		return string(data), nil
+	}
+
+	return a.edit("")
+}
+
+// isFlagSet tells us whether a flag was given on the command line, even if empty.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+func cmdNew(a *app, ctx context.Context, args []string) error {
+	fs := a.flagSet("new")
+	message := fs.String("m", "", "the note text")
+	output := fs.String("o", outputTable, "output format: table or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validOutputFormat(*output); err != nil {
+		return err
+	}
+
+	text, err := a.noteText(*message, isFlagSet(fs, "m"))
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return fmt.Errorf("empty note, not saved")
+	}
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+	note, err := c.CreateNote(ctx, text)
+	if err != nil {
+		return err
+	}
+
+	return printNotes(a.stdout, *output, []*client.Note{note})
+}
+
+// parseTime parses a time given on the command line, either as a Unix timestamp
+// or as a date (YYYY-MM-DD, in local time).
+func parseTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is neither a Unix timestamp nor a YYYY-MM-DD date", value)
+	}
+	return t.Unix(), nil
+}
+
+// listNotes is "notably ls" and "notably search", which only differ in where the
+// search text comes from.
+func (a *app) listNotes(ctx context.Context, name string, args []string) error {
+	var opts client.ListOptions
+	fs := a.flagSet(name)
+	max := fs.Int("n", 0, "the maximum number of notes to list, 0 for all")
+	fs.StringVar(&opts.SortBy, "sort", client.SortCreated, "sort by 'created' or 'updated'")
+	fs.BoolVar(&opts.Descending, "desc", false, "newest first")
+	if name == "ls" {
+		fs.StringVar(&opts.Query, "q", "", "only notes containing this text, ignoring case")
+	}
+	after := fs.String("after", "", "only notes created after this Unix timestamp or YYYY-MM-DD date")
+	before := fs.String("before", "", "only notes created before this Unix timestamp or YYYY-MM-DD date")
+	output := fs.String("o", outputTable, "output format: table or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validOutputFormat(*output); err != nil {
+		return err
+	}
+
+	if name == "search" {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errUsage
+		}
+		opts.Query = fs.Arg(0)
+	} else if fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var err error
+	if opts.CreatedAfter, err = parseTime(*after); err != nil {
+		return err
+	}
+	if opts.CreatedBefore, err = parseTime(*before); err != nil {
+		return err
+	}
+	if *max > 0 {
+		// The server caps the page size, so we may still need more than one page.
+		opts.Limit = *max
+	}
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	notes := []*client.Note{}
+	it := c.Notes(ctx, opts)
+	for (*max <= 0 || len(notes) < *max) && it.Next() {
+		notes = append(notes, it.Note())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return printNotes(a.stdout, *output, notes)
+}
+
+func cmdList(a *app, ctx context.Context, args []string) error {
+	return a.listNotes(ctx, "ls", args)
+}
+
+func cmdSearch(a *app, ctx context.Context, args []string) error {
+	return a.listNotes(ctx, "search", args)
+}
+
+func cmdCat(a *app, ctx context.Context, args []string) error {
+	fs := a.flagSet("cat")
+	output := fs.String("o", outputTable, "output format: table (just the note text) or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validOutputFormat(*output); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	notes := []*client.Note{}
+	for _, noteID := range fs.Args() {
+		note, err := c.GetNote(ctx, noteID)
+		if err != nil {
+			return err
+		}
+		notes = append(notes, note)
+	}
+
+	if *output == outputJSON {
+		return printJSON(a.stdout, notes)
+	}
+	for _, note := range notes {
+		fmt.Fprintln(a.stdout, note.Note)
+	}
+	return nil
+}
+
+func cmdEdit(a *app, ctx context.Context, args []string) error {
+	fs := a.flagSet("edit")
+	message := fs.String("m", "", "the new note text, instead of using $EDITOR")
+	output := fs.String("o", outputTable, "output format: table or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validOutputFormat(*output); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	noteID := fs.Arg(0)
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+	note, err := c.GetNote(ctx, noteID)
+	if err != nil {
+		return err
+	}
+
+	text := *message
+	if !isFlagSet(fs, "m") {
+		if text, err = a.edit(note.Note); err != nil {
+			return err
+		}
+	}
+	if text == "" {
+		return fmt.Errorf("empty note, not saved")
+	}
+	if text == note.Note {
+		fmt.Fprintln(a.stderr, "Note unchanged")
+		return nil
+	}
+
+	note, err = c.UpdateNote(ctx, noteID, text)
+	if err != nil {
+		return err
+	}
+
+	return printNotes(a.stdout, *output, []*client.Note{note})
+}
+
+func cmdRemove(a *app, ctx context.Context, args []string) error {
+	fs := a.flagSet("rm")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, noteID := range fs.Args() {
+		if err := c.DeleteNote(ctx, noteID); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.stdout, "Deleted %s\n", noteID)
+	}
+	return nil
+}
+
+func cmdExport(a *app, ctx context.Context, args []string) error {
+	fs := a.flagSet("export")
+	file := fs.String("f", "", "the file to export to, instead of stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	c, err := a.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	notes := []*client.Note{}
+	it := c.Notes(ctx, client.ListOptions{})
+	for it.Next() {
+		notes = append(notes, it.Note())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return printJSON(a.stdout, notes)
+	}
+
+	f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("error creating export file: %s", err.Error())
+	}
+	if err := printJSON(f, notes); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing export file: %s", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing export file: %s", err.Error())
+	}
+
+	fmt.Fprintf(a.stderr, "Exported %d notes to %s\n", len(notes), *file)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The environment variable which overrides where the config file lives.
+const configPathEnvVar = "NOTABLY_CONFIG"
+
+const defaultServer = "http://localhost:8080"
+
+// config is what "notably login" saves, so that the other commands can log in.
+// notablyd's login session is a cookie which expires, so we keep the credentials
+// rather than the session. Hence the config file is only readable by its owner.
+type config struct {
+	Server   string `json:"server"`
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+}
+
+// defaultConfigPath is $NOTABLY_CONFIG if set, or else notably/config.json under the
+// user's config directory (e.g. ~/.config/notably/config.json on Linux).
+func defaultConfigPath() string {
+	if path := os.Getenv(configPathEnvVar); path != "" {
+		return path
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		// No $HOME? Fall back to the current directory.
+		return "notably.json"
+	}
+	return filepath.Join(dir, "notably", "config.json")
+}
+
+// loadConfig reads the config file. A missing config file means nobody has logged in.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("not logged in, please run 'notably login' first")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file '%s': %s", path, err.Error())
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %s", path, err.Error())
+	}
+	if cfg.Server == "" || cfg.UserID == "" {
+		return nil, fmt.Errorf("config file '%s' is incomplete, please run 'notably login' again", path)
+	}
+
+	return &cfg, nil
+}
+
+// saveConfig writes the config file, readable only by its owner since it has a password in it.
+func saveConfig(path string, cfg *config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("error creating config directory: %s", err.Error())
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error marshalling config: %s", err.Error())
+	}
+
+	// WriteFile() only uses the permissions when creating the file, so make sure of them.
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("error writing config file '%s': %s", path, err.Error())
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		return fmt.Errorf("error setting permissions of config file '%s': %s", path, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editText lets the user edit some text in their editor: $VISUAL, or $EDITOR, or vi.
+// The editor setting may have arguments in it, e.g. "code --wait".
+func editText(initial string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	tmp, err := os.CreateTemp("", "notably-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file for editing: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(initial)
+	tmp.Close()
+	if err != nil {
+		return "", fmt.Errorf("error writing temp file for editing: %s", err.Error())
+	}
+
+	editorArgs := strings.Fields(editor)
+	cmd := exec.Command(editorArgs[0], append(editorArgs[1:], tmp.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running editor '%s': %s", editor, err.Error())
+	}
+
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return "", fmt.Errorf("error reading edited temp file: %s", err.Error())
+	}
+
+	// Editors like to add a newline at the end, which isn't really part of the note.
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
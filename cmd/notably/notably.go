@@ -0,0 +1,178 @@
+// notably is a command line client for the Notably API.
+//
+// Run "notably help" to see what it can do.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"notably/pkg/client"
+)
+
+// command is a notably subcommand, e.g. "ls".
+type command struct {
+	usage   string // The arguments, shown after the command name.
+	summary string
+	run     func(a *app, ctx context.Context, args []string) error
+}
+
+// The commands. These are set up in init(), since the commands themselves look up
+// their usage in here.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"login":  {"[-server URL] [-user ID]", "Log in, saving the credentials in the config file", cmdLogin},
+		"logout": {"", "Log out, removing the saved credentials", cmdLogout},
+		"new":    {"[-m TEXT] [-o table|json]", "Create a note from -m, stdin or $EDITOR", cmdNew},
+		"ls":     {"[list flags]", "List notes", cmdList},
+		"search": {"[list flags] TEXT", "List notes containing TEXT, ignoring case", cmdSearch},
+		"cat":    {"[-o table|json] ID...", "Show notes", cmdCat},
+		"edit":   {"[-m TEXT] [-o table|json] ID", "Change a note with -m or $EDITOR", cmdEdit},
+		"rm":     {"ID...", "Delete notes", cmdRemove},
+		"export": {"[-f FILE]", "Export all notes as JSON to FILE or stdout", cmdExport},
+	}
+}
+
+// app is what the commands run with.
+type app struct {
+	configPath string
+	stdin      *bufio.Reader
+	stdinFile  *os.File // Set if stdin is a real file, so we can tell if it's a terminal.
+	stdout     io.Writer
+	stderr     io.Writer
+	edit       func(initial string) (string, error)
+}
+
+// errUsage means the command line was wrong, and the usage has already been shown.
+var errUsage = errors.New("usage error")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line, returning the exit code.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{
+		stdin:  bufio.NewReader(stdin),
+		stdout: stdout,
+		stderr: stderr,
+		edit:   editText,
+	}
+	if f, ok := stdin.(*os.File); ok {
+		a.stdinFile = f
+	}
+
+	fs := flag.NewFlagSet("notably", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&a.configPath, "config", defaultConfigPath(), "the config file, also settable with $"+configPathEnvVar)
+	fs.Usage = func() { a.usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	name := fs.Arg(0)
+	if name == "" || name == "help" {
+		a.usage(fs)
+		return 2
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "notably: unknown command '%s'\n", name)
+		a.usage(fs)
+		return 2
+	}
+
+	err := cmd.run(a, ctx, fs.Args()[1:])
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "notably %s: %s\n", name, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func (a *app) usage(fs *flag.FlagSet) {
+	fmt.Fprintln(a.stderr, "Usage: notably [-config FILE] COMMAND [ARGS]")
+	fmt.Fprintln(a.stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(a.stderr, "  %-7s %-32s %s\n", name, commands[name].usage, commands[name].summary)
+	}
+
+	fmt.Fprintln(a.stderr, "\nRun 'notably COMMAND -h' for the flags of a command.")
+	fmt.Fprintln(a.stderr, "\nGlobal flags:")
+	fs.PrintDefaults()
+}
+
+// flagSet makes the flag set for a command, which prints its errors and usage to stderr.
+func (a *app) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("notably "+name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "Usage: notably %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a command's flags, turning the errors into errUsage, since the
+// flag package has already complained about them.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	return nil
+}
+
+// readLine reads a line from stdin, without the line ending.
+func (a *app) readLine() (string, error) {
+	line, err := a.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("error reading from stdin: %s", err.Error())
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// connect logs in with the credentials saved by "notably login".
+func (a *app) connect(ctx context.Context) (*client.Client, error) {
+	cfg, err := loadConfig(a.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.New(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.Login(ctx, cfg.UserID, cfg.Password)
+	if errors.Is(err, client.ErrInvalidCredentials) {
+		return nil, fmt.Errorf("the saved credentials for '%s' no longer work, please run 'notably login' again",
+			cfg.UserID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error logging in to '%s': %w", cfg.Server, err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"notably/cmd/notablyd/routes"
+	"notably/pkg/client"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestCLI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // Which stops the router's background work.
+	srv := httptest.NewServer(routes.NewRouter(routes.RouterConfig{Context: ctx}))
+	defer srv.Close()
+	// The login cookie is for "localhost", so the cookie jar won't hand it back to 127.0.0.1.
+	server := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	userID := "testuser@testdomain.xyz"
+	c, err := client.New(server)
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+	if _, err := c.Register(ctx, userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed registering user: %v", err)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	// notably runs the command line, failing the test if the exit code isn't as expected.
+	notably := func(wantCode int, stdin string, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-config", configPath}, args...)
+		code := run(ctx, args, strings.NewReader(stdin), &stdout, &stderr)
+		if code != wantCode {
+			t.Fatalf("Expected exit code %d from 'notably %s', but got %d. Stderr:\n%s",
+				wantCode, strings.Join(args, " "), code, stderr.String())
+		}
+		fmt.Printf("TEST CLI: notably %s\n%s", strings.Join(args[2:], " "), stdout.String())
+		return stdout.String()
+	}
+
+	// Not logged in yet. Should fail.
+	notably(1, "", "ls")
+
+	// Wrong password. Should fail, and not save anything.
+	notably(1, "decafbad\n", "login", "-server", server, "-user", userID)
+	if _, err := os.Stat(configPath); err == nil {
+		t.Fatalf("Config file saved despite the login failing")
+	}
+
+	notably(0, userID+"\ncafed00d\n", "login", "-server", server)
+	info, err := os.Stat(configPath)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a config file only readable by its owner, got: %v, error: %v", info, err)
+	}
+
+	// Create notes with -m and from stdin.
+	var note client.Note
+	out := notably(0, "", "new", "-o", "json", "-m", "Buy milk")
+	if err := json.Unmarshal([]byte(out), &[]*client.Note{&note}); err != nil || note.Note != "Buy milk" {
+		t.Fatalf("Expected the new note as JSON, but got: %s", out)
+	}
+	notably(0, "Walk the dog\nand the cat", "new")
+
+	out = notably(0, "", "cat", note.NoteID)
+	if out != "Buy milk\n" {
+		t.Fatalf("Expected to cat the note text, but got: %s", out)
+	}
+
+	notably(0, "", "edit", "-m", "Buy oat milk", note.NoteID)
+
+	var notes []*client.Note
+	out = notably(0, "", "ls", "-o", "json")
+	if err := json.Unmarshal([]byte(out), &notes); err != nil || len(notes) != 2 {
+		t.Fatalf("Expected to list 2 notes, but got: %s", out)
+	}
+	out = notably(0, "", "ls", "-n", "1")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("Expected a table with a header and 1 note, but got: %s", out)
+	}
+
+	out = notably(0, "", "search", "-o", "json", "OAT")
+	if err := json.Unmarshal([]byte(out), &notes); err != nil || len(notes) != 1 || notes[0].Note != "Buy oat milk" {
+		t.Fatalf("Expected to find the edited note, but got: %s", out)
+	}
+
+	exportPath := filepath.Join(t.TempDir(), "export.json")
+	notably(0, "", "export", "-f", exportPath)
+	data, err := os.ReadFile(exportPath)
+	if err != nil || json.Unmarshal(data, &notes) != nil || len(notes) != 2 {
+		t.Fatalf("Expected to export 2 notes, but got: %s, error: %v", data, err)
+	}
+
+	notably(0, "", "rm", note.NoteID)
+	notably(1, "", "cat", note.NoteID)
+
+	// Bad usage.
+	notably(2, "", "bogus")
+	notably(2, "", "search")
+
+	notably(0, "", "logout")
+	notably(1, "", "ls")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"notably/pkg/client"
+)
+
+// The output formats for notes.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// How much of a note the table shows.
+const tableNoteWidth = 60
+
+func validOutputFormat(format string) error {
+	if format != outputTable && format != outputJSON {
+		return fmt.Errorf("output format must be '%s' or '%s', not '%s'", outputTable, outputJSON, format)
+	}
+	return nil
+}
+
+// printNotes prints notes as a table, or as a JSON array.
+func printNotes(w io.Writer, format string, notes []*client.Note) error {
+	if format == outputJSON {
+		return printJSON(w, notes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tUPDATED\tNOTE")
+	for _, note := range notes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", note.NoteID,
+			formatTimestamp(note.CreationTimestamp), formatTimestamp(note.UpdateTimestamp), summarize(note.Note))
+	}
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(v)
+}
+
+func formatTimestamp(ts int64) string {
+	return time.Unix(ts, 0).Local().Format("2006-01-02 15:04")
+}
+
+// summarize squashes a note into a single line which fits in the table.
+func summarize(note string) string {
+	line := strings.Join(strings.Fields(note), " ")
+	if runes := []rune(line); len(runes) > tableNoteWidth {
+		line = string(runes[:tableNoteWidth-3]) + "..."
+	}
+	return line
+}
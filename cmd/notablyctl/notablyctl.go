@@ -0,0 +1,248 @@
+// notablyctl is a tool for operators, which works on notablyd's data without going
+// through notablyd, e.g. when it can't start.
+//
+// With the go-memdb storage backend, the data only exists inside a running notablyd,
+// so what there is on disk is users' exports (see GET /api/v1/export), e.g. kept as
+// backups, and that's what notablyctl works on for now. Resetting passwords, disabling
+// accounts, and compacting, snapshotting and migrating the storage need a storage
+// backend which keeps its data on disk.
+//
+// Run "notablyctl help" to see what it can do.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"notably/internal/platform/archive"
+)
+
+// command is a notablyctl subcommand, e.g. "check".
+type command struct {
+	usage   string // The arguments, shown after the command name.
+	summary string
+	run     func(a *app, args []string) error
+}
+
+// The commands. These are set up in init(), since the commands themselves look up
+// their usage in here.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"users":   {"EXPORT...", "List whose exports they are, and how many notes they have", cmdUsers},
+		"check":   {"EXPORT...", "Check exports against their manifests", cmdCheck},
+		"reindex": {"[-user ID] [-format zip|tar.gz] -o FILE EXPORT", "Write an export again, with a new manifest", cmdReindex},
+	}
+}
+
+// app is what the commands run with.
+type app struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var (
+	// errUsage means the command line was wrong, and the usage has already been shown.
+	errUsage = errors.New("usage error")
+	// errProblems means the command found problems, and has already said what they are.
+	errProblems = errors.New("problems found")
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line, returning the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	a := &app{stdout: stdout, stderr: stderr}
+
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" || name == "help" || name == "-h" || name == "-help" {
+		a.usage()
+		return 2
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "notablyctl: unknown command '%s'\n", name)
+		a.usage()
+		return 2
+	}
+
+	err := cmd.run(a, args[1:])
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+	if errors.Is(err, errProblems) {
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "notablyctl %s: %s\n", name, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func (a *app) usage() {
+	fmt.Fprintln(a.stderr, "Usage: notablyctl COMMAND [ARGS]")
+	fmt.Fprintln(a.stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(a.stderr, "  %-8s %-48s %s\n", name, commands[name].usage, commands[name].summary)
+	}
+
+	fmt.Fprintln(a.stderr, "\nAn EXPORT is a zip or tar.gz from GET /api/v1/export.")
+	fmt.Fprintln(a.stderr, "Run 'notablyctl COMMAND -h' for the flags of a command.")
+}
+
+// flagSet makes the flag set for a command, which prints its errors and usage to stderr.
+func (a *app) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("notablyctl "+name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "Usage: notablyctl %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a command's flags, and checks that there are at least minArgs
+// arguments after them, turning the errors into errUsage, since they've already been
+// complained about.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func readExport(file string) (*archive.Export, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	export, err := archive.ReadExport(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return export, nil
+}
+
+func cmdUsers(a *app, args []string) error {
+	fs := a.flagSet("users")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	failed := false
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tNOTES\tEXPORTED\tFILE")
+	for _, file := range fs.Args() {
+		export, err := readExport(file)
+		if err == nil && export.Manifest == nil {
+			err = fmt.Errorf("%s: %w", file, export.ManifestErr)
+		}
+		if err != nil {
+			fmt.Fprintf(a.stderr, "notablyctl users: %s\n", err.Error())
+			failed = true
+			continue
+		}
+		m := export.Manifest
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", m.UserID, m.NoteCount,
+			time.Unix(m.ExportedAt, 0).Local().Format("2006-01-02 15:04"), file)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed {
+		return errProblems
+	}
+	return nil
+}
+
+func cmdCheck(a *app, args []string) error {
+	fs := a.flagSet("check")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, file := range fs.Args() {
+		export, err := readExport(file)
+		if err != nil {
+			fmt.Fprintf(a.stderr, "notablyctl check: %s\n", err.Error())
+			failed = true
+			continue
+		}
+		problems := export.Check()
+		if len(problems) == 0 {
+			fmt.Fprintf(a.stdout, "%s: OK, %d notes of %s\n", file, export.Manifest.NoteCount, export.Manifest.UserID)
+			continue
+		}
+		failed = true
+		fmt.Fprintf(a.stdout, "%s: %d problems\n", file, len(problems))
+		for _, problem := range problems {
+			fmt.Fprintf(a.stdout, "  %s\n", problem)
+		}
+	}
+	if failed {
+		return errProblems
+	}
+	return nil
+}
+
+func cmdReindex(a *app, args []string) error {
+	fs := a.flagSet("reindex")
+	userID := fs.String("user", "", "whose export it is, if not the manifest's user")
+	format := fs.String("format", archive.FormatZip, "the format to write, 'zip' or 'tar.gz'")
+	out := fs.String("o", "", "the file to write, which mustn't exist yet")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	if *out == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	export, err := readExport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Never over the top of something, in case it's the only copy.
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	problems, err := export.Reindex(f, *format, *userID, time.Now())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(a.stderr, "notablyctl reindex: left out %s\n", problem)
+	}
+	fmt.Fprintf(a.stdout, "Wrote %s\n", *out)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/archive"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestNotablyctl(t *testing.T) {
+	dir := t.TempDir()
+
+	// writeExport writes an export of the notes, as notablyd would, returning its file.
+	writeExport := func(name, format, userID string, notes ...*model.Note) string {
+		var buf bytes.Buffer
+		aw, err := archive.NewWriter(&buf, format, userID, time.Unix(1700001000, 0))
+		if err != nil {
+			t.Fatalf("Failed creating writer: %v", err)
+		}
+		for _, note := range notes {
+			if err := aw.WriteNote(note); err != nil {
+				t.Fatalf("Failed writing note: %v", err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, buf.Bytes(), 0o600); err != nil {
+			t.Fatalf("Failed writing export: %v", err)
+		}
+		return file
+	}
+
+	// notablyctl runs the command line, failing the test if the exit code isn't as expected.
+	notablyctl := func(wantCode int, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, &stdout, &stderr); code != wantCode {
+			t.Fatalf("Expected exit code %d from 'notablyctl %s', but got %d. Stderr:\n%s",
+				wantCode, strings.Join(args, " "), code, stderr.String())
+		}
+		fmt.Printf("TEST NOTABLYCTL: notablyctl %s\n%s%s", strings.Join(args, " "), stdout.String(), stderr.String())
+		return stdout.String()
+	}
+
+	alice := writeExport("alice.zip", archive.FormatZip, "alice@testdomain.xyz",
+		&model.Note{NoteID: "one", CreationTimestamp: 1700000000, UpdateTimestamp: 1700000000, Version: 1, Note: "First"},
+		&model.Note{NoteID: "two", CreationTimestamp: 1700000100, UpdateTimestamp: 1700000200, Version: 4, Note: "Second #b"})
+	bob := writeExport("bob.tar.gz", archive.FormatTarGz, "bob@testdomain.xyz",
+		&model.Note{NoteID: "three", CreationTimestamp: 1700000000, UpdateTimestamp: 1700000000, Version: 2, Note: "Third"})
+
+	notablyctl(2)
+	notablyctl(2, "frobnicate")
+	notablyctl(2, "users")
+
+	out := notablyctl(0, "users", alice, bob)
+	if !strings.Contains(out, "alice@testdomain.xyz  2") || !strings.Contains(out, "bob@testdomain.xyz    1") {
+		t.Fatalf("Expected both users and their note counts, but got:\n%s", out)
+	}
+	notablyctl(0, "check", alice, bob)
+
+	// Something which isn't an export at all, or whose manifest has gone.
+	junk := filepath.Join(dir, "junk.zip")
+	if err := os.WriteFile(junk, []byte("not a zip"), 0o600); err != nil {
+		t.Fatalf("Failed writing junk: %v", err)
+	}
+	notablyctl(1, "users", alice, junk)
+	notablyctl(1, "check", junk)
+	// A zip of a note's Markdown file, as if the manifest had been lost.
+	noManifest := filepath.Join(dir, "nomanifest.zip")
+	markdown, err := archive.MarshalMarkdown(&model.Note{NoteID: "four", CreationTimestamp: 1700000000, Version: 1, Note: "Fourth"})
+	if err != nil {
+		t.Fatalf("Failed writing Markdown: %v", err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if f, err := zw.Create("notes/four.md"); err != nil {
+		t.Fatalf("Failed creating zip: %v", err)
+	} else if _, err := f.Write(markdown); err != nil {
+		t.Fatalf("Failed writing zip: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed closing zip: %v", err)
+	}
+	if err := os.WriteFile(noManifest, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("Failed writing zip: %v", err)
+	}
+	if out := notablyctl(1, "check", noManifest); !strings.Contains(out, "manifest.json") {
+		t.Fatalf("Expected the check to say the manifest is missing, but got:\n%s", out)
+	}
+
+	// Reindexing it needs to be told whose it is, and won't overwrite anything.
+	reindexed := filepath.Join(dir, "reindexed.tar.gz")
+	notablyctl(1, "reindex", "-o", reindexed, noManifest)
+	notablyctl(1, "reindex", "-user", "carol@testdomain.xyz", "-o", alice, noManifest)
+	notablyctl(0, "reindex", "-user", "carol@testdomain.xyz", "-format", "tar.gz", "-o", reindexed, noManifest)
+	notablyctl(0, "check", reindexed)
+	if out := notablyctl(0, "users", reindexed); !strings.Contains(out, "carol@testdomain.xyz  1") {
+		t.Fatalf("Expected the reindexed export to be carol's, with the one note, but got:\n%s", out)
+	}
+}
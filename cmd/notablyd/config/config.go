@@ -0,0 +1,713 @@
+// Package config is the notablyd configuration: what it is, where it comes from,
+// and whether it makes sense.
+//
+// Each setting has a default, which can be overridden by a config file (YAML or TOML,
+// going by the file extension), which can be overridden by an environment variable,
+// which can be overridden by a command line flag. For the setting "cookie.domain",
+// say, these are:
+//
+//	cookie:                       # YAML config file
+//	    domain: notably.example.com
+//	NOTABLYD_COOKIE_DOMAIN=notably.example.com
+//	notablyd -cookie.domain=notably.example.com
+//
+// The config file is given with the -config flag, or the NOTABLYD_CONFIG environment
+// variable. Without one, it's just the defaults, environment variables and flags.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The prefix of the environment variables which override settings.
+	EnvPrefix = "NOTABLYD_"
+
+	// The environment variable giving the config file, if there's no -config flag.
+	ConfigPathEnvVar = EnvPrefix + "CONFIG"
+
+	// The only storage backend there is, for now.
+	StorageBackendMemDB = "memdb"
+
+	// The values of tls.client_auth, i.e. whether clients must have a certificate (mutual TLS).
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional" // Verified if given.
+	ClientAuthRequire  = "require"
+
+	// The values of log.format.
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	// The only rate limit backend there is, for now.
+	RateLimitBackendMemory = "memory"
+)
+
+// Duration is a time.Duration which is given as a string like "5s" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("'%s' is not a duration like '30s' or '1m30s'", text)
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Config is the whole notablyd configuration.
+// The yaml (and toml) tags are the setting names, from which the environment
+// variable and flag names are built.
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	TLS       TLS       `yaml:"tls" toml:"tls"`
+	Cookie    Cookie    `yaml:"cookie" toml:"cookie"`
+	CORS      CORS      `yaml:"cors" toml:"cors"`
+	Storage   Storage   `yaml:"storage" toml:"storage"`
+	Quota     Quota     `yaml:"quota" toml:"quota"`
+	Log       Log       `yaml:"log" toml:"log"`
+	Limits    Limits    `yaml:"limits" toml:"limits"`
+	RateLimit RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+	Metrics   Metrics   `yaml:"metrics" toml:"metrics"`
+	Tracing   Tracing   `yaml:"tracing" toml:"tracing"`
+	Health    Health    `yaml:"health" toml:"health"`
+	Audit     Audit     `yaml:"audit" toml:"audit"`
+	Collab    Collab    `yaml:"collab" toml:"collab"`
+	Webhooks  Webhooks  `yaml:"webhooks" toml:"webhooks"`
+	Import    Import    `yaml:"import" toml:"import"`
+	Features  Features  `yaml:"features" toml:"features"`
+}
+
+type Server struct {
+	ListenAddress   string   `yaml:"listen_address" toml:"listen_address"`     // host:port, or just :port for all interfaces.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"` // How long in-flight requests get to finish.
+	// The proxies in front of us, whose X-Forwarded-For headers are believed, as a comma
+	// separated list of addresses or CIDR ranges. Empty means none are.
+	TrustedProxies string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// TrustedProxyList is the trusted proxies as a list, which is empty if there are none.
+func (s *Server) TrustedProxyList() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(s.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+type TLS struct {
+	Enabled        bool     `yaml:"enabled" toml:"enabled"`                 // Serve HTTPS instead of HTTP.
+	CertFile       string   `yaml:"cert_file" toml:"cert_file"`             // PEM certificate (chain).
+	KeyFile        string   `yaml:"key_file" toml:"key_file"`               // PEM private key.
+	ReloadInterval Duration `yaml:"reload_interval" toml:"reload_interval"` // How often to check the files for changes. 0 means only on SIGHUP.
+	ClientAuth     string   `yaml:"client_auth" toml:"client_auth"`         // "none", "optional" or "require".
+	ClientCAFile   string   `yaml:"client_ca_file" toml:"client_ca_file"`   // PEM CA certificates which client certificates must be signed by.
+	HSTSMaxAge     Duration `yaml:"hsts_max_age" toml:"hsts_max_age"`       // Of the Strict-Transport-Security header. 0 means no header.
+
+	// Where to listen for plain HTTP requests, which are redirected to HTTPS. Empty means don't.
+	RedirectHTTPAddress string `yaml:"redirect_http_address" toml:"redirect_http_address"`
+}
+
+// The login session cookie.
+type Cookie struct {
+	Domain     string `yaml:"domain" toml:"domain"`
+	MaxAgeSecs int    `yaml:"max_age_secs" toml:"max_age_secs"`
+	Secure     bool   `yaml:"secure" toml:"secure"` // Only send the cookie over HTTPS.
+}
+
+// Cross-origin requests, from web apps served from somewhere else.
+type CORS struct {
+	// The origins which can call the APIs, like "https://app.example.com", as a comma
+	// separated list, or "*" for any origin, but then without the login cookie. Empty
+	// means none can.
+	AllowedOrigins string `yaml:"allowed_origins" toml:"allowed_origins"`
+}
+
+// AllowedOriginList is the allowed origins as a list, which is empty if there are none.
+// Origins are compared as browsers send them, so they're lower-cased, without a trailing "/".
+func (c *CORS) AllowedOriginList() []string {
+	var origins []string
+	for _, origin := range strings.Split(c.AllowedOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+type Storage struct {
+	Backend string `yaml:"backend" toml:"backend"` // Only "memdb" for now.
+	Path    string `yaml:"path" toml:"path"`       // For backends which keep their data on disk.
+}
+
+// How much each user can store. 0 means no limit.
+type Quota struct {
+	MaxNoteBytes  int64 `yaml:"max_note_bytes" toml:"max_note_bytes"`   // Of the text of one note.
+	MaxNotes      int   `yaml:"max_notes" toml:"max_notes"`             // Per user.
+	MaxTotalBytes int64 `yaml:"max_total_bytes" toml:"max_total_bytes"` // Of the text of all of a user's notes.
+}
+
+type Log struct {
+	File   string `yaml:"file" toml:"file"`     // Appended to. Empty means stderr.
+	Level  string `yaml:"level" toml:"level"`   // "debug", "info", "warn" or "error".
+	Format string `yaml:"format" toml:"format"` // "text" (key=value pairs) or "json".
+
+	// Rotation of the log file. The rotated files are named after the log file, with
+	// the time of rotation, e.g. notablyd-2024-03-01T12-00-00.000.log
+	MaxSizeMB   int      `yaml:"max_size_mb" toml:"max_size_mb"`   // Rotate when the file gets this big.
+	RotateEvery Duration `yaml:"rotate_every" toml:"rotate_every"` // Also rotate this often. 0 means only by size.
+	MaxAgeDays  int      `yaml:"max_age_days" toml:"max_age_days"` // Delete rotated files older than this. 0 means keep them.
+	MaxBackups  int      `yaml:"max_backups" toml:"max_backups"`   // Keep at most this many rotated files. 0 means keep them all.
+	Compress    bool     `yaml:"compress" toml:"compress"`         // Gzip rotated files.
+}
+
+// SlogLevel is the log level as a slog.Level, which is info if it's not valid.
+func (l *Log) SlogLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// Limits protect the server from slow or greedy clients.
+// Zero means no limit, except for the request header size, where it means Go's default (1 MB).
+type Limits struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes"`
+	MaxBodyBytes      int64    `yaml:"max_body_bytes" toml:"max_body_bytes"`
+}
+
+// Token bucket rate limiting of the APIs. Each group of routes has its own buckets:
+// auth (registering and logging in) per client IP, notes per client IP and per logged-in
+// user, and other (the rest of the APIs) per client IP. The rate is how many requests a minute a client
+// gets on average, and the burst is how many it can make at once. A rate of 0 means
+// the group isn't limited.
+type RateLimit struct {
+	Enabled        bool    `yaml:"enabled" toml:"enabled"`
+	Backend        string  `yaml:"backend" toml:"backend"` // Only "memory" for now, which isn't shared between instances.
+	AuthPerMinute  float64 `yaml:"auth_per_minute" toml:"auth_per_minute"`
+	AuthBurst      int     `yaml:"auth_burst" toml:"auth_burst"`
+	NotesPerMinute float64 `yaml:"notes_per_minute" toml:"notes_per_minute"`
+	NotesBurst     int     `yaml:"notes_burst" toml:"notes_burst"`
+	OtherPerMinute float64 `yaml:"other_per_minute" toml:"other_per_minute"`
+	OtherBurst     int     `yaml:"other_burst" toml:"other_burst"`
+}
+
+// The Prometheus metrics, at /metrics.
+type Metrics struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Serve them on a separate admin listener, rather than with the API. Empty means with the API.
+	ListenAddress string `yaml:"listen_address" toml:"listen_address"`
+}
+
+// OpenTelemetry tracing of requests, down to the persistence layer.
+type Tracing struct {
+	Enabled  bool   `yaml:"enabled" toml:"enabled"`
+	Exporter string `yaml:"exporter" toml:"exporter"` // "otlp", "stdout" or "file".
+	// The OTLP/HTTP traces URL of the collector. Plain http:// means no TLS.
+	OTLPEndpoint string  `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	File         string  `yaml:"file" toml:"file"`                 // For the "file" exporter. Appended to.
+	SampleRatio  float64 `yaml:"sample_ratio" toml:"sample_ratio"` // Of traces which don't come with a sampling decision, 0 to 1.
+}
+
+// The tracing exporters.
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+// The health checks.
+type Health struct {
+	// The bearer token for GET /api/v2/health/details. Empty means there's no such route.
+	DetailsToken string `yaml:"details_token" toml:"details_token"`
+	// Not ready when there's less free space than this for the log file or the tracing
+	// file. 0 means don't check.
+	MinFreeDiskMB int `yaml:"min_free_disk_mb" toml:"min_free_disk_mb"`
+}
+
+// The audit log of security-relevant and data-changing requests.
+type Audit struct {
+	Retention Duration `yaml:"retention" toml:"retention"` // How long events are kept. 0 means forever.
+	// The bearer token for GET /api/v2/audit/events. Empty means there's no such route.
+	QueryToken string `yaml:"query_token" toml:"query_token"`
+}
+
+// Editing notes together, over WebSockets.
+type Collab struct {
+	SaveInterval Duration `yaml:"save_interval" toml:"save_interval"` // How often notes being edited are saved.
+}
+
+// Delivering events to the webhooks which users (and admins) register.
+type Webhooks struct {
+	// The bearer token for /api/v2/admin/webhooks. Empty means there are no such routes.
+	AdminToken  string   `yaml:"admin_token" toml:"admin_token"`
+	MaxAttempts int      `yaml:"max_attempts" toml:"max_attempts"` // Before a delivery is given up on.
+	MinBackoff  Duration `yaml:"min_backoff" toml:"min_backoff"`   // Before the first retry, doubling for each after.
+	MaxBackoff  Duration `yaml:"max_backoff" toml:"max_backoff"`   // The longest between retries.
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`           // For each delivery attempt.
+	// Whether webhooks can be on loopback and private network addresses, e.g. for testing.
+	AllowPrivateAddresses bool `yaml:"allow_private_addresses" toml:"allow_private_addresses"`
+}
+
+// Importing notes from Markdown archives and other note apps.
+type Import struct {
+	MaxBytes   int64 `yaml:"max_bytes" toml:"max_bytes"`     // The biggest upload, instead of limits.max_body_bytes. Zero means no limit.
+	AsyncItems int   `yaml:"async_items" toml:"async_items"` // Imports of more items than this go on in the background.
+}
+
+type Features struct {
+	APIV1             bool `yaml:"api_v1" toml:"api_v1"`
+	APIV2             bool `yaml:"api_v2" toml:"api_v2"`
+	OpenAPIValidation bool `yaml:"openapi_validation" toml:"openapi_validation"` // Of API v1 requests.
+}
+
+// Default returns the default configuration, which is how notablyd always ran before
+// it had any configuration.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			ListenAddress:   ":8080",
+			ShutdownTimeout: Duration{5 * time.Second},
+		},
+		TLS: TLS{
+			ReloadInterval: Duration{time.Minute},
+			ClientAuth:     ClientAuthNone,
+			HSTSMaxAge:     Duration{365 * 24 * time.Hour},
+		},
+		Cookie: Cookie{
+			Domain:     "localhost",
+			MaxAgeSecs: 28800, // 8 hours
+		},
+		Storage: Storage{
+			Backend: StorageBackendMemDB,
+		},
+		Quota: Quota{
+			MaxNoteBytes:  256 << 10, // 256 KB
+			MaxNotes:      10000,
+			MaxTotalBytes: 100 << 20, // 100 MB
+		},
+		Log: Log{
+			Level:      "info",
+			Format:     LogFormatText,
+			MaxSizeMB:  100,
+			MaxAgeDays: 30,
+			MaxBackups: 10,
+			Compress:   true,
+		},
+		Limits: Limits{
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			MaxBodyBytes:      1 << 20, // 1 MB
+		},
+		RateLimit: RateLimit{
+			Enabled:        true,
+			Backend:        RateLimitBackendMemory,
+			AuthPerMinute:  20,
+			AuthBurst:      10,
+			NotesPerMinute: 600,
+			NotesBurst:     100,
+			OtherPerMinute: 300,
+			OtherBurst:     60,
+		},
+		Metrics: Metrics{
+			Enabled: true,
+		},
+		Tracing: Tracing{
+			Exporter:     TracingExporterOTLP,
+			OTLPEndpoint: "http://localhost:4318/v1/traces",
+			SampleRatio:  1,
+		},
+		Health: Health{
+			MinFreeDiskMB: 100,
+		},
+		Audit: Audit{
+			Retention: Duration{90 * 24 * time.Hour},
+		},
+		Collab: Collab{
+			SaveInterval: Duration{5 * time.Second},
+		},
+		Webhooks: Webhooks{
+			MaxAttempts: 8,
+			MinBackoff:  Duration{10 * time.Second},
+			MaxBackoff:  Duration{time.Hour},
+			Timeout:     Duration{10 * time.Second},
+		},
+		Import: Import{
+			MaxBytes:   32 << 20, // 32 MB
+			AsyncItems: 100,
+		},
+		Features: Features{
+			APIV1:             true,
+			APIV2:             true,
+			OpenAPIValidation: true,
+		},
+	}
+}
+
+// setting is one leaf of the Config, e.g. "cookie.domain".
+type setting struct {
+	name  string        // e.g. "cookie.domain"
+	value reflect.Value // The settable struct field.
+}
+
+// envVar is the environment variable for the setting, e.g. NOTABLYD_COOKIE_DOMAIN.
+func (s setting) envVar() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, ".", "_"))
+}
+
+// set sets the setting from a string, as given in an environment variable or a flag.
+func (s setting) set(value string) error {
+	if u, ok := s.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not true or false", value)
+		}
+		s.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a whole number", value)
+		}
+		s.value.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", value)
+		}
+		s.value.SetFloat(f)
+	default:
+		// Only happens if someone adds a setting of a new type without handling it here.
+		panic(fmt.Sprintf("config setting '%s' has unsupported type %s", s.name, s.value.Type()))
+	}
+	return nil
+}
+
+// settings lists all the settings of a Config, in order.
+func (cfg *Config) settings() []setting {
+	var settings []setting
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			settings = append(settings, setting{
+				name:  sectionName + "." + section.Type().Field(j).Tag.Get("yaml"),
+				value: section.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+// Load works out the configuration from the command line args (without the program
+// name), the environment, and the config file if there is one, and validates it.
+// lookupEnv is normally os.LookupEnv.
+// If the args ask for help, the usage is printed to output and flag.ErrHelp is returned.
+func Load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	// Flags are applied last, since they trump everything else, so for now we just
+	// remember them. Every setting has a flag, e.g. -cookie.domain
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+
+	fs := flag.NewFlagSet("notablyd", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configPath := fs.String("config", "", fmt.Sprintf("the YAML or TOML config file (or set $%s)", ConfigPathEnvVar))
+	for _, s := range settings {
+		s := s
+		usage := fmt.Sprintf("overrides config setting %s (or set $%s)", s.name, s.envVar())
+		fs.Func(s.name, usage, func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected command line arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *configPath == "" {
+		*configPath, _ = lookupEnv(ConfigPathEnvVar)
+	}
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.envVar()); ok {
+			if err := s.set(value); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", s.envVar(), err))
+			}
+		}
+	}
+	for _, fv := range flagValues {
+		if err := fv.setting.set(fv.value); err != nil {
+			errs = append(errs, fmt.Errorf("flag -%s: %w", fv.setting.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the settings with those in a YAML or TOML config file.
+// Settings the file doesn't mention are left alone, and ones we don't know are an error.
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err.Error())
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if err == io.EOF {
+			err = nil // An empty file is fine.
+		}
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	default:
+		return fmt.Errorf("config file '%s' must be YAML (.yaml or .yml) or TOML (.toml), not '%s'", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file '%s': %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// Validate checks that the configuration makes sense, returning all the problems
+// with it, one per line, rather than just the first.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, name, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(validAddress(cfg.Server.ListenAddress), "server.listen_address",
+		"'%s' is not a valid host:port or :port", cfg.Server.ListenAddress)
+	check(cfg.Server.ShutdownTimeout.Duration > 0, "server.shutdown_timeout", "must be more than zero")
+	for _, proxy := range cfg.Server.TrustedProxyList() {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil || net.ParseIP(proxy) != nil, "server.trusted_proxies",
+			"'%s' is not an IP address or CIDR range", proxy)
+	}
+
+	if cfg.TLS.Enabled {
+		check(cfg.TLS.CertFile != "", "tls.cert_file", "is needed when TLS is enabled")
+		check(cfg.TLS.KeyFile != "", "tls.key_file", "is needed when TLS is enabled")
+		if cfg.TLS.CertFile != "" {
+			_, err := os.Stat(cfg.TLS.CertFile)
+			check(err == nil, "tls.cert_file", "%v", err)
+		}
+		if cfg.TLS.KeyFile != "" {
+			_, err := os.Stat(cfg.TLS.KeyFile)
+			check(err == nil, "tls.key_file", "%v", err)
+		}
+	}
+	check(cfg.TLS.ReloadInterval.Duration >= 0, "tls.reload_interval", "can't be negative")
+	check(cfg.TLS.ClientAuth == ClientAuthNone || cfg.TLS.ClientAuth == ClientAuthOptional ||
+		cfg.TLS.ClientAuth == ClientAuthRequire, "tls.client_auth",
+		"'%s' must be '%s', '%s' or '%s'", cfg.TLS.ClientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	if cfg.TLS.Enabled && cfg.TLS.ClientAuth != ClientAuthNone {
+		check(cfg.TLS.ClientCAFile != "", "tls.client_ca_file", "is needed when tls.client_auth is '%s'", cfg.TLS.ClientAuth)
+	}
+	if cfg.TLS.Enabled && cfg.TLS.ClientCAFile != "" {
+		_, err := os.Stat(cfg.TLS.ClientCAFile)
+		check(err == nil, "tls.client_ca_file", "%v", err)
+	}
+	check(cfg.TLS.HSTSMaxAge.Duration >= 0, "tls.hsts_max_age", "can't be negative")
+	if cfg.TLS.RedirectHTTPAddress != "" {
+		check(cfg.TLS.Enabled, "tls.redirect_http_address", "only makes sense when TLS is enabled")
+		check(validAddress(cfg.TLS.RedirectHTTPAddress), "tls.redirect_http_address",
+			"'%s' is not a valid host:port or :port", cfg.TLS.RedirectHTTPAddress)
+		check(cfg.TLS.RedirectHTTPAddress != cfg.Server.ListenAddress, "tls.redirect_http_address",
+			"can't be the same as server.listen_address")
+	}
+
+	check(cfg.Cookie.MaxAgeSecs > 0, "cookie.max_age_secs", "must be more than zero")
+
+	for _, origin := range cfg.CORS.AllowedOriginList() {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+			u.User == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == ""), "cors.allowed_origins",
+			"'%s' is not '*' or an origin like 'https://app.example.com'", origin)
+	}
+
+	check(cfg.Storage.Backend == StorageBackendMemDB, "storage.backend",
+		"'%s' is not a storage backend, the only one is '%s'", cfg.Storage.Backend, StorageBackendMemDB)
+	check(cfg.Storage.Backend != StorageBackendMemDB || cfg.Storage.Path == "", "storage.path",
+		"must be empty for the '%s' backend, which keeps everything in memory", StorageBackendMemDB)
+
+	check(cfg.Quota.MaxNoteBytes >= 0, "quota.max_note_bytes", "can't be negative")
+	check(cfg.Quota.MaxNotes >= 0, "quota.max_notes", "can't be negative")
+	check(cfg.Quota.MaxTotalBytes >= 0, "quota.max_total_bytes", "can't be negative")
+	check(cfg.Quota.MaxTotalBytes == 0 || cfg.Quota.MaxNoteBytes <= cfg.Quota.MaxTotalBytes, "quota.max_note_bytes",
+		"can't be more than quota.max_total_bytes")
+
+	if cfg.Log.File != "" {
+		info, err := os.Stat(filepath.Dir(cfg.Log.File))
+		check(err == nil && info.IsDir(), "log.file", "the directory of '%s' does not exist", cfg.Log.File)
+	}
+	var level slog.Level
+	check(level.UnmarshalText([]byte(cfg.Log.Level)) == nil, "log.level",
+		"'%s' must be 'debug', 'info', 'warn' or 'error'", cfg.Log.Level)
+	check(cfg.Log.Format == LogFormatText || cfg.Log.Format == LogFormatJSON, "log.format",
+		"'%s' must be '%s' or '%s'", cfg.Log.Format, LogFormatText, LogFormatJSON)
+	check(cfg.Log.MaxSizeMB > 0, "log.max_size_mb", "must be more than zero")
+	check(cfg.Log.RotateEvery.Duration >= 0, "log.rotate_every", "can't be negative")
+	check(cfg.Log.MaxAgeDays >= 0, "log.max_age_days", "can't be negative")
+	check(cfg.Log.MaxBackups >= 0, "log.max_backups", "can't be negative")
+
+	check(cfg.Limits.ReadHeaderTimeout.Duration >= 0, "limits.read_header_timeout", "can't be negative")
+	check(cfg.Limits.ReadTimeout.Duration >= 0, "limits.read_timeout", "can't be negative")
+	check(cfg.Limits.WriteTimeout.Duration >= 0, "limits.write_timeout", "can't be negative")
+	check(cfg.Limits.IdleTimeout.Duration >= 0, "limits.idle_timeout", "can't be negative")
+	check(cfg.Limits.MaxHeaderBytes >= 0, "limits.max_header_bytes", "can't be negative")
+	check(cfg.Limits.MaxBodyBytes >= 0, "limits.max_body_bytes", "can't be negative")
+
+	check(cfg.RateLimit.Backend == RateLimitBackendMemory, "rate_limit.backend",
+		"'%s' is not a rate limit backend, the only one is '%s'", cfg.RateLimit.Backend, RateLimitBackendMemory)
+	for _, group := range []struct {
+		name      string
+		perMinute float64
+		burst     int
+	}{
+		{"auth", cfg.RateLimit.AuthPerMinute, cfg.RateLimit.AuthBurst},
+		{"notes", cfg.RateLimit.NotesPerMinute, cfg.RateLimit.NotesBurst},
+		{"other", cfg.RateLimit.OtherPerMinute, cfg.RateLimit.OtherBurst},
+	} {
+		check(group.perMinute >= 0, "rate_limit."+group.name+"_per_minute", "can't be negative")
+		check(group.perMinute == 0 || group.burst > 0, "rate_limit."+group.name+"_burst",
+			"must be more than zero when there's a rate")
+	}
+
+	if cfg.Metrics.ListenAddress != "" {
+		check(validAddress(cfg.Metrics.ListenAddress), "metrics.listen_address",
+			"'%s' is not a valid host:port or :port", cfg.Metrics.ListenAddress)
+		check(cfg.Metrics.ListenAddress != cfg.Server.ListenAddress && cfg.Metrics.ListenAddress != cfg.TLS.RedirectHTTPAddress,
+			"metrics.listen_address", "can't be the same as server.listen_address or tls.redirect_http_address")
+	}
+
+	if cfg.Tracing.Enabled {
+		switch cfg.Tracing.Exporter {
+		case TracingExporterOTLP:
+			u, err := url.Parse(cfg.Tracing.OTLPEndpoint)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.otlp_endpoint",
+				"'%s' is not an http:// or https:// URL", cfg.Tracing.OTLPEndpoint)
+		case TracingExporterFile:
+			check(cfg.Tracing.File != "", "tracing.file", "is needed for the '%s' exporter", TracingExporterFile)
+			if cfg.Tracing.File != "" {
+				info, err := os.Stat(filepath.Dir(cfg.Tracing.File))
+				check(err == nil && info.IsDir(), "tracing.file", "the directory of '%s' does not exist", cfg.Tracing.File)
+			}
+		case TracingExporterStdout:
+		default:
+			check(false, "tracing.exporter", "'%s' must be '%s', '%s' or '%s'", cfg.Tracing.Exporter,
+				TracingExporterOTLP, TracingExporterStdout, TracingExporterFile)
+		}
+	}
+	check(cfg.Tracing.SampleRatio >= 0 && cfg.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be from 0 to 1")
+
+	check(cfg.Health.DetailsToken == "" || len(cfg.Health.DetailsToken) >= 16, "health.details_token",
+		"is too short to be hard to guess, it needs at least 16 characters")
+	check(cfg.Health.MinFreeDiskMB >= 0, "health.min_free_disk_mb", "can't be negative")
+
+	check(cfg.Audit.Retention.Duration >= 0, "audit.retention", "can't be negative")
+	check(cfg.Collab.SaveInterval.Duration > 0, "collab.save_interval", "must be more than 0s")
+	check(cfg.Audit.QueryToken == "" || len(cfg.Audit.QueryToken) >= 16, "audit.query_token",
+		"is too short to be hard to guess, it needs at least 16 characters")
+
+	check(cfg.Webhooks.AdminToken == "" || len(cfg.Webhooks.AdminToken) >= 16, "webhooks.admin_token",
+		"is too short to be hard to guess, it needs at least 16 characters")
+	check(cfg.Webhooks.MaxAttempts > 0, "webhooks.max_attempts", "must be at least 1")
+	check(cfg.Webhooks.MinBackoff.Duration > 0, "webhooks.min_backoff", "must be more than 0s")
+	check(cfg.Webhooks.MaxBackoff.Duration >= cfg.Webhooks.MinBackoff.Duration, "webhooks.max_backoff",
+		"can't be less than webhooks.min_backoff")
+	check(cfg.Webhooks.Timeout.Duration > 0, "webhooks.timeout", "must be more than 0s")
+	check(cfg.Import.MaxBytes >= 0, "import.max_bytes", "can't be negative")
+	check(cfg.Import.AsyncItems > 0, "import.async_items", "must be at least 1")
+
+	check(cfg.Features.APIV1 || cfg.Features.APIV2, "features", "at least one of api_v1 and api_v2 must be enabled")
+
+	return errors.Join(errs...)
+}
+
+// validAddress tells us whether address is a host:port or :port we could listen on.
+func validAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	if err == nil {
+		_, err = net.LookupPort("tcp", port)
+	}
+	return err == nil
+}
+
+// Changed lists the names of the settings which are different in other, e.g.
+// "cookie.max_age_secs", in order.
+func (cfg *Config) Changed(other *Config) []string {
+	var changed []string
+	otherSettings := other.settings()
+	for i, s := range cfg.settings() {
+		if s.value.Interface() != otherSettings[i].value.Interface() {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
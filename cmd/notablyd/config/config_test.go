@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("Failed writing '%s': %v", path, err)
+		}
+		return path
+	}
+	envOf := func(env map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+	}
+	noEnv := envOf(nil)
+
+	// No config at all is just the defaults.
+	cfg, err := Load(nil, noEnv, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed loading the default config: %v", err)
+	}
+	if *cfg != *Default() {
+		t.Fatalf("Expected the default config, but got: %+v", cfg)
+	}
+
+	// The example config file should also be just the defaults.
+	cfg, err = Load([]string{"-config", "../notablyd.example.yaml"}, noEnv, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed loading the example config file: %v", err)
+	}
+	if *cfg != *Default() {
+		t.Fatalf("Expected the example config file to have the defaults, but got: %+v", cfg)
+	}
+
+	// File, then env, then flags.
+	yamlPath := writeFile("notablyd.yaml", `
+server:
+    listen_address: ":9090"
+cookie:
+    domain: file.example.com
+    max_age_secs: 60
+limits:
+    read_timeout: 30s
+`)
+	env := envOf(map[string]string{
+		ConfigPathEnvVar:         yamlPath,
+		"NOTABLYD_COOKIE_DOMAIN": "env.example.com",
+		"NOTABLYD_COOKIE_SECURE": "true",
+	})
+	cfg, err = Load([]string{"-cookie.max_age_secs=120", "-features.api_v1=false"}, env, io.Discard)
+	if err != nil {
+		t.Fatalf("Failed loading config from file, env and flags: %v", err)
+	}
+	fmt.Printf("TEST CONFIG: Loaded config: %+v\n", cfg)
+	if cfg.Server.ListenAddress != ":9090" || cfg.Limits.ReadTimeout.Duration != 30*time.Second {
+		t.Fatalf("Config file settings not applied: %+v", cfg)
+	}
+	if cfg.Cookie.Domain != "env.example.com" || !cfg.Cookie.Secure {
+		t.Fatalf("Environment variables not applied over the config file: %+v", cfg.Cookie)
+	}
+	if cfg.Cookie.MaxAgeSecs != 120 || cfg.Features.APIV1 {
+		t.Fatalf("Flags not applied over the config file: %+v", cfg)
+	}
+	if cfg.Server.ShutdownTimeout != Default().Server.ShutdownTimeout {
+		t.Fatalf("Setting not in the config file did not keep its default: %+v", cfg.Server)
+	}
+
+	// What changed from the defaults, in order.
+	changed := Default().Changed(cfg)
+	fmt.Println("TEST CONFIG: Changed settings:", changed)
+	expected := []string{"server.listen_address", "cookie.domain", "cookie.max_age_secs", "cookie.secure",
+		"limits.read_timeout", "features.api_v1"}
+	if strings.Join(changed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected changed settings %v, but got %v", expected, changed)
+	}
+
+	// TOML works too.
+	tomlPath := writeFile("notablyd.toml", `
+[server]
+listen_address = "127.0.0.1:8081"
+shutdown_timeout = "10s"
+`)
+	cfg, err = Load([]string{"-config", tomlPath}, noEnv, io.Discard)
+	if err != nil || cfg.Server.ListenAddress != "127.0.0.1:8081" || cfg.Server.ShutdownTimeout.Duration != 10*time.Second {
+		t.Fatalf("Failed loading TOML config file, got: %+v, error: %v", cfg, err)
+	}
+
+	// Unknown settings in the config file. Should error.
+	_, err = Load([]string{"-config", writeFile("typo.yaml", "server:\n    listen_adress: \":80\"\n")}, noEnv, io.Discard)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown setting in the config file, but got none")
+	}
+	fmt.Println("TEST CONFIG: Unknown setting error:", err)
+
+	// A bad env var value. Should error, naming the env var.
+	_, err = Load(nil, envOf(map[string]string{"NOTABLYD_LIMITS_IDLE_TIMEOUT": "forever"}), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "NOTABLYD_LIMITS_IDLE_TIMEOUT") {
+		t.Fatalf("Expected an error naming the bad environment variable, but got: %v", err)
+	}
+
+	// Lots of invalid settings. Should error about every one of them.
+	_, err = Load([]string{
+		"-server.listen_address=nope",
+		"-tls.enabled=true",
+		"-tls.client_auth=maybe",
+		"-log.level=chatty",
+		"-log.format=xml",
+		"-cookie.max_age_secs=0",
+		"-cors.allowed_origins=https://app.example.com,https://app.example.com/notes",
+		"-storage.backend=postgres",
+		"-server.trusted_proxies=10.0.0.0/8,proxy.example.com",
+		"-rate_limit.backend=redis",
+		"-quota.max_notes=-1",
+		"-rate_limit.auth_burst=0",
+		"-tracing.enabled=true",
+		"-tracing.exporter=zipkin",
+		"-tracing.sample_ratio=1.5",
+		"-health.details_token=letmein",
+		"-audit.query_token=letmein",
+		"-collab.save_interval=0s",
+		"-webhooks.admin_token=letmein",
+		"-webhooks.max_attempts=0",
+		"-webhooks.max_backoff=1s",
+		"-import.max_bytes=-1",
+		"-import.async_items=0",
+		"-features.api_v1=false",
+		"-features.api_v2=false",
+	}, noEnv, io.Discard)
+	if err == nil {
+		t.Fatalf("Expected validation errors, but got none")
+	}
+	fmt.Println("TEST CONFIG: Validation errors:", err)
+	for _, name := range []string{"server.listen_address", "tls.cert_file", "tls.key_file", "tls.client_auth", "cookie.max_age_secs", "cors.allowed_origins",
+		"storage.backend", "log.level", "server.trusted_proxies", "rate_limit.backend", "rate_limit.auth_burst", "quota.max_notes", "log.format", "tracing.exporter", "tracing.sample_ratio",
+		"health.details_token", "audit.query_token", "collab.save_interval",
+		"webhooks.admin_token", "webhooks.max_attempts", "webhooks.max_backoff",
+		"import.max_bytes", "import.async_items", "features"} {
+		if !strings.Contains(err.Error(), name+":") {
+			t.Fatalf("Expected a validation error for '%s', but got: %v", name, err)
+		}
+	}
+}
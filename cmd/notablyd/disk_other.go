@@ -0,0 +1,12 @@
+//go:build !(linux || darwin)
+
+package main
+
+import (
+	"errors"
+)
+
+// freeDiskSpace can't tell how much space is free on this OS.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+)
+
+// freeDiskSpace is how many bytes an unprivileged user can still write to the disk with dir on it.
+func freeDiskSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
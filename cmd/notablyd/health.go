@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"notably/cmd/notablyd/config"
+	"notably/cmd/notablyd/routes/handlers"
+)
+
+// diskSpaceChecks are the health checks of the free space on the disks we write to,
+// which are the ones with the log file and the tracing file, if there are any.
+// There are none if the free space can't be checked on this OS.
+func diskSpaceChecks(cfg *config.Config) []handlers.HealthCheck {
+	if cfg.Health.MinFreeDiskMB == 0 {
+		return nil
+	}
+	var dirs []string
+	if cfg.Log.File != "" {
+		dirs = append(dirs, filepath.Dir(cfg.Log.File))
+	}
+	if cfg.Tracing.Enabled && cfg.Tracing.Exporter == config.TracingExporterFile {
+		dirs = append(dirs, filepath.Dir(cfg.Tracing.File))
+	}
+
+	minFree := uint64(cfg.Health.MinFreeDiskMB) << 20
+	var checks []handlers.HealthCheck
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if _, err := freeDiskSpace(dir); errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		dir := dir
+		checks = append(checks, handlers.HealthCheck{
+			Name: "disk:" + dir,
+			Check: func(context.Context) error {
+				free, err := freeDiskSpace(dir)
+				if err != nil {
+					return fmt.Errorf("can't get the free disk space: %s", err.Error())
+				}
+				if free < minFree {
+					return fmt.Errorf("only %d MB of disk space left, which is less than %d MB",
+						free>>20, cfg.Health.MinFreeDiskMB)
+				}
+				return nil
+			},
+		})
+	}
+	return checks
+}
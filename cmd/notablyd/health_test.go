@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"notably/cmd/notablyd/config"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestDiskSpaceChecks(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Log.File = filepath.Join(dir, "notablyd.log")
+	cfg.Tracing.Enabled = true
+	cfg.Tracing.Exporter = config.TracingExporterFile
+	cfg.Tracing.File = filepath.Join(dir, "traces.json")
+	cfg.Health.MinFreeDiskMB = 1
+
+	// The log and tracing files are in the same directory, so that's one check.
+	checks := diskSpaceChecks(cfg)
+	if len(checks) != 1 || checks[0].Name != "disk:"+dir {
+		t.Fatalf("Expected one disk space check of '%s', but got %+v", dir, checks)
+	}
+	if err := checks[0].Check(context.Background()); err != nil {
+		t.Fatalf("Expected at least 1 MB free in '%s', but got: %v", dir, err)
+	}
+
+	// More free space than any disk has.
+	cfg.Health.MinFreeDiskMB = 1 << 40
+	err := diskSpaceChecks(cfg)[0].Check(context.Background())
+	fmt.Println("TEST HEALTH: Not enough disk space:", err)
+	if err == nil {
+		t.Fatalf("Expected the disk space check to fail with an exabyte needed")
+	}
+
+	// Not checking.
+	cfg.Health.MinFreeDiskMB = 0
+	if checks := diskSpaceChecks(cfg); len(checks) != 0 {
+		t.Fatalf("Expected no disk space checks when they're turned off, but got %+v", checks)
+	}
+}
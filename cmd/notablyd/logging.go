@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"notably/cmd/notablyd/config"
+)
+
+// newLogger makes the logger for everything notablyd logs, which writes to w in the
+// given format (config.LogFormatText or config.LogFormatJSON) at the given level.
+func newLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// openLogFile opens the log file, which rotates itself as configured.
+// Closing it doesn't stop it being written to: it's reopened on the next write, which
+// is how an external logrotate (which moves the file away) gets us to start a new one.
+func openLogFile(settings config.Log) (*lumberjack.Logger, error) {
+	// lumberjack only opens the file when it's first written to, so make sure we can
+	// open it now, rather than find out once we're up and running.
+	f, err := os.OpenFile(settings.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("can't open log file: %s", err.Error())
+	}
+	f.Close()
+
+	return &lumberjack.Logger{
+		Filename:   settings.File,
+		MaxSize:    settings.MaxSizeMB,
+		MaxAge:     settings.MaxAgeDays,
+		MaxBackups: settings.MaxBackups,
+		Compress:   settings.Compress,
+	}, nil
+}
+
+// rotateLogFile rotates the log file every interval, until the context is done.
+func rotateLogFile(ctx context.Context, logFile *lumberjack.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := logFile.Rotate(); err != nil {
+				// Nowhere better to complain than the log, which carries on in the old file.
+				slog.Error("LOG ROTATION", "error", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"notably/cmd/notablyd/config"
+	"notably/cmd/notablyd/routes"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestLogFile(t *testing.T) {
+	dir := t.TempDir()
+	settings := config.Default().Log
+	settings.File = filepath.Join(dir, "notablyd.log")
+	settings.MaxSizeMB = 1
+	settings.MaxBackups = 2
+	settings.Compress = false
+
+	logFile, err := openLogFile(settings)
+	if err != nil {
+		t.Fatalf("Failed opening log file: %v", err)
+	}
+	defer logFile.Close()
+	logger := newLogger(logFile, config.LogFormatJSON, slog.LevelInfo)
+
+	// Over 3 MB of logs. Should rotate 3 times, but only keep 2 rotated files.
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 3500; i++ {
+		logger.Info(line, "i", i)
+	}
+	// Old files are removed in the background, so give it a moment.
+	var files []string
+	for tries := 0; tries < 100; tries++ {
+		if files, _ = filepath.Glob(filepath.Join(dir, "notablyd-*.log")); len(files) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Println("TEST LOG FILE: Rotated files:", files)
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 rotated log files, but got: %v", files)
+	}
+
+	// logrotate moves the log file away, and then we get a SIGHUP. Should reopen it.
+	moved := filepath.Join(dir, "notablyd.log.1")
+	if err := os.Rename(settings.File, moved); err != nil {
+		t.Fatalf("Failed moving log file: %v", err)
+	}
+	logger.Info("Before the reload")
+
+	r := &reloader{lookupEnv: func(string) (string, bool) { return "", false }, running: config.Default(),
+		live: &routes.LiveConfig{}, logLevel: &slog.LevelVar{}, logFile: logFile}
+	if _, err := r.reload(); err != nil {
+		t.Fatalf("Failed reloading: %v", err)
+	}
+	logger.Info("After the reload")
+
+	data, err := os.ReadFile(settings.File)
+	if err != nil || !strings.Contains(string(data), "After the reload") || strings.Contains(string(data), "Before the reload") {
+		t.Fatalf("Expected a new log file after the reload, but got: %.200s, error: %v", data, err)
+	}
+	if data, _ := os.ReadFile(moved); !strings.Contains(string(data), "Before the reload") {
+		t.Fatalf("Expected the moved log file to get the lines from before the reload")
+	}
+}
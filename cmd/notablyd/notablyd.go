@@ -2,59 +2,223 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"notably/cmd/notablyd/config"
 	"notably/cmd/notablyd/routes"
+	"notably/internal/model"
+	"notably/internal/platform/metrics"
+	"notably/internal/platform/ratelimit"
+	"notably/internal/platform/webhooks"
 )
 
-// TODO: Use a config file for things like:
-//   The HTTP port on which to start the server.
-//   The maximum age (in seconds) of the login cookie.
-//   Other things when it becomes necessary (e.g. log settings, HTTPS, etc)
-
-// TODO: Proper level-aware logger, with log file rotation.
-
-var httpPort = "8080"
-
 func main() {
-	log.SetFlags(log.LstdFlags | log.Llongfile | log.Lmicroseconds | log.LUTC)
+	// See the config package for where the configuration comes from.
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "notablyd: bad configuration:\n%s\n", err.Error())
+		os.Exit(2)
+	}
 
-	log.Println("Welcome to Notably, a simple backend for a simple multi-user note-taking web service.")
+	var logOutput io.Writer = os.Stderr
+	var logFile *lumberjack.Logger
+	if cfg.Log.File != "" {
+		logFile, err = openLogFile(cfg.Log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "notablyd: %s\n", err.Error())
+			os.Exit(2)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+		// gin's own debug messages go to gin.DefaultWriter.
+		gin.DefaultWriter = logFile
+		gin.DefaultErrorWriter = logFile
+	}
+	// The level can be changed by reloading the config.
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(cfg.Log.SlogLevel())
+	// This also sends anything logged with the log package through our logger.
+	slog.SetDefault(newLogger(logOutput, cfg.Log.Format, logLevel))
+
+	slog.Info("Welcome to Notably, a simple backend for a simple multi-user note-taking web service.")
 
-	log.Println("Starting webserver on port ", httpPort)
+	slog.Info("Starting webserver", "address", cfg.Server.ListenAddress, "tls", cfg.TLS.Enabled)
 
 	ctx, stop := signal.NotifyContext(context.Background(),
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
 		syscall.SIGSTOP,
-		syscall.SIGHUP,
 	)
 	defer stop()
 
-	rc := routes.RouterConfig{}
-	router := routes.NewRouter(rc)
+	if logFile != nil && cfg.Log.RotateEvery.Duration > 0 {
+		go rotateLogFile(ctx, logFile, cfg.Log.RotateEvery.Duration)
+	}
+
+	var shutdownTracing func(context.Context) error
+	if cfg.Tracing.Enabled {
+		shutdownTracing, err = setupTracing(ctx, cfg.Tracing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "notablyd: %s\n", err.Error())
+			os.Exit(2)
+		}
+		slog.Info("Tracing", "exporter", cfg.Tracing.Exporter, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+
+	live := &routes.LiveConfig{}
+	live.SetLoginCookieMaxAgeSecs(cfg.Cookie.MaxAgeSecs)
+	live.SetCORSAllowedOrigins(cfg.CORS.AllowedOriginList())
+	live.SetRateLimits(rateLimits(cfg.RateLimit))
+	rc := routes.RouterConfig{
+		LoginCookieDomain:        cfg.Cookie.Domain,
+		LoginCookieSecure:        cfg.Cookie.Secure || cfg.TLS.Enabled,
+		DisableAPIV1:             !cfg.Features.APIV1,
+		DisableAPIV2:             !cfg.Features.APIV2,
+		DisableOpenAPIValidation: !cfg.Features.OpenAPIValidation,
+		DisableMetricsEndpoint:   !cfg.Metrics.Enabled || cfg.Metrics.ListenAddress != "",
+		HealthChecks:             diskSpaceChecks(cfg),
+		HealthDetailsToken:       cfg.Health.DetailsToken,
+		AuditRetention:           cfg.Audit.Retention.Duration,
+		AuditQueryToken:          cfg.Audit.QueryToken,
+		CollabSaveInterval:       cfg.Collab.SaveInterval.Duration,
+		WebhooksAdminToken:       cfg.Webhooks.AdminToken,
+		TrustedProxies:           cfg.Server.TrustedProxyList(),
+		Quota:                    model.Quota(cfg.Quota), // The same fields.
+		ImportAsyncItems:         cfg.Import.AsyncItems,
+		Live:                     live,
+		Context:                  ctx, // The webhooks stop being delivered when we're signalled to stop.
+	}
+	rc.Webhooks = webhooks.Options{
+		MaxAttempts:           cfg.Webhooks.MaxAttempts,
+		MinBackoff:            cfg.Webhooks.MinBackoff.Duration,
+		MaxBackoff:            cfg.Webhooks.MaxBackoff.Duration,
+		Timeout:               cfg.Webhooks.Timeout.Duration,
+		AllowPrivateAddresses: cfg.Webhooks.AllowPrivateAddresses,
+	}
+	// The memory backend is the only one, for now. There's a store even with rate
+	// limiting off, so that it can be turned on with a reload.
+	rc.RateLimitStore = ratelimit.NewMemoryStore()
+	var handler http.Handler = routes.NewRouter(rc)
+	if cfg.Limits.MaxBodyBytes > 0 || cfg.Import.MaxBytes > 0 {
+		handler = bodyLimitHandler(handler, cfg.Limits.MaxBodyBytes, cfg.Import.MaxBytes)
+	}
+	if cfg.TLS.Enabled && cfg.TLS.HSTSMaxAge.Duration > 0 {
+		handler = hstsHandler(handler, cfg.TLS.HSTSMaxAge.Duration)
+	}
 
 	// Don't use router.Run(), wrap it in an HTTP server instead.
 	// This is so that we can shut it down gracefully.
 	// gin.Engine does NOT have a Shutdown() method.
-	srvAddr := fmt.Sprintf(":%s", httpPort)
 	srv := &http.Server{
-		Addr:    srvAddr,
-		Handler: router,
+		Addr:              cfg.Server.ListenAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.Limits.ReadTimeout.Duration,
+		WriteTimeout:      cfg.Limits.WriteTimeout.Duration,
+		IdleTimeout:       cfg.Limits.IdleTimeout.Duration,
+		MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
 	}
 
+	// Event streams go on until the client goes away, so Shutdown() would wait them
+	// out until it timed out. Instead, shutting down cancels the requests' contexts,
+	// which ends the streams.
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+	srv.RegisterOnShutdown(cancelRequests)
+
+	// The TLS configuration comes from the tlsLoader, rather than ListenAndServeTLS(),
+	// so that it can be reloaded.
+	var tl *tlsLoader
+	var redirectSrv *http.Server
+	if cfg.TLS.Enabled {
+		tl = &tlsLoader{}
+		if err := tl.load(cfg.TLS); err != nil {
+			fmt.Fprintf(os.Stderr, "notablyd: %s\n", err.Error())
+			os.Exit(2)
+		}
+		srv.TLSConfig = tl.serverConfig()
+		if cfg.TLS.ReloadInterval.Duration > 0 {
+			go tl.watch(ctx, cfg.TLS.ReloadInterval.Duration)
+		}
+
+		if cfg.TLS.RedirectHTTPAddress != "" {
+			redirectSrv = &http.Server{
+				Addr:              cfg.TLS.RedirectHTTPAddress,
+				Handler:           redirectToHTTPS(cfg.Server.ListenAddress),
+				ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout.Duration,
+				IdleTimeout:       cfg.Limits.IdleTimeout.Duration,
+			}
+			slog.Info("Redirecting HTTP to HTTPS", "address", cfg.TLS.RedirectHTTPAddress)
+			go func() {
+				if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					slog.Error("Can't listen for HTTP to redirect", "error", err.Error())
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+
+	// The admin listener, for things which shouldn't be out there with the API.
+	var adminSrv *http.Server
+	if cfg.Metrics.Enabled && cfg.Metrics.ListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle(routes.MetricsPath, metrics.Handler())
+		adminSrv = &http.Server{
+			Addr:              cfg.Metrics.ListenAddress,
+			Handler:           mux,
+			ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout.Duration,
+			IdleTimeout:       cfg.Limits.IdleTimeout.Duration,
+		}
+		slog.Info("Serving metrics on the admin listener", "address", cfg.Metrics.ListenAddress)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Can't listen for admin requests", "error", err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// SIGHUP reloads the configuration, rather than shutting down.
+	running := *cfg
+	r := &reloader{args: os.Args[1:], lookupEnv: os.LookupEnv, running: &running, live: live, tls: tl,
+		logLevel: logLevel, logFile: logFile}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			r.reloadAndLog()
+		}
+	}()
+
 	// Initializing the HTTP server in a goroutine so that
 	// it won't block the graceful shutdown handling below.
 	go func() {
-		//router.Run(fmt.Sprintf(":%s", httpPort))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		var err error
+		if cfg.TLS.Enabled {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Can't listen", "error", err.Error())
+			os.Exit(1)
 		}
 	}()
 
@@ -63,15 +227,58 @@ func main() {
 
 	// Restore default behavior on the interrupt signal and notify user of shutdown.
 	stop()
-	log.Println("shutting down gracefully, press Ctrl+C again to force")
+	slog.Info("Shutting down gracefully, press Ctrl+C again to force")
 
-	// The context is used to inform the server it has 5 seconds to finish
+	// The context is used to inform the server how long it has to finish
 	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
 	defer cancel()
+	if redirectSrv != nil {
+		// Nothing to finish there, it only redirects.
+		redirectSrv.Close()
+	}
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown: ", err)
+		slog.Error("Server forced to shutdown", "error", err.Error())
+		os.Exit(1)
+	}
+	if adminSrv != nil {
+		// Scrapes are quick, and we're done anyway.
+		adminSrv.Close()
+	}
+	if shutdownTracing != nil {
+		// Export the spans of the last requests.
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("TRACING SHUTDOWN", "error", err.Error())
+		}
 	}
 
-	log.Println("Server exiting")
+	slog.Info("Server exiting")
+}
+
+// bodyLimitHandler limits the size of request bodies, which can be bigger for
+// imports, which are uploads. Zero means no limit.
+func bodyLimitHandler(h http.Handler, maxBodyBytes, maxImportBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBodyBytes
+		if routes.IsImport(r) {
+			limit = maxImportBytes
+		}
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rateLimits are the rate limits, by route group, in the configuration, or none if
+// rate limiting is off.
+func rateLimits(cfg config.RateLimit) map[string]ratelimit.Limit {
+	if !cfg.Enabled {
+		return nil
+	}
+	return map[string]ratelimit.Limit{
+		routes.RateLimitGroupAuth:  ratelimit.PerMinute(cfg.AuthPerMinute, cfg.AuthBurst),
+		routes.RateLimitGroupNotes: ratelimit.PerMinute(cfg.NotesPerMinute, cfg.NotesBurst),
+		routes.RateLimitGroupOther: ratelimit.PerMinute(cfg.OtherPerMinute, cfg.OtherBurst),
+	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"notably/cmd/notablyd/config"
+	"notably/cmd/notablyd/routes"
+)
+
+// reloader re-reads the configuration (on SIGHUP), and applies the settings which
+// can be changed without restarting: see reload().
+type reloader struct {
+	mu        sync.Mutex
+	args      []string // The command line, without the program name.
+	lookupEnv func(string) (string, bool)
+	running   *config.Config // What we're running with, as far as the live settings go.
+	live      *routes.LiveConfig
+	tls       *tlsLoader // Nil without TLS.
+	logLevel  *slog.LevelVar
+	logFile   *lumberjack.Logger // Nil when logging to stderr.
+}
+
+// reload reopens the log file, for logrotate, then re-reads the configuration the
+// same way as at startup, and applies:
+//
+//   - log.level.
+//   - cookie.max_age_secs, for logins from now on.
+//   - cors.allowed_origins.
+//   - The rate limits, and rate_limit.enabled, but not rate_limit.backend.
+//   - The TLS certificate, key and client authentication, which are reloaded even if
+//     their file names haven't changed.
+//
+// It returns the settings which changed but need a restart to take effect.
+// If the new configuration is invalid, none of it is applied.
+func (r *reloader) reload() (needRestart []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.logFile != nil {
+		// It's reopened on the next write, under its configured name.
+		if err := r.logFile.Close(); err != nil {
+			slog.Error("CONFIG RELOAD: Failed closing the log file to reopen it", "error", err.Error())
+		}
+	}
+
+	cfg, err := config.Load(r.args, r.lookupEnv, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("bad configuration, keeping the current one:\n%w", err)
+	}
+
+	if r.tls != nil && cfg.TLS.Enabled {
+		if err := r.tls.load(cfg.TLS); err != nil {
+			return nil, fmt.Errorf("%w, keeping the current configuration", err)
+		}
+		r.running.TLS.CertFile = cfg.TLS.CertFile
+		r.running.TLS.KeyFile = cfg.TLS.KeyFile
+		r.running.TLS.ClientAuth = cfg.TLS.ClientAuth
+		r.running.TLS.ClientCAFile = cfg.TLS.ClientCAFile
+	}
+
+	r.logLevel.Set(cfg.Log.SlogLevel())
+	r.running.Log.Level = cfg.Log.Level
+
+	r.live.SetLoginCookieMaxAgeSecs(cfg.Cookie.MaxAgeSecs)
+	r.running.Cookie.MaxAgeSecs = cfg.Cookie.MaxAgeSecs
+
+	r.live.SetCORSAllowedOrigins(cfg.CORS.AllowedOriginList())
+	r.running.CORS = cfg.CORS
+
+	r.live.SetRateLimits(rateLimits(cfg.RateLimit))
+	backend := r.running.RateLimit.Backend
+	r.running.RateLimit = cfg.RateLimit
+	r.running.RateLimit.Backend = backend
+
+	// Whatever's still different can't be applied live.
+	return r.running.Changed(cfg), nil
+}
+
+// reloadAndLog is reload() for the SIGHUP handler, which can only log what happened.
+func (r *reloader) reloadAndLog() {
+	slog.Info("Reloading configuration...")
+	needRestart, err := r.reload()
+	if err != nil {
+		slog.Error("CONFIG RELOAD", "error", err.Error())
+		return
+	}
+	for _, name := range needRestart {
+		slog.Warn("CONFIG RELOAD: Setting has changed, but needs a restart to take effect", "setting", name)
+	}
+	slog.Info("Configuration reloaded", "log_level", r.logLevel.Level())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"notably/cmd/notablyd/config"
+	"notably/cmd/notablyd/routes"
+	"notably/internal/platform/ratelimit"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	configFile := filepath.Join(dir, "notablyd.yaml")
+	writeConfig := func(contents string) {
+		if err := os.WriteFile(configFile, []byte(contents), 0o600); err != nil {
+			t.Fatalf("Failed writing config file: %v", err)
+		}
+	}
+	noEnv := func(string) (string, bool) { return "", false }
+
+	newTestCert(t, "old.example.com", nil).write(t, certFile, keyFile)
+	writeConfig(fmt.Sprintf("tls:\n    enabled: true\n    cert_file: %s\n    key_file: %s\ncookie:\n    max_age_secs: 60\n",
+		certFile, keyFile))
+
+	args := []string{"-config", configFile}
+	cfg, err := config.Load(args, noEnv, os.Stderr)
+	if err != nil {
+		t.Fatalf("Failed loading config: %v", err)
+	}
+	live := &routes.LiveConfig{}
+	live.SetLoginCookieMaxAgeSecs(cfg.Cookie.MaxAgeSecs)
+	live.SetRateLimits(rateLimits(cfg.RateLimit))
+	tl := &tlsLoader{}
+	if err := tl.load(cfg.TLS); err != nil {
+		t.Fatalf("Failed loading certificate: %v", err)
+	}
+	logLevel := &slog.LevelVar{}
+	r := &reloader{args: args, lookupEnv: noEnv, running: cfg, live: live, tls: tl, logLevel: logLevel}
+
+	certSubject := func() string {
+		leaf, err := x509.ParseCertificate(tl.config.Load().Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("Failed parsing certificate: %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	// A renewed certificate, a new log level, a new cookie max age, new CORS origins, a new
+	// rate limit, and a new listen address. All but the listen address should be applied.
+	newTestCert(t, "new.example.com", nil).write(t, certFile, keyFile)
+	writeConfig(fmt.Sprintf("server:\n    listen_address: \":9090\"\ntls:\n    enabled: true\n    cert_file: %s\n    key_file: %s\nlog:\n    level: debug\ncookie:\n    max_age_secs: 120\ncors:\n    allowed_origins: https://app.example.com/\nrate_limit:\n    auth_per_minute: 6\n",
+		certFile, keyFile))
+	needRestart, err := r.reload()
+	if err != nil {
+		t.Fatalf("Failed reloading config: %v", err)
+	}
+	fmt.Println("TEST RELOAD: Needs a restart:", needRestart)
+	if len(needRestart) != 1 || needRestart[0] != "server.listen_address" {
+		t.Fatalf("Expected only server.listen_address to need a restart, but got: %v", needRestart)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("Expected the log level to be reloaded, but it's %s", logLevel.Level())
+	}
+	if live.LoginCookieMaxAgeSecs() != 120 {
+		t.Fatalf("Expected the cookie max age to be reloaded, but it's %d", live.LoginCookieMaxAgeSecs())
+	}
+	if subject := certSubject(); subject != "new.example.com" {
+		t.Fatalf("Expected the renewed certificate to be loaded, but got the one for %s", subject)
+	}
+	if allowed, _ := live.CORSAllowedOrigin("https://app.example.com"); !allowed {
+		t.Fatalf("Expected the CORS origins to be reloaded")
+	}
+	if limit := live.RateLimit(routes.RateLimitGroupAuth); limit != ratelimit.PerMinute(6, cfg.RateLimit.AuthBurst) {
+		t.Fatalf("Expected the auth rate limit to be reloaded, but it's %+v", limit)
+	}
+
+	// Rate limiting turned off, and the CORS origin gone, which can be done live too.
+	writeConfig(fmt.Sprintf("server:\n    listen_address: \":9090\"\ntls:\n    enabled: true\n    cert_file: %s\n    key_file: %s\nlog:\n    level: debug\ncookie:\n    max_age_secs: 120\nrate_limit:\n    enabled: false\n",
+		certFile, keyFile))
+	needRestart, err = r.reload()
+	if err != nil {
+		t.Fatalf("Failed reloading config: %v", err)
+	}
+	if len(needRestart) != 1 || needRestart[0] != "server.listen_address" {
+		t.Fatalf("Expected only server.listen_address to need a restart, but got: %v", needRestart)
+	}
+	if allowed, _ := live.CORSAllowedOrigin("https://app.example.com"); allowed {
+		t.Fatalf("Expected the CORS origin to be gone")
+	}
+	for _, group := range []string{routes.RateLimitGroupAuth, routes.RateLimitGroupNotes, routes.RateLimitGroupOther} {
+		if limit := live.RateLimit(group); !limit.Unlimited() {
+			t.Fatalf("Expected rate limiting to be turned off, but the %s group has %+v", group, limit)
+		}
+	}
+
+	// A bad config. Should error, and change nothing.
+	writeConfig("cookie:\n    max_age_secs: -1\n")
+	if _, err := r.reload(); err == nil {
+		t.Fatalf("Expected an error reloading a bad config, but got none")
+	} else {
+		fmt.Println("TEST RELOAD: Bad config error:", err)
+	}
+	if live.LoginCookieMaxAgeSecs() != 120 || certSubject() != "new.example.com" {
+		t.Fatalf("Bad config was partly applied")
+	}
+
+	// A certificate which doesn't load. Should error, and keep the current one.
+	writeConfig(fmt.Sprintf("tls:\n    enabled: true\n    cert_file: %s\n    key_file: %s\ncookie:\n    max_age_secs: 30\n",
+		keyFile, keyFile))
+	if _, err := r.reload(); err == nil {
+		t.Fatalf("Expected an error reloading a bad certificate, but got none")
+	}
+	if live.LoginCookieMaxAgeSecs() != 120 || certSubject() != "new.example.com" {
+		t.Fatalf("Config with a bad certificate was partly applied")
+	}
+}
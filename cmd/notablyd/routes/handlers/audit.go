@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+)
+
+const (
+	// The name of the router context variable holding how long audit events are
+	// kept, as a time.Duration. Zero or less means forever.
+	AuditRetentionKey = "AuditRetention"
+
+	// The names of the router context variables saying who and what the request was
+	// about, when the route doesn't say. See setAuditTarget().
+	auditTargetUserIDKey = "AuditTargetUserID"
+	auditTargetNoteIDKey = "AuditTargetNoteID"
+
+	// Query param keys for filtering the audit log. Paging uses LimitQueryParamKey and CursorQueryParamKey.
+	ActionQueryParamKey  = "action"
+	OutcomeQueryParamKey = "outcome"
+	ActorQueryParamKey   = "actor"   // The user ID of who did it.
+	TargetQueryParamKey  = "user"    // The user ID of who it was done to.
+	NoteIDQueryParamKey  = "note_id" // The note it was done to.
+	SinceQueryParamKey   = "since"   // Unix timestamp.
+	UntilQueryParamKey   = "until"   // Unix timestamp.
+)
+
+// setAuditTarget says which user and note the request is about, for the audit log,
+// for when that's not just the logged-in user and the note ID in the path, e.g. when
+// logging in, or creating a note. Empty means no change.
+func setAuditTarget(c *gin.Context, userID, noteID string) {
+	if userID != "" {
+		c.Set(auditTargetUserIDKey, userID)
+	}
+	if noteID != "" {
+		c.Set(auditTargetNoteIDKey, noteID)
+	}
+}
+
+// RecordAuditEvent adds the outcome of the request, which has been handled, to the
+// audit log, as the given action (e.g. model.AuditActionLogin).
+// If it can't be recorded, that's logged, and the response stands.
+func RecordAuditEvent(c *gin.Context, action string) {
+	event := model.AuditEvent{
+		Action:    action,
+		Outcome:   model.AuditOutcomeSuccess,
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: c.GetString(RequestIDKey),
+	}
+	if c.Writer.Status() >= http.StatusBadRequest {
+		event.Outcome = model.AuditOutcomeFailure
+		event.Reason = c.GetString(problemCodeKey)
+	}
+
+	// Whoever the login cookie says, which has been checked if the request got as far as the handler.
+	event.ActorUserID, _ = c.Cookie(LoginCookieName)
+	event.TargetUserID = c.GetString(auditTargetUserIDKey)
+	if event.TargetUserID == "" {
+		event.TargetUserID = event.ActorUserID
+	}
+	event.TargetNoteID = c.GetString(auditTargetNoteIDKey)
+	if event.TargetNoteID == "" {
+		event.TargetNoteID = c.Param("id")
+	}
+
+	var keepSince int64
+	if retention, ok := c.Value(AuditRetentionKey).(time.Duration); ok && retention > 0 {
+		keepSince = time.Now().Add(-retention).Unix()
+	}
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	if _, err := db.AddAuditEvent(event, keepSince); err != nil {
+		Logger(c).Error("AUDIT LOG", "action", action, "outcome", event.Outcome, "error", err.Error())
+	}
+}
+
+// auditListOptionsFromQuery works out the audit log list options from the query params.
+func auditListOptionsFromQuery(c *gin.Context) (model.AuditListOptions, error) {
+	var opts model.AuditListOptions
+	var err error
+
+	query := c.Request.URL.Query()
+	if limit := query.Get(LimitQueryParamKey); limit != "" {
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil || opts.Limit <= 0 {
+			return opts, fmt.Errorf("'%s' must be a positive integer", LimitQueryParamKey)
+		}
+	}
+	opts.Cursor = query.Get(CursorQueryParamKey)
+
+	opts.Action = query.Get(ActionQueryParamKey)
+	opts.Outcome = query.Get(OutcomeQueryParamKey)
+	if opts.Outcome != "" && opts.Outcome != model.AuditOutcomeSuccess && opts.Outcome != model.AuditOutcomeFailure {
+		return opts, fmt.Errorf("'%s' must be one of '%s' or '%s'",
+			OutcomeQueryParamKey, model.AuditOutcomeSuccess, model.AuditOutcomeFailure)
+	}
+	opts.ActorUserID = query.Get(ActorQueryParamKey)
+	opts.TargetUserID = query.Get(TargetQueryParamKey)
+	opts.TargetNoteID = query.Get(NoteIDQueryParamKey)
+
+	if since := query.Get(SinceQueryParamKey); since != "" {
+		opts.Since, err = strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("'%s' must be a Unix timestamp", SinceQueryParamKey)
+		}
+	}
+	if until := query.Get(UntilQueryParamKey); until != "" {
+		opts.Until, err = strconv.ParseInt(until, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("'%s' must be a Unix timestamp", UntilQueryParamKey)
+		}
+	}
+
+	return opts, nil
+}
+
+// Lists the audit log, newest first, a page at a time. The query params filter it,
+// and the paging info is in the response "meta". The route needs an operator's token.
+func ListAuditEventsV2(c *gin.Context) {
+	logPrefix := "V2 LIST AUDIT EVENTS"
+
+	listOpts, err := auditListOptionsFromQuery(c)
+	if err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, err.Error())
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	auditPage, err := db.GetAuditPage(listOpts)
+	if err != nil {
+		// A bad page cursor will get a 400.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, auditPage.Events, gin.H{"next_cursor": auditPage.NextCursor})
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// Where an event stream picks up from. Browsers send the header when they
+	// reconnect, and the query param is for the first connection, which they can't
+	// send headers with. Either is the ID of the last event the client got.
+	LastEventIDHeader        = "Last-Event-ID"
+	LastEventIDQueryParamKey = "last_event_id"
+
+	// The event sent, instead of the changes, when the change journal doesn't go back
+	// as far as the client asked for. The client needs to get all its notes again.
+	EventTypeReset = "reset"
+
+	// How often an idle event stream gets a comment, so that proxies don't give up on it.
+	eventsKeepAliveInterval = 15 * time.Second
+)
+
+// StreamNoteEvents streams the changes to the logged-in user's notes as server-sent
+// events, as they're committed, until the client goes away.
+func StreamNoteEvents(c *gin.Context) {
+	// Query().Get() is nice enough to URL-decode the encoded things for us.
+	userID, ok := ourutils.ValidateStringNotempty(c.Request.URL.Query().Get(UserIDQueryParamKey))
+	if !ok {
+		message := "Bad Request. User ID value in the query params was missing or empty"
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "STREAM EVENTS", message)
+		return
+	}
+
+	streamNoteEvents(c, "STREAM EVENTS", userID)
+}
+
+// StreamNoteEventsV2 is the API v2 StreamNoteEvents, for the user of the login session.
+func StreamNoteEventsV2(c *gin.Context) {
+	streamNoteEvents(c, "STREAM EVENTS V2", sessionUserID(c))
+}
+
+// changeToken makes an event ID, or a sync token, for where the change journal is
+// up to. Its sequence numbers start from 1 again when we do, so it says which journal
+// it's from, as "<journal ID>.<sequence number>".
+func changeToken(db *persistence.NotablyDB, seq int64) string {
+	return db.JournalID() + "." + strconv.FormatInt(seq, 10)
+}
+
+// parseChangeToken gets the sequence number from an event ID, or a sync token. One from
+// another change journal (including a bare sequence number, from before they said which)
+// gets one which this journal has never had, so the client is told to start again.
+// It returns false if it's not an event ID at all.
+func parseChangeToken(db *persistence.NotablyDB, token string) (int64, bool) {
+	journalID, seqStr, found := strings.Cut(token, ".")
+	if !found {
+		journalID, seqStr = "", token
+	}
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false
+	}
+	if journalID != db.JournalID() {
+		return math.MaxInt64, true
+	}
+	return seq, true
+}
+
+// streamNoteEvents does the streaming for both APIs.
+// Each event's ID is where its change is in the change journal (see changeToken). With
+// no Last-Event-ID, the stream starts with the next change.
+func streamNoteEvents(c *gin.Context, logPrefix, userID string) {
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	afterSeq := int64(-1) // From now on.
+	lastEventID := c.GetHeader(LastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = c.Query(LastEventIDQueryParamKey)
+	}
+	if lastEventID != "" {
+		seq, ok := parseChangeToken(db, lastEventID)
+		if !ok {
+			message := fmt.Sprintf("Bad Request. The last event ID '%s' is not an event ID", lastEventID)
+			RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, message)
+			return
+		}
+		afterSeq = seq
+	}
+
+	// The first read is before the response starts, so that we can still say what's wrong.
+	page, watch, err := db.GetNoteChangesForUser(userID, afterSeq, 0)
+	if err != nil {
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	// A write timeout would cut the stream off, so it has none.
+	noWriteDeadline(c, logPrefix)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Don't let nginx buffer the stream.
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// send writes to the stream, and tells whether the client is still there.
+	send := func(frame string) bool {
+		if _, err := io.WriteString(c.Writer, frame); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+	ctx := c.Request.Context()
+	for {
+		if page.Truncated {
+			data, _ := json.Marshal(gin.H{"seq": page.Seq})
+			if !send(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", changeToken(db, page.Seq), EventTypeReset, data)) {
+				return
+			}
+		}
+		for _, change := range page.Changes {
+			data, err := json.Marshal(change)
+			if err != nil {
+				Logger(c).Error(logPrefix, "detail", "Can't marshal the note change", "seq", change.Seq,
+					"error", err.Error())
+				return
+			}
+			if !send(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", changeToken(db, change.Seq), change.Type, data)) {
+				return
+			}
+		}
+		afterSeq = page.Seq
+
+		// A full page means there may be more already, so there's no waiting for them.
+		if len(page.Changes) < persistence.DefaultChangePageLimit {
+		wait:
+			for {
+				select {
+				case <-watch:
+					break wait
+				case <-keepAlive.C:
+					if !send(": keep-alive\n\n") {
+						return
+					}
+				case <-ctx.Done():
+					// The client has gone, or we're shutting down.
+					return
+				}
+			}
+		}
+
+		page, watch, err = db.GetNoteChangesForUser(userID, afterSeq, 0)
+		if err != nil {
+			// It's too late for a problem response. The client can reconnect from the last event.
+			Logger(c).Error(logPrefix, "detail", "Can't get note changes", "user_id", userID,
+				"error", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/platform/archive"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+// Query param key for the format of an export: "zip" (the default) or "tar.gz".
+const FormatQueryParamKey = "format"
+
+// ExportNotes downloads all the logged-in user's notes, as a zip or tar.gz with a
+// Markdown file for each note, and a manifest.json. See the archive package.
+func ExportNotes(c *gin.Context) {
+	// Query().Get() is nice enough to URL-decode the encoded things for us.
+	userID, ok := ourutils.ValidateStringNotempty(c.Request.URL.Query().Get(UserIDQueryParamKey))
+	if !ok {
+		message := "Bad Request. User ID value in the query params was missing or empty"
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "EXPORT NOTES", message)
+		return
+	}
+
+	exportNotes(c, "EXPORT NOTES", userID)
+}
+
+// ExportNotesV2 is the API v2 ExportNotes, for the user of the login session.
+func ExportNotesV2(c *gin.Context) {
+	exportNotes(c, "V2 EXPORT NOTES", sessionUserID(c))
+}
+
+// exportNotes does the exporting for both APIs. The archive is written as the notes
+// are read, so that it's never all in memory, however many notes there are.
+func exportNotes(c *gin.Context, logPrefix, userID string) {
+	format := c.DefaultQuery(FormatQueryParamKey, archive.FormatZip)
+	if format != archive.FormatZip && format != archive.FormatTarGz {
+		message := fmt.Sprintf("Bad Request. '%s' must be '%s' or '%s'", FormatQueryParamKey,
+			archive.FormatZip, archive.FormatTarGz)
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, message)
+		return
+	}
+
+	// The user is looked for before the response starts, so that we can still say what's wrong.
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	if _, err := db.GetUserByID(userID); err != nil {
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	// A big export takes a while to download.
+	noWriteDeadline(c, logPrefix)
+
+	now := time.Now()
+	aw, err := archive.NewWriter(c.Writer, format, userID, now)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+	c.Header("Content-Type", archive.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="notably-export-%s.%s"`,
+		now.UTC().Format("20060102-150405"), format))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	// It's too late for a problem response once the archive has started. Leaving it
+	// unfinished, with no manifest, is how the client can tell that it went wrong.
+	if err := db.WalkNotesForUser(userID, aw.WriteNote); err != nil {
+		Logger(c).Error(logPrefix, "detail", "Can't export notes", "user_id", userID, "error", err.Error())
+		return
+	}
+	if err := aw.Close(); err != nil {
+		Logger(c).Error(logPrefix, "detail", "Can't finish export", "user_id", userID, "error", err.Error())
+		return
+	}
+	Logger(c).Info(logPrefix, "detail", "Exported notes", "user_id", userID, "format", format)
+}
@@ -1,15 +1,152 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"notably/internal/platform/persistence"
 )
 
 func GetHealth(c *gin.Context) {
 	message := fmt.Sprintf("Hello, the Notably web server is alive. The current time is %s",
 		time.Now().UTC().Format(time.RFC3339))
-	c.IndentedJSON(http.StatusOK, gin.H{"message:": message})
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message})
+}
+
+// HealthCheck checks something we depend on, other than the store, which is always
+// checked. Until it passes, we're not ready for requests.
+type HealthCheck struct {
+	Name  string // e.g. "disk:/var/log/notablyd"
+	Check func(ctx context.Context) error
+}
+
+const (
+	// The name of the router context variable holding the []HealthCheck.
+	HealthChecksKey = "HealthChecks"
+
+	// How long the health checks get, all together.
+	healthCheckTimeout = 5 * time.Second
+
+	HealthStatusOK          = "ok"
+	HealthStatusFailing     = "failing"     // Of a check.
+	HealthStatusUnavailable = "unavailable" // Of the server, when a check is failing.
+)
+
+// When we started, near enough.
+var startTime = time.Now()
+
+// HealthCheckResult is how one health check went.
+type HealthCheckResult struct {
+	Status   string `json:"status"` // HealthStatusOK or HealthStatusFailing.
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// runHealthChecks checks the store, and then everything else, returning whether all
+// is well, and how each check went, by name.
+func runHealthChecks(c *gin.Context) (bool, map[string]HealthCheckResult) {
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	checks := []HealthCheck{{Name: "store", Check: func(context.Context) error { return db.Ping() }}}
+	if more, ok := c.Value(HealthChecksKey).([]HealthCheck); ok {
+		checks = append(checks, more...)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+	allOK := true
+	results := make(map[string]HealthCheckResult, len(checks))
+	for _, check := range checks {
+		start := time.Now()
+		err := check.Check(ctx)
+		result := HealthCheckResult{Status: HealthStatusOK, Duration: time.Since(start).String()}
+		if err != nil {
+			allOK = false
+			result.Status = HealthStatusFailing
+			result.Error = err.Error()
+			Logger(c).Warn("HEALTH CHECK", "check", check.Name, "error", err.Error())
+		}
+		results[check.Name] = result
+	}
+	return allOK, results
+}
+
+// GetLiveness tells whether we're alive, which we are if we can answer at all.
+// It deliberately doesn't check anything else: if the store is unavailable,
+// restarting us won't help.
+func GetLiveness(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": HealthStatusOK})
+}
+
+// GetReadiness tells whether we're ready for requests, which we are if the store and
+// everything else we depend on pass their health checks. If not, it's a 503, so that
+// a load balancer sends requests elsewhere for now.
+func GetReadiness(c *gin.Context) {
+	ok, results := runHealthChecks(c)
+	status, healthStatus := http.StatusOK, HealthStatusOK
+	if !ok {
+		status, healthStatus = http.StatusServiceUnavailable, HealthStatusUnavailable
+	}
+	c.IndentedJSON(status, gin.H{"status": healthStatus, "checks": results})
+}
+
+// HealthDetails is the detailed health report, for operators.
+type HealthDetails struct {
+	Status      string                       `json:"status"`
+	Checks      map[string]HealthCheckResult `json:"checks"`
+	Version     string                       `json:"version"` // Of the notably module, "(devel)" if built from a checkout.
+	GoVersion   string                       `json:"go_version"`
+	VCSRevision string                       `json:"vcs_revision,omitempty"`
+	VCSTime     string                       `json:"vcs_time,omitempty"`
+	VCSModified bool                         `json:"vcs_modified,omitempty"` // Built with uncommitted changes.
+	StartedAt   time.Time                    `json:"started_at"`
+	UptimeSecs  int64                        `json:"uptime_secs"`
+	Users       int                          `json:"users"`
+	Notes       int                          `json:"notes"`
+}
+
+// GetHealthDetailsV2 reports the health checks, what we're running, for how long,
+// and how many users and notes there are. The route needs an operator's token.
+func GetHealthDetailsV2(c *gin.Context) {
+	logPrefix := "V2 HEALTH DETAILS"
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+
+	ok, results := runHealthChecks(c)
+	details := HealthDetails{
+		Status:     HealthStatusOK,
+		Checks:     results,
+		StartedAt:  startTime.UTC(),
+		UptimeSecs: int64(time.Since(startTime).Seconds()),
+	}
+	if !ok {
+		details.Status = HealthStatusUnavailable
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		details.Version = info.Main.Version
+		details.GoVersion = info.GoVersion
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				details.VCSRevision = setting.Value
+			case "vcs.time":
+				details.VCSTime = setting.Value
+			case "vcs.modified":
+				details.VCSModified = setting.Value == "true"
+			}
+		}
+	}
+
+	var err error
+	details.Users, details.Notes, err = db.CountUsersAndNotes()
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, details, nil)
 }
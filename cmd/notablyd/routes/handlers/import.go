@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/model"
+	"notably/internal/platform/archive"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// The name of the router context variable holding the DB for work which goes on
+	// after the request is done, without its trace, e.g. a big import.
+	BackgroundDBKey = "BackgroundDB"
+
+	// The name of the router context variable holding the context of the work which
+	// goes on after the request is done, which is done when that has to stop, e.g. the
+	// server is shutting down.
+	BackgroundContextKey = "BackgroundContext"
+
+	// The name of the router context variable holding how many items an import can
+	// have before it goes on in the background.
+	ImportAsyncItemsKey = "ImportAsyncItems"
+
+	// How many items an import can have before it goes on in the background, by default.
+	DefaultImportAsyncItems = 100
+
+	// How often a background import saves how far it has got, in items.
+	importProgressItems = 50
+)
+
+// ImportNotes imports notes into the logged-in user's account, from the upload in
+// the request body, with the user ID in the query params, as for a GET. See
+// archive.ReadImport for what can be imported.
+//
+// A small import is done there and then, and gets a 200 with the results. A big one
+// gets a 202 straight away, and goes on in the background, with a Location header
+// pointing at where to see how it's getting on (see GetImport).
+func ImportNotes(c *gin.Context) {
+	// Query().Get() is nice enough to URL-decode the encoded things for us.
+	userID, ok := ourutils.ValidateStringNotempty(c.Request.URL.Query().Get(UserIDQueryParamKey))
+	if !ok {
+		message := "Bad Request. User ID value in the query params was missing or empty"
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "IMPORT NOTES", message)
+		return
+	}
+
+	imp, status := importNotes(c, "IMPORT NOTES", userID)
+	if imp == nil {
+		return
+	}
+	if status == http.StatusAccepted {
+		c.Header("Location", c.FullPath()+"/"+imp.ImportID+"?"+UserIDQueryParamKey+"="+url.QueryEscape(userID))
+	}
+	c.IndentedJSON(status, gin.H{"message": imp})
+}
+
+// ImportNotesV2 is the API v2 ImportNotes, for the user of the login session.
+func ImportNotesV2(c *gin.Context) {
+	imp, status := importNotes(c, "V2 IMPORT NOTES", sessionUserID(c))
+	if imp == nil {
+		return
+	}
+	if status == http.StatusAccepted {
+		c.Header("Location", c.FullPath()+"/"+imp.ImportID)
+	}
+	RespondV2(c, status, imp, nil)
+}
+
+// importNotes does the importing for both APIs, returning the import, and the status
+// to respond with. On failure, it has already sent the error response, and returns nil.
+func importNotes(c *gin.Context, logPrefix, userID string) (*model.Import, int) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			RespondProblem(c, http.StatusRequestEntityTooLarge, ProblemCodeUploadTooLarge, logPrefix,
+				fmt.Sprintf("The upload is bigger than the %d bytes allowed", tooLarge.Limit))
+			return nil, 0
+		}
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix,
+			fmt.Sprintf("Error reading the upload: %s", err.Error()))
+		return nil, 0
+	}
+
+	// Something which isn't any of the kinds of import we know gets a 415, and one
+	// which can't be read a 400. A file bigger than a note can be isn't worth reading.
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	items, err := archive.ReadImport(data, db.Quota().MaxNoteBytes)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return nil, 0
+	}
+
+	imp, err := db.AddImport(userID, len(items))
+	if err != nil {
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return nil, 0
+	}
+
+	asyncItems := c.GetInt(ImportAsyncItemsKey)
+	if asyncItems <= 0 {
+		asyncItems = DefaultImportAsyncItems
+	}
+	if len(items) <= asyncItems {
+		runImport(c.Request.Context(), db, Logger(c), imp, items)
+		return imp, http.StatusOK
+	}
+
+	// The request will be long gone, so it's done without its trace, or its context,
+	// but still with its logger, so that the import can be followed in the logs.
+	started := *imp
+	ctx := c.MustGet(BackgroundContextKey).(context.Context)
+	bg := c.MustGet(BackgroundDBKey).(*persistence.NotablyDB).WithLogger(Logger(c))
+	go runImport(ctx, bg, Logger(c), imp, items)
+	Logger(c).Info(logPrefix, "detail", "Importing in the background", "user_id", userID,
+		"import_id", imp.ImportID, "total", len(items))
+	return &started, http.StatusAccepted
+}
+
+// runImport imports the items, one note at a time, through the same path as any new
+// note, quotas and all. How far it has got is saved every so often, and when it's done,
+// which is early, as cancelled, if the context is done first.
+func runImport(ctx context.Context, db *persistence.NotablyDB, log *slog.Logger, imp *model.Import, items []*archive.Item) {
+	status := model.ImportDone
+	for _, item := range items {
+		if ctx.Err() != nil {
+			status = model.ImportCancelled
+			break
+		}
+		result := &model.ImportResult{Item: item.Name}
+		switch {
+		case item.Skip != "":
+			result.Status, result.Detail = model.ImportStatusSkipped, item.Skip
+			imp.Skipped++
+		case item.Err != nil:
+			result.Status, result.Code, result.Detail = model.ImportStatusFailed, ProblemCodeInvalidNote, item.Err.Error()
+			imp.Failed++
+		default:
+			note, err := db.ImportNoteForUser(imp.UserID, item.Text, item.CreationTimestamp, item.UpdateTimestamp)
+			if err != nil {
+				// The same problem code it would have on its own, e.g. "quota_exceeded".
+				_, result.Code = ProblemForError(err)
+				result.Status, result.Detail = model.ImportStatusFailed, err.Error()
+				imp.Failed++
+			} else {
+				result.Status, result.NoteID = model.ImportStatusImported, note.NoteID
+				imp.Imported++
+			}
+		}
+		imp.Results = append(imp.Results, result)
+		imp.Processed++
+
+		if imp.Processed%importProgressItems == 0 && imp.Processed < imp.Total {
+			if err := db.UpdateImport(imp); err != nil {
+				log.Warn("IMPORT NOTES", "detail", "Can't save import progress", "import_id", imp.ImportID,
+					"error", err.Error())
+			}
+		}
+	}
+
+	imp.Status = status
+	imp.FinishTimestamp = time.Now().Unix() // seconds since Unix epoch
+	if err := db.UpdateImport(imp); err != nil {
+		log.Error("IMPORT NOTES", "detail", "Can't save finished import", "import_id", imp.ImportID,
+			"error", err.Error())
+	}
+	log.Info("IMPORT NOTES", "detail", "Imported notes", "user_id", imp.UserID, "import_id", imp.ImportID,
+		"status", imp.Status, "imported", imp.Imported, "failed", imp.Failed, "skipped", imp.Skipped)
+}
+
+// GetImport gets how an import into the logged-in user's account, with its import ID
+// in the request path, is getting on, or how it went. The last few are kept.
+func GetImport(c *gin.Context) {
+	userID, ok := ourutils.ValidateStringNotempty(c.Request.URL.Query().Get(UserIDQueryParamKey))
+	if !ok {
+		message := "Bad Request. User ID value in the query params was missing or empty"
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "GET IMPORT", message)
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	imp, err := db.GetImport(userID, c.Param("import_id"))
+	if err != nil {
+		RespondErrorProblem(c, "GET IMPORT", err.Error(), err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"message": imp})
+}
+
+// GetImportV2 is the API v2 GetImport, for the user of the login session.
+func GetImportV2(c *gin.Context) {
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	imp, err := db.GetImport(sessionUserID(c), c.Param("import_id"))
+	if err != nil {
+		RespondErrorProblem(c, "V2 GET IMPORT", err.Error(), err)
+		return
+	}
+	RespondV2(c, http.StatusOK, imp, nil)
+}
@@ -3,8 +3,8 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 
@@ -33,14 +33,14 @@ func AddNoteForUser(c *gin.Context) {
 	var reqNote model.RequestNote
 	var message string
 
-	// Get the body into the REQUEST DTO
-	if err := c.BindJSON(&reqNote); err != nil {
+	// Get the body into the REQUEST DTO.
+	// ShouldBindJSON() rather than BindJSON(), since the latter writes a 400 before we can.
+	if err := c.ShouldBindJSON(&reqNote); err != nil {
 		message = "Potentially malformed POST body."
 		message += " Please ensure that the body is valid JSON and"
 		message += " contains all relevant fields ('user_id', 'note')."
 		message += fmt.Sprintf(" Error: %s", err.Error())
-		log.Printf("ERROR: ADD NOTE: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "ADD NOTE", message)
 		return
 	}
 
@@ -50,8 +50,7 @@ func AddNoteForUser(c *gin.Context) {
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		message = "Request 'user_id' field is empty or blank"
-		log.Printf("ERROR: ADD NOTE: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "ADD NOTE", message)
 		return
 	}
 
@@ -60,8 +59,7 @@ func AddNoteForUser(c *gin.Context) {
 	// So we just check if it is altogether empty.
 	if noteText == "" {
 		message = fmt.Sprintf("Request 'note' field is empty for user '%s'", userID)
-		log.Printf("ERROR: ADD NOTE: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "ADD NOTE", message)
 		return
 	}
 
@@ -75,25 +73,16 @@ func AddNoteForUser(c *gin.Context) {
 	// Now we call our persistence function to create the note.
 	aNote, err := db.AddNoteForUser(userID, noteText)
 	if err != nil {
-		respErr := http.StatusInternalServerError
-		// Check whether the error has "not found" in it
-		if ourutils.StrContainsInsensitive(err.Error(), "already exists") {
-			respErr = http.StatusConflict
-		}
-
 		message := fmt.Sprintf("Error adding note for user '%s': %s", userID, err.Error())
-		log.Printf("ERROR: ADD NOTE: %s\n", message)
-		c.IndentedJSON(respErr, gin.H{"error": message})
+		RespondErrorProblem(c, "ADD NOTE", message, err)
 		return
 	}
+	setAuditTarget(c, "", aNote.NoteID)
 
 	respData, err := json.Marshal(aNote)
 	if err != nil {
 		message := fmt.Sprintf("Error adding note for user '%s': %s", userID, err.Error())
-		log.Printf("ERROR: ADD NOTE: %s\n", message)
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{
-			"error": message,
-		})
+		RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "ADD NOTE", message)
 		return
 	}
 
@@ -113,10 +102,7 @@ func GetOrDeleteNoteByNoteIDForUser(c *gin.Context) {
 		// Any route where this is set as middleware MUST have the key.
 		message := fmt.Sprintf("Bad Request for %s Note. Did not find the user ID key in the query params",
 			reqMethod)
-		log.Printf("ERROR: %s NOTE: %s\n", reqMethod, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": message,
-		})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, reqMethod+" NOTE", message)
 		return
 	}
 
@@ -127,8 +113,7 @@ func GetOrDeleteNoteByNoteIDForUser(c *gin.Context) {
 	if err != nil {
 		message := fmt.Sprintf("Bad Request for %s Note. Request %s param error: %s",
 			reqMethod, UserIDQueryParamKey, err.Error())
-		log.Printf("ERROR: %s NOTE: %s\n", reqMethod, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, reqMethod+" NOTE", message)
 		return
 	}
 
@@ -147,19 +132,10 @@ func GetOrDeleteNoteByNoteIDForUser(c *gin.Context) {
 		numDeleted, err = db.DeleteNoteForUser(userID, noteID)
 	}
 	if err != nil {
+		// A note which does not exist will get a 404.
+		// Deleting a note which does not exist is not an error, though.
 		message := fmt.Sprintf("Error %s note for user '%s': %s", reqMethod, userID, err.Error())
-		log.Printf("ERROR: %s NOTE: %s\n", reqMethod, message)
-		if isGET {
-			respErr := http.StatusInternalServerError
-			// Check whether the error has "not found" in it
-			if ourutils.StrContainsInsensitive(err.Error(), "not found") {
-				respErr = http.StatusNotFound
-			}
-
-			c.IndentedJSON(respErr, gin.H{"error": message})
-		} else {
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": message})
-		}
+		RespondErrorProblem(c, reqMethod+" NOTE", message, err)
 		return
 	}
 
@@ -170,10 +146,7 @@ func GetOrDeleteNoteByNoteIDForUser(c *gin.Context) {
 		respData, err := json.Marshal(aNote)
 		if err != nil {
 			message := fmt.Sprintf("Error getting note for user '%s': %s", userID, err.Error())
-			log.Printf("ERROR: GET NOTE: %s", message)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{
-				"error": message,
-			})
+			RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "GET NOTE", message)
 			return
 		}
 
@@ -187,17 +160,65 @@ func GetOrDeleteNoteByNoteIDForUser(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, gin.H{"message": numDeleted})
 }
 
+// noteListOptionsFromQuery builds the paging, sorting and filtering options for
+// listing notes from the (all optional) request query params.
+func noteListOptionsFromQuery(c *gin.Context) (model.NoteListOptions, error) {
+	var opts model.NoteListOptions
+	var err error
+
+	query := c.Request.URL.Query()
+	if limit := query.Get(LimitQueryParamKey); limit != "" {
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil || opts.Limit <= 0 {
+			return opts, fmt.Errorf("'%s' must be a positive integer", LimitQueryParamKey)
+		}
+	}
+
+	opts.Cursor = query.Get(CursorQueryParamKey)
+	opts.SortBy = query.Get(SortQueryParamKey)
+	if opts.SortBy != "" && opts.SortBy != persistence.NoteSortCreated && opts.SortBy != persistence.NoteSortUpdated {
+		return opts, fmt.Errorf("'%s' must be one of '%s' or '%s'",
+			SortQueryParamKey, persistence.NoteSortCreated, persistence.NoteSortUpdated)
+	}
+
+	switch order := query.Get(OrderQueryParamKey); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("'%s' must be one of 'asc' or 'desc'", OrderQueryParamKey)
+	}
+
+	opts.Query = query.Get(SearchQueryParamKey)
+
+	if after := query.Get(CreatedAfterQueryParamKey); after != "" {
+		opts.CreatedAfter, err = strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("'%s' must be a Unix timestamp", CreatedAfterQueryParamKey)
+		}
+	}
+	if before := query.Get(CreatedBeforeQueryParamKey); before != "" {
+		opts.CreatedBefore, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("'%s' must be a Unix timestamp", CreatedBeforeQueryParamKey)
+		}
+	}
+
+	return opts, nil
+}
+
 // GET Handler as well as DELETE handler for all notes for a logged-in user.
+// GETs return one page of notes. See noteListOptionsFromQuery() for the optional
+// query params used for paging, sorting and filtering. The response carries the
+// "next_cursor" to pass in to get the next page (empty on the last page), and the
+// "total_count" of notes matching the filters.
 func GetOrDeleteAllNotesForUser(c *gin.Context) {
 	reqMethod := c.Request.Method
 	if !c.Request.URL.Query().Has(UserIDQueryParamKey) {
 		// Any route where this is set as middleware MUST have the key.
 		message := fmt.Sprintf("Bad Request for %s All Notes. Did not find the user ID key in the query params",
 			reqMethod)
-		log.Printf("ERROR: %s ALL NOTES: %s\n", reqMethod, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": message,
-		})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, reqMethod+" ALL NOTES", message)
 		return
 	}
 
@@ -207,15 +228,14 @@ func GetOrDeleteAllNotesForUser(c *gin.Context) {
 	if !ok {
 		message := fmt.Sprintf("Bad Request for %s All Notes: User ID is empty or missing",
 			reqMethod)
-		log.Printf("ERROR: %s ALL NOTES: %s\n", reqMethod, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, reqMethod+" ALL NOTES", message)
 		return
 	}
 
 	// middlewareCookieMonster() should have done its job
 	db := c.MustGet("DB").(*persistence.NotablyDB)
 
-	var manyNotes []*model.Note
+	var notesPage *model.NotePage
 	var err error
 	var numDeleted int
 	var isGET bool
@@ -223,34 +243,40 @@ func GetOrDeleteAllNotesForUser(c *gin.Context) {
 	// Now call the appropriate DB method depending on the request method.
 	if reqMethod == "" || reqMethod == http.MethodGet {
 		isGET = true
-		manyNotes, err = db.GetAllNotesForUser(userID)
+
+		// GETs are paged, so we don't send giant payloads for users with lots of notes.
+		var listOpts model.NoteListOptions
+		listOpts, err = noteListOptionsFromQuery(c)
+		if err != nil {
+			message := fmt.Sprintf("Bad Request for %s All Notes: %s", reqMethod, err.Error())
+			RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, reqMethod+" ALL NOTES", message)
+			return
+		}
+		notesPage, err = db.GetNotesPageForUser(userID, listOpts)
 	} else {
 		numDeleted, err = db.DeleteAllNotesForUser(userID)
 	}
 	if err != nil {
+		// A bad page cursor will get a 400.
 		message := fmt.Sprintf("Error %s all notes for user '%s': %s", reqMethod, userID, err.Error())
-		log.Printf("ERROR: %s ALL NOTES: %s\n", reqMethod, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": message,
-		})
+		RespondErrorProblem(c, reqMethod+" ALL NOTES", message, err)
 		return
 	}
 
 	if isGET {
 		// Now we convert the slice of our DTOs to raw JSON
-		respData, err := json.Marshal(manyNotes)
+		respData, err := json.Marshal(notesPage.Notes)
 		if err != nil {
 			message := fmt.Sprintf("Error getting all notes for user '%s': %s", userID, err.Error())
-			log.Printf("ERROR: GET ALL NOTES: %s\n", message)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{
-				"error": message,
-			})
+			RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "GET ALL NOTES", message)
 			return
 		}
 
 		n := json.RawMessage(string(respData))
 		c.IndentedJSON(http.StatusOK, gin.H{
-			"message": n,
+			"message":     n,
+			"next_cursor": notesPage.NextCursor,
+			"total_count": notesPage.TotalCount,
 		})
 		return
 	}
@@ -264,14 +290,14 @@ func UpdateNoteByNoteIDForUser(c *gin.Context) {
 	var reqNote model.RequestNote
 	var message string
 
-	// Get the body into the REQUEST DTO
-	if err := c.BindJSON(&reqNote); err != nil {
+	// Get the body into the REQUEST DTO.
+	// ShouldBindJSON() rather than BindJSON(), since the latter writes a 400 before we can.
+	if err := c.ShouldBindJSON(&reqNote); err != nil {
 		message = "Potentially malformed POST body."
 		message += " Please ensure that the body is valid JSON and contains"
 		message += " all relevant fields ('id', 'user_id', 'note')."
 		message += fmt.Sprintf(" Error: %s", err.Error())
-		log.Printf("ERROR: UPDATE SINGLE NOTE: %s\n", err.Error())
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "UPDATE SINGLE NOTE", message)
 		return
 	}
 
@@ -282,8 +308,7 @@ func UpdateNoteByNoteIDForUser(c *gin.Context) {
 	userID, noteID, err := ourutils.ValidateUserIDAndNoteID(userID, noteID)
 	if err != nil {
 		message = fmt.Sprintf("Bad Request. Missing required field(s): %s", err.Error())
-		log.Printf("ERROR: UPDATE SINGLE NOTE: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "UPDATE SINGLE NOTE", message)
 		return
 	}
 
@@ -293,24 +318,24 @@ func UpdateNoteByNoteIDForUser(c *gin.Context) {
 	// We don't space-trim notes; we want them as the user entered them.
 	// So we just check if it is altogether empty.
 	if noteText == "" {
-		message = "Bad Request. Request 'note' field is empty"
-		log.Printf("ERROR: UPDATE SINGLE NOTE for user '%s': %s\n", userID, message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		message = fmt.Sprintf("Bad Request. Request 'note' field is empty for user '%s'", userID)
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "UPDATE SINGLE NOTE", message)
 		return
 	}
 
 	db := c.MustGet("DB").(*persistence.NotablyDB)
 	aNote, err := db.UpdateNoteForUser(userID, noteID, noteText)
 	if err != nil {
-		log.Printf("ERROR: UPDATE SINGLE NOTE for user '%s': %s\n", userID, err.Error())
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		// A note which does not exist will get a 404.
+		message = fmt.Sprintf("Error updating note for user '%s': %s", userID, err.Error())
+		RespondErrorProblem(c, "UPDATE SINGLE NOTE", message, err)
 		return
 	}
 
 	respData, err := json.Marshal(aNote)
 	if err != nil {
-		log.Printf("ERROR: UPDATE SINGLE NOTE for user '%s': %s\n", userID, err.Error())
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		message = fmt.Sprintf("Error updating note for user '%s': %s", userID, err.Error())
+		RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "UPDATE SINGLE NOTE", message)
 		return
 	}
 
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/cmd/notablyd/routes/openapi"
+)
+
+// Serves the OpenAPI 3 document describing API v1.
+// The document is also what the router validates v1 requests against, so it is
+// always in step with what the server accepts.
+func GetOpenAPISpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openapi.Spec())
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+// SyncNotes syncs a client's copy of the logged-in user's notes, for clients which
+// work offline. This is a POST handler, with the JSON POST body having these fields:
+//   - user_id : The email ID of the logged-in user.
+//   - sync_token : The sync token from the last sync. Empty (or missing) for the first.
+//   - changes : The changes the client made since, each on a base version of the note.
+//
+// On success, will return the results of the changes, the notes which have changed
+// since the last sync, and the sync token for the next one.
+func SyncNotes(c *gin.Context) {
+	var reqSync model.RequestSync
+	if err := c.ShouldBindJSON(&reqSync); err != nil {
+		message := "Potentially malformed POST body."
+		message += " Please ensure that the body is valid JSON and"
+		message += " contains all relevant fields ('user_id', 'sync_token', 'changes')."
+		message += fmt.Sprintf(" Error: %s", err.Error())
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "SYNC NOTES", message)
+		return
+	}
+
+	userID, ok := ourutils.ValidateStringNotempty(reqSync.UserID)
+	if !ok {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "SYNC NOTES", "Request 'user_id' field is empty or blank")
+		return
+	}
+
+	// middlewareCookieMonster() should have already taken care of ensuring that the
+	// user in the request body and the logged in user are the same.
+	resp := syncNotes(c, "SYNC NOTES", userID, &reqSync)
+	if resp == nil {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"message": resp})
+}
+
+// SyncNotesV2 is the API v2 SyncNotes, for the user of the login session.
+func SyncNotesV2(c *gin.Context) {
+	var reqSync model.RequestSync
+	if err := c.ShouldBindJSON(&reqSync); err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "V2 SYNC NOTES",
+			fmt.Sprintf("Request body must be a JSON object with 'sync_token' and 'changes' fields: %s", err.Error()))
+		return
+	}
+
+	resp := syncNotes(c, "V2 SYNC NOTES", sessionUserID(c), &reqSync)
+	if resp == nil {
+		return
+	}
+	RespondV2(c, http.StatusOK, resp, nil)
+}
+
+// syncNotes does the syncing for both APIs. The sync token is where the change journal
+// was up to at the last sync (see changeToken), which clients shouldn't count on.
+// On failure, it has already sent the error response, and returns nil.
+func syncNotes(c *gin.Context, logPrefix, userID string, reqSync *model.RequestSync) *model.ResponseSync {
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	afterSeq := int64(-1) // Never synced.
+	if reqSync.SyncToken != "" {
+		seq, ok := parseChangeToken(db, reqSync.SyncToken)
+		if !ok {
+			message := fmt.Sprintf("Bad Request. '%s' is not a sync token", reqSync.SyncToken)
+			RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, message)
+			return nil
+		}
+		afterSeq = seq
+	}
+
+	noteSync, err := db.SyncNotesForUser(userID, afterSeq, reqSync.Changes)
+	if err != nil {
+		// A nonexistent user will get a 404, and too many changes a 400.
+		message := fmt.Sprintf("Error syncing notes for user '%s': %s", userID, err.Error())
+		RespondErrorProblem(c, logPrefix, message, err)
+		return nil
+	}
+
+	// The changes which failed get the problem code they would have on their own.
+	for _, result := range noteSync.Results {
+		if result.Err != nil {
+			_, result.Code = ProblemForError(result.Err)
+			result.Detail = result.Err.Error()
+		}
+	}
+
+	return &model.ResponseSync{NoteSync: noteSync, SyncToken: changeToken(db, noteSync.Seq)}
+}
@@ -3,7 +3,6 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/mail"
 
@@ -32,25 +31,25 @@ func AddUser(c *gin.Context) {
 	var reqUser model.RequestUser
 	var message string
 
-	// Get the body into the REQUEST DTO
-	if err := c.BindJSON(&reqUser); err != nil {
+	// Get the body into the REQUEST DTO.
+	// ShouldBindJSON() rather than BindJSON(), since the latter writes a 400 before we can.
+	if err := c.ShouldBindJSON(&reqUser); err != nil {
 		message = "Potentially malformed POST body."
 		message += " Please ensure that the body is valid JSON and contains all relevant fields ('id', 'password')."
 		message += fmt.Sprintf(" Error: %s", err.Error())
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "REGISTER/ADD USER", message)
 		return
 	}
 
 	// Sanity checks on the request DTO
 	userID := reqUser.ID
+	setAuditTarget(c, userID, "")
 	plaintextPassword := reqUser.Password
 
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		message = "Request 'id' field is empty or blank"
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "REGISTER/ADD USER", message)
 		return
 	}
 
@@ -58,16 +57,14 @@ func AddUser(c *gin.Context) {
 	_, err := mail.ParseAddress(userID)
 	if err != nil {
 		message = "Request 'id' field does not appear to be a valid email address"
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "REGISTER/ADD USER", message)
 		return
 	}
 
 	plaintextPassword, ok = ourutils.ValidateStringNotempty(plaintextPassword)
 	if !ok {
 		message = "Request 'password' field is empty or blank"
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "REGISTER/ADD USER", message)
 		return
 	}
 
@@ -75,8 +72,7 @@ func AddUser(c *gin.Context) {
 	hashedPassword, ok = ourutils.ValidateStringNotempty(hashedPassword)
 	if !ok {
 		message = "Failed to hash Request 'password' field"
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": message})
+		RespondProblem(c, http.StatusUnprocessableEntity, ProblemCodeInternal, "REGISTER/ADD USER", message)
 		return
 	}
 
@@ -87,14 +83,8 @@ func AddUser(c *gin.Context) {
 	// Now we can finally call our persistence function.
 	aUser, err := db.AddUser(userID, hashedPassword)
 	if err != nil {
-		respErr := http.StatusInternalServerError
-		// Check whether the error has "not found" in it
-		if ourutils.StrContainsInsensitive(err.Error(), "already exists") {
-			respErr = http.StatusConflict
-		}
-
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", err.Error())
-		c.IndentedJSON(respErr, gin.H{"error": err.Error()})
+		// An existing user will get a 409.
+		RespondErrorProblem(c, "REGISTER/ADD USER", err.Error(), err)
 		return
 	}
 
@@ -106,8 +96,7 @@ func AddUser(c *gin.Context) {
 	respData, err := json.Marshal(aUser)
 	if err != nil {
 		message := fmt.Sprintf("Error marshalling model user to JSON: %s", err.Error())
-		log.Printf("ERROR: REGISTER/ADD USER: %s\n", message)
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": message})
+		RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "REGISTER/ADD USER", message)
 		return
 	}
 
@@ -127,30 +116,31 @@ func AddUser(c *gin.Context) {
 // The client must set the "Content-Type: application/json" header and pass a valid
 // JSON body in the request.
 func LoginUser(c *gin.Context) {
+	defer observeLogin(c, "v1")
 	var reqUser model.RequestUser
 	var message string
 
 	// NOTE: The Login backend MUST be idenpotent. See LogoutUser() below.
 
-	// Get the body into the REQUEST DTO
-	if err := c.BindJSON(&reqUser); err != nil {
+	// Get the body into the REQUEST DTO.
+	// ShouldBindJSON() rather than BindJSON(), since the latter writes a 400 before we can.
+	if err := c.ShouldBindJSON(&reqUser); err != nil {
 		message = "Potentially malformed POST body."
 		message += " Please ensure that the body is valid JSON and contains all relevant fields ('id', 'password')."
 		message += fmt.Sprintf(" Error: %s", err.Error())
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, "LOGIN USER", message)
 		return
 	}
 
 	// Sanity checks on the request DTO
 	userID := reqUser.ID
+	setAuditTarget(c, userID, "")
 	plaintextPassword := reqUser.Password
 
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		message = fmt.Sprintf("Request 'id' field is empty or blank when logging in user '%s'", userID)
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "LOGIN USER", message)
 		return
 	}
 
@@ -159,16 +149,14 @@ func LoginUser(c *gin.Context) {
 	if err != nil {
 		message = fmt.Sprintf("Request 'id' field does not appear to be a valid email address when logging in user '%s'",
 			userID)
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "LOGIN USER", message)
 		return
 	}
 
 	plaintextPassword, ok = ourutils.ValidateStringNotempty(plaintextPassword)
 	if !ok {
 		message = fmt.Sprintf("Request 'password' field is empty or blank when logging in user '%s'", userID)
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "LOGIN USER", message)
 		return
 	}
 
@@ -177,8 +165,7 @@ func LoginUser(c *gin.Context) {
 	hashedPassword, ok = ourutils.ValidateStringNotempty(hashedPassword)
 	if !ok {
 		message = fmt.Sprintf("Failed to hash Request 'password' field when logging in user '%s'", userID)
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"error": message})
+		RespondProblem(c, http.StatusUnprocessableEntity, ProblemCodeInternal, "LOGIN USER", message)
 		return
 	}
 
@@ -189,14 +176,8 @@ func LoginUser(c *gin.Context) {
 	// Now we can finally call our persistence function.
 	aUser, err := db.GetUserByID(userID)
 	if err != nil {
-		respErr := http.StatusInternalServerError
-		// Check whether the error has "not found" in it
-		if ourutils.StrContainsInsensitive(err.Error(), "not found") {
-			respErr = http.StatusNotFound
-		}
-
-		log.Printf("ERROR: LOGIN USER: %s\n", err.Error())
-		c.IndentedJSON(respErr, gin.H{"error": err.Error()})
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, "LOGIN USER", err.Error(), err)
 		return
 	}
 
@@ -205,17 +186,14 @@ func LoginUser(c *gin.Context) {
 	aUserHashedPassword := aUser.PasswordHash
 	if aUserID != userID || aUserHashedPassword != hashedPassword {
 		message = fmt.Sprintf("Forbidden. Terminating login due to user verification failure for user '%s'", userID)
-		log.Printf("ERROR: LOGIN USER: %s\n", message)
-		c.IndentedJSON(http.StatusForbidden, gin.H{"error": message})
+		RespondProblem(c, http.StatusForbidden, ProblemCodeInvalidCredentials, "LOGIN USER", message)
 		return
 	}
 
 	// If we got here, we have a validated user. Let's set a cookie in the context.
 	// We will use this cookie in subsequent calls to backend functions
 	// which need a "logged in" user.
-	// The signature of gin.Context.SetCookie() is:
-	//    SetCookie(name, value string, maxAge int, path, domain string, secure, httpOnly bool)
-	// where "maxAge" is in seconds (the docs don't mention this, but the source does)
+	// See setLoginCookie() for the other cookie settings.
 	loginCookieMaxAgeSecs := c.MustGet(LoginCookieMaxAgeKey).(int)
 
 	// Paranoia? Perhaps...
@@ -223,7 +201,7 @@ func LoginUser(c *gin.Context) {
 		loginCookieMaxAgeSecs = DefaultLoginCookieMaxAgeSecs
 	}
 
-	c.SetCookie(LoginCookieName, aUserID, loginCookieMaxAgeSecs, "/", "localhost", false, true)
+	setLoginCookie(c, aUserID, loginCookieMaxAgeSecs)
 
 	message = fmt.Sprintf("OK, user '%s' logged in", userID)
 	c.IndentedJSON(http.StatusOK, gin.H{"message": message})
@@ -236,18 +214,12 @@ func LogoutUser(c *gin.Context) {
 		if err == http.ErrNoCookie {
 			// TODO When proper login is implemented, send a WWW-Authenticate header in the response.
 			message := "No valid logged-in user found"
-			log.Printf("ERROR: LOGOUT USER: %s\n", message)
-			c.IndentedJSON(http.StatusUnauthorized, gin.H{
-				"error": message,
-			})
+			RespondProblem(c, http.StatusUnauthorized, ProblemCodeNotLoggedIn, "LOGOUT USER", message)
 		} else {
 			// Uh oh. What happened here?
 			// We really the IETF to specify more 5xx errors in the RFC 9110 standard.
 			message := fmt.Sprintf("logout failed because %s", err.Error())
-			log.Printf("ERROR: LOGOUT USER: %s\n", message)
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("logout failed because %s", message),
-			})
+			RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "LOGOUT USER", message)
 		}
 
 		return
@@ -260,7 +232,7 @@ func LogoutUser(c *gin.Context) {
 		// on seeing this response.
 		// Therefore, the Login functionality MUST be idempotent.
 		message := "Already logged out or session has expired"
-		log.Printf("WARNING: LOGOUT USER: %s\n", message)
+		Logger(c).Warn("LOGOUT USER", "detail", message)
 		c.IndentedJSON(http.StatusOK, gin.H{
 			"message": message,
 		})
@@ -268,7 +240,7 @@ func LogoutUser(c *gin.Context) {
 	}
 
 	// "Delete" the login cookie. This is done by expiring the cookie and setting it to contain an empty value.
-	c.SetCookie(LoginCookieName, "", -1, "/", "localhost", false, true)
+	setLoginCookie(c, "", -1)
 	c.IndentedJSON(http.StatusOK, gin.H{
 		"message": fmt.Sprintf("user '%s' has been logged out", cookieValue),
 	})
@@ -283,10 +255,7 @@ func GetUserById(c *gin.Context) {
 	if !c.Request.URL.Query().Has(UserIDQueryParamKey) {
 		// Any route where this is set as middleware MUST have the key.
 		message := "Bad Request. Did not find the user ID key in the query params"
-		log.Printf("ERROR: GET USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": message,
-		})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "GET USER", message)
 		return
 	}
 
@@ -295,10 +264,7 @@ func GetUserById(c *gin.Context) {
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		message := "Bad Request. User ID value in the query params was empty"
-		log.Printf("ERROR: GET USER: %s\n", message)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": message,
-		})
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "GET USER", message)
 		return
 	}
 
@@ -306,21 +272,14 @@ func GetUserById(c *gin.Context) {
 	db := c.MustGet("DB").(*persistence.NotablyDB)
 	aUser, err := db.GetUserByID(userID)
 	if err != nil {
-		respErr := http.StatusInternalServerError
-		// Check whether the error has "not found" in it
-		if ourutils.StrContainsInsensitive(err.Error(), "not found") {
-			respErr = http.StatusNotFound
-		}
-
-		log.Printf("ERROR: GET USER: %s\n", err.Error())
-		c.IndentedJSON(respErr, gin.H{"error": err.Error()})
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, "GET USER", err.Error(), err)
 		return
 	}
 	if aUser.UserID != userID {
 		// Hmmm...how did this happen? At any rate, we need to set a 404
 		message := fmt.Sprintf("User '%s' not found", userID)
-		log.Printf("ERROR: GET USER: %s\n", message)
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": message})
+		RespondProblem(c, http.StatusNotFound, ProblemCodeUserNotFound, "GET USER", message)
 		return
 	}
 
@@ -331,8 +290,7 @@ func GetUserById(c *gin.Context) {
 	respData, err := json.Marshal(aUser)
 	if err != nil {
 		message := fmt.Sprintf("Error marshalling model user to JSON: %s", err.Error())
-		log.Printf("ERROR: GET USER: %s\n", message)
-		c.IndentedJSON(http.StatusNotFound, gin.H{"error": message})
+		RespondProblem(c, http.StatusInternalServerError, ProblemCodeInternal, "GET USER", message)
 		return
 	}
 
@@ -340,3 +298,26 @@ func GetUserById(c *gin.Context) {
 
 	c.IndentedJSON(http.StatusOK, gin.H{"message": r})
 }
+
+// This is a GET request handler
+// Like GetUserById(), the user ID is a URL-encoded query parameter, and users can only
+// see their own usage.
+func GetUserUsage(c *gin.Context) {
+	// Query().Get() is nice enough to URL-decode the encoded things for us.
+	userID, ok := ourutils.ValidateStringNotempty(c.Request.URL.Query().Get(UserIDQueryParamKey))
+	if !ok {
+		message := "Bad Request. User ID value in the query params was missing or empty"
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, "GET USAGE", message)
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	usage, err := db.GetUsageForUser(userID)
+	if err != nil {
+		// A nonexistent user will get a 404.
+		RespondErrorProblem(c, "GET USAGE", err.Error(), err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": model.ResponseUsage{Usage: usage, Quota: db.Quota()}})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"notably/internal/platform/collab"
+)
+
+const (
+	// The name of the router context variable holding the *collab.Hub.
+	CollabHubKey = "CollabHub"
+
+	// The biggest message a collab client can send, e.g. an edit pasting in a lot of text.
+	collabMaxMessageBytes = 1 << 20 // 1 MB
+	// How long a message to a collab client can take to send.
+	collabWriteWait = 10 * time.Second
+	// How long a collab client can go without a pong, before it's taken for gone.
+	collabPongWait = time.Minute
+	// How often collab clients are pinged. It has to be less than collabPongWait.
+	collabPingPeriod = collabPongWait * 9 / 10
+)
+
+// CollabNoteV2 edits a note together with whoever else is editing it, over a WebSocket.
+// The messages are JSON collab.Messages. The WebSocket has to be opened from a page on
+// the same origin as the API, so that other sites can't open one with our login cookie.
+func CollabNoteV2(c *gin.Context) {
+	logPrefix := "V2 COLLAB NOTE"
+	aNote := v2NoteForSessionUser(c, logPrefix)
+	if aNote == nil {
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			code := ProblemCodeBadRequest
+			if status == http.StatusForbidden {
+				// The origin isn't ours.
+				code = ProblemCodeForbidden
+			}
+			RespondProblem(c, status, code, logPrefix, fmt.Sprintf("Can't open the WebSocket: %s", reason.Error()))
+		},
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already responded.
+		return
+	}
+	defer conn.Close()
+
+	hub := c.MustGet(CollabHubKey).(*collab.Hub)
+	client, err := hub.Join(aNote, sessionUserID(c))
+	if err != nil {
+		Logger(c).Error(logPrefix, "detail", "Can't join the room", "note_id", aNote.NoteID, "error", err.Error())
+		closing := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Can't join the room")
+		_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(collabWriteWait))
+		return
+	}
+	Logger(c).Debug(logPrefix, "detail", "Joined", "note_id", aNote.NoteID, "client_id", client.ID)
+
+	// Only this goroutine writes to the WebSocket, which can only have one writer.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		ping := time.NewTicker(collabPingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case msg, ok := <-client.Messages():
+				_ = conn.SetWriteDeadline(time.Now().Add(collabWriteWait))
+				if !ok {
+					// Out of the room, one way or another.
+					closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					_ = conn.WriteMessage(websocket.CloseMessage, closing)
+					conn.Close() // Which ends the reading.
+					return
+				}
+				if err := conn.WriteJSON(msg); err != nil {
+					conn.Close()
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(collabWriteWait)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-c.Request.Context().Done():
+				// We're shutting down.
+				closing := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Shutting down")
+				_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(collabWriteWait))
+				conn.Close()
+				return
+			}
+		}
+	}()
+	// Deferred, so that even if handling a message panics, the room isn't left open,
+	// being saved every so often, forever.
+	defer func() {
+		client.Leave()
+		<-written
+		Logger(c).Debug(logPrefix, "detail", "Left", "note_id", aNote.NoteID, "client_id", client.ID)
+	}()
+
+	conn.SetReadLimit(collabMaxMessageBytes)
+	_ = conn.SetReadDeadline(time.Now().Add(collabPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(collabPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var msg collab.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			client.Reject(fmt.Sprintf("Not a message: %s", err.Error()))
+			continue
+		}
+		client.Receive(msg)
+	}
+}
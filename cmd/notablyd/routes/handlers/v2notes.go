@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+// API v2 note handlers. Notes are a proper REST resource: the collection lives at
+// /notes and each note at /notes/{id}. The user is whoever is logged in, so there
+// is no user ID in the query string or the body, and the note ID is only in the path.
+
+// v2NoteForSessionUser gets the note in the request path, making sure that it belongs
+// to the logged-in user. A note which does not exist gets a 404, and a note belonging
+// to somebody else gets a 403.
+// On failure, it has already sent the error response, and returns nil.
+func v2NoteForSessionUser(c *gin.Context, logPrefix string) *model.Note {
+	userID := sessionUserID(c)
+	noteID, ok := ourutils.ValidateStringNotempty(c.Param("id"))
+	if !ok {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, "Note ID in the request path is empty or blank")
+		return nil
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aNote, err := db.GetNoteByID(noteID)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return nil
+	}
+
+	if aNote.NoteUserID != userID {
+		RespondProblem(c, http.StatusForbidden, ProblemCodeForbidden, logPrefix,
+			fmt.Sprintf("Note '%s' does not belong to user '%s'", noteID, userID))
+		return nil
+	}
+
+	return aNote
+}
+
+// bindRequestNoteV2 binds the note request body. When requireNote is set, the 'note'
+// field must be present and non-empty; otherwise it may be missing, but not empty.
+// On failure, it has already sent the error response, and returns nil.
+func bindRequestNoteV2(c *gin.Context, logPrefix string, requireNote bool) *model.RequestNoteV2 {
+	var reqNote model.RequestNoteV2
+	if err := c.ShouldBindJSON(&reqNote); err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, logPrefix,
+			fmt.Sprintf("Request body must be a JSON object with a 'note' field: %s", err.Error()))
+		return nil
+	}
+
+	if reqNote.Note == nil && requireNote {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, "Request 'note' field is missing")
+		return nil
+	}
+	// We don't space-trim notes; we want them as the user entered them.
+	if reqNote.Note != nil && *reqNote.Note == "" {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, "Request 'note' field is empty")
+		return nil
+	}
+
+	return &reqNote
+}
+
+// Lists the logged-in user's notes, a page at a time. This is a GET handler for the
+// notes collection. It takes the same query params as the v1 list (see
+// noteListOptionsFromQuery()), and returns the paging info in the response "meta".
+func ListNotesV2(c *gin.Context) {
+	logPrefix := "V2 LIST NOTES"
+	userID := sessionUserID(c)
+
+	listOpts, err := noteListOptionsFromQuery(c)
+	if err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, err.Error())
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	notesPage, err := db.GetNotesPageForUser(userID, listOpts)
+	if err != nil {
+		// A bad page cursor will get a 400.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, notesPage.Notes, gin.H{
+		"next_cursor": notesPage.NextCursor,
+		"total_count": notesPage.TotalCount,
+	})
+}
+
+// Creates a note for the logged-in user. This is a POST handler for the notes
+// collection, with a JSON body having the (non-empty) 'note' field.
+// Responds with 201 and a Location header pointing at the new note.
+func CreateNoteV2(c *gin.Context) {
+	logPrefix := "V2 CREATE NOTE"
+	userID := sessionUserID(c)
+
+	reqNote := bindRequestNoteV2(c, logPrefix, true)
+	if reqNote == nil {
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aNote, err := db.AddNoteForUser(userID, *reqNote.Note)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+	setAuditTarget(c, "", aNote.NoteID)
+
+	c.Header("Location", fmt.Sprintf("%s/notes/%s", APIV2Prefix, aNote.NoteID))
+	RespondV2(c, http.StatusCreated, aNote, nil)
+}
+
+// Gets a note of the logged-in user. This is a GET handler.
+func GetNoteV2(c *gin.Context) {
+	aNote := v2NoteForSessionUser(c, "V2 GET NOTE")
+	if aNote == nil {
+		return
+	}
+
+	RespondV2(c, http.StatusOK, aNote, nil)
+}
+
+// patchNoteV2 applies the JSON Merge Patch or JSON Patch in the request body to a note.
+// The patch is applied (and the result validated) by the persistence layer.
+func patchNoteV2(c *gin.Context, aNote *model.Note, logPrefix string) {
+	patch, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix,
+			fmt.Sprintf("Error reading request body: %s", err.Error()))
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aNote, err = db.PatchNoteForUser(aNote.NoteUserID, aNote.NoteID, c.ContentType(), patch)
+	if err != nil {
+		// A bad patch will get a 400, and one which leaves an invalid note behind a 422.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, aNote, nil)
+}
+
+// Replaces (PUT) or partially updates (PATCH) a note of the logged-in user.
+// PUT requires the whole note representation, i.e. the 'note' field.
+// PATCH takes one of:
+//   - Content-Type: application/json : only the fields present in the body are changed.
+//   - Content-Type: application/merge-patch+json : a JSON Merge Patch (RFC 7396).
+//   - Content-Type: application/json-patch+json : a JSON Patch (RFC 6902).
+func UpdateNoteV2(c *gin.Context) {
+	isPUT := c.Request.Method == http.MethodPut
+	logPrefix := "V2 PATCH NOTE"
+	if isPUT {
+		logPrefix = "V2 PUT NOTE"
+	}
+
+	aNote := v2NoteForSessionUser(c, logPrefix)
+	if aNote == nil {
+		return
+	}
+
+	if !isPUT {
+		switch contentType := c.ContentType(); contentType {
+		case persistence.PatchTypeMerge, persistence.PatchTypeJSON:
+			patchNoteV2(c, aNote, logPrefix)
+			return
+		case "", binding.MIMEJSON:
+			// Handled below, the same as PUT, except that the note is optional.
+		default:
+			RespondProblem(c, http.StatusUnsupportedMediaType, ProblemCodeUnsupportedMediaType, logPrefix,
+				fmt.Sprintf("Unsupported Content-Type '%s' for PATCH, must be one of '%s', '%s' or '%s'",
+					contentType, binding.MIMEJSON, persistence.PatchTypeMerge, persistence.PatchTypeJSON))
+			return
+		}
+	}
+
+	reqNote := bindRequestNoteV2(c, logPrefix, isPUT)
+	if reqNote == nil {
+		return
+	}
+
+	noteText := aNote.Note
+	if reqNote.Note != nil {
+		noteText = *reqNote.Note
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aNote, err := db.UpdateNoteForUser(aNote.NoteUserID, aNote.NoteID, noteText)
+	if err != nil {
+		// The note may have been deleted from under us, which will get a 404.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, aNote, nil)
+}
+
+// Deletes a note of the logged-in user. This is a DELETE handler, responding with 204.
+// Unlike v1, deleting a note which does not exist is a 404.
+func DeleteNoteV2(c *gin.Context) {
+	logPrefix := "V2 DELETE NOTE"
+	aNote := v2NoteForSessionUser(c, logPrefix)
+	if aNote == nil {
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	if _, err := db.DeleteNoteForUser(aNote.NoteUserID, aNote.NoteID); err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Deletes ALL the notes of the logged-in user. This is a DELETE handler for the notes
+// collection. Responds with the number of notes deleted.
+func DeleteAllNotesV2(c *gin.Context) {
+	logPrefix := "V2 DELETE ALL NOTES"
+	userID := sessionUserID(c)
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	numDeleted, err := db.DeleteAllNotesForUser(userID)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, gin.H{"deleted": numDeleted}, nil)
+}
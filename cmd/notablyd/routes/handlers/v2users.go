@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+// API v2 user handlers. These use the v2 response envelope (see xxxxv2infra.go),
+// and take the identity of the logged-in user from the login session rather than
+// from the request.
+
+// validateRequestUserV2 binds and sanity checks the user ID and password in the request body.
+// On failure, it has already sent the error response, and returns ok=false.
+func validateRequestUserV2(c *gin.Context, logPrefix string) (userID, hashedPassword string, ok bool) {
+	var reqUser model.RequestUser
+	if err := c.ShouldBindJSON(&reqUser); err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, logPrefix,
+			fmt.Sprintf("Request body must be a JSON object with 'id' and 'password' fields: %s", err.Error()))
+		return "", "", false
+	}
+
+	setAuditTarget(c, reqUser.ID, "")
+	userID, ok = ourutils.ValidateStringNotempty(reqUser.ID)
+	if !ok {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, "Request 'id' field is empty or blank")
+		return "", "", false
+	}
+	if _, err := mail.ParseAddress(userID); err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix,
+			"Request 'id' field does not appear to be a valid email address")
+		return "", "", false
+	}
+
+	plaintextPassword, ok := ourutils.ValidateStringNotempty(reqUser.Password)
+	if !ok {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix, "Request 'password' field is empty or blank")
+		return "", "", false
+	}
+
+	return userID, ourutils.SHA256Hash(plaintextPassword), true
+}
+
+// Registers a new user. This is a POST handler for the users collection,
+// taking the same JSON body as the v1 registration: 'id' (an email address) and 'password'.
+// Responds with 201 and a Location header pointing at the new user.
+func RegisterUserV2(c *gin.Context) {
+	logPrefix := "V2 REGISTER USER"
+	userID, hashedPassword, ok := validateRequestUserV2(c, logPrefix)
+	if !ok {
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aUser, err := db.AddUser(userID, hashedPassword)
+	if err != nil {
+		// An existing user will get a 409.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	c.Header("Location", APIV2Prefix+"/users/me")
+	RespondV2(c, http.StatusCreated, model.ResponseUserV2{
+		UserID:            aUser.UserID,
+		CreationTimestamp: aUser.CreationTimestamp,
+	}, nil)
+}
+
+// Logs in a user by creating a login session. This is a POST handler for the sessions
+// collection, taking the same JSON body as registration.
+// Unlike v1, an unknown user and a wrong password get the same 401 response,
+// so that the API does not give away which user IDs are registered.
+func LoginUserV2(c *gin.Context) {
+	defer observeLogin(c, "v2")
+	logPrefix := "V2 LOGIN USER"
+	userID, hashedPassword, ok := validateRequestUserV2(c, logPrefix)
+	if !ok {
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aUser, err := db.GetUserByID(userID)
+	if err != nil && !errors.Is(err, persistence.ErrUserNotFound) {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+	if err != nil || aUser.UserID != userID || aUser.PasswordHash != hashedPassword {
+		RespondProblem(c, http.StatusUnauthorized, ProblemCodeInvalidCredentials, logPrefix,
+			fmt.Sprintf("Invalid user ID or password for user '%s'", userID))
+		return
+	}
+
+	loginCookieMaxAgeSecs := c.MustGet(LoginCookieMaxAgeKey).(int)
+	if loginCookieMaxAgeSecs <= 0 {
+		loginCookieMaxAgeSecs = DefaultLoginCookieMaxAgeSecs
+	}
+	setLoginCookie(c, aUser.UserID, loginCookieMaxAgeSecs)
+
+	RespondV2(c, http.StatusOK, model.ResponseUserV2{
+		UserID:            aUser.UserID,
+		CreationTimestamp: aUser.CreationTimestamp,
+	}, gin.H{"session_max_age_secs": loginCookieMaxAgeSecs})
+}
+
+// Logs out the logged-in user by deleting their login session.
+// This is a DELETE handler for the sessions collection, responding with 204.
+func LogoutUserV2(c *gin.Context) {
+	// "Delete" the login cookie by expiring it.
+	setLoginCookie(c, "", -1)
+	c.Status(http.StatusNoContent)
+}
+
+// Shows the logged-in user their own details. This is a GET handler.
+func GetOurselfV2(c *gin.Context) {
+	logPrefix := "V2 GET USER"
+	userID := sessionUserID(c)
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	aUser, err := db.GetUserByID(userID)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, model.ResponseUserV2{
+		UserID:            aUser.UserID,
+		CreationTimestamp: aUser.CreationTimestamp,
+	}, nil)
+}
+
+// GetOurUsageV2 gets how much the logged-in user is storing, and their quota.
+func GetOurUsageV2(c *gin.Context) {
+	logPrefix := "V2 GET USAGE"
+	userID := sessionUserID(c)
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	usage, err := db.GetUsageForUser(userID)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, model.ResponseUsage{Usage: usage, Quota: db.Quota()}, nil)
+}
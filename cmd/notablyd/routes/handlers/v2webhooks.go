@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+)
+
+// API v2 webhook handlers. A logged-in user's webhooks are at /webhooks, and get their
+// own events. The admins' are at /admin/webhooks, behind a bearer token, and get
+// everybody's. The same handlers serve both, as whoever webhookOwner() says.
+
+const (
+	// The name of the router context variable saying that the request is about the
+	// admins' webhooks, rather than the logged-in user's. See WebhooksAsAdmin().
+	webhookAdminKey = "WebhookAdmin"
+
+	// Query param key for filtering a webhook's delivery log by status. Paging uses
+	// LimitQueryParamKey and CursorQueryParamKey.
+	StatusQueryParamKey = "status"
+)
+
+// WebhooksAsAdmin is router middleware which makes the webhook handlers after it
+// manage the admins' webhooks. It goes after the check of the admins' bearer token.
+func WebhooksAsAdmin(c *gin.Context) {
+	c.Set(webhookAdminKey, true)
+	c.Next()
+}
+
+// webhookOwner is whose webhooks the request is about: the logged-in user's, or the
+// admins', which is the empty user ID.
+func webhookOwner(c *gin.Context) string {
+	if c.GetBool(webhookAdminKey) {
+		return ""
+	}
+	return sessionUserID(c)
+}
+
+// Registers a webhook. The JSON body has the 'url' to POST the events to, and the
+// 'events' it wants (empty or missing means all of them). The response has the
+// webhook's secret, which the deliveries are signed with, and which is never given
+// out again. Responds with 201 and a Location header pointing at the new webhook.
+func CreateWebhookV2(c *gin.Context) {
+	logPrefix := "V2 CREATE WEBHOOK"
+
+	var reqWebhook model.RequestWebhook
+	if err := c.ShouldBindJSON(&reqWebhook); err != nil {
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeMalformedBody, logPrefix,
+			fmt.Sprintf("Request body must be a JSON object with a 'url' field: %s", err.Error()))
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	webhook, err := db.AddWebhook(webhookOwner(c), reqWebhook.URL, reqWebhook.Events)
+	if err != nil {
+		// A bad URL or event type will get a 400, and too many webhooks a 507.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	c.Header("Location", c.FullPath()+"/"+webhook.WebhookID)
+	RespondV2(c, http.StatusCreated, webhook, nil)
+}
+
+// Lists the webhooks, oldest first.
+func ListWebhooksV2(c *gin.Context) {
+	logPrefix := "V2 LIST WEBHOOKS"
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	webhooks, err := db.GetWebhooks(webhookOwner(c))
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, webhooks, gin.H{"total_count": len(webhooks)})
+}
+
+// Gets the webhook in the request path.
+func GetWebhookV2(c *gin.Context) {
+	logPrefix := "V2 GET WEBHOOK"
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	webhook, err := db.GetWebhook(webhookOwner(c), c.Param("webhook_id"))
+	if err != nil {
+		// Somebody else's webhook is as good as not there, and gets a 404 too.
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, webhook, nil)
+}
+
+// Deletes the webhook in the request path, and its deliveries, including any which
+// haven't been delivered yet.
+func DeleteWebhookV2(c *gin.Context) {
+	logPrefix := "V2 DELETE WEBHOOK"
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	if err := db.DeleteWebhook(webhookOwner(c), c.Param("webhook_id")); err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Lists the delivery log of the webhook in the request path, newest first, a page at
+// a time, optionally only the deliveries with the given 'status' (pending, delivered
+// or dead). The paging info is in the response "meta".
+func ListWebhookDeliveriesV2(c *gin.Context) {
+	logPrefix := "V2 LIST WEBHOOK DELIVERIES"
+
+	var listOpts model.WebhookDeliveryListOptions
+	query := c.Request.URL.Query()
+	if limit := query.Get(LimitQueryParamKey); limit != "" {
+		var err error
+		listOpts.Limit, err = strconv.Atoi(limit)
+		if err != nil || listOpts.Limit <= 0 {
+			RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix,
+				fmt.Sprintf("'%s' must be a positive integer", LimitQueryParamKey))
+			return
+		}
+	}
+	listOpts.Cursor = query.Get(CursorQueryParamKey)
+	listOpts.Status = query.Get(StatusQueryParamKey)
+	switch listOpts.Status {
+	case "", model.WebhookDeliveryPending, model.WebhookDeliveryDelivered, model.WebhookDeliveryDead:
+	default:
+		RespondProblem(c, http.StatusBadRequest, ProblemCodeBadRequest, logPrefix,
+			fmt.Sprintf("'%s' must be one of '%s', '%s' or '%s'", StatusQueryParamKey,
+				model.WebhookDeliveryPending, model.WebhookDeliveryDelivered, model.WebhookDeliveryDead))
+		return
+	}
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	page, err := db.GetWebhookDeliveriesPage(webhookOwner(c), c.Param("webhook_id"), listOpts)
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusOK, page.Deliveries, gin.H{"next_cursor": page.NextCursor})
+}
+
+// Sends the delivery in the request path again, from its first attempt, e.g. a dead
+// one, once the webhook has been fixed. This is a POST handler with no body.
+func RetryWebhookDeliveryV2(c *gin.Context) {
+	logPrefix := "V2 RETRY WEBHOOK DELIVERY"
+
+	db := c.MustGet("DB").(*persistence.NotablyDB)
+	delivery, err := db.RetryWebhookDelivery(webhookOwner(c), c.Param("webhook_id"), c.Param("delivery_id"))
+	if err != nil {
+		RespondErrorProblem(c, logPrefix, err.Error(), err)
+		return
+	}
+
+	RespondV2(c, http.StatusAccepted, delivery, nil)
+}
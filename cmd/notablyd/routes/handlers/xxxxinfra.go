@@ -3,15 +3,89 @@
 
 package handlers
 
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/platform/metrics"
+)
+
 const (
 	DefaultLoginCookieMaxAgeSecs = 28800 // 28800 seconds = 8 hours
+	DefaultLoginCookieDomain     = "localhost"
 
 	// The name of the login cookie we set on successful user login.
 	LoginCookieName = "lcmas"
 
-	// The name of the router context variable used to get the max age setting.
+	// The names of the router context variables used to get the login cookie settings.
 	LoginCookieMaxAgeKey = "LoginCookieMaxAgeSecs"
+	LoginCookieDomainKey = "LoginCookieDomain"
+	LoginCookieSecureKey = "LoginCookieSecure"
+
+	// The name of the router context variable holding the logger for the request.
+	LoggerKey = "Logger"
 
 	// When a user ID is passed as a (URL-encoded) query param, this is the key it will have.
 	UserIDQueryParamKey = "userid"
+
+	// Query param keys for paging, sorting and filtering the list of notes.
+	LimitQueryParamKey         = "limit"          // Max notes in a page.
+	CursorQueryParamKey        = "cursor"         // Opaque cursor from the "next_cursor" of the previous page.
+	SortQueryParamKey          = "sort"           // "created" (the default) or "updated".
+	OrderQueryParamKey         = "order"          // "asc" (the default) or "desc".
+	SearchQueryParamKey        = "q"              // Case-insensitive text the note must contain.
+	CreatedAfterQueryParamKey  = "created_after"  // Unix timestamp.
+	CreatedBeforeQueryParamKey = "created_before" // Unix timestamp.
 )
+
+// setLoginCookie sets the login cookie, using the cookie settings the router put into
+// the context. A negative maxAgeSecs deletes the cookie.
+// The signature of gin.Context.SetCookie() is:
+//
+//	SetCookie(name, value string, maxAge int, path, domain string, secure, httpOnly bool)
+//
+// where "maxAge" is in seconds (the docs don't mention this, but the source does)
+// Setting and deleting the cookie is what starts and ends a session, as far as the
+// metrics go.
+func setLoginCookie(c *gin.Context, value string, maxAgeSecs int) {
+	if maxAgeSecs > 0 {
+		metrics.SessionStarted(value, maxAgeSecs)
+	} else if userID, err := c.Cookie(LoginCookieName); err == nil {
+		metrics.SessionEnded(userID)
+	}
+
+	domain := c.GetString(LoginCookieDomainKey)
+	if domain == "" {
+		domain = DefaultLoginCookieDomain
+	}
+	c.SetCookie(LoginCookieName, value, maxAgeSecs, "/", domain, c.GetBool(LoginCookieSecureKey), true)
+}
+
+// Logger gets the logger for the request, which tags every log line with the request ID.
+// Never log note text or passwords.
+func Logger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Value(LoggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// observeLogin records whether a login worked, going by the response status.
+// The login handlers defer it, so it runs once the response is written.
+func observeLogin(c *gin.Context, api string) {
+	metrics.ObserveLogin(api, c.Writer.Status() < http.StatusMultipleChoices)
+}
+
+// noWriteDeadline turns off the server's write timeout for the response, for one
+// which takes as long as it takes, e.g. a stream. Not every ResponseWriter can do
+// this (e.g. in tests), which is fine.
+func noWriteDeadline(c *gin.Context, logPrefix string) {
+	err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		Logger(c).Warn(logPrefix, "detail", "Can't turn off the write deadline", "error", err.Error())
+	}
+}
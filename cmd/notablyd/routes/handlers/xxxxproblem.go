@@ -0,0 +1,160 @@
+// THIS IS NOT A ROUTE HANDLER. Hence the xxxx prefix.
+// It is the error model shared by all the route handlers and router middleware.
+
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"notably/internal/platform/archive"
+	"notably/internal/platform/persistence"
+)
+
+// Every error response from the API is an RFC 7807 "problem details" JSON object,
+// sent with the Content-Type ProblemContentType, e.g.:
+//
+//	{
+//	    "type": "urn:notably:problem:note_not_found",
+//	    "title": "Not Found",
+//	    "status": 404,
+//	    "detail": "Note '3KtzZvfoa7gC3OpRpob1FgJNcik' not found",
+//	    "instance": "/api/v2/notes/3KtzZvfoa7gC3OpRpob1FgJNcik",
+//	    "code": "note_not_found",
+//	    "request_id": "3KtzZvfoa7gC3OpRpob1FgJNcik"
+//	}
+//
+// Clients should look at "code" (or "type", which is built from it) to decide what
+// to do. The codes below are stable, whereas "detail" is meant for humans and may change.
+
+const (
+	ProblemContentType = "application/problem+json"
+
+	// The prefix of the problem "type" URI. The problem code is appended to it.
+	ProblemTypePrefix = "urn:notably:problem:"
+
+	// The header carrying the request ID, which is echoed in problem details.
+	RequestIDHeader = "X-Request-ID"
+
+	// The name of the router context variable holding the request ID, if any.
+	RequestIDKey = "RequestID"
+
+	// The name of the router context variable holding the problem code of the error
+	// response, if there was one, for the audit log.
+	problemCodeKey = "ProblemCode"
+)
+
+// The stable, machine-readable problem codes.
+const (
+	ProblemCodeBadRequest           = "bad_request"            // The request is missing something, or has something invalid.
+	ProblemCodeMalformedBody        = "malformed_body"         // The request body is not the JSON it should be.
+	ProblemCodeNotLoggedIn          = "not_logged_in"          // There is no valid login session.
+	ProblemCodeInvalidToken         = "invalid_token"          // The bearer token is missing or wrong.
+	ProblemCodeInvalidCredentials   = "invalid_credentials"    // Wrong user ID or password when logging in.
+	ProblemCodeForbidden            = "forbidden"              // The logged-in user may not do this.
+	ProblemCodeUserNotFound         = "user_not_found"         // persistence.ErrUserNotFound
+	ProblemCodeNoteNotFound         = "note_not_found"         // persistence.ErrNoteNotFound
+	ProblemCodeUserExists           = "user_exists"            // persistence.ErrUserExists
+	ProblemCodeInvalidPatch         = "invalid_patch"          // persistence.ErrInvalidPatch
+	ProblemCodeInvalidNote          = "invalid_note"           // persistence.ErrInvalidNote
+	ProblemCodeNoteTooLarge         = "note_too_large"         // persistence.ErrNoteTooLarge
+	ProblemCodeQuotaExceeded        = "quota_exceeded"         // persistence.ErrQuotaExceeded
+	ProblemCodeWebhookNotFound      = "webhook_not_found"      // persistence.ErrWebhookNotFound
+	ProblemCodeDeliveryNotFound     = "delivery_not_found"     // persistence.ErrDeliveryNotFound
+	ProblemCodeImportNotFound       = "import_not_found"       // persistence.ErrImportNotFound
+	ProblemCodeUploadTooLarge       = "upload_too_large"       // The upload is bigger than allowed.
+	ProblemCodeUnsupportedMediaType = "unsupported_media_type" // The request Content-Type is not supported here.
+	ProblemCodeRateLimited          = "rate_limited"           // Too many requests, try again after the Retry-After header's seconds.
+	ProblemCodeInternal             = "internal_error"         // Something went wrong on our side.
+)
+
+// Problem is an RFC 7807 problem details object, with our own "code" and "request_id"
+// extension members.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewProblem builds the problem details for the current request.
+func NewProblem(c *gin.Context, status int, code, detail string) *Problem {
+	requestID := c.GetString(RequestIDKey)
+	if requestID == "" {
+		requestID = c.GetHeader(RequestIDHeader)
+	}
+
+	return &Problem{
+		Type:      ProblemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: requestID,
+	}
+}
+
+// RespondProblem logs and sends a problem details error response, and aborts the
+// handler chain. logPrefix is the log message, e.g. "GET USER".
+// Server errors are logged as errors, and client errors as warnings.
+func RespondProblem(c *gin.Context, status int, code, logPrefix, detail string) {
+	level := slog.LevelWarn
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	Logger(c).Log(c, level, logPrefix, "status", status, "code", code, "detail", detail)
+	c.Set(problemCodeKey, code)
+	// gin only sets the Content-Type when rendering if it hasn't already been set.
+	c.Header("Content-Type", ProblemContentType)
+	c.IndentedJSON(status, NewProblem(c, status, code, detail))
+	c.Abort()
+}
+
+// RespondErrorProblem is RespondProblem for an error returned by the persistence layer.
+// The HTTP status and problem code are worked out from the sentinel error it wraps.
+func RespondErrorProblem(c *gin.Context, logPrefix, detail string, err error) {
+	status, code := ProblemForError(err)
+	RespondProblem(c, status, code, logPrefix, detail)
+}
+
+// ProblemForError maps the persistence layer's sentinel errors to an HTTP status
+// and a problem code. Anything else is an internal error.
+func ProblemForError(err error) (status int, code string) {
+	switch {
+	case errors.Is(err, persistence.ErrUserNotFound):
+		return http.StatusNotFound, ProblemCodeUserNotFound
+	case errors.Is(err, persistence.ErrNoteNotFound):
+		return http.StatusNotFound, ProblemCodeNoteNotFound
+	case errors.Is(err, persistence.ErrUserExists):
+		return http.StatusConflict, ProblemCodeUserExists
+	case errors.Is(err, persistence.ErrInvalidInput):
+		return http.StatusBadRequest, ProblemCodeBadRequest
+	case errors.Is(err, persistence.ErrInvalidPatch):
+		return http.StatusBadRequest, ProblemCodeInvalidPatch
+	case errors.Is(err, persistence.ErrInvalidNote):
+		return http.StatusUnprocessableEntity, ProblemCodeInvalidNote
+	case errors.Is(err, persistence.ErrNoteTooLarge):
+		return http.StatusRequestEntityTooLarge, ProblemCodeNoteTooLarge
+	case errors.Is(err, persistence.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, ProblemCodeQuotaExceeded
+	case errors.Is(err, persistence.ErrWebhookNotFound):
+		return http.StatusNotFound, ProblemCodeWebhookNotFound
+	case errors.Is(err, persistence.ErrDeliveryNotFound):
+		return http.StatusNotFound, ProblemCodeDeliveryNotFound
+	case errors.Is(err, persistence.ErrImportNotFound):
+		return http.StatusNotFound, ProblemCodeImportNotFound
+	case errors.Is(err, archive.ErrUnknownFormat):
+		return http.StatusUnsupportedMediaType, ProblemCodeUnsupportedMediaType
+	case errors.Is(err, archive.ErrBadArchive):
+		return http.StatusBadRequest, ProblemCodeBadRequest
+	default:
+		return http.StatusInternalServerError, ProblemCodeInternal
+	}
+}
@@ -0,0 +1,38 @@
+// THIS IS NOT A ROUTE HANDLER. Hence the xxxx prefix.
+// It is local infrastructure for the API v2 route handlers.
+
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// The name of the router context variable holding the user ID of the logged-in user.
+	// Set by the session middleware for API v2 routes, which don't take the user ID from
+	// the request at all.
+	SessionUserIDKey = "SessionUserID"
+
+	// The prefix of the API v2 routes, used to build Location headers.
+	APIV2Prefix = "/api/v2"
+)
+
+// Every successful API v2 response with a body has a JSON object body of the form
+//
+//	{"data": <the resource(s)>, "meta": {<optional extra info, e.g. paging>}}
+//
+// Errors are problem details, just like everywhere else (see xxxxproblem.go).
+
+// RespondV2 sends a successful API v2 response. meta may be nil.
+func RespondV2(c *gin.Context, status int, data interface{}, meta gin.H) {
+	body := gin.H{"data": data}
+	if meta != nil {
+		body["meta"] = meta
+	}
+	c.IndentedJSON(status, body)
+}
+
+// sessionUserID gets the user ID of the logged-in user, as set by the session middleware.
+func sessionUserID(c *gin.Context) string {
+	return c.MustGet(SessionUserIDKey).(string)
+}
@@ -0,0 +1,57 @@
+// Package openapi holds the OpenAPI 3 document for API v1 (openapi.json, which is
+// embedded into the binary), along with what the router needs to validate requests
+// against it.
+//
+// The document is the API contract. When changing a v1 route or DTO, change
+// openapi.json to match, or the request validation will reject perfectly good requests.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the raw OpenAPI document, as served by the API.
+func Spec() []byte {
+	return spec
+}
+
+// Load parses the OpenAPI document and checks that it is itself valid.
+func Load() (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OpenAPI document: %s", err.Error())
+	}
+
+	err = doc.Validate(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %s", err.Error())
+	}
+
+	return doc, nil
+}
+
+// NewRouter loads the OpenAPI document, and returns a router which finds the
+// operation in the document for an HTTP request.
+func NewRouter() (routers.Router, error) {
+	doc, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OpenAPI router: %s", err.Error())
+	}
+
+	return router, nil
+}
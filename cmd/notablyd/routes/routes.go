@@ -2,24 +2,358 @@ package routes
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/mail"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"notably/cmd/notablyd/routes/handlers"
+	"notably/cmd/notablyd/routes/openapi"
+	"notably/internal/model"
+	"notably/internal/platform/collab"
+	"notably/internal/platform/metrics"
 	"notably/internal/platform/persistence"
+	"notably/internal/platform/ratelimit"
+	"notably/internal/platform/tracing"
+	"notably/internal/platform/webhooks"
 	ourutils "notably/internal/utils"
 )
 
+// The most we take of a request ID from the client, and what it can have in it, so
+// that it can't mess up the logs.
+const maxRequestIDLength = 128
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]+$`)
+
+// middlewareRequestID is router middleware which gives each request an ID, and a
+// logger which tags every log line with it. The ID comes from the X-Request-ID
+// request header if the client (or a proxy in front of us) sent a sensible one, and
+// is generated otherwise. Either way, it goes back in the X-Request-ID response header.
+func middlewareRequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(handlers.RequestIDHeader)
+		if len(requestID) > maxRequestIDLength || !requestIDPattern.MatchString(requestID) {
+			var err error
+			requestID, err = ourutils.GenerateKsuidAsString()
+			if err != nil {
+				// Not worth failing the request for.
+				slog.Error("REQUEST ID ROUTER MIDDLEWARE", "error", err.Error())
+			}
+		}
+
+		c.Set(handlers.RequestIDKey, requestID)
+		c.Set(handlers.LoggerKey, slog.Default().With("request_id", requestID))
+		c.Header(handlers.RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// middlewareTracing is router middleware which makes a span of every request, as
+// part of the caller's trace if the request has a W3C traceparent header. The span
+// goes into the request's context, so that the persistence spans are its children,
+// and the trace ID goes into the request's logger.
+func middlewareTracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracing.Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				attribute.String("notably.request_id", c.GetString(handlers.RequestIDKey)),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		if span.SpanContext().IsValid() {
+			c.Set(handlers.LoggerKey, handlers.Logger(c).With("trace_id", span.SpanContext().TraceID().String()))
+		}
+
+		c.Next()
+
+		// The user is whoever the login cookie says, which is who the request was for if it got that far.
+		userID := c.GetString(handlers.SessionUserIDKey)
+		if userID == "" {
+			userID, _ = c.Cookie(handlers.LoginCookieName)
+		}
+		if userID != "" {
+			span.SetAttributes(tracing.User(userID))
+		}
+		if noteID := c.Param("id"); noteID != "" {
+			span.SetAttributes(tracing.NoteID(noteID))
+		}
+
+		status := c.Writer.Status()
+		result := tracing.ResultOK
+		switch {
+		case status >= http.StatusInternalServerError:
+			result = tracing.ResultError
+			span.SetStatus(codes.Error, http.StatusText(status))
+		case status == http.StatusNotFound:
+			result = tracing.ResultNotFound
+		case status >= http.StatusBadRequest:
+			result = tracing.ResultClientError
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status), tracing.Result(result))
+	}
+}
+
+// middlewareRequestLog is router middleware which logs every request once it's done,
+// replacing gin's own request log. It deliberately leaves out the query string, which
+// can have search text in it, and of course the body.
+func middlewareRequestLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		handlers.Logger(c).Log(c, level, "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"bytes", c.Writer.Size(),
+			"duration", time.Since(start),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// middlewareMetrics is router middleware which counts and times every request, for
+// the Prometheus metrics.
+func middlewareMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			// Don't let clients make up new routes, and with them new time series.
+			route = "unmatched"
+		}
+		metrics.ObserveHTTPRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// The audited routes, by method and route, and the actions they're audited as.
+var auditedRoutes = map[string]string{
+	"POST /api/v1/register":   model.AuditActionRegister,
+	"POST /api/v1/login":      model.AuditActionLogin,
+	"PUT /api/v1/logout":      model.AuditActionLogout,
+	"POST /api/v1/note":       model.AuditActionNoteCreate,
+	"POST /api/v1/note/:id":   model.AuditActionNoteUpdate,
+	"DELETE /api/v1/note/:id": model.AuditActionNoteDelete,
+	"DELETE /api/v1/note":     model.AuditActionNoteDeleteAll,
+	"POST /api/v1/sync":       model.AuditActionNoteSync,
+	"GET /api/v1/export":      model.AuditActionNoteExport,
+	"POST /api/v1/import":     model.AuditActionNoteImport,
+
+	"POST " + handlers.APIV2Prefix + "/users":       model.AuditActionRegister,
+	"POST " + handlers.APIV2Prefix + "/sessions":    model.AuditActionLogin,
+	"DELETE " + handlers.APIV2Prefix + "/sessions":  model.AuditActionLogout,
+	"POST " + handlers.APIV2Prefix + "/notes":       model.AuditActionNoteCreate,
+	"PUT " + handlers.APIV2Prefix + "/notes/:id":    model.AuditActionNoteUpdate,
+	"PATCH " + handlers.APIV2Prefix + "/notes/:id":  model.AuditActionNoteUpdate,
+	"DELETE " + handlers.APIV2Prefix + "/notes/:id": model.AuditActionNoteDelete,
+	"DELETE " + handlers.APIV2Prefix + "/notes":     model.AuditActionNoteDeleteAll,
+	"POST " + handlers.APIV2Prefix + "/sync":        model.AuditActionNoteSync,
+	"GET " + handlers.APIV2Prefix + "/export":       model.AuditActionNoteExport,
+	"POST " + handlers.APIV2Prefix + "/import":      model.AuditActionNoteImport,
+
+	"POST " + handlers.APIV2Prefix + "/webhooks":                     model.AuditActionWebhookCreate,
+	"DELETE " + handlers.APIV2Prefix + "/webhooks/:webhook_id":       model.AuditActionWebhookDelete,
+	"POST " + handlers.APIV2Prefix + "/admin/webhooks":               model.AuditActionWebhookCreate,
+	"DELETE " + handlers.APIV2Prefix + "/admin/webhooks/:webhook_id": model.AuditActionWebhookDelete,
+}
+
+// middlewareAudit is router middleware which adds every request to an audited route
+// to the audit log, once it's done, whether it succeeded or not. It goes before the
+// routes' own middleware, so that e.g. a request with no login is audited too.
+func middlewareAudit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		action, ok := auditedRoutes[c.Request.Method+" "+c.FullPath()]
+		c.Next()
+		if ok {
+			handlers.RecordAuditEvent(c, action)
+		}
+	}
+}
+
+// The rate limit headers, from the IETF draft "RateLimit header fields for HTTP".
+const (
+	rateLimitLimitHeader     = "RateLimit-Limit"     // The burst size.
+	rateLimitRemainingHeader = "RateLimit-Remaining" // The requests the client has left, right now.
+	rateLimitResetHeader     = "RateLimit-Reset"     // The seconds until it has them all again.
+)
+
+// middlewareRateLimit is router middleware which rate limits a group of routes, with a
+// token bucket per client IP, and if byUser, another per logged-in user as well, so that
+// a user can't get round the limit by spreading their requests over addresses. It goes
+// before the middleware which checks the login, so that nobody gets to make us do that
+// work for free, which means the user ID is only what the login cookie claims; that's
+// why the IP bucket always counts too. Every response says how the client is doing, in
+// the RateLimit-* headers, from whichever bucket has the fewest requests left, and once
+// it's out of requests, it's a 429 with a Retry-After header. The limit comes from the
+// live config, so it can change while we're running.
+func middlewareRateLimit(rc RouterConfig, group string, byUser bool) gin.HandlerFunc {
+	if rc.RateLimitStore == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		limit := rc.Live.RateLimit(group)
+		if limit.Unlimited() {
+			c.Next()
+			return
+		}
+
+		keys := []string{group + ":ip:" + c.ClientIP()}
+		if byUser {
+			if userID, _ := c.Cookie(handlers.LoginCookieName); userID != "" {
+				keys = append(keys, group+":user:"+userID)
+			}
+		}
+
+		var result ratelimit.Result
+		for i, key := range keys {
+			taken, err := rc.RateLimitStore.Take(c.Request.Context(), key, limit, time.Now())
+			if err != nil {
+				// Better to let requests through than to be down whenever the store is.
+				handlers.Logger(c).Error("RATE LIMIT ROUTER MIDDLEWARE", "group", group, "error", err.Error())
+				c.Next()
+				return
+			}
+			if i == 0 || !taken.Allowed || taken.Remaining < result.Remaining {
+				result = taken
+			}
+			if !taken.Allowed {
+				// No point using up the other buckets on a request we're turning away.
+				break
+			}
+		}
+
+		c.Header(rateLimitLimitHeader, strconv.Itoa(result.Limit))
+		c.Header(rateLimitRemainingHeader, strconv.Itoa(result.Remaining))
+		c.Header(rateLimitResetHeader, strconv.Itoa(wholeSeconds(result.ResetAfter)))
+		if !result.Allowed {
+			retryAfter := wholeSeconds(result.RetryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			handlers.RespondProblem(c, http.StatusTooManyRequests, handlers.ProblemCodeRateLimited,
+				"RATE LIMIT ROUTER MIDDLEWARE", fmt.Sprintf("Too many requests, try again in %d seconds", retryAfter))
+			return
+		}
+		c.Next()
+	}
+}
+
+// wholeSeconds rounds a duration up to whole seconds, for headers which only have those.
+func wholeSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// middlewareRecovery is router middleware which turns a panic into a 500, like gin's
+// own, but logs it with the request ID.
+func middlewareRecovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		handlers.Logger(c).Error("PANIC", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
+
+// What browsers are told about the cross-origin requests they can make: the methods and
+// request headers, beyond the ones they can always use, and the response headers which
+// scripts can read.
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowHeaders  = "Authorization, Content-Type, " + handlers.LastEventIDHeader + ", " + handlers.RequestIDHeader
+	corsExposeHeaders = "Content-Disposition, Location, Retry-After, " + handlers.RequestIDHeader + ", " +
+		rateLimitLimitHeader + ", " + rateLimitRemainingHeader + ", " + rateLimitResetHeader
+	corsMaxAgeSecs = 600 // How long a browser can remember a preflight's answer.
+)
+
+// middlewareCORS is router middleware which lets web apps on the allowed origins call the
+// APIs, by answering the browser's preflight requests and adding the CORS headers to the
+// responses. Origins which are allowed by name get to send the login cookie; "*" lets any
+// origin call the APIs, but without it. Requests from any other origin get no CORS
+// headers, so the browser won't let the app see the response. The origins come from the
+// live config, so they can change while we're running.
+func middlewareCORS(rc RouterConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		allowed, credentials := rc.Live.CORSAllowedOrigin(origin)
+		c.Writer.Header().Add("Vary", "Origin")
+		if !allowed {
+			c.Next()
+			return
+		}
+
+		if credentials {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		} else {
+			c.Header("Access-Control-Allow-Origin", "*")
+		}
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", strconv.Itoa(corsMaxAgeSecs))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+		c.Next()
+	}
+}
+
+// The API v1 POST routes whose body is an upload, rather than JSON, so which have the
+// user ID in the query params, as for a GET.
+var uploadRoutes = map[string]bool{
+	"/api/v1/import": true,
+}
+
+// IsImport tells whether the request is an import of notes, in either API. Its body
+// is an upload, which can be a lot bigger than any other request's.
+func IsImport(r *http.Request) bool {
+	return r.Method == http.MethodPost &&
+		(r.URL.Path == "/api/v1/import" || r.URL.Path == handlers.APIV2Prefix+"/import")
+}
+
 // middlewareCookieMonster is router middleware which handles checking whether the
 // request user has a valid login/session cookie.
 func middlewareCookieMonster() gin.HandlerFunc {
-	log.Println("Setting up the middleware cookie monster (om nom nom nom)...")
+	slog.Debug("Setting up the middleware cookie monster (om nom nom nom)...")
 	return func(c *gin.Context) {
 		// Get the login cookie
 		message := ""
@@ -31,7 +365,7 @@ func middlewareCookieMonster() gin.HandlerFunc {
 				bodyMap := make(map[string]interface{})
 				userID := ""
 
-				if c.Request.Method == http.MethodPost {
+				if c.Request.Method == http.MethodPost && !uploadRoutes[c.FullPath()] {
 					// POST methods have the user ID in the body.
 					// If we access the body in the middleware, we will consume it.
 					// So let's make a copy of it first, and then work with the copy.
@@ -45,11 +379,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					if err != nil {
 						message = fmt.Sprintf("Login Verification Error (POST request): Error copying request body: %s",
 							err.Error())
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusInternalServerError, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusInternalServerError, handlers.ProblemCodeInternal,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 					bodyData := bodyCopy.Bytes()
@@ -58,11 +389,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					if err != nil {
 						message = fmt.Sprintf("Login Verification Error (POST request): Error parsing copied request body: %s",
 							err.Error())
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusInternalServerError, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusBadRequest, handlers.ProblemCodeMalformedBody,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 
@@ -80,11 +408,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					userID, ok := ourutils.ValidateStringNotempty(userID)
 					if !ok {
 						message = "Login Verification Error (POST request): User ID is missing or empty"
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusBadRequest, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 					// Now check if it is an email ID
@@ -92,11 +417,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					if err != nil {
 						message = fmt.Sprintf("Login Verification Error (POST request): Error parsing user ID: %s",
 							err.Error())
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusBadRequest, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 
@@ -104,27 +426,21 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					if userID != cookieValue {
 						message = fmt.Sprintf("Login Verification Error (POST request): User '%s' is not logged in",
 							userID)
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusForbidden, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusForbidden, handlers.ProblemCodeForbidden,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 
 					// Replace the body - without this, the request EOFs when parsing the body.
 					c.Request.Body = io.NopCloser(bytes.NewReader(bodyData))
 				} else {
-					// Not POST, userID will be a URL-encoded query parameter having key handlers.UserIDQueryParamKey
+					// Not POST (or an upload), userID will be a URL-encoded query parameter having key handlers.UserIDQueryParamKey
 					if !c.Request.URL.Query().Has(handlers.UserIDQueryParamKey) {
 						// Any route where this is set as middleware MUST have the key.
 						message = fmt.Sprintf("Login Verification Error: Request URL Query Params do not contain User ID field: %s",
 							handlers.UserIDQueryParamKey)
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusBadRequest, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 
@@ -133,11 +449,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					userID, ok := ourutils.ValidateStringNotempty(userID)
 					if !ok {
 						message = "Login Verification Error: User ID is missing or empty"
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusBadRequest, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 
@@ -145,11 +458,8 @@ func middlewareCookieMonster() gin.HandlerFunc {
 					if userID != cookieValue {
 						message = fmt.Sprintf("Login Verification Error: User '%s' is not logged in",
 							userID)
-						log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-						c.IndentedJSON(http.StatusForbidden, gin.H{
-							"error": message,
-						})
-						c.Abort()
+						handlers.RespondProblem(c, http.StatusForbidden, handlers.ProblemCodeForbidden,
+							"LOGIN COOKIE ROUTER MIDDLEWARE", message)
 						return
 					}
 				}
@@ -163,62 +473,263 @@ func middlewareCookieMonster() gin.HandlerFunc {
 		// If we got here, Cookie verification failed, usually because there is no cookie.
 		// TODO When proper login is implemented, send a WWW-Authenticate header in the response.
 		message = "Login Verification Error: No user logged in, or failure verifying valid login session"
-		log.Printf("ERROR: LOGIN COOKIE ROUTER MIDDLEWARE: %s\n", message)
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{
-			"error": message,
+		handlers.RespondProblem(c, http.StatusUnauthorized, handlers.ProblemCodeNotLoggedIn,
+			"LOGIN COOKIE ROUTER MIDDLEWARE", message)
+	}
+}
+
+// middlewareSessionUser is router middleware for API v2 routes which need a logged-in user.
+// Unlike middlewareCookieMonster(), the request does not say who the user is: the user
+// is whoever the login session belongs to, and is put into the context for the handlers.
+func middlewareSessionUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := c.Cookie(handlers.LoginCookieName)
+		if err == nil {
+			userID, ok := ourutils.ValidateStringNotempty(userID)
+			if ok {
+				c.Set(handlers.SessionUserIDKey, userID)
+				c.Next()
+				return
+			}
+		}
+
+		// TODO When proper login is implemented, send a WWW-Authenticate header in the response.
+		handlers.RespondProblem(c, http.StatusUnauthorized, handlers.ProblemCodeNotLoggedIn, "V2 SESSION MIDDLEWARE",
+			"No user logged in, or the login session has expired")
+	}
+}
+
+// middlewareBearerToken is router middleware for routes which are only for
+// operators, who have to send the given token as "Authorization: Bearer <token>".
+func middlewareBearerToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if found && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			c.Next()
+			return
+		}
+
+		c.Header("WWW-Authenticate", `Bearer realm="notablyd"`)
+		handlers.RespondProblem(c, http.StatusUnauthorized, handlers.ProblemCodeInvalidToken, "BEARER TOKEN MIDDLEWARE",
+			"The Authorization header must have the bearer token")
+	}
+}
+
+// middlewareOpenAPIValidator is router middleware for API v1 routes which validates the
+// request (path and query params, and the body) against the OpenAPI document in the
+// openapi package. This way, the documented API contract and what the server actually
+// accepts can't drift apart.
+// For routes which need a logged-in user, it goes after middlewareCookieMonster(),
+// so that a request with no login gets told so, rather than what's wrong with it.
+func middlewareOpenAPIValidator(router routers.Router) gin.HandlerFunc {
+	options := &openapi3filter.Options{
+		// middlewareCookieMonster() takes care of checking the login cookie.
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		// Validate the request, but don't touch it.
+		SkipSettingDefaults: true,
+	}
+	// Uploads are read by their handlers, which know what to make of them.
+	uploadOptions := *options
+	uploadOptions.ExcludeRequestBody = true
+
+	return func(c *gin.Context) {
+		route, pathParams, err := router.FindRoute(c.Request)
+		if err != nil {
+			// Every route which uses this middleware should be in the OpenAPI document.
+			// If it isn't, the document needs fixing, which is hardly the client's fault.
+			message := fmt.Sprintf("No OpenAPI operation found for %s %s: %s",
+				c.Request.Method, c.Request.URL.Path, err.Error())
+			handlers.RespondProblem(c, http.StatusInternalServerError, handlers.ProblemCodeInternal,
+				"OPENAPI VALIDATOR MIDDLEWARE", message)
+			return
+		}
+
+		routeOptions := options
+		if isUpload(route.Operation) {
+			routeOptions = &uploadOptions
+		}
+		err = openapi3filter.ValidateRequest(c.Request.Context(), &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    routeOptions,
 		})
-		c.Abort()
+		if err != nil {
+			status, code, message := problemForValidationError(err)
+			handlers.RespondProblem(c, status, code, "OPENAPI VALIDATOR MIDDLEWARE", message)
+			return
+		}
+
+		// ValidateRequest() puts the body back after reading it, so the handler can still bind it.
+		c.Next()
+	}
+}
+
+// isUpload tells whether the operation's request body is an upload, i.e. binary,
+// whatever its Content-Type. Decoding it to validate it would mean e.g. unzipping all
+// of a zip, in memory, and some of what can be uploaded can't be decoded at all.
+func isUpload(op *openapi3.Operation) bool {
+	if op.RequestBody == nil || op.RequestBody.Value == nil || len(op.RequestBody.Value.Content) == 0 {
+		return false
+	}
+	for _, mediaType := range op.RequestBody.Value.Content {
+		if mediaType.Schema == nil || mediaType.Schema.Value == nil || mediaType.Schema.Value.Format != "binary" {
+			return false
+		}
+	}
+	return true
+}
+
+// problemForValidationError works out the HTTP status, problem code and a readable
+// message for a request which failed OpenAPI validation.
+// The errors from the validator dump the whole schema, which is a bit much for a client.
+func problemForValidationError(err error) (status int, code, message string) {
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return http.StatusBadRequest, handlers.ProblemCodeBadRequest, err.Error()
+	}
+
+	reason := reqErr.Reason
+	var schemaErr *openapi3.SchemaError
+	isSchemaErr := errors.As(reqErr.Err, &schemaErr)
+	if isSchemaErr {
+		reason = schemaErr.Reason
+		if field := strings.Join(schemaErr.JSONPointer(), "/"); field != "" {
+			reason = fmt.Sprintf("'%s': %s", field, reason)
+		}
+	} else if reqErr.Err != nil {
+		reason = reqErr.Err.Error()
+	}
+
+	switch {
+	case reqErr.Parameter != nil:
+		return http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+			fmt.Sprintf("Request %s param '%s' is invalid: %s", reqErr.Parameter.In, reqErr.Parameter.Name, reason)
+	case reqErr.RequestBody != nil && reqErr.Err == nil:
+		// The only body error without an underlying error is the wrong Content-Type.
+		return http.StatusUnsupportedMediaType, handlers.ProblemCodeUnsupportedMediaType,
+			fmt.Sprintf("Request body error: %s", reason)
+	case reqErr.RequestBody != nil && isSchemaErr:
+		return http.StatusBadRequest, handlers.ProblemCodeBadRequest,
+			fmt.Sprintf("Request body does not match the API spec: %s", reason)
+	case reqErr.RequestBody != nil:
+		return http.StatusBadRequest, handlers.ProblemCodeMalformedBody,
+			fmt.Sprintf("Request body is missing or malformed: %s", reason)
+	default:
+		return http.StatusBadRequest, handlers.ProblemCodeBadRequest, reqErr.Error()
 	}
 }
 
 // middlewareSetupRouter is middleware which sets up the DB connection to pass to route handlers.
 // Also passes the max age (in seconds) of the login session cookie which gets
-// set on a successful login.
+// set on a successful login. That comes from the live config, so it can change
+// while we're running.
 func middlewareSetupRouter(rc RouterConfig) gin.HandlerFunc {
-	// Get the max age of the login cookie.
-	loginCookieMaxAgeSecs := rc.LoginCookieMaxAgeSecs
-	if loginCookieMaxAgeSecs <= 0 {
-		// Set it to the default
-		loginCookieMaxAgeSecs = handlers.DefaultLoginCookieMaxAgeSecs
+	live := rc.Live
+	loginCookieDomain := rc.LoginCookieDomain
+	if loginCookieDomain == "" {
+		loginCookieDomain = handlers.DefaultLoginCookieDomain
 	}
-	log.Printf("Router middleware setup: Login cookie max age (seconds): %d\n", loginCookieMaxAgeSecs)
+	slog.Info("Router middleware setup", "login_cookie_max_age_secs", live.LoginCookieMaxAgeSecs(),
+		"login_cookie_domain", loginCookieDomain, "login_cookie_secure", rc.LoginCookieSecure)
 
 	// Calisthenics to pass the DB connection to the route handlers.
 	// Adapted from: https://github.com/gin-gonic/gin/issues/420
 	// We pass the DB connection object to the handlers via the gin context.
-	log.Println("Router middleware setup: Opening DB connection...")
+	slog.Debug("Router middleware setup: Opening DB connection...")
 	db, err := persistence.Open()
 	if err != nil {
 		// No option but to panic and die
 		panic(err)
 	}
 
-	log.Println("Router middleware setup done, returning with context settings for required things.")
+	// The notes being edited together are saved without any one request's logger or trace.
+	collabHub := collab.NewHub(db.WithQuota(rc.Quota), rc.CollabSaveInterval)
+
+	// As are the webhooks, which are delivered from the outbox in the background,
+	// without tracing every look in the outbox.
+	ctx := rc.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go webhooks.NewDispatcher(db.WithoutTracing(), rc.Webhooks).Run(ctx)
+
+	// Big imports go on after their request is done, so without its trace, until the
+	// background work stops.
+	backgroundDB := db.WithoutTracing().WithQuota(rc.Quota)
+
+	slog.Debug("Router middleware setup done, returning with context settings for required things.")
 	// Now we set our router context with the things we want in it.
 	return func(c *gin.Context) {
-		c.Set("DB", db)
-		c.Set(handlers.LoginCookieMaxAgeKey, loginCookieMaxAgeSecs)
+		// The DB logs with the request's logger, so its log lines have the request ID too.
+		// And its operations are traced as part of the request.
+		c.Set("DB", db.WithLogger(handlers.Logger(c)).WithContext(c.Request.Context()).WithQuota(rc.Quota))
+		c.Set(handlers.LoginCookieMaxAgeKey, live.LoginCookieMaxAgeSecs())
+		c.Set(handlers.LoginCookieDomainKey, loginCookieDomain)
+		c.Set(handlers.LoginCookieSecureKey, rc.LoginCookieSecure)
+		c.Set(handlers.HealthChecksKey, rc.HealthChecks)
+		c.Set(handlers.AuditRetentionKey, rc.AuditRetention)
+		c.Set(handlers.CollabHubKey, collabHub)
+		c.Set(handlers.BackgroundDBKey, backgroundDB)
+		c.Set(handlers.BackgroundContextKey, ctx)
+		c.Set(handlers.ImportAsyncItemsKey, rc.ImportAsyncItems)
 		c.Next()
 	}
 }
 
 // NewRouter creates a new Gin router.
 func NewRouter(rc RouterConfig) *gin.Engine {
-	log.Println("Creating router...")
-	r := gin.Default()
+	slog.Debug("Creating router...")
+	if rc.Live == nil {
+		rc.Live = &LiveConfig{}
+	}
+	r := gin.New()
+	if err := r.SetTrustedProxies(rc.TrustedProxies); err != nil {
+		// No option but to panic and die
+		panic(err)
+	}
 
-	log.Println("Setting up router middleware...")
-	r.Use(middlewareSetupRouter(rc))
+	slog.Debug("Setting up router middleware...")
+	r.Use(middlewareRequestID(), middlewareTracing(), middlewareRequestLog(), middlewareMetrics(), middlewareRecovery(),
+		middlewareCORS(rc), middlewareSetupRouter(rc), middlewareAudit())
+
+	// Prometheus metrics, unless they're served somewhere else (or not at all).
+	if !rc.DisableMetricsEndpoint {
+		r.GET(MetricsPath, gin.WrapH(metrics.Handler()))
+	}
+
+	// Probes for the likes of Kubernetes and load balancers, whichever APIs are turned on.
+	// Like the metrics, they aren't rate limited, so that a busy client can't make us look down.
+	r.GET(LivenessPath, handlers.GetLiveness)
+	r.GET(ReadinessPath, handlers.GetReadiness)
+
+	slog.Debug("Setting up routes and their associated handlers...")
+	authLimit := middlewareRateLimit(rc, RateLimitGroupAuth, false)
+	notesLimit := middlewareRateLimit(rc, RateLimitGroupNotes, true)
+	otherLimit := middlewareRateLimit(rc, RateLimitGroupOther, false)
 
-	log.Println("Setting up routes and their associated handlers...")
 	// Specify an API v1 group.
 	// In case we ever make breaking changes in the future, those changes can
 	// go into a v2 API group, and so on.
 	// The handler functions are defined in the "handlers" subdirectory.
-	v1 := r.Group("/api/v1")
-	{
+	if !rc.DisableAPIV1 {
+		v1 := r.Group("/api/v1")
+
+		// All v1 requests are validated against the OpenAPI document, which is served
+		// at /api/v1/openapi.json, unless that has been turned off.
+		validate := func(c *gin.Context) { c.Next() }
+		if !rc.DisableOpenAPIValidation {
+			openAPIRouter, err := openapi.NewRouter()
+			if err != nil {
+				// No option but to panic and die
+				panic(err)
+			}
+			validate = middlewareOpenAPIValidator(openAPIRouter)
+		}
+
 		// Are we alive? How are we doing?
-		v1.GET("/health", handlers.GetHealth)
+		v1.GET("/health", otherLimit, validate, handlers.GetHealth)
+		v1.GET("/openapi.json", otherLimit, validate, handlers.GetOpenAPISpec)
 
 		// NOTE: For anything other than a POST, and which requires the user ID,
 		// the userID will be a query parameter called "userid", with the value URL-encoded.
@@ -228,25 +739,88 @@ func NewRouter(rc RouterConfig) *gin.Engine {
 		//  - Administrative routes for an admin user.
 		//  - Allow users to modify themselves.
 		//  - Allow users to delete themselves (GDPR!)
-		v1.POST("/register", handlers.AddUser)
-		v1.POST("/login", handlers.LoginUser)                            // Will set a cookie with the username.
-		v1.PUT("/logout", handlers.LogoutUser)                           // Deletes an existing login cookie.
-		v1.GET("/user", middlewareCookieMonster(), handlers.GetUserById) // Get our own info. Needs the cookie from login.
+		v1.POST("/register", authLimit, validate, handlers.AddUser)
+		v1.POST("/login", authLimit, validate, handlers.LoginUser)                             // Will set a cookie with the username.
+		v1.PUT("/logout", otherLimit, validate, handlers.LogoutUser)                           // Deletes an existing login cookie.
+		v1.GET("/user", otherLimit, middlewareCookieMonster(), validate, handlers.GetUserById) // Get our own info. Needs the cookie from login.
+		v1.GET("/user/usage", otherLimit, middlewareCookieMonster(), validate, handlers.GetUserUsage)
 
 		// Note APIs.
 		// Life would be MUCH simpler if GET and DELETE requests had been designed with bodies.
 		// These all check/use the cookie created by the user login route.
-		v1.POST("/note", middlewareCookieMonster(), handlers.AddNoteForUser)
+		v1.POST("/note", notesLimit, middlewareCookieMonster(), validate, handlers.AddNoteForUser)
 
 		// Note ID needs to be in path param as well as body
-		v1.POST("/note/:id", middlewareCookieMonster(), handlers.UpdateNoteByNoteIDForUser)
+		v1.POST("/note/:id", notesLimit, middlewareCookieMonster(), validate, handlers.UpdateNoteByNoteIDForUser)
+
+		v1.GET("/note/:id", notesLimit, middlewareCookieMonster(), validate, handlers.GetOrDeleteNoteByNoteIDForUser)
+		v1.GET("/note", notesLimit, middlewareCookieMonster(), validate, handlers.GetOrDeleteAllNotesForUser)
+		v1.DELETE("/note/:id", notesLimit, middlewareCookieMonster(), validate, handlers.GetOrDeleteNoteByNoteIDForUser)
+		v1.DELETE("/note", notesLimit, middlewareCookieMonster(), validate, handlers.GetOrDeleteAllNotesForUser)
+
+		// Server-sent events of the changes to our notes, as they happen.
+		v1.GET("/events", notesLimit, middlewareCookieMonster(), validate, handlers.StreamNoteEvents)
+		// Catching up on the changes to our notes, and sending ours, after being offline.
+		v1.POST("/sync", notesLimit, middlewareCookieMonster(), validate, handlers.SyncNotes)
+		// Downloading all our notes, as Markdown files in a zip or tar.gz.
+		v1.GET("/export", notesLimit, middlewareCookieMonster(), validate, handlers.ExportNotes)
+		// Uploading notes from Markdown files, Evernote or Google Keep, and seeing how that went.
+		// The upload is the body, so the user ID is in the query params.
+		v1.POST("/import", notesLimit, middlewareCookieMonster(), validate, handlers.ImportNotes)
+		v1.GET("/import/:import_id", notesLimit, middlewareCookieMonster(), validate, handlers.GetImport)
+	}
 
-		v1.GET("/note/:id", middlewareCookieMonster(), handlers.GetOrDeleteNoteByNoteIDForUser)
-		v1.GET("/note", middlewareCookieMonster(), handlers.GetOrDeleteAllNotesForUser)
-		v1.DELETE("/note/:id", middlewareCookieMonster(), handlers.GetOrDeleteNoteByNoteIDForUser)
-		v1.DELETE("/note", middlewareCookieMonster(), handlers.GetOrDeleteAllNotesForUser)
+	// API v2 treats users, sessions and notes as proper REST resources.
+	// The logged-in user comes from the login session, never from the request itself.
+	if !rc.DisableAPIV2 {
+		v2 := r.Group(handlers.APIV2Prefix)
+
+		v2.GET("/health", otherLimit, handlers.GetHealth)
+		if rc.HealthDetailsToken != "" {
+			v2.GET("/health/details", middlewareBearerToken(rc.HealthDetailsToken), handlers.GetHealthDetailsV2)
+		}
+		if rc.AuditQueryToken != "" {
+			v2.GET("/audit/events", middlewareBearerToken(rc.AuditQueryToken), handlers.ListAuditEventsV2)
+		}
+
+		v2.POST("/users", authLimit, handlers.RegisterUserV2)
+		v2.GET("/users/me", otherLimit, middlewareSessionUser(), handlers.GetOurselfV2)
+		v2.GET("/users/me/usage", otherLimit, middlewareSessionUser(), handlers.GetOurUsageV2)
+		v2.POST("/sessions", authLimit, handlers.LoginUserV2)                              // Log in.
+		v2.DELETE("/sessions", otherLimit, middlewareSessionUser(), handlers.LogoutUserV2) // Log out.
+
+		notes := v2.Group("/notes", notesLimit, middlewareSessionUser())
+		notes.GET("", handlers.ListNotesV2)
+		notes.POST("", handlers.CreateNoteV2)
+		notes.DELETE("", handlers.DeleteAllNotesV2)
+		notes.GET("/:id", handlers.GetNoteV2)
+		notes.PUT("/:id", handlers.UpdateNoteV2)
+		notes.PATCH("/:id", handlers.UpdateNoteV2)
+		notes.DELETE("/:id", handlers.DeleteNoteV2)
+		notes.GET("/:id/collab", handlers.CollabNoteV2) // A WebSocket for editing the note together.
+
+		v2.GET("/events", notesLimit, middlewareSessionUser(), handlers.StreamNoteEventsV2)
+		v2.POST("/sync", notesLimit, middlewareSessionUser(), handlers.SyncNotesV2)
+		v2.GET("/export", notesLimit, middlewareSessionUser(), handlers.ExportNotesV2)
+		v2.POST("/import", notesLimit, middlewareSessionUser(), handlers.ImportNotesV2)
+		v2.GET("/import/:import_id", notesLimit, middlewareSessionUser(), handlers.GetImportV2)
+
+		// Webhooks, which get the events of our notes and account, and their delivery logs.
+		webhookRoutes := func(group *gin.RouterGroup) {
+			group.POST("", handlers.CreateWebhookV2)
+			group.GET("", handlers.ListWebhooksV2)
+			group.GET("/:webhook_id", handlers.GetWebhookV2)
+			group.DELETE("/:webhook_id", handlers.DeleteWebhookV2)
+			group.GET("/:webhook_id/deliveries", handlers.ListWebhookDeliveriesV2)
+			group.POST("/:webhook_id/deliveries/:delivery_id/retry", handlers.RetryWebhookDeliveryV2)
+		}
+		webhookRoutes(v2.Group("/webhooks", otherLimit, middlewareSessionUser()))
+		// The admins' webhooks get everybody's events.
+		if rc.WebhooksAdminToken != "" {
+			webhookRoutes(v2.Group("/admin/webhooks", middlewareBearerToken(rc.WebhooksAdminToken), handlers.WebhooksAsAdmin))
+		}
 	}
 
-	log.Println("Router creation completed successfully")
+	slog.Debug("Router creation completed successfully")
 	return r
 }
@@ -0,0 +1,1464 @@
+package routes
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"notably/cmd/notablyd/routes/handlers"
+	"notably/cmd/notablyd/routes/openapi"
+	"notably/internal/model"
+	"notably/internal/platform/archive"
+	"notably/internal/platform/collab"
+	"notably/internal/platform/ratelimit"
+	"notably/internal/platform/tracing"
+	"notably/internal/platform/webhooks"
+	"notably/pkg/client"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+// testServer is a router, served over HTTP until the test is done, and a client which
+// keeps its login cookie.
+type testServer struct {
+	t      *testing.T
+	URL    string // With "localhost", so that the cookie jar hands the login cookie back.
+	Client *http.Client
+}
+
+// newTestRouter makes a router with the given configuration, whose background work
+// (e.g. delivering webhooks) stops when the test is done, unless it has a context.
+func newTestRouter(t *testing.T, rc RouterConfig) *gin.Engine {
+	if rc.Context == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		rc.Context = ctx
+	}
+	return NewRouter(rc)
+}
+
+// newTestServer serves a router with the given configuration, wrapped in the given
+// handlers, if any, as notablyd wraps it.
+func newTestServer(t *testing.T, rc RouterConfig, wrap ...func(http.Handler) http.Handler) *testServer {
+	var handler http.Handler = newTestRouter(t, rc)
+	for _, w := range wrap {
+		handler = w(handler)
+	}
+	srv := httptest.NewServer(handler)
+	// Not deferred by the tests, so that e.g. their event streams and WebSockets are
+	// closed first, which Close() waits for.
+	t.Cleanup(srv.Close)
+	// The login cookie is for "localhost", so the cookie jar won't hand it back to 127.0.0.1.
+	jar, _ := cookiejar.New(nil)
+	return &testServer{
+		t:      t,
+		URL:    strings.Replace(srv.URL, "127.0.0.1", "localhost", 1),
+		Client: &http.Client{Jar: jar},
+	}
+}
+
+// do sends the request, with a JSON body, if any, and the headers given as name and
+// value pairs, which can replace the Content-Type. The response has to have the given
+// status, and its body is returned.
+func (ts *testServer) do(method, path, body string, wantStatus int, headers ...string) []byte {
+	_, respBody := ts.send(method, path, body, wantStatus, headers...)
+	return respBody
+}
+
+// send is do, which returns the response too, e.g. for its headers. Its body has
+// already been read.
+func (ts *testServer) send(method, path, body string, wantStatus int, headers ...string) (*http.Response, []byte) {
+	t := ts.t
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := ts.Client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		fmt.Printf("TEST ROUTES: %s: %s %s: %d %s\n", t.Name(), method, path, resp.StatusCode, respBody)
+	} else {
+		fmt.Printf("TEST ROUTES: %s: %s %s: %d %s, %d bytes\n", t.Name(), method, path, resp.StatusCode,
+			resp.Header.Get("Content-Type"), len(respBody))
+	}
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("Expected status %d from %s %s, but got %d: %s", wantStatus, method, path, resp.StatusCode, respBody)
+	}
+	return resp, respBody
+}
+
+// Checks that the OpenAPI document and the API v1 routes match, both ways.
+// A v1 route missing from the document would fail every request with a 500, and an
+// operation in the document with no route behind it would be a lie.
+func TestOpenAPISpecMatchesV1Routes(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatalf("Failed loading the OpenAPI document: %v", err)
+	}
+
+	// gin path params look like ":id", OpenAPI ones look like "{id}".
+	ginParam := regexp.MustCompile(`:([^/]+)`)
+
+	routes := make(map[string]bool)
+	for _, route := range newTestRouter(t, RouterConfig{}).Routes() {
+		path, isV1 := strings.CutPrefix(route.Path, "/api/v1")
+		if !isV1 {
+			continue
+		}
+		path = ginParam.ReplaceAllString(path, "{$1}")
+		routes[route.Method+" "+path] = true
+
+		pathItem := doc.Paths.Find(path)
+		if pathItem == nil || pathItem.GetOperation(route.Method) == nil {
+			t.Fatalf("Route %s %s is not in the OpenAPI document", route.Method, route.Path)
+		}
+		fmt.Println("TEST ROUTES: OPENAPI: Found route in OpenAPI document:", route.Method, path)
+	}
+
+	for path, pathItem := range doc.Paths.Map() {
+		for method := range pathItem.Operations() {
+			if !routes[method+" "+path] {
+				t.Fatalf("OpenAPI operation %s %s has no route", method, path)
+			}
+		}
+	}
+}
+
+// Checks that requests get an ID, which tags their log lines (including the
+// persistence layer's), and that passwords and note text stay out of the logs.
+func TestRequestIDAndLogging(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	ts := newTestServer(t, RouterConfig{})
+
+	const password = "sup3rs3cretpassw0rd"
+	const noteText = "The combination to the safe is 12-34-56"
+
+	// post sends a JSON body with the given request ID header, if any, returning the
+	// response's request ID.
+	post := func(path, body, requestID string, wantStatus int) string {
+		var headers []string
+		if requestID != "" {
+			headers = []string{handlers.RequestIDHeader, requestID}
+		}
+		resp, _ := ts.send(http.MethodPost, handlers.APIV2Prefix+path, body, wantStatus, headers...)
+		return resp.Header.Get(handlers.RequestIDHeader)
+	}
+
+	credentials := `{"id": "testuser@testdomain.xyz", "password": "` + password + `"}`
+
+	// No request ID from the client. Should get a generated one.
+	requestID := post("/users", credentials, "", http.StatusCreated)
+	fmt.Println("TEST ROUTES: REQUEST ID: Generated request ID:", requestID)
+	if len(requestID) != 27 {
+		t.Fatalf("Expected a generated KSUID request ID, but got '%s'", requestID)
+	}
+
+	// One which would mess up the logs. Should get a generated one instead.
+	badRequestID := `"}, {"injected": "log line`
+	if requestID := post("/sessions", credentials, badRequestID, http.StatusOK); requestID == badRequestID || requestID == "" {
+		t.Fatalf("Expected a bad request ID to be replaced, but got '%s'", requestID)
+	}
+
+	// A sensible one from the client. Should be kept.
+	if requestID := post("/notes", `{"note": "`+noteText+`"}`, "test-request-1", http.StatusCreated); requestID != "test-request-1" {
+		t.Fatalf("Expected the client's request ID back, but got '%s'", requestID)
+	}
+
+	var sawRequestLog, sawPersistenceLog bool
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line is not JSON: %s", line)
+		}
+		if entry["request_id"] != "test-request-1" {
+			continue
+		}
+		fmt.Println("TEST ROUTES: REQUEST ID: Log line:", line)
+		sawRequestLog = sawRequestLog || (entry["msg"] == "Request" && entry["route"] == "/api/v2/notes")
+		sawPersistenceLog = sawPersistenceLog || entry["msg"] == "Saved note"
+	}
+	if !sawRequestLog || !sawPersistenceLog {
+		t.Fatalf("Expected request and persistence log lines with the request ID, but got:\n%s", logs.String())
+	}
+
+	for _, secret := range []string{password, noteText} {
+		if strings.Contains(logs.String(), secret) {
+			t.Fatalf("Found '%s' in the logs:\n%s", secret, logs.String())
+		}
+	}
+}
+
+// Checks that the Prometheus metrics cover requests, logins, sessions, persistence
+// operations and the Go runtime.
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, RouterConfig{})
+	c, err := client.New(ts.URL)
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+
+	userID := "metricsuser@testdomain.xyz"
+	if _, err := c.Register(ctx, userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed registering user: %v", err)
+	}
+	if _, err := c.Login(ctx, userID, "decafbad"); err == nil {
+		t.Fatalf("Expected logging in with the wrong password to fail")
+	}
+	if _, err := c.Login(ctx, "nobody@testdomain.xyz", "cafed00d"); err == nil {
+		t.Fatalf("Expected logging in as an unknown user to fail")
+	}
+	if _, err := c.Login(ctx, userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed logging in: %v", err)
+	}
+	note, err := c.CreateNote(ctx, "Count me")
+	if err != nil {
+		t.Fatalf("Failed creating note: %v", err)
+	}
+	if _, err := c.GetNote(ctx, note.NoteID); err != nil {
+		t.Fatalf("Failed getting note: %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + MetricsPath)
+	if err != nil {
+		t.Fatalf("Failed getting metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Expected metrics in the Prometheus text format, but got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	// The metrics are global, and other tests make requests too, so we don't check the counts.
+	for _, metric := range []string{
+		`notably_http_requests_total{method="POST",route="/api/v2/notes",status="201"}`,
+		`notably_http_request_duration_seconds_bucket{method="GET",route="/api/v2/notes/:id",status="200",le="0.005"}`,
+		`notably_logins_total{api="v2",result="success"}`,
+		`notably_logins_total{api="v2",result="failure"}`,
+		`notably_active_sessions`,
+		`notably_persistence_operation_duration_seconds_count{method="AddNoteForUser"}`,
+		`notably_persistence_operation_errors_total{method="GetUserByID"}`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), "\n"+metric+" ") {
+			t.Fatalf("Expected metric '%s', but got:\n%s", metric, body)
+		}
+		fmt.Println("TEST ROUTES: METRICS: Found metric:", metric)
+	}
+	if strings.Contains(string(body), note.NoteID) {
+		t.Fatalf("Found a note ID in the metrics, which should be by route, not path")
+	}
+
+	// Turned off, e.g. because they're served on the admin listener.
+	w := httptest.NewRecorder()
+	newTestRouter(t, RouterConfig{DisableMetricsEndpoint: true}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected no metrics endpoint when it's disabled, but got %d", w.Code)
+	}
+}
+
+// Checks that requests are traced, down to the persistence layer, as part of the
+// caller's trace, and that the spans don't give away who the user is.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	ts := newTestServer(t, RouterConfig{})
+
+	const userID = "traceduser@testdomain.xyz"
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+
+	// do sends the request as part of our trace, returning the response body.
+	do := func(method, path, body string, wantStatus int) []byte {
+		return ts.do(method, handlers.APIV2Prefix+path, body, wantStatus, "traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	}
+
+	credentials := `{"id": "` + userID + `", "password": "cafed00d"}`
+	do(http.MethodPost, "/users", credentials, http.StatusCreated)
+	do(http.MethodPost, "/sessions", credentials, http.StatusOK)
+	var created struct {
+		Data struct {
+			NoteID string `json:"note_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/notes", `{"note": "Trace me"}`, http.StatusCreated), &created); err != nil || created.Data.NoteID == "" {
+		t.Fatalf("Failed getting the new note's ID: %v", err)
+	}
+	note := created.Data
+	do(http.MethodGet, "/notes/"+note.NoteID, "", http.StatusOK)
+	do(http.MethodGet, "/notes/nosuchnote", "", http.StatusNotFound)
+
+	spans := recorder.Ended()
+	attributeOf := func(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+		for _, kv := range span.Attributes() {
+			if kv.Key == key {
+				return kv.Value.Emit()
+			}
+		}
+		return ""
+	}
+	// findSpan finds the span with the given name and note ID attribute, if any.
+	findSpan := func(name, noteID string) sdktrace.ReadOnlySpan {
+		for _, span := range spans {
+			if span.Name() == name && attributeOf(span, tracing.NoteIDKey) == noteID {
+				return span
+			}
+		}
+		t.Fatalf("Expected a span '%s' with note ID '%s', but got %d spans", name, noteID, len(spans))
+		return nil
+	}
+
+	for _, span := range spans {
+		fmt.Printf("TEST ROUTES: TRACING: Span '%s', parent %s, attributes %v\n", span.Name(), span.Parent().SpanID(), span.Attributes())
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Fatalf("Expected span '%s' to be part of trace %s, but it's in %s", span.Name(), traceID, span.SpanContext().TraceID())
+		}
+		for _, kv := range span.Attributes() {
+			if strings.Contains(kv.Value.Emit(), userID) {
+				t.Fatalf("Found the user ID in attribute '%s' of span '%s'", kv.Key, span.Name())
+			}
+		}
+	}
+
+	// The request, as a child of the caller's span.
+	create := findSpan("POST /api/v2/notes", "")
+	if create.Parent().SpanID().String() != parentSpanID || create.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("Expected the request span to be a server span with the caller's span as parent, but got parent %s, kind %s",
+			create.Parent().SpanID(), create.SpanKind())
+	}
+	if attributeOf(create, "http.route") != "/api/v2/notes" || attributeOf(create, "http.response.status_code") != "201" ||
+		attributeOf(create, tracing.ResultKey) != tracing.ResultOK || attributeOf(create, tracing.UserKey) != tracing.User(userID).Value.Emit() {
+		t.Fatalf("Request span is missing attributes: %v", create.Attributes())
+	}
+
+	// The persistence operation, as a child of the request, and its transaction, as a child of that.
+	add := findSpan("NotablyDB.AddNoteForUser", "")
+	if add.Parent().SpanID() != create.SpanContext().SpanID() {
+		t.Fatalf("Expected the persistence span to be a child of the request span")
+	}
+	var sawTxn bool
+	for _, span := range spans {
+		if span.Name() == "memdb.Txn" && span.Parent().SpanID() == add.SpanContext().SpanID() {
+			sawTxn = attributeOf(span, "notably.txn.write") == "true" && attributeOf(span, "notably.txn.committed") == "true"
+		}
+	}
+	if !sawTxn {
+		t.Fatalf("Expected a committed write transaction span as a child of the persistence span")
+	}
+
+	// The note ID, and the result.
+	findSpan("GET /api/v2/notes/:id", note.NoteID)
+	findSpan("NotablyDB.GetNoteByID", note.NoteID)
+	if notFound := findSpan("GET /api/v2/notes/:id", "nosuchnote"); attributeOf(notFound, tracing.ResultKey) != tracing.ResultNotFound {
+		t.Fatalf("Expected the result of getting a missing note to be '%s', but got: %v", tracing.ResultNotFound, notFound.Attributes())
+	}
+}
+
+// Checks the liveness and readiness probes, and the detailed health report.
+func TestHealth(t *testing.T) {
+	const token = "0123456789abcdef-health"
+	var failing atomic.Bool
+	router := newTestRouter(t, RouterConfig{
+		HealthChecks: []handlers.HealthCheck{{Name: "flaky", Check: func(context.Context) error {
+			if failing.Load() {
+				return fmt.Errorf("flaked out")
+			}
+			return nil
+		}}},
+		HealthDetailsToken: token,
+	})
+
+	// get gets the path with the given bearer token, if any, returning the decoded body.
+	get := func(path, bearer string, wantStatus int) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		fmt.Printf("TEST ROUTES: HEALTH: GET %s: %d %s\n", path, w.Code, w.Body.String())
+		if w.Code != wantStatus {
+			t.Fatalf("Expected status %d from GET %s, but got %d: %s", wantStatus, path, w.Code, w.Body.String())
+		}
+		body := make(map[string]interface{})
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed decoding the response to GET %s: %v", path, err)
+		}
+		return body
+	}
+
+	if body := get(LivenessPath, "", http.StatusOK); body["status"] != handlers.HealthStatusOK {
+		t.Fatalf("Expected to be alive, but got: %v", body)
+	}
+
+	body := get(ReadinessPath, "", http.StatusOK)
+	checks, _ := body["checks"].(map[string]interface{})
+	store, _ := checks["store"].(map[string]interface{})
+	if body["status"] != handlers.HealthStatusOK || store["status"] != handlers.HealthStatusOK || checks["flaky"] == nil {
+		t.Fatalf("Expected to be ready, with the store and the extra check OK, but got: %v", body)
+	}
+
+	// A failing check. Not ready, but still alive.
+	failing.Store(true)
+	body = get(ReadinessPath, "", http.StatusServiceUnavailable)
+	checks, _ = body["checks"].(map[string]interface{})
+	flaky, _ := checks["flaky"].(map[string]interface{})
+	if body["status"] != handlers.HealthStatusUnavailable || flaky["error"] != "flaked out" {
+		t.Fatalf("Expected to be unavailable because of the failing check, but got: %v", body)
+	}
+	get(LivenessPath, "", http.StatusOK)
+	failing.Store(false)
+
+	// The details need the token.
+	for _, bearer := range []string{"", "wrong-token"} {
+		if body := get(handlers.APIV2Prefix+"/health/details", bearer, http.StatusUnauthorized); body["code"] != handlers.ProblemCodeInvalidToken {
+			t.Fatalf("Expected an invalid token problem, but got: %v", body)
+		}
+	}
+	body = get(handlers.APIV2Prefix+"/health/details", token, http.StatusOK)
+	details, _ := body["data"].(map[string]interface{})
+	for _, field := range []string{"status", "checks", "go_version", "started_at", "uptime_secs", "users", "notes"} {
+		if _, ok := details[field]; !ok {
+			t.Fatalf("Expected '%s' in the health details, but got: %v", field, details)
+		}
+	}
+
+	// No token, no details.
+	w := httptest.NewRecorder()
+	newTestRouter(t, RouterConfig{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, handlers.APIV2Prefix+"/health/details", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected no health details without a token, but got %d", w.Code)
+	}
+}
+
+// Checks that logins, registrations and note changes are audited, whether they
+// succeed or not, and that the audit log can be queried with the token.
+func TestAuditLog(t *testing.T) {
+	const token = "0123456789abcdef-audit"
+	ts := newTestServer(t, RouterConfig{AuditQueryToken: token})
+
+	// do sends the request, with the bearer token if any, returning the response body.
+	do := func(method, path, body, bearer string, wantStatus int) []byte {
+		headers := []string{"User-Agent", "audit-test/1.0"}
+		if bearer != "" {
+			headers = append(headers, "Authorization", "Bearer "+bearer)
+		}
+		return ts.do(method, path, body, wantStatus, headers...)
+	}
+
+	const userID = "audited@testdomain.xyz"
+	do(http.MethodPost, "/api/v2/notes", `{"note": "Not logged in"}`, "", http.StatusUnauthorized)
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+userID+`", "password": "cafed00d"}`, "", http.StatusCreated)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+userID+`", "password": "decafbad"}`, "", http.StatusUnauthorized)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+userID+`", "password": "cafed00d"}`, "", http.StatusOK)
+	var created struct {
+		Data struct {
+			NoteID string `json:"note_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v2/notes", `{"note": "Audit me"}`, "", http.StatusCreated), &created); err != nil {
+		t.Fatalf("Failed getting the new note's ID: %v", err)
+	}
+	do(http.MethodGet, "/api/v2/notes/"+created.Data.NoteID, "", "", http.StatusOK) // Not audited.
+	do(http.MethodDelete, "/api/v2/notes/"+created.Data.NoteID, "", "", http.StatusNoContent)
+	do(http.MethodPut, "/api/v1/logout", "", "", http.StatusOK)
+
+	// query gets the audit events, newest first, and the next page's cursor.
+	query := func(params string) ([]model.AuditEvent, string) {
+		var page struct {
+			Data []model.AuditEvent `json:"data"`
+			Meta struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(do(http.MethodGet, "/api/v2/audit/events?"+params, "", token, http.StatusOK), &page); err != nil {
+			t.Fatalf("Failed decoding the audit events: %v", err)
+		}
+		return page.Data, page.Meta.NextCursor
+	}
+
+	events, _ := query("")
+	var actions []string
+	for _, event := range events {
+		fmt.Printf("TEST ROUTES: AUDIT: Event: %+v\n", event)
+		actions = append(actions, event.Action+":"+event.Outcome)
+		if event.ClientIP == "" || event.UserAgent != "audit-test/1.0" || event.RequestID == "" || event.Timestamp == 0 {
+			t.Fatalf("Expected the event to have where and when it came from, but got %+v", event)
+		}
+	}
+	expected := "[session.logout:success note.delete:success note.create:success session.login:success " +
+		"session.login:failure user.register:success note.create:failure]"
+	if fmt.Sprint(actions) != expected {
+		t.Fatalf("Expected the audit events %s, but got %v", expected, actions)
+	}
+
+	// The details.
+	if failedLogin, _ := query("action=session.login&outcome=failure"); len(failedLogin) != 1 ||
+		failedLogin[0].TargetUserID != userID || failedLogin[0].ActorUserID != "" || failedLogin[0].Reason != handlers.ProblemCodeInvalidCredentials {
+		t.Fatalf("Expected the failed login to be of the user, by nobody, with the reason, but got %+v", failedLogin)
+	}
+	if noteEvents, _ := query("note_id=" + created.Data.NoteID); len(noteEvents) != 2 ||
+		noteEvents[0].ActorUserID != userID || noteEvents[1].TargetUserID != userID {
+		t.Fatalf("Expected the note's creation and deletion, by the user, but got %+v", noteEvents)
+	}
+	if notLoggedIn, _ := query("action=note.create&outcome=failure"); len(notLoggedIn) != 1 || notLoggedIn[0].Reason != handlers.ProblemCodeNotLoggedIn {
+		t.Fatalf("Expected the note creation without a login, but got %+v", notLoggedIn)
+	}
+
+	// A page at a time.
+	firstPage, cursor := query("limit=4")
+	secondPage, lastCursor := query("limit=4&cursor=" + cursor)
+	if len(firstPage) != 4 || len(secondPage) != 3 || lastCursor != "" || secondPage[0].Seq != firstPage[3].Seq-1 {
+		t.Fatalf("Expected pages of 4 and 3 events, but got %d and %d, with cursors '%s' and '%s'",
+			len(firstPage), len(secondPage), cursor, lastCursor)
+	}
+
+	// Not without the token, and not with bad filters.
+	do(http.MethodGet, "/api/v2/audit/events", "", "", http.StatusUnauthorized)
+	do(http.MethodGet, "/api/v2/audit/events?outcome=meh", "", token, http.StatusBadRequest)
+	do(http.MethodGet, "/api/v2/audit/events?cursor=meh", "", token, http.StatusBadRequest)
+}
+
+func TestRateLimit(t *testing.T) {
+	live := &LiveConfig{}
+	live.SetRateLimits(map[string]ratelimit.Limit{
+		RateLimitGroupAuth:  ratelimit.PerMinute(1, 2),
+		RateLimitGroupNotes: ratelimit.PerMinute(1, 1),
+	})
+	router := newTestRouter(t, RouterConfig{
+		RateLimitStore: ratelimit.NewMemoryStore(),
+		TrustedProxies: []string{"10.0.0.1"},
+		Live:           live,
+	})
+
+	// do makes a request from the given address, with the given X-Forwarded-For and
+	// login cookie, if any, checking whether it was rate limited.
+	do := func(method, path, remoteAddr, forwardedFor, userID string, wantLimited bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if userID != "" {
+			req.AddCookie(&http.Cookie{Name: handlers.LoginCookieName, Value: userID})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		fmt.Printf("TEST ROUTES: RATE LIMIT: %s %s from %s (%s): %d, RateLimit-Remaining %s\n",
+			method, path, remoteAddr, forwardedFor, w.Code, w.Header().Get(rateLimitRemainingHeader))
+		if limited := w.Code == http.StatusTooManyRequests; limited != wantLimited {
+			t.Fatalf("Expected rate limited to be %v for %s %s from %s, but got %d: %s",
+				wantLimited, method, path, remoteAddr, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	// The auth routes share a bucket per client IP, of two requests.
+	w := do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "192.0.2.1:1234", "", "", false)
+	if w.Header().Get(rateLimitLimitHeader) != "2" || w.Header().Get(rateLimitRemainingHeader) != "1" {
+		t.Fatalf("Expected RateLimit headers with one request of two left, but got: %v", w.Header())
+	}
+	do(http.MethodPost, "/api/v1/login", "192.0.2.1:1234", "", "", false)
+	w = do(http.MethodPost, handlers.APIV2Prefix+"/users", "192.0.2.1:1234", "", "", true)
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get(rateLimitRemainingHeader) != "0" ||
+		w.Header().Get(rateLimitResetHeader) != "120" {
+		t.Fatalf("Expected to be told to retry in a minute, but got: %v", w.Header())
+	}
+	var problem handlers.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || problem.Code != handlers.ProblemCodeRateLimited {
+		t.Fatalf("Expected a rate limited problem, but got: %s", w.Body.String())
+	}
+
+	// An X-Forwarded-For is only believed from a trusted proxy.
+	do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "192.0.2.1:1234", "198.51.100.7", "", true)
+	do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "192.0.2.2:1234", "", "", false)
+	do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "10.0.0.1:1234", "192.0.2.1", "", true)
+	do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "10.0.0.1:1234", "198.51.100.7", "", false)
+
+	// The note routes are per user, whatever the IP, as well as per IP. On API v1, the limit
+	// comes before the login check, which would have turned this body away.
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.1:1234", "", "limited@testdomain.xyz", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.2:1234", "", "limited@testdomain.xyz", true)
+	do(http.MethodPost, "/api/v1/note", "192.0.2.3:1234", "", "limited@testdomain.xyz", true)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.4:1234", "", "other@testdomain.xyz", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.1:1234", "", "another@testdomain.xyz", true)
+
+	// So making up a user each time doesn't get round it.
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.5:1234", "", "made.up.1@testdomain.xyz", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.5:1234", "", "made.up.2@testdomain.xyz", true)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.5:1234", "", "", true)
+
+	// A group without a limit isn't limited, and nor are the probes.
+	for i := 0; i < 5; i++ {
+		w = do(http.MethodGet, handlers.APIV2Prefix+"/health", "192.0.2.1:1234", "", "", false)
+		if w.Header().Get(rateLimitLimitHeader) != "" {
+			t.Fatalf("Expected no RateLimit headers for an unlimited group, but got: %v", w.Header())
+		}
+		do(http.MethodGet, ReadinessPath, "192.0.2.1:1234", "", "", false)
+	}
+
+	// The limits can change while we're running. The buckets are kept, and refill at the new rate.
+	live.SetRateLimits(map[string]ratelimit.Limit{RateLimitGroupOther: ratelimit.PerMinute(1, 1)})
+	do(http.MethodPost, handlers.APIV2Prefix+"/sessions", "192.0.2.1:1234", "", "", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/notes", "192.0.2.2:1234", "", "limited@testdomain.xyz", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/health", "192.0.2.1:1234", "", "", false)
+	do(http.MethodGet, handlers.APIV2Prefix+"/health", "192.0.2.1:1234", "", "", true)
+	live.SetRateLimits(nil)
+	do(http.MethodGet, handlers.APIV2Prefix+"/health", "192.0.2.1:1234", "", "", false)
+}
+
+func TestCORS(t *testing.T) {
+	live := &LiveConfig{}
+	router := newTestRouter(t, RouterConfig{Live: live})
+
+	// do makes a request from the given origin, if any, returning the response.
+	do := func(method, path, origin string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		fmt.Printf("TEST ROUTES: CORS: %s %s from %s: %d, Access-Control-Allow-Origin %s\n",
+			method, path, origin, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		return w
+	}
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		return do(http.MethodOptions, handlers.APIV2Prefix+"/notes", origin,
+			"Access-Control-Request-Method", http.MethodPost, "Access-Control-Request-Headers", "content-type")
+	}
+
+	// No origins are allowed by default.
+	if w := preflight("https://app.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS headers without any allowed origins, but got: %v", w.Header())
+	}
+
+	// An origin allowed by name gets to send the login cookie.
+	live.SetCORSAllowedOrigins([]string{"https://app.example.com"})
+	w := preflight("https://app.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), http.MethodPost) ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Content-Type") {
+		t.Fatalf("Expected the preflight to be allowed, but got %d: %v", w.Code, w.Header())
+	}
+	w = do(http.MethodGet, handlers.APIV2Prefix+"/health", "https://app.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), handlers.RequestIDHeader) {
+		t.Fatalf("Expected the CORS headers on the response, but got %d: %v", w.Code, w.Header())
+	}
+
+	// Another origin gets nothing, so the browser won't let it see the response.
+	if w := preflight("https://evil.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS headers for an origin which isn't allowed, but got: %v", w.Header())
+	}
+	w = do(http.MethodGet, handlers.APIV2Prefix+"/health", "https://evil.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "Origin" {
+		t.Fatalf("Expected no CORS headers for an origin which isn't allowed, but got: %v", w.Header())
+	}
+
+	// Any origin, but without the login cookie.
+	live.SetCORSAllowedOrigins([]string{"*"})
+	w = preflight("https://evil.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("Expected the preflight to be allowed without credentials, but got %d: %v", w.Code, w.Header())
+	}
+
+	// Not a cross-origin request at all.
+	if w := do(http.MethodGet, handlers.APIV2Prefix+"/health", ""); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS headers without an Origin, but got: %v", w.Header())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{
+		Quota: model.Quota{MaxNoteBytes: 10, MaxNotes: 2, MaxTotalBytes: 15},
+	})
+	do := ts.do
+
+	// checkProblem checks the problem code of an error response.
+	checkProblem := func(body []byte, wantCode string) {
+		var problem handlers.Problem
+		if err := json.Unmarshal(body, &problem); err != nil || problem.Code != wantCode {
+			t.Fatalf("Expected a '%s' problem, but got: %s", wantCode, body)
+		}
+	}
+
+	const userID = "quota@testdomain.xyz"
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+
+	checkProblem(do(http.MethodPost, "/api/v2/notes", `{"note": "Far too long"}`, http.StatusRequestEntityTooLarge),
+		handlers.ProblemCodeNoteTooLarge)
+	checkProblem(do(http.MethodPost, "/api/v1/note", `{"user_id": "`+userID+`", "note": "Far too long"}`, http.StatusRequestEntityTooLarge),
+		handlers.ProblemCodeNoteTooLarge)
+	do(http.MethodPost, "/api/v2/notes", `{"note": "Ten bytes!"}`, http.StatusCreated)
+	checkProblem(do(http.MethodPost, "/api/v1/note", `{"user_id": "`+userID+`", "note": "Six by"}`, http.StatusInsufficientStorage),
+		handlers.ProblemCodeQuotaExceeded)
+	do(http.MethodPost, "/api/v1/note", `{"user_id": "`+userID+`", "note": "Five!"}`, http.StatusCreated)
+	checkProblem(do(http.MethodPost, "/api/v2/notes", `{"note": "1"}`, http.StatusInsufficientStorage),
+		handlers.ProblemCodeQuotaExceeded)
+
+	// The usage, and the quota, through both APIs.
+	var v2 struct {
+		Data model.ResponseUsage `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/v2/users/me/usage", "", http.StatusOK), &v2); err != nil {
+		t.Fatalf("Failed decoding the usage: %v", err)
+	}
+	if v2.Data.Usage == nil || v2.Data.Notes != 2 || v2.Data.Bytes != 15 || v2.Data.Quota.MaxNotes != 2 {
+		t.Fatalf("Expected 2 notes of 15 bytes, and the quota, but got: %+v", v2.Data)
+	}
+	var v1 struct {
+		Message model.ResponseUsage `json:"message"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/v1/user/usage?userid="+userID, "", http.StatusOK), &v1); err != nil {
+		t.Fatalf("Failed decoding the usage: %v", err)
+	}
+	if v1.Message.Usage == nil || v1.Message.Notes != 2 || v1.Message.Bytes != 15 || v1.Message.Quota.MaxTotalBytes != 15 {
+		t.Fatalf("Expected 2 notes of 15 bytes, and the quota, but got: %+v", v1.Message)
+	}
+	do(http.MethodGet, "/api/v1/user/usage?userid=someone.else@testdomain.xyz", "", http.StatusForbidden)
+
+	// Making room.
+	do(http.MethodDelete, "/api/v2/notes", "", http.StatusOK)
+	do(http.MethodPost, "/api/v2/notes", `{"note": "1"}`, http.StatusCreated)
+}
+
+func TestEvents(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{})
+	do := ts.do
+
+	type event struct {
+		id, name string
+		change   model.NoteChange
+	}
+
+	// stream opens an event stream, and gets its events, until the test is done.
+	stream := func(path, lastEventID string) <-chan event {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed creating request: %v", err)
+		}
+		if lastEventID != "" {
+			req.Header.Set(handlers.LastEventIDHeader, lastEventID)
+		}
+		resp, err := ts.Client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed GET %s: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Expected an event stream from %s, but got %d %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		events := make(chan event, 10)
+		go func() {
+			defer resp.Body.Close()
+			scanner := bufio.NewScanner(resp.Body)
+			var e event
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					e.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					e.name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.change)
+				case line == "" && e.name != "":
+					fmt.Printf("TEST ROUTES: EVENTS: %s got event %s %s\n", path, e.id, e.name)
+					events <- e
+					e = event{}
+				}
+			}
+		}()
+		return events
+	}
+
+	// next gets the next event, which has to be of the given type.
+	next := func(events <-chan event, wantName string) event {
+		select {
+		case e := <-events:
+			if e.name != wantName {
+				t.Fatalf("Expected a %s event, but got %+v", wantName, e)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a %s event", wantName)
+		}
+		return event{}
+	}
+
+	const userID = "events@testdomain.xyz"
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+	const otherUserID = "otherevents@testdomain.xyz"
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+otherUserID+`", "password": "cafed00d"}`, http.StatusCreated)
+
+	// Only the right user, and a sensible last event ID.
+	do(http.MethodGet, "/api/v1/events?userid="+url.QueryEscape(otherUserID), "", http.StatusForbidden)
+	do(http.MethodGet, "/api/v1/events?userid="+url.QueryEscape(userID)+"&last_event_id=nope", "", http.StatusBadRequest)
+
+	v1Events := stream("/api/v1/events?userid="+url.QueryEscape(userID), "")
+	v2Events := stream("/api/v2/events", "")
+
+	var note struct {
+		Data model.Note `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v2/notes", `{"note": "Hello"}`, http.StatusCreated), &note); err != nil {
+		t.Fatalf("Failed decoding the note: %v", err)
+	}
+	do(http.MethodPut, "/api/v2/notes/"+note.Data.NoteID, `{"note": "Hello again"}`, http.StatusOK)
+	do(http.MethodDelete, "/api/v2/notes/"+note.Data.NoteID, "", http.StatusNoContent)
+
+	// The event IDs are "<change journal ID>.<sequence number>".
+	var createdID, deletedID string
+	for _, events := range []<-chan event{v1Events, v2Events} {
+		created := next(events, model.NoteChangeCreated)
+		journalID, seq, _ := strings.Cut(created.id, ".")
+		if journalID == "" || seq != "1" || created.change.NoteID != note.Data.NoteID || created.change.UserID != userID {
+			t.Fatalf("Expected event 1 to be the new note, but got %+v", created)
+		}
+		next(events, model.NoteChangeUpdated)
+		deleted := next(events, model.NoteChangeDeleted)
+		if deleted.id != journalID+".3" || deleted.change.Note != nil {
+			t.Fatalf("Expected event 3 to be the deletion, with no note, but got %+v", deleted)
+		}
+		createdID, deletedID = created.id, deleted.id
+	}
+
+	// Picking up after the first event gets the rest again.
+	resumed := stream("/api/v2/events", createdID)
+	next(resumed, model.NoteChangeUpdated)
+	next(resumed, model.NoteChangeDeleted)
+
+	// An event ID from before a restart, say, means starting again, even if the change
+	// journal has got as far since.
+	for _, lastEventID := range []string{"42", "1", "0ujtsYcgvSTl8PAuAdqWYSMnLOv.1"} {
+		if reset := next(stream("/api/v2/events", lastEventID), handlers.EventTypeReset); reset.id != deletedID {
+			t.Fatalf("Expected a reset to event 3 from %s, but got %+v", lastEventID, reset)
+		}
+	}
+}
+
+func TestCollab(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{CollabSaveInterval: 50 * time.Millisecond})
+	wsURL := strings.Replace(ts.URL, "http://", "ws://", 1)
+	dialer := &websocket.Dialer{Jar: ts.Client.Jar, HandshakeTimeout: 5 * time.Second}
+	do := ts.do
+
+	// dial opens the note's WebSocket, which has to get the given status.
+	dial := func(noteID, origin string, wantStatus int) *websocket.Conn {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := dialer.Dial(wsURL+"/api/v2/notes/"+noteID+"/collab", header)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		fmt.Printf("TEST ROUTES: COLLAB: Dial note %s from origin '%s': %d\n", noteID, origin, status)
+		if status != wantStatus {
+			t.Fatalf("Expected status %d opening the WebSocket of note %s, but got %d (%v)", wantStatus, noteID, status, err)
+		}
+		if conn != nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+		return conn
+	}
+
+	// next reads the next message, which has to be of the given type.
+	next := func(conn *websocket.Conn, wantType string) collab.Message {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg collab.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed reading a %s message: %v", wantType, err)
+		}
+		if msg.Type != wantType {
+			t.Fatalf("Expected a %s message, but got %+v", wantType, msg)
+		}
+		return msg
+	}
+
+	const userID = "collab@testdomain.xyz"
+	const otherUserID = "othercollab@testdomain.xyz"
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+otherUserID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+otherUserID+`", "password": "cafed00d"}`, http.StatusOK)
+	var othersNote struct {
+		Data model.Note `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v2/notes", `{"note": "Not yours"}`, http.StatusCreated), &othersNote); err != nil {
+		t.Fatalf("Failed decoding the note: %v", err)
+	}
+	do(http.MethodPost, "/api/v2/users", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v2/sessions", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+	var note struct {
+		Data model.Note `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v2/notes", `{"note": "Hello"}`, http.StatusCreated), &note); err != nil {
+		t.Fatalf("Failed decoding the note: %v", err)
+	}
+
+	// Only our own notes, and only from our own pages.
+	dial(othersNote.Data.NoteID, "", http.StatusForbidden)
+	dial("nope", "", http.StatusNotFound)
+	dial(note.Data.NoteID, "https://evil.example.com", http.StatusForbidden)
+
+	alice := dial(note.Data.NoteID, ts.URL, http.StatusSwitchingProtocols)
+	if init := next(alice, collab.MessageInit); init.Text == nil || *init.Text != "Hello" || init.Revision != 0 || len(init.Clients) != 1 {
+		t.Fatalf("Expected to start with the note's text, as revision 0, but got %+v", init)
+	}
+	bob := dial(note.Data.NoteID, "", http.StatusSwitchingProtocols)
+	init := next(bob, collab.MessageInit)
+	if len(init.Clients) != 2 {
+		t.Fatalf("Expected two clients in the room, but got %+v", init)
+	}
+	next(alice, collab.MessageJoin)
+
+	// Nonsense gets an error, and the WebSocket stays open.
+	if err := bob.WriteMessage(websocket.TextMessage, []byte("nonsense")); err != nil {
+		t.Fatalf("Failed sending nonsense: %v", err)
+	}
+	if bad := next(bob, collab.MessageError); bad.Code != collab.ErrorBadMessage {
+		t.Fatalf("Expected a %s error, but got %+v", collab.ErrorBadMessage, bad)
+	}
+
+	// An edit is acked to its sender, and passed on to everybody else.
+	var op collab.Operation
+	if err := alice.WriteJSON(collab.Message{Type: collab.MessageOp, Revision: 0, Op: op.Retain(5).Insert(", world")}); err != nil {
+		t.Fatalf("Failed sending the edit: %v", err)
+	}
+	if ack := next(alice, collab.MessageAck); ack.Revision != 1 {
+		t.Fatalf("Expected the edit to be revision 1, but got %+v", ack)
+	}
+	if got := next(bob, collab.MessageOp); got.Revision != 1 || got.ClientID == init.ClientID {
+		t.Fatalf("Expected the other client to get the edit, as revision 1, but got %+v", got)
+	}
+
+	// The edit is saved soon enough.
+	if saved := next(bob, collab.MessageSaved); saved.Revision != 1 {
+		t.Fatalf("Expected revision 1 to be saved, but got %+v", saved)
+	}
+	var got struct {
+		Data model.Note `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/api/v2/notes/"+note.Data.NoteID, "", http.StatusOK), &got); err != nil {
+		t.Fatalf("Failed decoding the note: %v", err)
+	}
+	if got.Data.Note != "Hello, world" {
+		t.Fatalf("Expected the saved note to be 'Hello, world', but got '%s'", got.Data.Note)
+	}
+
+	// Leaving is passed on too.
+	alice.Close()
+	next(bob, collab.MessageLeave)
+}
+
+func TestSync(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{})
+	do := ts.do
+
+	const userID = "sync@testdomain.xyz"
+	const otherUserID = "othersync@testdomain.xyz"
+	do(http.MethodPost, "/api/v1/register", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v1/login", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+
+	// Only the right user, with a sensible body.
+	do(http.MethodPost, "/api/v1/sync", `{"user_id": "`+otherUserID+`"}`, http.StatusForbidden)
+	do(http.MethodPost, "/api/v1/sync", `{"user_id": "`+userID+`", "sync_token": "nope"}`, http.StatusBadRequest)
+	do(http.MethodPost, "/api/v1/sync", `{"user_id": "`+userID+`", "changes": [{"base_version": -1}]}`, http.StatusBadRequest)
+
+	var synced struct {
+		Message model.ResponseSync `json:"message"`
+	}
+	body := `{"user_id": "` + userID + `", "changes": [{"client_ref": "a", "note": "Offline"}]}`
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v1/sync", body, http.StatusOK), &synced); err != nil {
+		t.Fatalf("Failed decoding the sync: %v", err)
+	}
+	// The sync token is "<change journal ID>.<sequence number>".
+	journalID, seq, _ := strings.Cut(synced.Message.SyncToken, ".")
+	if !synced.Message.Reset || len(synced.Message.Notes) != 1 || journalID == "" || seq != "1" ||
+		synced.Message.Results[0].Status != model.SyncStatusApplied {
+		t.Fatalf("Expected the offline note, synced up to 1, but got %+v", synced.Message)
+	}
+	noteID := synced.Message.Results[0].NoteID
+
+	// Deleted on the latest version, which comes back as a tombstone.
+	body = `{"user_id": "` + userID + `", "sync_token": "` + synced.Message.SyncToken + `", "changes": [{"note_id": "` + noteID + `", "base_version": 1, "deleted": true}]}`
+	synced.Message = model.ResponseSync{}
+	if err := json.Unmarshal(do(http.MethodPost, "/api/v1/sync", body, http.StatusOK), &synced); err != nil {
+		t.Fatalf("Failed decoding the sync: %v", err)
+	}
+	if synced.Message.Reset || len(synced.Message.Notes) != 1 || !synced.Message.Notes[0].Deleted ||
+		synced.Message.SyncToken != journalID+".2" {
+		t.Fatalf("Expected the note's tombstone, synced up to 2, but got %+v", synced.Message)
+	}
+	do(http.MethodGet, "/api/v1/note/"+noteID+"?userid="+url.QueryEscape(userID), "", http.StatusNotFound)
+
+	// A sync token from before a restart, say, means getting all the notes again, even if
+	// the change journal has got as far since.
+	for _, syncToken := range []string{"1", "0ujtsYcgvSTl8PAuAdqWYSMnLOv.1"} {
+		body = `{"user_id": "` + userID + `", "sync_token": "` + syncToken + `"}`
+		synced.Message = model.ResponseSync{}
+		if err := json.Unmarshal(do(http.MethodPost, "/api/v1/sync", body, http.StatusOK), &synced); err != nil {
+			t.Fatalf("Failed decoding the sync: %v", err)
+		}
+		if !synced.Message.Reset || synced.Message.SyncToken != journalID+".2" {
+			t.Fatalf("Expected a reset from sync token %s, but got %+v", syncToken, synced.Message)
+		}
+	}
+}
+
+// Checks that the notes can be exported as zips and tar.gzs, through both APIs.
+func TestExport(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{})
+	do := ts.send
+
+	const userID = "export@testdomain.xyz"
+	query := "?userid=" + url.QueryEscape(userID)
+	do(http.MethodPost, "/api/v1/register", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v1/login", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+	texts := []string{"Shopping #groceries", "Second thoughts"}
+	for _, text := range texts {
+		do(http.MethodPost, "/api/v2/notes", `{"note": "`+text+`"}`, http.StatusCreated)
+	}
+
+	// Only the right user, and a format we know.
+	do(http.MethodGet, "/api/v1/export?userid=other%40testdomain.xyz", "", http.StatusForbidden)
+	do(http.MethodGet, "/api/v1/export"+query+"&format=rar", "", http.StatusBadRequest)
+	do(http.MethodGet, "/api/v2/export?format=rar", "", http.StatusBadRequest)
+
+	for _, tc := range []struct{ path, format, contentType string }{
+		{"/api/v1/export" + query, archive.FormatZip, "application/zip"},
+		{"/api/v2/export?format=tar.gz", archive.FormatTarGz, "application/gzip"},
+	} {
+		resp, data := do(http.MethodGet, tc.path, "", http.StatusOK)
+		if resp.Header.Get("Content-Type") != tc.contentType ||
+			!strings.Contains(resp.Header.Get("Content-Disposition"), "."+tc.format+`"`) {
+			t.Fatalf("Expected a %s attachment, but got %v", tc.format, resp.Header)
+		}
+
+		// Everything's in there, as said in the manifest.
+		files := make(map[string]string)
+		if tc.format == archive.FormatZip {
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("Failed reading the zip: %v", err)
+			}
+			for _, f := range zr.File {
+				r, _ := f.Open()
+				content, _ := io.ReadAll(r)
+				r.Close()
+				files[f.Name] = string(content)
+			}
+		} else {
+			gr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Failed reading the gzip: %v", err)
+			}
+			tr := tar.NewReader(gr)
+			for header, err := tr.Next(); err != io.EOF; header, err = tr.Next() {
+				if err != nil {
+					t.Fatalf("Failed reading the tar: %v", err)
+				}
+				content, _ := io.ReadAll(tr)
+				files[header.Name] = string(content)
+			}
+		}
+		var manifest model.ExportManifest
+		if err := json.Unmarshal([]byte(files[archive.ManifestFile]), &manifest); err != nil {
+			t.Fatalf("Failed decoding the manifest %q: %v", files[archive.ManifestFile], err)
+		}
+		if manifest.UserID != userID || manifest.NoteCount != len(texts) || len(files) != len(texts)+1 {
+			t.Fatalf("Expected the manifest of %d notes, but got %+v", len(texts), manifest)
+		}
+		// Notes created in the same second can be in either order.
+		exportedTexts := make(map[string][]string)
+		for _, exported := range manifest.Notes {
+			file := files[exported.File]
+			_, text, ok := strings.Cut(strings.TrimPrefix(file, "---\n"), "\n---\n")
+			if !strings.HasPrefix(file, "---\nid: "+exported.NoteID+"\n") || !ok {
+				t.Fatalf("Expected note %s's file to have its front matter and text, but got %q", exported.NoteID, file)
+			}
+			exportedTexts[text] = exported.Tags
+		}
+		if tags, ok := exportedTexts[texts[0]]; !ok || len(tags) != 1 || tags[0] != "groceries" {
+			t.Fatalf("Expected the first note, tagged, but got %v", exportedTexts)
+		}
+		if tags, ok := exportedTexts[texts[1]]; !ok || len(tags) != 0 {
+			t.Fatalf("Expected the second note, untagged, but got %v", exportedTexts)
+		}
+	}
+}
+
+// Checks that the webhooks can be managed by their users, and the admins, and that
+// they get signed deliveries of the events they want, which go in their delivery logs.
+func TestWebhooks(t *testing.T) {
+	// The webhooks, each of which keeps the events it gets, by path.
+	var mu sync.Mutex
+	received := make(map[string][]model.WebhookEvent)
+	secrets := make(map[string]string)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := webhooks.Verify(secrets[r.URL.Path], r.Header.Get(webhooks.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			t.Errorf("Expected a signed delivery to %s, but got: %v", r.URL.Path, err)
+		}
+		var event model.WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Failed decoding the event: %v", err)
+		}
+		fmt.Printf("TEST ROUTES: WEBHOOKS: %s got %s\n", r.URL.Path, body)
+		received[r.URL.Path] = append(received[r.URL.Path], event)
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const token = "0123456789abcdef-webhooks"
+	ts := newTestServer(t, RouterConfig{
+		WebhooksAdminToken: token,
+		Webhooks:           webhooks.Options{MinBackoff: 10 * time.Millisecond, AllowPrivateAddresses: true},
+		Context:            ctx,
+	})
+
+	// do sends the request, with the bearer token if any, returning the response body.
+	do := func(method, path, body, bearer string, wantStatus int) []byte {
+		var headers []string
+		if bearer != "" {
+			headers = []string{"Authorization", "Bearer " + bearer}
+		}
+		return ts.do(method, handlers.APIV2Prefix+path, body, wantStatus, headers...)
+	}
+	// register registers a webhook for the receiver's path, returning its ID.
+	register := func(prefix, path, events, bearer string) string {
+		var created struct {
+			Data model.Webhook `json:"data"`
+		}
+		body := `{"url": "` + receiver.URL + path + `", "events": ` + events + `}`
+		if err := json.Unmarshal(do(http.MethodPost, prefix, body, bearer, http.StatusCreated), &created); err != nil || created.Data.Secret == "" {
+			t.Fatalf("Expected the new webhook with its secret, but got %+v: %v", created.Data, err)
+		}
+		mu.Lock()
+		secrets[path] = created.Data.Secret
+		mu.Unlock()
+		return created.Data.WebhookID
+	}
+
+	const userID = "hooked@testdomain.xyz"
+	credentials := `{"id": "` + userID + `", "password": "cafed00d"}`
+	do(http.MethodPost, "/webhooks", `{"url": "https://example.com/hook"}`, "", http.StatusUnauthorized)
+	do(http.MethodPost, "/users", credentials, "", http.StatusCreated)
+	do(http.MethodPost, "/sessions", credentials, "", http.StatusOK)
+
+	// The user wants their new notes, and the admins want everything.
+	do(http.MethodPost, "/webhooks", `{"url": "`+receiver.URL+`", "events": ["note.exploded"]}`, "", http.StatusBadRequest)
+	userHook := register("/webhooks", "/user", `["note.created"]`, "")
+	do(http.MethodPost, "/admin/webhooks", `{"url": "`+receiver.URL+`"}`, "", http.StatusUnauthorized)
+	adminHook := register("/admin/webhooks", "/admin", `[]`, token)
+
+	var listed struct {
+		Data []model.Webhook `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodGet, "/webhooks", "", "", http.StatusOK), &listed); err != nil ||
+		len(listed.Data) != 1 || listed.Data[0].WebhookID != userHook || listed.Data[0].Secret != "" {
+		t.Fatalf("Expected the user's webhook, without its secret, but got %+v: %v", listed.Data, err)
+	}
+	do(http.MethodGet, "/webhooks/"+adminHook, "", "", http.StatusNotFound)
+	do(http.MethodGet, "/admin/webhooks/"+adminHook, "", token, http.StatusOK)
+
+	var created struct {
+		Data model.Note `json:"data"`
+	}
+	if err := json.Unmarshal(do(http.MethodPost, "/notes", `{"note": "Hook me"}`, "", http.StatusCreated), &created); err != nil {
+		t.Fatalf("Failed getting the new note: %v", err)
+	}
+	do(http.MethodPut, "/notes/"+created.Data.NoteID, `{"note": "Hook me again"}`, "", http.StatusOK)
+	do(http.MethodDelete, "/sessions", "", "", http.StatusNoContent)
+
+	// deliveries waits for the webhook's deliveries to have all been delivered, and
+	// gets them, newest first.
+	deliveries := func(prefix, webhookID, bearer string, want int) []model.WebhookDelivery {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var page struct {
+				Data []model.WebhookDelivery `json:"data"`
+			}
+			if err := json.Unmarshal(do(http.MethodGet, prefix+"/"+webhookID+"/deliveries?status=delivered", "", bearer, http.StatusOK), &page); err != nil {
+				t.Fatalf("Failed decoding the deliveries: %v", err)
+			}
+			if len(page.Data) == want {
+				return page.Data
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %d deliveries, but got %+v", want, page.Data)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	do(http.MethodPost, "/sessions", credentials, "", http.StatusOK)
+	userDeliveries := deliveries("/webhooks", userHook, "", 1)
+	adminDeliveries := deliveries("/admin/webhooks", adminHook, token, 4)
+	var types []string
+	for _, delivery := range adminDeliveries {
+		types = append(types, delivery.Event.Type)
+	}
+	if userDeliveries[0].Event.Type != model.NoteChangeCreated ||
+		strings.Join(types, ",") != "session.login,session.logout,note.updated,note.created" {
+		t.Fatalf("Expected the user's new note, and everything for the admins, but got %+v, and %v", userDeliveries, types)
+	}
+	mu.Lock()
+	if len(received["/user"]) != 1 || len(received["/admin"]) != 4 || received["/user"][0].Note.Note != "Hook me" {
+		t.Fatalf("Expected the events delivered, but got %+v", received)
+	}
+	mu.Unlock()
+
+	// A delivered event can be sent again, but not somebody else's.
+	do(http.MethodPost, "/webhooks/"+userHook+"/deliveries/"+userDeliveries[0].DeliveryID+"/retry", "", "", http.StatusAccepted)
+	do(http.MethodPost, "/webhooks/"+userHook+"/deliveries/"+adminDeliveries[0].DeliveryID+"/retry", "", "", http.StatusNotFound)
+	deliveries("/webhooks", userHook, "", 1)
+
+	// Deleted webhooks are gone.
+	do(http.MethodDelete, "/webhooks/"+userHook, "", "", http.StatusNoContent)
+	do(http.MethodGet, "/webhooks/"+userHook, "", "", http.StatusNotFound)
+	do(http.MethodDelete, "/admin/webhooks/"+adminHook, "", token, http.StatusNoContent)
+}
+
+func TestImport(t *testing.T) {
+	// A low threshold, so that an import goes on in the background, a body limit, as
+	// notablyd has, and a quota, which is as big as a file in a zip can be.
+	ts := newTestServer(t, RouterConfig{ImportAsyncItems: 3, Quota: model.Quota{MaxNoteBytes: 1 << 10}}, func(h http.Handler) http.Handler {
+		return http.MaxBytesHandler(h, 64<<10)
+	})
+
+	// do sends the request, returning the response, and decoding its body into v.
+	do := func(method, path, contentType string, body []byte, wantStatus int, v any) *http.Response {
+		resp, respBody := ts.send(method, path, string(body), wantStatus, "Content-Type", contentType)
+		if v != nil {
+			if err := json.Unmarshal(respBody, v); err != nil {
+				t.Fatalf("Failed decoding response of %s %s: %v", method, path, err)
+			}
+		}
+		return resp
+	}
+
+	const userID = "import@testdomain.xyz"
+	query := "?userid=" + url.QueryEscape(userID)
+	do(http.MethodPost, "/api/v1/register", "application/json", []byte(`{"id": "`+userID+`", "password": "cafed00d"}`), http.StatusCreated, nil)
+	do(http.MethodPost, "/api/v1/login", "application/json", []byte(`{"id": "`+userID+`", "password": "cafed00d"}`), http.StatusOK, nil)
+
+	// A Google Keep note, there and then, in API v1.
+	keepNote := []byte(`{"title": "Packing", "textContent": "Passport", "labels": [{"name": "Travel"}],
+		"createdTimestampUsec": 1714555800000000, "userEditedTimestampUsec": 1714669512000000}`)
+	do(http.MethodPost, "/api/v1/import?userid=other%40testdomain.xyz", "application/json", keepNote, http.StatusForbidden, nil)
+	var v1Resp struct{ Message model.Import }
+	do(http.MethodPost, "/api/v1/import"+query, "application/json", keepNote, http.StatusOK, &v1Resp)
+	imp := v1Resp.Message
+	if imp.Status != model.ImportDone || imp.Total != 1 || imp.Imported != 1 || len(imp.Results) != 1 ||
+		imp.Results[0].Status != model.ImportStatusImported || imp.FinishTimestamp == 0 {
+		t.Fatalf("Expected the note to be imported, but got %+v", imp)
+	}
+	var noteResp struct{ Data model.Note }
+	do(http.MethodGet, "/api/v2/notes/"+imp.Results[0].NoteID, "", nil, http.StatusOK, &noteResp)
+	if noteResp.Data.Note != "# Packing\n\nPassport\n\n#Travel" || noteResp.Data.CreationTimestamp != 1714555800 ||
+		noteResp.Data.UpdateTimestamp != 1714669512 {
+		t.Fatalf("Expected the note with its Keep timestamps, but got %+v", noteResp.Data)
+	}
+	do(http.MethodGet, "/api/v1/import/"+imp.ImportID+query, "", nil, http.StatusOK, &v1Resp)
+	if v1Resp.Message.ImportID != imp.ImportID || v1Resp.Message.Imported != 1 {
+		t.Fatalf("Expected to get the import back, but got %+v", v1Resp.Message)
+	}
+
+	// What can't be imported, whatever it says it is.
+	do(http.MethodPost, "/api/v1/import"+query, "text/plain", []byte("Just some text"), http.StatusUnsupportedMediaType, nil)
+	do(http.MethodPost, "/api/v2/import", "application/zip", []byte("PK\x03\x04 not really a zip"), http.StatusBadRequest, nil)
+	var problem handlers.Problem
+	do(http.MethodPost, "/api/v2/import", "application/zip", bytes.Repeat([]byte("x"), 100<<10), http.StatusRequestEntityTooLarge, &problem)
+	if problem.Code != handlers.ProblemCodeUploadTooLarge {
+		t.Fatalf("Expected an upload too large problem, but got %+v", problem)
+	}
+	do(http.MethodGet, "/api/v2/import/nope", "", nil, http.StatusNotFound, &problem)
+	if problem.Code != handlers.ProblemCodeImportNotFound {
+		t.Fatalf("Expected an import not found problem, but got %+v", problem)
+	}
+
+	// A small zip of a file which is far too big once it's uncompressed isn't read past the quota.
+	var bomb bytes.Buffer
+	zw := zip.NewWriter(&bomb)
+	w, _ := zw.Create("notes/bomb.md")
+	w.Write(bytes.Repeat([]byte("a"), 16<<20))
+	zw.Close()
+	var v2Resp struct{ Data model.Import }
+	do(http.MethodPost, "/api/v2/import", "application/zip", bomb.Bytes(), http.StatusOK, &v2Resp)
+	if v2Resp.Data.Failed != 1 || len(v2Resp.Data.Results) != 1 ||
+		!strings.Contains(v2Resp.Data.Results[0].Detail, "bigger than 1024 bytes") {
+		t.Fatalf("Expected the file to fail for being bigger than a note can be, but got %+v", v2Resp.Data)
+	}
+
+	// A zip of more items than the threshold goes on in the background.
+	var buf bytes.Buffer
+	zw = zip.NewWriter(&buf)
+	for _, file := range []struct{ name, content string }{
+		{"notes/one.md", "---\ncreated: 2024-05-01T09:30:00Z\n---\nOne"},
+		{"notes/two.txt", "Two"},
+		{"notes/three.md", "Three #x"},
+		{"notes/empty.md", ""},
+		{"notes/photo.jpg", "\xff\xd8\xff"},
+	} {
+		w, _ := zw.Create(file.name)
+		w.Write([]byte(file.content))
+	}
+	zw.Close()
+	resp := do(http.MethodPost, "/api/v2/import", "application/zip", buf.Bytes(), http.StatusAccepted, &v2Resp)
+	location := resp.Header.Get("Location")
+	if v2Resp.Data.Status != model.ImportRunning || v2Resp.Data.Total != 5 ||
+		location != "/api/v2/import/"+v2Resp.Data.ImportID {
+		t.Fatalf("Expected a running import of 5 items, and where to see it, but got %+v at '%s'", v2Resp.Data, location)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		do(http.MethodGet, location, "", nil, http.StatusOK, &v2Resp)
+		if v2Resp.Data.Status == model.ImportDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the import to be done by now, but got %+v", v2Resp.Data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	imp = v2Resp.Data
+	results := map[string]*model.ImportResult{}
+	for _, result := range imp.Results {
+		results[result.Item] = result
+	}
+	if imp.Processed != 5 || imp.Imported != 3 || imp.Failed != 1 || imp.Skipped != 1 || len(imp.Results) != 5 ||
+		results["notes/empty.md"].Code != handlers.ProblemCodeInvalidNote ||
+		results["notes/photo.jpg"].Status != model.ImportStatusSkipped {
+		t.Fatalf("Expected 3 imported, 1 failed and 1 skipped, but got %+v", imp)
+	}
+	do(http.MethodGet, "/api/v2/notes/"+results["notes/one.md"].NoteID, "", nil, http.StatusOK, &noteResp)
+	if noteResp.Data.Note != "One" || noteResp.Data.CreationTimestamp != 1714555800 {
+		t.Fatalf("Expected the note with its front matter's timestamp, but got %+v", noteResp.Data)
+	}
+}
+
+// Checks that an import in the background stops when the background work does, as when
+// notablyd is shutting down, and is left cancelled, rather than running for good.
+func TestImportCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ts := newTestServer(t, RouterConfig{Context: ctx, ImportAsyncItems: 1})
+
+	const userID = "cancelled@testdomain.xyz"
+	ts.do(http.MethodPost, "/api/v1/register", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	ts.do(http.MethodPost, "/api/v1/login", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"notes/one.md", "notes/two.md"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("Never imported"))
+	}
+	zw.Close()
+	resp, body := ts.send(http.MethodPost, "/api/v2/import", buf.String(), http.StatusAccepted, "Content-Type", "application/zip")
+	location := resp.Header.Get("Location")
+
+	var v2Resp struct{ Data model.Import }
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := json.Unmarshal(body, &v2Resp); err != nil {
+			t.Fatalf("Failed decoding the import: %v", err)
+		}
+		if v2Resp.Data.Status != model.ImportRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the import to be cancelled by now, but got %+v", v2Resp.Data)
+		}
+		time.Sleep(20 * time.Millisecond)
+		body = ts.do(http.MethodGet, location, "", http.StatusOK)
+	}
+	fmt.Printf("TEST IMPORT CANCELLED: Import is %+v\n", v2Resp.Data)
+	if imp := v2Resp.Data; imp.Status != model.ImportCancelled || imp.Processed != 0 || imp.Imported != 0 ||
+		imp.FinishTimestamp == 0 {
+		t.Fatalf("Expected the import to be cancelled before any notes, but got %+v", imp)
+	}
+}
+
+// Checks that a page cursor which isn't one gets a 400, in both APIs, rather than
+// the handler carrying on without a page.
+func TestNotePagingBadCursor(t *testing.T) {
+	ts := newTestServer(t, RouterConfig{})
+	do := ts.do
+
+	const userID = "paging@testdomain.xyz"
+	do(http.MethodPost, "/api/v1/register", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusCreated)
+	do(http.MethodPost, "/api/v1/login", `{"id": "`+userID+`", "password": "cafed00d"}`, http.StatusOK)
+	do(http.MethodPost, "/api/v1/note", `{"user_id": "`+userID+`", "note": "Page me"}`, http.StatusCreated)
+
+	query := "?userid=" + url.QueryEscape(userID)
+	do(http.MethodGet, "/api/v1/note"+query+"&limit=1", "", http.StatusOK)
+	for _, path := range []string{"/api/v1/note" + query + "&cursor=garbage", "/api/v2/notes?cursor=garbage"} {
+		var problem handlers.Problem
+		if err := json.Unmarshal(do(http.MethodGet, path, "", http.StatusBadRequest), &problem); err != nil ||
+			problem.Code != handlers.ProblemCodeBadRequest {
+			t.Fatalf("Expected a bad request problem for GET %s, but got %+v, error: %v", path, problem, err)
+		}
+	}
+}
@@ -1,6 +1,143 @@
 package routes
 
-// Configuration for setting up the router
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"notably/cmd/notablyd/routes/handlers"
+	"notably/internal/model"
+	"notably/internal/platform/ratelimit"
+	"notably/internal/platform/webhooks"
+)
+
+// Where the Prometheus metrics are served.
+const MetricsPath = "/metrics"
+
+// Where the liveness and readiness probes are served.
+const (
+	LivenessPath  = "/livez"
+	ReadinessPath = "/readyz"
+)
+
+// The rate limited route groups, each of which has its own buckets.
+const (
+	RateLimitGroupAuth  = "auth"  // Registering and logging in, per client IP.
+	RateLimitGroupNotes = "notes" // The note routes, per client IP and per logged-in user.
+	RateLimitGroupOther = "other" // The rest of the APIs, per client IP.
+)
+
+// Configuration for setting up the router.
+// The zero value is a router with everything turned on, and the default cookie settings.
 type RouterConfig struct {
-	LoginCookieMaxAgeSecs int // The maximum age, in seconds, of the login cookie
+	LoginCookieDomain string // The domain of the login cookie. Empty means "localhost".
+	LoginCookieSecure bool   // Whether the login cookie is only sent over HTTPS.
+
+	// Feature toggles.
+	DisableAPIV1             bool
+	DisableAPIV2             bool
+	DisableOpenAPIValidation bool // Of API v1 requests.
+	DisableMetricsEndpoint   bool // Serving the Prometheus metrics at MetricsPath.
+
+	// What readiness depends on, other than the store, which is always checked.
+	HealthChecks []handlers.HealthCheck
+	// The bearer token for the detailed health report. Empty means there's no report.
+	HealthDetailsToken string
+
+	// How long audit events are kept. Zero means forever.
+	AuditRetention time.Duration
+	// The bearer token for querying the audit log. Empty means it can't be queried.
+	AuditQueryToken string
+
+	// How much each user can store. The zero value means no limits.
+	Quota model.Quota
+
+	// How often notes being edited together are saved. Zero means collab.DefaultSaveInterval.
+	CollabSaveInterval time.Duration
+
+	// How webhooks are delivered. The zero value has the webhooks package defaults.
+	Webhooks webhooks.Options
+	// The bearer token for managing the admins' webhooks, which get everybody's events.
+	// Empty means there are none.
+	WebhooksAdminToken string
+
+	// How many items an import can have before it goes on in the background. Zero
+	// means handlers.DefaultImportAsyncItems.
+	ImportAsyncItems int
+
+	// The background work, like delivering webhooks, stops when this is done. Nil means never.
+	Context context.Context
+
+	// Where the rate limit buckets are kept. Nothing is limited without a store. The
+	// limits themselves are in the live config, so that they can change.
+	RateLimitStore ratelimit.Store
+
+	// The addresses (or CIDR ranges) of the proxies in front of us, whose
+	// X-Forwarded-For headers are believed. Empty means none are, and the client IP is
+	// whoever connected to us.
+	TrustedProxies []string
+
+	// The settings which can be changed while the router is running. Nil means the defaults.
+	Live *LiveConfig
+}
+
+// LiveConfig is the part of the router configuration which can be changed while the
+// router is running, e.g. when notablyd reloads its config file.
+// It is safe for concurrent use, and the zero value has the default settings.
+type LiveConfig struct {
+	loginCookieMaxAgeSecs atomic.Int64
+	rateLimits            atomic.Pointer[map[string]ratelimit.Limit]
+	corsAllowedOrigins    atomic.Pointer[[]string]
+}
+
+// SetLoginCookieMaxAgeSecs sets the maximum age, in seconds, of login cookies set from now on.
+// Zero or less means the default.
+func (lc *LiveConfig) SetLoginCookieMaxAgeSecs(secs int) {
+	lc.loginCookieMaxAgeSecs.Store(int64(secs))
+}
+
+// LoginCookieMaxAgeSecs is the maximum age, in seconds, of the login cookie.
+func (lc *LiveConfig) LoginCookieMaxAgeSecs() int {
+	secs := int(lc.loginCookieMaxAgeSecs.Load())
+	if secs <= 0 {
+		return handlers.DefaultLoginCookieMaxAgeSecs
+	}
+	return secs
+}
+
+// SetRateLimits sets the rate limits, by route group, for requests from now on. A group
+// without a limit isn't limited, so nil turns rate limiting off.
+func (lc *LiveConfig) SetRateLimits(limits map[string]ratelimit.Limit) {
+	limits = maps.Clone(limits)
+	lc.rateLimits.Store(&limits)
+}
+
+// RateLimit is the rate limit of a route group, which may be ratelimit.Limit.Unlimited().
+func (lc *LiveConfig) RateLimit(group string) ratelimit.Limit {
+	if limits := lc.rateLimits.Load(); limits != nil {
+		return (*limits)[group]
+	}
+	return ratelimit.Limit{}
+}
+
+// SetCORSAllowedOrigins sets the origins, like "https://app.example.com", which can make
+// cross-origin requests from now on, with "*" for any origin. Nil means none can.
+func (lc *LiveConfig) SetCORSAllowedOrigins(origins []string) {
+	origins = slices.Clone(origins)
+	lc.corsAllowedOrigins.Store(&origins)
+}
+
+// CORSAllowedOrigin tells whether an origin can make cross-origin requests, and if so,
+// whether with credentials (the login cookie), which is only for origins allowed by name.
+func (lc *LiveConfig) CORSAllowedOrigin(origin string) (allowed, credentials bool) {
+	origins := lc.corsAllowedOrigins.Load()
+	if origins == nil {
+		return false, false
+	}
+	if slices.Contains(*origins, origin) {
+		return true, true
+	}
+	return slices.Contains(*origins, "*"), false
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"notably/cmd/notablyd/config"
+)
+
+// tlsLoader holds the TLS configuration made from the certificate, key and client CA
+// files, and reloads it when they change, so that e.g. a renewed certificate is
+// picked up without a restart. New connections get the new configuration, and
+// existing ones carry on with the old one.
+type tlsLoader struct {
+	mu       sync.Mutex
+	settings config.TLS  // What the current configuration was loaded from.
+	modTimes []time.Time // Of the files, when they were loaded.
+	config   atomic.Pointer[tls.Config]
+}
+
+// tlsFiles are the files the TLS configuration is loaded from.
+func tlsFiles(settings config.TLS) []string {
+	files := []string{settings.CertFile, settings.KeyFile}
+	if settings.ClientAuth != config.ClientAuthNone {
+		files = append(files, settings.ClientCAFile)
+	}
+	return files
+}
+
+// fileModTimes gets the modification times of files, with the zero time for any we
+// can't stat.
+func fileModTimes(files []string) []time.Time {
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// load loads the TLS configuration, keeping the current one if it doesn't load.
+func (tl *tlsLoader) load(settings config.TLS) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.loadLocked(settings)
+}
+
+func (tl *tlsLoader) loadLocked(settings config.TLS) error {
+	// Stat before reading, so that a change while we're reading gets picked up next time.
+	modTimes := fileModTimes(tlsFiles(settings))
+
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate '%s' and key '%s': %s",
+			settings.CertFile, settings.KeyFile, err.Error())
+	}
+	tc := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	switch settings.ClientAuth {
+	case config.ClientAuthOptional:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case config.ClientAuthRequire:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if tc.ClientAuth != tls.NoClientCert {
+		data, err := os.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading TLS client CA file: %s", err.Error())
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no PEM certificates in TLS client CA file '%s'", settings.ClientCAFile)
+		}
+	}
+
+	tl.config.Store(tc)
+	tl.settings = settings
+	tl.modTimes = modTimes
+	return nil
+}
+
+// reloadIfChanged reloads the TLS configuration if any of its files have changed
+// since it was loaded, telling us whether it tried.
+func (tl *tlsLoader) reloadIfChanged() (bool, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	modTimes := fileModTimes(tlsFiles(tl.settings))
+	changed := false
+	for i := range modTimes {
+		changed = changed || !modTimes[i].Equal(tl.modTimes[i])
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, tl.loadLocked(tl.settings)
+}
+
+// watch checks the files for changes every interval, until the context is done.
+func (tl *tlsLoader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := tl.reloadIfChanged()
+			if err != nil {
+				// Most likely the files are being replaced, so we'll try again next time.
+				slog.Error("TLS RELOAD", "error", err.Error())
+			} else if reloaded {
+				slog.Info("TLS certificate files changed, reloaded them")
+			}
+		}
+	}
+}
+
+// serverConfig is the tls.Config for the http.Server, which gets the current
+// configuration for each new connection.
+func (tl *tlsLoader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tl.config.Load(), nil
+		},
+		// Not used, given the above, but it tells http.Server we have a certificate.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &tl.config.Load().Certificates[0], nil
+		},
+	}
+}
+
+// hstsHandler adds the Strict-Transport-Security header to every response, telling
+// browsers to only use HTTPS for the next maxAge.
+func hstsHandler(h http.Handler, maxAge time.Duration) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS redirects every request to the same URL with HTTPS, on the port of
+// httpsAddress (our listen address).
+func redirectToHTTPS(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	if p, err := net.LookupPort("tcp", port); err == nil {
+		port = strconv.Itoa(p)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
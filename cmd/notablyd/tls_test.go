@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"notably/cmd/notablyd/config"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+// testCert is a throwaway certificate.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert makes a certificate for name, signed by parent, or a self-signed CA
+// if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed parsing certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (tc *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.cert.Raw})
+}
+
+func (tc *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatalf("Failed marshalling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// write writes the certificate and key files, with a modification time in the future,
+// so that a rewrite is always seen as a change.
+func (tc *testCert) write(t *testing.T, certFile, keyFile string) {
+	future := time.Now().Add(time.Duration(tc.cert.SerialNumber.Int64() % int64(time.Hour)))
+	for file, data := range map[string][]byte{certFile: tc.certPEM(), keyFile: tc.keyPEM(t)} {
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			t.Fatalf("Failed writing '%s': %v", file, err)
+		}
+		if err := os.Chtimes(file, future, future); err != nil {
+			t.Fatalf("Failed setting the time of '%s': %v", file, err)
+		}
+	}
+}
+
+func (tc *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(tc.certPEM(), tc.keyPEM(t))
+	if err != nil {
+		t.Fatalf("Failed making TLS certificate: %v", err)
+	}
+	return cert
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	settings := config.TLS{
+		Enabled:      true,
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientAuth:   config.ClientAuthRequire,
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+
+	newTestCert(t, "old.example.com", nil).write(t, settings.CertFile, settings.KeyFile)
+	clientCA := newTestCert(t, "Notably Test Client CA", nil)
+	if err := os.WriteFile(settings.ClientCAFile, clientCA.certPEM(), 0o600); err != nil {
+		t.Fatalf("Failed writing client CA file: %v", err)
+	}
+	clientCert := newTestCert(t, "client.example.com", clientCA).tlsCertificate(t)
+	untrustedCert := newTestCert(t, "untrusted.example.com", nil).tlsCertificate(t)
+
+	tl := &tlsLoader{}
+	if err := tl.load(settings); err != nil {
+		t.Fatalf("Failed loading TLS configuration: %v", err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	srv := httptest.NewUnstartedServer(hstsHandler(ok, 24*time.Hour))
+	srv.TLS = tl.serverConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	// get makes a request on a new connection with the client certificate, if any,
+	// returning the name on the server certificate.
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+		}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if hsts := resp.Header.Get("Strict-Transport-Security"); hsts != "max-age=86400" {
+			t.Fatalf("Expected a one day HSTS header, but got '%s'", hsts)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	name, err := get(clientCert)
+	if err != nil || name != "old.example.com" {
+		t.Fatalf("Expected the old server certificate, but got '%s', error: %v", name, err)
+	}
+
+	// Without a client certificate, or with one not from the client CA. Should fail.
+	if _, err := get(); err == nil {
+		t.Fatalf("Expected an error without a client certificate, but got none")
+	} else {
+		fmt.Println("TEST TLS: No client certificate error:", err)
+	}
+	if _, err := get(untrustedCert); err == nil {
+		t.Fatalf("Expected an error with an untrusted client certificate, but got none")
+	}
+
+	// Nothing changed, so nothing to reload.
+	if reloaded, err := tl.reloadIfChanged(); reloaded || err != nil {
+		t.Fatalf("Expected no reload when nothing changed, but got: %t, error: %v", reloaded, err)
+	}
+
+	// Renew the certificate. New connections should get it.
+	newTestCert(t, "new.example.com", nil).write(t, settings.CertFile, settings.KeyFile)
+	if reloaded, err := tl.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Expected a reload after renewing the certificate, but got: %t, error: %v", reloaded, err)
+	}
+	name, err = get(clientCert)
+	if err != nil || name != "new.example.com" {
+		t.Fatalf("Expected the renewed server certificate, but got '%s', error: %v", name, err)
+	}
+
+	// A half-written key. Should error, and keep the current certificate.
+	if err := os.WriteFile(settings.KeyFile, []byte("-----BEGIN"), 0o600); err != nil {
+		t.Fatalf("Failed writing key file: %v", err)
+	}
+	if reloaded, err := tl.reloadIfChanged(); !reloaded || err == nil {
+		t.Fatalf("Expected an error reloading a bad key, but got: %t, error: %v", reloaded, err)
+	}
+	if name, err = get(clientCert); err != nil || name != "new.example.com" {
+		t.Fatalf("Expected to keep the renewed certificate, but got '%s', error: %v", name, err)
+	}
+
+	// Redirecting HTTP to HTTPS, on the port we listen on, which is left out if it's 443.
+	for listenAddress, expected := range map[string]string{
+		":8443":       "https://notably.example.com:8443/api/v1/note?userid=a%40b.c",
+		"0.0.0.0:443": "https://notably.example.com/api/v1/note?userid=a%40b.c",
+		"[::1]:https": "https://notably.example.com/api/v1/note?userid=a%40b.c",
+	} {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(listenAddress).ServeHTTP(w,
+			httptest.NewRequest(http.MethodPost, "http://notably.example.com:8080/api/v1/note?userid=a%40b.c", nil))
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != expected {
+			t.Fatalf("Expected a redirect to %s, but got %d to %s", expected, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
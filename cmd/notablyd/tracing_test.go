@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"notably/cmd/notablyd/config"
+	"notably/cmd/notablyd/routes"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestTracingFile(t *testing.T) {
+	settings := config.Default().Tracing
+	settings.Enabled = true
+	settings.Exporter = config.TracingExporterFile
+	settings.File = filepath.Join(t.TempDir(), "traces.json")
+
+	shutdown, err := setupTracing(context.Background(), settings)
+	if err != nil {
+		t.Fatalf("Failed setting up tracing: %v", err)
+	}
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/health", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // Which stops the router's background work.
+	routes.NewRouter(routes.RouterConfig{Context: ctx}).ServeHTTP(httptest.NewRecorder(), req)
+
+	// The spans are exported in batches, so they're only in the file once it's flushed.
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed shutting down tracing: %v", err)
+	}
+	data, err := os.ReadFile(settings.File)
+	if err != nil {
+		t.Fatalf("Failed reading the traces file: %v", err)
+	}
+	fmt.Println("TEST TRACING: Traces file:", string(data))
+
+	// One JSON span per line.
+	var span struct {
+		Name        string
+		SpanContext struct{ TraceID string }
+		Resource    []struct {
+			Key   string
+			Value struct{ Value interface{} }
+		}
+	}
+	if err := json.Unmarshal([]byte(strings.Split(string(data), "\n")[0]), &span); err != nil {
+		t.Fatalf("Traces file does not have a JSON span: %v", err)
+	}
+	if span.Name != "GET /api/v2/health" || span.SpanContext.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected the request's span, as part of the caller's trace, but got: %+v", span)
+	}
+	var sawServiceName bool
+	for _, kv := range span.Resource {
+		sawServiceName = sawServiceName || (kv.Key == "service.name" && kv.Value.Value == "notablyd")
+	}
+	if !sawServiceName {
+		t.Fatalf("Expected the span's resource to say it's from notablyd, but got: %+v", span.Resource)
+	}
+}
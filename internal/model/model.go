@@ -4,7 +4,7 @@ package model
 type User struct {
 	UserID            string `json:"user_id"`
 	PasswordHash      string `json:"password_hash"`
-	CreationTimestamp int64  `json:creation_timestamp"`
+	CreationTimestamp int64  `json:"creation_timestamp"`
 }
 
 type Note struct {
@@ -13,6 +13,9 @@ type Note struct {
 	CreationTimestamp int64  `json:"creation_timestamp"`
 	UpdateTimestamp   int64  `json:"update_timestamp"`
 	Note              string `json:"note"`
+	// Goes up every time the note changes. It's the sequence number of the note's last
+	// change in the change journal.
+	Version int64 `json:"version"`
 }
 
 // The RESPONSE Data Transfer Object (DTO) for operations on users.
@@ -25,6 +28,208 @@ type ResponseNote struct {
 	*Note
 }
 
+// The API v2 RESPONSE DTO for users. Unlike v1, the password hash is left out altogether
+// instead of being redacted.
+type ResponseUserV2 struct {
+	UserID            string `json:"user_id"`
+	CreationTimestamp int64  `json:"creation_timestamp"`
+}
+
+// How much a user is storing.
+type Usage struct {
+	UserID string `json:"user_id"`
+	Notes  int    `json:"notes"`
+	Bytes  int64  `json:"bytes"` // Of note text, all told.
+}
+
+// Quota limits how much each user can store. Zero means no limit.
+type Quota struct {
+	MaxNoteBytes  int64 `json:"max_note_bytes"`  // Of the text of one note.
+	MaxNotes      int   `json:"max_notes"`       // Per user.
+	MaxTotalBytes int64 `json:"max_total_bytes"` // Of the text of all of a user's notes.
+}
+
+// The RESPONSE DTO for a user's usage, which has their quota with it.
+type ResponseUsage struct {
+	*Usage
+	Quota Quota `json:"quota"`
+}
+
+// A change to one of a user's notes, as kept in the change journal.
+type NoteChange struct {
+	Seq       int64  `json:"seq"`       // Where it is in the journal, from 1 up, across all users.
+	Timestamp int64  `json:"timestamp"` // Unix timestamp.
+	Type      string `json:"type"`      // e.g. "note.updated"
+	UserID    string `json:"user_id"`
+	NoteID    string `json:"note_id"`
+	// The note as it is now, which may be newer than the change. Nil if it has since
+	// been deleted, which will be a later change.
+	Note *Note `json:"note,omitempty"`
+}
+
+// The types of note change.
+const (
+	NoteChangeCreated = "note.created"
+	NoteChangeUpdated = "note.updated"
+	NoteChangeDeleted = "note.deleted"
+)
+
+// The changes to a user's notes since some point in the change journal.
+type NoteChangePage struct {
+	Changes []*NoteChange `json:"changes"`
+	// Where these changes take the reader up to in the journal, to ask for the changes
+	// after next time. It can be past the last of the changes, which were only the user's.
+	Seq int64 `json:"seq"`
+	// The journal no longer goes back as far as was asked for, or doesn't know of that
+	// point at all (say, because the server has restarted). Changes is empty, and the
+	// reader needs to get all the notes again.
+	Truncated bool `json:"truncated"`
+}
+
+// A change which a client made to its copy of a user's notes while it was offline, to
+// sync. It creates a note when there's no NoteID, deletes the note when Deleted is set,
+// and otherwise replaces the note's text.
+type SyncChange struct {
+	// The client's own name for the change, e.g. its local ID of a new note, which the
+	// change's result has with it. Optional.
+	ClientRef string `json:"client_ref,omitempty"`
+	NoteID    string `json:"note_id,omitempty"`
+	// The version of the note which the client changed. Ignored for a new note.
+	BaseVersion int64  `json:"base_version"`
+	Note        string `json:"note,omitempty"` // The note's new text, unless it's deleted.
+	Deleted     bool   `json:"deleted,omitempty"`
+}
+
+// The outcomes of a SyncChange.
+const (
+	SyncStatusApplied  = "applied"  // The change was made as asked.
+	SyncStatusConflict = "conflict" // The note changed since the base version. See the SyncResolutions.
+	SyncStatusFailed   = "failed"   // The change couldn't be made, e.g. it would go over the quota.
+)
+
+// How a SyncStatusConflict was resolved. No text anybody wrote is thrown away.
+const (
+	// The note was changed since the base version, so it was left as it is, and the
+	// client's text was saved as a new note.
+	SyncResolutionCopied = "copied"
+	// The note was deleted since the base version, so the client's text was saved as
+	// a new note.
+	SyncResolutionRecreated = "recreated"
+	// The note was changed since the base version, so it wasn't deleted.
+	SyncResolutionKept = "kept"
+)
+
+// What came of a SyncChange.
+type SyncResult struct {
+	ClientRef  string `json:"client_ref,omitempty"`
+	NoteID     string `json:"note_id,omitempty"` // The note it ended up as, e.g. the new note's ID.
+	Status     string `json:"status"`
+	Resolution string `json:"resolution,omitempty"` // For a SyncStatusConflict.
+	// The note it ended up as, nil if it's deleted, or the change failed.
+	Note *Note `json:"note,omitempty"`
+	// Why the change failed. The handlers fill in the problem Code from it.
+	Err    error  `json:"-"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// A note which has changed since a sync, as it is now.
+type SyncedNote struct {
+	NoteID  string `json:"note_id"`
+	Version int64  `json:"version"` // The note's version, or when it was deleted.
+	Deleted bool   `json:"deleted"`
+	Note    *Note  `json:"note,omitempty"` // Nil if it's deleted.
+}
+
+// What a sync sends the client back: the results of its changes, and everybody's
+// changes since its last sync, including its own.
+type NoteSync struct {
+	Results []*SyncResult `json:"results"`
+	Notes   []*SyncedNote `json:"notes"`
+	// Where the notes take the client up to in the change journal, for next time.
+	// Clients get it as an opaque sync token.
+	Seq int64 `json:"-"`
+	// Notes has all the user's notes, rather than what has changed, since the client
+	// had never synced, or the change journal no longer goes back as far as its last
+	// sync. The client should let go of any notes it has which aren't among them.
+	Reset bool `json:"reset"`
+	// There are more changes, which the client can get by syncing again straight away.
+	HasMore bool `json:"has_more"`
+}
+
+// The REQUEST DTO for syncing notes. The user ID is only for API v1, like RequestNote's.
+type RequestSync struct {
+	UserID    string       `json:"user_id,omitempty"`
+	SyncToken string       `json:"sync_token"` // From the last sync. Empty for the first.
+	Changes   []SyncChange `json:"changes"`
+}
+
+// The RESPONSE DTO for syncing notes.
+type ResponseSync struct {
+	*NoteSync
+	SyncToken string `json:"sync_token"` // For the next sync.
+}
+
+// The manifest.json of an export of a user's notes, which says what's in it.
+type ExportManifest struct {
+	FormatVersion int             `json:"format_version"` // Of the export. Goes up if it changes incompatibly.
+	UserID        string          `json:"user_id"`
+	ExportedAt    int64           `json:"exported_at"` // Unix timestamp.
+	NoteCount     int             `json:"note_count"`
+	Notes         []*ExportedNote `json:"notes"` // In the order they were created.
+}
+
+// A note in an export.
+type ExportedNote struct {
+	NoteID            string   `json:"note_id"`
+	File              string   `json:"file"` // Its Markdown file, e.g. "notes/<note ID>.md".
+	CreationTimestamp int64    `json:"creation_timestamp"`
+	UpdateTimestamp   int64    `json:"update_timestamp"`
+	Version           int64    `json:"version"`
+	Tags              []string `json:"tags"`
+	Size              int      `json:"size"`   // Of the note's text, in bytes.
+	SHA256            string   `json:"sha256"` // Hex, of the note's text.
+}
+
+// The outcomes of importing an item, e.g. a file in a zip, or a note in an ENEX.
+const (
+	ImportStatusImported = "imported"
+	ImportStatusFailed   = "failed"
+	ImportStatusSkipped  = "skipped" // It isn't a note, e.g. it's a picture, or a note in the trash.
+)
+
+// What came of importing an item.
+type ImportResult struct {
+	Item   string `json:"item"` // Where it came from, e.g. "notes/shopping.md", or "Notebook.enex: Shopping".
+	Status string `json:"status"`
+	NoteID string `json:"note_id,omitempty"` // The note it was imported as.
+	Code   string `json:"code,omitempty"`    // The problem code of a failure, e.g. "quota_exceeded".
+	Detail string `json:"detail,omitempty"`  // Why it failed, or was skipped.
+}
+
+// The states of an Import.
+const (
+	ImportRunning   = "running"
+	ImportDone      = "done"
+	ImportCancelled = "cancelled" // Stopped part way through, because the server was shutting down.
+)
+
+// An import of notes into a user's account, which goes on in the background when
+// there are a lot of them, and how far it has got.
+type Import struct {
+	ImportID          string          `json:"import_id"`
+	UserID            string          `json:"user_id"`
+	Status            string          `json:"status"`
+	Total             int             `json:"total"` // Items.
+	Processed         int             `json:"processed"`
+	Imported          int             `json:"imported"`
+	Failed            int             `json:"failed"`
+	Skipped           int             `json:"skipped"`
+	CreationTimestamp int64           `json:"creation_timestamp"`
+	FinishTimestamp   int64           `json:"finish_timestamp,omitempty"`
+	Results           []*ImportResult `json:"results"` // So far, in the order of the items.
+}
+
 // The REQUEST DTO used in the route handler for user ops.
 type RequestUser struct {
 	ID       string `json:"id"`
@@ -37,3 +242,186 @@ type RequestNote struct {
 	UserID string `json:"user_id"`
 	Note   string `json:"note"`
 }
+
+// Options for listing a user's notes a page at a time.
+// The zero value lists the first page of notes sorted by creation time, oldest first,
+// using the default page size.
+type NoteListOptions struct {
+	Limit         int    // Maximum number of notes in the page. <= 0 means the default page size.
+	Cursor        string // Opaque cursor from a previous NotePage. Empty means the first page.
+	SortBy        string // "created" or "updated". Empty means "created".
+	Descending    bool   // Newest first instead of oldest first.
+	Query         string // Only notes whose text contains this (case-insensitive).
+	CreatedAfter  int64  // Only notes created strictly after this Unix timestamp, if > 0.
+	CreatedBefore int64  // Only notes created strictly before this Unix timestamp, if > 0.
+}
+
+// A single page of notes, as returned by the paged note listing.
+type NotePage struct {
+	Notes      []*Note `json:"notes"`
+	NextCursor string  `json:"next_cursor"` // Empty when there are no more pages.
+	TotalCount int     `json:"total_count"` // Number of notes matching the filters across ALL pages.
+}
+
+// The API v2 REQUEST DTO for note ops. The note ID comes from the URL path and the
+// user from the login session, so only the note contents are in the body.
+// Fields are pointers so that a PATCH can tell a missing field from an empty one.
+type RequestNoteV2 struct {
+	Note *string `json:"note"`
+}
+
+// An entry in the audit log, of something security-relevant or data-changing which
+// somebody did, or tried to do.
+type AuditEvent struct {
+	Seq          int64  `json:"seq"`                      // Where it is in the log, from 1 up.
+	Timestamp    int64  `json:"timestamp"`                // Unix timestamp.
+	Action       string `json:"action"`                   // e.g. "session.login"
+	Outcome      string `json:"outcome"`                  // "success" or "failure"
+	Reason       string `json:"reason,omitempty"`         // Why it failed: the problem code.
+	ActorUserID  string `json:"actor_user_id,omitempty"`  // Who did it, as per their login cookie. Empty if not logged in.
+	TargetUserID string `json:"target_user_id,omitempty"` // The user it was done to, e.g. who was logged in.
+	TargetNoteID string `json:"target_note_id,omitempty"`
+	ClientIP     string `json:"client_ip"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	RequestID    string `json:"request_id,omitempty"` // To find the request in the logs.
+}
+
+// The audited actions.
+const (
+	AuditActionRegister      = "user.register"
+	AuditActionLogin         = "session.login"
+	AuditActionLogout        = "session.logout"
+	AuditActionNoteCreate    = "note.create"
+	AuditActionNoteUpdate    = "note.update"
+	AuditActionNoteDelete    = "note.delete"
+	AuditActionNoteDeleteAll = "note.delete_all"
+	AuditActionNoteSync      = "note.sync"
+	AuditActionNoteExport    = "note.export"
+	AuditActionNoteImport    = "note.import"
+	AuditActionWebhookCreate = "webhook.create"
+	AuditActionWebhookDelete = "webhook.delete"
+)
+
+// The outcomes of audited actions.
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// Options for listing the audit log a page at a time, newest first. The zero value
+// lists the first page of all the events, using the default page size.
+type AuditListOptions struct {
+	Limit        int    // Maximum number of events in the page. <= 0 means the default page size.
+	Cursor       string // Opaque cursor from a previous AuditPage. Empty means the first page.
+	Action       string // Only events of this action, if not empty.
+	Outcome      string // Only events with this outcome, if not empty.
+	ActorUserID  string // Only events done by this user, if not empty.
+	TargetUserID string // Only events done to this user, if not empty.
+	TargetNoteID string // Only events done to this note, if not empty.
+	Since        int64  // Only events at or after this Unix timestamp, if > 0.
+	Until        int64  // Only events before this Unix timestamp, if > 0.
+}
+
+// A single page of the audit log.
+type AuditPage struct {
+	Events     []*AuditEvent `json:"events"`
+	NextCursor string        `json:"next_cursor"` // Empty when there are no more pages.
+}
+
+// A URL which gets sent events, as they happen.
+type Webhook struct {
+	WebhookID string `json:"webhook_id"`
+	// The user who registered it, whose events it gets. Empty for an admin's webhook,
+	// which gets everybody's.
+	UserID string `json:"user_id,omitempty"`
+	URL    string `json:"url"`
+	// The types of event it gets, e.g. "note.created". Empty means all of them.
+	Events []string `json:"events"`
+	// What the deliveries are signed with. Only given out when the webhook is registered.
+	Secret            string `json:"secret,omitempty"`
+	CreationTimestamp int64  `json:"creation_timestamp"`
+}
+
+// The types of webhook event, other than the NoteChange types, which are the same.
+// They're the audited actions they come from, when they succeed.
+const (
+	WebhookEventUserRegister  = AuditActionRegister
+	WebhookEventSessionLogin  = AuditActionLogin
+	WebhookEventSessionLogout = AuditActionLogout
+)
+
+// WebhookEventTypes are all the types of webhook event.
+var WebhookEventTypes = []string{
+	NoteChangeCreated, NoteChangeUpdated, NoteChangeDeleted,
+	WebhookEventUserRegister, WebhookEventSessionLogin, WebhookEventSessionLogout,
+}
+
+// Something which happened, as sent to webhooks.
+type WebhookEvent struct {
+	EventID   string `json:"id"` // The same for every webhook it's sent to.
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"` // Unix timestamp.
+	UserID    string `json:"user_id"`
+	NoteID    string `json:"note_id,omitempty"`
+	// The note as it was after the change, for a created or updated note.
+	Note *Note `json:"note,omitempty"`
+}
+
+// The states of a webhook delivery.
+const (
+	WebhookDeliveryPending   = "pending"   // Still to be sent, or to be tried again.
+	WebhookDeliveryDelivered = "delivered" // The webhook said 2xx.
+	WebhookDeliveryDead      = "dead"      // Given up on, after too many attempts.
+)
+
+// The sending of an event to a webhook, in the outbox until it's sent, and in the
+// delivery log after.
+type WebhookDelivery struct {
+	DeliveryID        string       `json:"delivery_id"`
+	Seq               int64        `json:"-"` // Goes up by one for each delivery, of any webhook.
+	WebhookID         string       `json:"webhook_id"`
+	Event             WebhookEvent `json:"event"`
+	Status            string       `json:"status"`
+	Attempts          int          `json:"attempts"`
+	CreationTimestamp int64        `json:"creation_timestamp"`
+	// When it's next to be tried, while it's pending, as Unix time in milliseconds.
+	NextAttemptMillis int64 `json:"next_attempt_millis,omitempty"`
+	// How the last attempt went.
+	LastAttemptTimestamp int64  `json:"last_attempt_timestamp,omitempty"`
+	LastStatusCode       int    `json:"last_status_code,omitempty"` // Of the webhook's response, if there was one.
+	LastError            string `json:"last_error,omitempty"`
+}
+
+// A webhook delivery which is due to be sent, with the webhook it's to.
+type DueWebhookDelivery struct {
+	Delivery *WebhookDelivery
+	Webhook  *Webhook
+}
+
+// How an attempt to send a webhook delivery went, and what's next for it.
+type WebhookAttempt struct {
+	Status            string // What the delivery is now.
+	StatusCode        int    // Of the webhook's response, if there was one.
+	Error             string // What went wrong, if anything.
+	NextAttemptMillis int64  // When to try again, if it's still pending.
+}
+
+// Options for listing a webhook's deliveries a page at a time, newest first. The zero
+// value lists the first page of all of them, using the default page size.
+type WebhookDeliveryListOptions struct {
+	Limit  int    // Maximum number of deliveries in the page. <= 0 means the default page size.
+	Cursor string // Opaque cursor from a previous WebhookDeliveryPage. Empty means the first page.
+	Status string // Only deliveries in this state, if not empty.
+}
+
+// A single page of a webhook's delivery log.
+type WebhookDeliveryPage struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+	NextCursor string             `json:"next_cursor"` // Empty when there are no more pages.
+}
+
+// The REQUEST DTO for registering a webhook.
+type RequestWebhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
@@ -0,0 +1,151 @@
+// Package archive is users' notes as files, for taking them somewhere else. An
+// export is a zip or tar.gz with a Markdown file for each note, whose front matter
+// has the note's ID, timestamps, version and tags, and a manifest.json (see
+// model.ExportManifest) saying what's in it, which comes last.
+//
+// A Writer writes the archive as it goes, one note at a time, so that however many
+// notes there are, only the one being written is held on to.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"notably/internal/model"
+)
+
+// The formats of an export.
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+const (
+	// The model.ExportManifest FormatVersion of the exports we write.
+	FormatVersion = 1
+
+	// Where things are in an export.
+	ManifestFile = "manifest.json"
+	NotesDir     = "notes"
+)
+
+// ErrUnknownFormat is the error for a format which isn't FormatZip or FormatTarGz.
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// ContentType is the MIME type of an export in the given format.
+func ContentType(format string) string {
+	if format == FormatTarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+// Writer writes an export of a user's notes to an io.Writer, e.g. an HTTP response.
+type Writer struct {
+	zw       *zip.Writer
+	gw       *gzip.Writer
+	tw       *tar.Writer
+	manifest model.ExportManifest
+}
+
+// NewWriter returns a Writer of an export of the user's notes, as at the given time,
+// in the given format.
+func NewWriter(w io.Writer, format, userID string, exportedAt time.Time) (*Writer, error) {
+	aw := &Writer{
+		manifest: model.ExportManifest{
+			FormatVersion: FormatVersion,
+			UserID:        userID,
+			ExportedAt:    exportedAt.Unix(),
+			Notes:         []*model.ExportedNote{},
+		},
+	}
+	switch format {
+	case FormatZip:
+		aw.zw = zip.NewWriter(w)
+	case FormatTarGz:
+		aw.gw = gzip.NewWriter(w)
+		aw.tw = tar.NewWriter(aw.gw)
+	default:
+		return nil, fmt.Errorf("%w: '%s', must be one of '%s' or '%s'", ErrUnknownFormat, format, FormatZip, FormatTarGz)
+	}
+	return aw, nil
+}
+
+// WriteNote writes the next note's Markdown file.
+func (aw *Writer) WriteNote(note *model.Note) error {
+	data, err := MarshalMarkdown(note)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(note.Note))
+	exported := &model.ExportedNote{
+		NoteID:            note.NoteID,
+		File:              path.Join(NotesDir, note.NoteID+".md"),
+		CreationTimestamp: note.CreationTimestamp,
+		UpdateTimestamp:   note.UpdateTimestamp,
+		Version:           note.Version,
+		Tags:              Tags(note.Note),
+		Size:              len(note.Note),
+		SHA256:            hex.EncodeToString(sum[:]),
+	}
+	if err := aw.writeFile(exported.File, data, time.Unix(note.UpdateTimestamp, 0)); err != nil {
+		return fmt.Errorf("can't write note '%s': %w", note.NoteID, err)
+	}
+	aw.manifest.Notes = append(aw.manifest.Notes, exported)
+	aw.manifest.NoteCount++
+	return nil
+}
+
+// Close writes the manifest, and finishes the archive. It doesn't close the
+// underlying io.Writer. An archive which isn't closed is incomplete, which is what
+// it should be if something went wrong part way through.
+func (aw *Writer) Close() error {
+	data, err := json.MarshalIndent(aw.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't write manifest: %w", err)
+	}
+	if err := aw.writeFile(ManifestFile, data, time.Unix(aw.manifest.ExportedAt, 0)); err != nil {
+		return fmt.Errorf("can't write manifest: %w", err)
+	}
+
+	if aw.zw != nil {
+		return aw.zw.Close()
+	}
+	if err := aw.tw.Close(); err != nil {
+		return err
+	}
+	return aw.gw.Close()
+}
+
+func (aw *Writer) writeFile(name string, data []byte, modified time.Time) error {
+	if aw.zw != nil {
+		f, err := aw.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o644,
+		ModTime:  modified,
+	}
+	if err := aw.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := aw.tw.Write(data)
+	return err
+}
@@ -0,0 +1,482 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"notably/internal/model"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestTags(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"No tags here", []string{}},
+		{"#groceries milk, eggs #Urgent", []string{"groceries", "Urgent"}},
+		{"#todo then #TODO and #todo", []string{"todo"}},
+		{"# A heading\n## Another\nissue #42 and #v2 in #work/project-x-", []string{"v2", "work/project-x"}},
+		{"mail me@example.com#nope, see https://example.com/#anchor", []string{}},
+		{"Ünïcödé #café", []string{"café"}},
+	} {
+		got := Tags(tc.text)
+		fmt.Printf("TEST ARCHIVE: Tags of %q: %q\n", tc.text, got)
+		if !slices.Equal(got, tc.want) {
+			t.Fatalf("Expected the tags of %q to be %q, but got %q", tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestMarshalMarkdown(t *testing.T) {
+	note := &model.Note{
+		NoteID:            "2ZvPnVh7bXJ3r8JxJ3WkPq3Xk1c",
+		CreationTimestamp: 1714555800,
+		UpdateTimestamp:   1714669512,
+		Version:           7,
+		Note:              "Milk, eggs: bread #groceries\n---\nnot front matter",
+	}
+	data, err := MarshalMarkdown(note)
+	if err != nil {
+		t.Fatalf("Failed marshaling: %v", err)
+	}
+	fmt.Printf("TEST ARCHIVE: Markdown:\n%s\n", data)
+
+	want := "---\n" +
+		"id: 2ZvPnVh7bXJ3r8JxJ3WkPq3Xk1c\n" +
+		"created: 2024-05-01T09:30:00Z\n" +
+		"updated: 2024-05-02T17:05:12Z\n" +
+		"version: 7\n" +
+		"tags:\n" +
+		"    - groceries\n" +
+		"---\n" + note.Note
+	if string(data) != want {
+		t.Fatalf("Expected the Markdown:\n%s\nbut got:\n%s", want, data)
+	}
+}
+
+// readArchive reads all the files in an export, by name.
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+	files := make(map[string]string)
+	switch format {
+	case FormatZip:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Failed reading zip: %v", err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatalf("Failed opening %s: %v", f.Name, err)
+			}
+			content, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("Failed reading %s: %v", f.Name, err)
+			}
+			files[f.Name] = string(content)
+		}
+	case FormatTarGz:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed reading gzip: %v", err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed reading tar: %v", err)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("Failed reading %s: %v", header.Name, err)
+			}
+			files[header.Name] = string(content)
+		}
+	}
+	return files
+}
+
+func TestWriter(t *testing.T) {
+	if _, err := NewWriter(io.Discard, "rar", "writer@testdomain.xyz", time.Now()); err == nil {
+		t.Fatalf("Expected an unknown format to fail")
+	}
+
+	notes := []*model.Note{
+		{NoteID: "one", CreationTimestamp: 1700000000, UpdateTimestamp: 1700000100, Version: 1, Note: "First #a"},
+		{NoteID: "two", CreationTimestamp: 1700000200, UpdateTimestamp: 1700000200, Version: 3, Note: "Second"},
+	}
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		var buf bytes.Buffer
+		aw, err := NewWriter(&buf, format, "writer@testdomain.xyz", time.Unix(1700001000, 0))
+		if err != nil {
+			t.Fatalf("Failed creating %s writer: %v", format, err)
+		}
+		for _, note := range notes {
+			if err := aw.WriteNote(note); err != nil {
+				t.Fatalf("Failed writing note %s: %v", note.NoteID, err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("Failed closing %s writer: %v", format, err)
+		}
+
+		files := readArchive(t, format, buf.Bytes())
+		fmt.Printf("TEST ARCHIVE: %s: %d bytes, manifest: %s\n", format, buf.Len(), files[ManifestFile])
+		if len(files) != 3 || !strings.HasSuffix(files["notes/one.md"], "\n---\nFirst #a") ||
+			!strings.HasSuffix(files["notes/two.md"], "\n---\nSecond") {
+			t.Fatalf("Expected a %s with both notes and the manifest, but got %q", format, files)
+		}
+
+		var manifest model.ExportManifest
+		if err := json.Unmarshal([]byte(files[ManifestFile]), &manifest); err != nil {
+			t.Fatalf("Failed decoding the manifest: %v", err)
+		}
+		if manifest.FormatVersion != FormatVersion || manifest.UserID != "writer@testdomain.xyz" ||
+			manifest.ExportedAt != 1700001000 || manifest.NoteCount != 2 || len(manifest.Notes) != 2 {
+			t.Fatalf("Expected a manifest of both notes, but got %+v", manifest)
+		}
+		first, second := manifest.Notes[0], manifest.Notes[1]
+		if first.NoteID != "one" || first.File != "notes/one.md" || first.UpdateTimestamp != 1700000100 ||
+			!slices.Equal(first.Tags, []string{"a"}) || first.Size != len("First #a") || len(first.SHA256) != 64 ||
+			second.NoteID != "two" || second.Version != 3 || second.Tags == nil {
+			t.Fatalf("Expected the notes in the manifest, but got %+v and %+v", *first, *second)
+		}
+	}
+}
+
+func TestReadExport(t *testing.T) {
+	notes := []*model.Note{
+		{NoteID: "one", CreationTimestamp: 1700000000, UpdateTimestamp: 1700000100, Version: 1, Note: "First #a"},
+		{NoteID: "two", CreationTimestamp: 1700000200, UpdateTimestamp: 1700000200, Version: 3, Note: "Second"},
+	}
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		var buf bytes.Buffer
+		aw, err := NewWriter(&buf, format, "reader@testdomain.xyz", time.Unix(1700001000, 0))
+		if err != nil {
+			t.Fatalf("Failed creating %s writer: %v", format, err)
+		}
+		for _, note := range notes {
+			if err := aw.WriteNote(note); err != nil {
+				t.Fatalf("Failed writing note %s: %v", note.NoteID, err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("Failed closing %s writer: %v", format, err)
+		}
+
+		export, err := ReadExport(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed reading %s export: %v", format, err)
+		}
+		if export.Manifest == nil || export.Manifest.UserID != "reader@testdomain.xyz" || len(export.Files) != 2 {
+			t.Fatalf("Expected the manifest and both notes, but got %+v", export)
+		}
+		if problems := export.Check(); len(problems) != 0 {
+			t.Fatalf("Expected a %s export to check out, but got: %q", format, problems)
+		}
+		read, problems := export.Notes("someone@testdomain.xyz")
+		if len(problems) != 0 || len(read) != 2 || *read[0] != (model.Note{NoteID: "one", NoteUserID: "someone@testdomain.xyz",
+			CreationTimestamp: 1700000000, UpdateTimestamp: 1700000100, Version: 1, Note: "First #a"}) || read[1].Note != "Second" {
+			t.Fatalf("Expected both notes back, but got %+v, %q", read, problems)
+		}
+	}
+
+	// An export which has been tampered with: a note changed, one gone, and one added.
+	var buf bytes.Buffer
+	aw, _ := NewWriter(&buf, FormatZip, "reader@testdomain.xyz", time.Unix(1700001000, 0))
+	for _, note := range notes {
+		aw.WriteNote(note)
+	}
+	aw.Close()
+	export, err := ReadExport(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed reading export: %v", err)
+	}
+	export.Files["notes/one.md"] = bytes.Replace(export.Files["notes/one.md"], []byte("First"), []byte("Frist"), 1)
+	delete(export.Files, "notes/two.md")
+	export.Files["notes/three.md"] = []byte("Third, without any front matter")
+	problems := export.Check()
+	fmt.Printf("TEST ARCHIVE: Problems with a tampered export: %q\n", problems)
+	if len(problems) != 3 || !strings.Contains(problems[0], "'one': its text has changed") ||
+		!strings.Contains(problems[1], "'two': its file 'notes/two.md' is missing") ||
+		!strings.Contains(problems[2], "'notes/three.md' isn't in the manifest") {
+		t.Fatalf("Expected the changed, missing and extra notes, but got: %q", problems)
+	}
+
+	// Reindexing makes a good export of what's there, without the manifest.
+	export.Manifest, export.ManifestErr = nil, errors.New("gone")
+	if problems := export.Check(); len(problems) != 1 || problems[0] != "gone" {
+		t.Fatalf("Expected an export without a manifest to fail the check, but got: %q", problems)
+	}
+	if _, err := export.Reindex(io.Discard, FormatZip, "", time.Now()); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("Expected reindexing without a user to fail, but got: %v", err)
+	}
+	buf.Reset()
+	if problems, err := export.Reindex(&buf, FormatTarGz, "reader@testdomain.xyz", time.Now()); err != nil || len(problems) != 0 {
+		t.Fatalf("Failed reindexing: %v, %q", err, problems)
+	}
+	reindexed, err := ReadExport(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed reading the reindexed export: %v", err)
+	}
+	if problems := reindexed.Check(); len(problems) != 0 || reindexed.Manifest.NoteCount != 2 ||
+		reindexed.Manifest.Notes[0].NoteID != "three" || reindexed.Manifest.Notes[1].NoteID != "one" {
+		t.Fatalf("Expected a reindexed export of the two notes there, but got %+v: %q", reindexed.Manifest, problems)
+	}
+
+	if _, err := ReadExport([]byte("not an archive")); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("Expected an unknown format, but got: %v", err)
+	}
+}
+
+func TestUnmarshalMarkdown(t *testing.T) {
+	note := &model.Note{NoteID: "one", CreationTimestamp: 1714555800, UpdateTimestamp: 1714669512, Version: 2,
+		Note: "Milk #groceries\n---\nnot front matter"}
+	data, err := MarshalMarkdown(note)
+	if err != nil {
+		t.Fatalf("Failed marshaling: %v", err)
+	}
+	frontMatter, text, err := UnmarshalMarkdown(data)
+	if err != nil || text != note.Note || frontMatter.ID != "one" || frontMatter.Created.Unix() != 1714555800 ||
+		frontMatter.Updated.Unix() != 1714669512 || !slices.Equal(frontMatter.Tags, []string{"groceries"}) {
+		t.Fatalf("Expected the note back, but got %+v, %q, error: %v", frontMatter, text, err)
+	}
+
+	// No front matter, or no end to it. All text.
+	for _, data := range []string{"Just text\n---\n", "---\nno: end\n", "\uFEFFJust text"} {
+		frontMatter, text, err := UnmarshalMarkdown([]byte(data))
+		fmt.Printf("TEST ARCHIVE: Unmarshaled %q: %+v, %q\n", data, frontMatter, text)
+		if err != nil || frontMatter.ID != "" || text != strings.TrimPrefix(data, "\uFEFF") {
+			t.Fatalf("Expected %q to be all text, but got %+v, %q, error: %v", data, frontMatter, text, err)
+		}
+	}
+
+	// Garbled front matter. Should error.
+	if _, _, err := UnmarshalMarkdown([]byte("---\ncreated: [not a time\n---\ntext")); err == nil {
+		t.Fatalf("Expected garbled front matter to fail")
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		tags []string
+		want string
+	}{
+		{"Milk", nil, "Milk"},
+		{"Milk #groceries\n", []string{"Groceries", "#shopping", "Big Shop", "42", ""}, "Milk #groceries\n\n#shopping #Big-Shop"},
+		{"", []string{"a"}, "#a"},
+	} {
+		got := WithTags(tc.text, tc.tags)
+		fmt.Printf("TEST ARCHIVE: %q with tags %q: %q\n", tc.text, tc.tags, got)
+		if got != tc.want {
+			t.Fatalf("Expected %q with tags %q to be %q, but got %q", tc.text, tc.tags, tc.want, got)
+		}
+	}
+}
+
+// zipOf is a zip of the files, in order, modified at the given time.
+func zipOf(t *testing.T, modified time.Time, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: files[i], Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			t.Fatalf("Failed adding %s to zip: %v", files[i], err)
+		}
+		if _, err := w.Write([]byte(files[i+1])); err != nil {
+			t.Fatalf("Failed writing %s to zip: %v", files[i], err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed closing zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+const testENEX = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export3.dtd">
+<en-export export-date="20240501T093000Z" application="Evernote" version="10.0">
+  <note>
+    <title>Shopping</title>
+    <content><![CDATA[<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note><div>Don&apos;t forget:</div><div><en-todo checked="true"/>Milk</div><div><en-todo/>Eggs&nbsp;&amp; bread</div><ul><li>Soon</li></ul><br/></en-note>]]></content>
+    <created>20240501T093000Z</created>
+    <updated>20240502T170512Z</updated>
+    <tag>errands</tag>
+    <tag>home list</tag>
+    <resource><data encoding="base64">aGVsbG8=</data></resource>
+  </note>
+  <note>
+    <content><![CDATA[<en-note><h2>Untitled</h2><p>Text</p></en-note>]]></content>
+  </note>
+</en-export>
+`
+
+const testKeep = `{
+  "color": "DEFAULT",
+  "isTrashed": false,
+  "isPinned": false,
+  "isArchived": false,
+  "title": "Packing",
+  "listContent": [{"text": "Passport", "isChecked": true}, {"text": "Charger", "isChecked": false}],
+  "labels": [{"name": "Travel"}],
+  "userEditedTimestampUsec": 1714669512000000,
+  "createdTimestampUsec": 1714555800000000
+}`
+
+func TestReadImport(t *testing.T) {
+	byName := func(items []*Item) map[string]*Item {
+		m := map[string]*Item{}
+		for _, item := range items {
+			fmt.Printf("TEST ARCHIVE: Item %q: %q, %d/%d, skip: %q, error: %v\n", item.Name, item.Text,
+				item.CreationTimestamp, item.UpdateTimestamp, item.Skip, item.Err)
+			m[item.Name] = item
+		}
+		return m
+	}
+
+	// An ENEX on its own.
+	items, err := ReadImport([]byte(testENEX), 0)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected the 2 notes of the ENEX, but got %d, error: %v", len(items), err)
+	}
+	enex := byName(items)
+	shopping := enex["import.enex: Shopping"]
+	if shopping == nil || shopping.Err != nil ||
+		shopping.Text != "# Shopping\n\nDon't forget:\n[x] Milk\n[ ] Eggs & bread\n- Soon\n\n#errands #home-list" ||
+		shopping.CreationTimestamp != 1714555800 || shopping.UpdateTimestamp != 1714669512 {
+		t.Fatalf("Expected the Shopping note, but got %+v", shopping)
+	}
+	if untitled := enex["import.enex: note 2"]; untitled == nil || untitled.Text != "## Untitled\nText" ||
+		untitled.CreationTimestamp != 0 {
+		t.Fatalf("Expected the untitled note, but got %+v", untitled)
+	}
+
+	// A Keep note on its own.
+	items, err = ReadImport([]byte(testKeep), 0)
+	if err != nil || len(items) != 1 || items[0].Err != nil ||
+		items[0].Text != "# Packing\n\n- [x] Passport\n- [ ] Charger\n\n#Travel" ||
+		items[0].CreationTimestamp != 1714555800 || items[0].UpdateTimestamp != 1714669512 {
+		t.Fatalf("Expected the Keep note, but got %+v, error: %v", items, err)
+	}
+
+	// A zip of an export, and the rest.
+	var export bytes.Buffer
+	aw, _ := NewWriter(&export, FormatZip, "import@testdomain.xyz", time.Now())
+	if err := aw.WriteNote(&model.Note{NoteID: "one", CreationTimestamp: 1700000000, UpdateTimestamp: 1700000100,
+		Note: "Exported #a"}); err != nil {
+		t.Fatalf("Failed writing note: %v", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Failed closing export: %v", err)
+	}
+	items, err = ReadImport(export.Bytes(), 0)
+	if err != nil || len(items) != 1 || items[0].Name != "notes/one.md" || items[0].Text != "Exported #a" ||
+		items[0].CreationTimestamp != 1700000000 || items[0].UpdateTimestamp != 1700000100 {
+		t.Fatalf("Expected the exported note back, but got %+v, error: %v", items, err)
+	}
+
+	modified := time.Unix(1710000000, 0)
+	items, err = ReadImport(zipOf(t, modified,
+		"Notes/", "",
+		"Notes/plain.txt", "Just text",
+		"Notes/titled.md", "---\ntitle: Titled\ncreated: 2024-05-01T09:30:00Z\ntags: [x]\n---\nBody",
+		"Notes/garbled.md", "---\ncreated: [\n---\nBody",
+		"Notes/latin1.txt", "caf\xe9",
+		"Notes/photo.jpg", "\xff\xd8\xff",
+		"Notes/.DS_Store", "junk",
+		"__MACOSX/Notes/._plain.txt", "junk",
+		"Takeout/Keep/Packing.json", testKeep,
+		"Takeout/Keep/Trashed.json", `{"textContent": "gone", "isTrashed": true, "createdTimestampUsec": 1}`,
+		"Takeout/Keep/Labels.txt", "Travel",
+		"Evernote/Notebook.enex", testENEX,
+	), 0)
+	if err != nil || len(items) != 9 {
+		t.Fatalf("Expected 9 items in the zip, but got %d, error: %v", len(items), err)
+	}
+	zipped := byName(items)
+	if plain := zipped["Notes/plain.txt"]; plain.Text != "Just text" || plain.CreationTimestamp != 1710000000 ||
+		plain.UpdateTimestamp != 1710000000 {
+		t.Fatalf("Expected the plain text file, modified when the zip says, but got %+v", plain)
+	}
+	if titled := zipped["Notes/titled.md"]; titled.Text != "# Titled\n\nBody\n\n#x" || titled.CreationTimestamp != 1714555800 ||
+		titled.UpdateTimestamp != 1710000000 {
+		t.Fatalf("Expected the file's front matter to be used, but got %+v", titled)
+	}
+	if zipped["Notes/garbled.md"].Err == nil || zipped["Notes/latin1.txt"].Err == nil {
+		t.Fatalf("Expected garbled front matter, and text which isn't UTF-8, to fail")
+	}
+	if zipped["Notes/photo.jpg"].Skip == "" || zipped["Takeout/Keep/Trashed.json"].Skip == "" {
+		t.Fatalf("Expected a picture, and a note in the trash, to be skipped")
+	}
+	if zipped["Takeout/Keep/Packing.json"].Err != nil || zipped["Evernote/Notebook.enex: Shopping"] == nil ||
+		zipped["Evernote/Notebook.enex: note 2"] == nil {
+		t.Fatalf("Expected the Keep and ENEX notes in the zip")
+	}
+
+	// What can't be imported at all.
+	for _, tc := range []struct {
+		data string
+		want error
+	}{
+		{"Just some text", ErrUnknownFormat},
+		{"<html><body>Not ENEX</body></html>", ErrUnknownFormat},
+		{"<en-export><note><title>Cut off", ErrBadArchive},
+		{"PK\x03\x04 not really a zip", ErrBadArchive},
+	} {
+		_, err := ReadImport([]byte(tc.data), 0)
+		fmt.Printf("TEST ARCHIVE: Import of %q: %v\n", tc.data, err)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("Expected importing %q to fail with %v, but got: %v", tc.data, tc.want, err)
+		}
+	}
+}
+
+// Checks that a zip which is mostly compressed nothing can't take all the memory.
+func TestReadImportZipBombs(t *testing.T) {
+	defer func(size int64) { maxTotalBytes = size }(maxTotalBytes)
+	maxTotalBytes = 1 << 20
+	modified := time.Unix(1710000000, 0)
+	nothing := strings.Repeat("a", 600<<10)
+
+	// A file bigger than the limit is a failed item, and the rest are still read.
+	data := zipOf(t, modified, "big.md", nothing, "small.md", "Small")
+	fmt.Printf("TEST ARCHIVE: Zip of %d bytes, of %d uncompressed\n", len(data), len(nothing)+5)
+	items, err := ReadImport(data, 1000)
+	if err != nil || len(items) != 2 || items[0].Err == nil || !strings.Contains(items[0].Err.Error(), "bigger than 1000 bytes") ||
+		items[1].Err != nil || items[1].Text != "Small" {
+		t.Fatalf("Expected the big file to fail, and the small one to be read, but got %+v, error: %v", items, err)
+	}
+
+	// Files which add up to more than the total, even if they're each small enough, or
+	// are an ENEX, which is read a note at a time.
+	for _, files := range [][]string{
+		{"one.md", nothing, "two.md", nothing},
+		{"Notebook.enex", "<en-export><note><title>Big</title><content>" + nothing + nothing + "</content></note></en-export>"},
+	} {
+		_, err := ReadImport(zipOf(t, modified, files...), 0)
+		fmt.Printf("TEST ARCHIVE: Import of %s: %v\n", files[0], err)
+		if !errors.Is(err, ErrBadArchive) {
+			t.Fatalf("Expected importing files adding up to too much to fail, but got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"notably/internal/model"
+)
+
+// An Export is what's in an export, as read back from its archive, e.g. by an operator
+// checking a backup.
+type Export struct {
+	Manifest    *model.ExportManifest // Nil if there isn't one, or it can't be read.
+	ManifestErr error                 // Why there's no Manifest.
+	Files       map[string][]byte     // The files other than the manifest, by name.
+}
+
+// ReadExport reads an export, in either format, which it tells from the data. Like an
+// import, no file can be bigger than MaxFileBytes, uncompressed, and they can't add up
+// to more than the total an import can. It's only an error if the archive can't be read
+// at all: a missing or unreadable manifest is the Export's ManifestErr.
+func ReadExport(data []byte) (*Export, error) {
+	export := &Export{Files: map[string][]byte{}}
+	left := maxTotalBytes
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadArchive, err.Error())
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			content, err := readZipFile(f, MaxFileBytes, &left)
+			if err != nil {
+				return nil, fmt.Errorf("%w: can't read '%s': %s", ErrBadArchive, f.Name, err.Error())
+			}
+			export.Files[f.Name] = content
+		}
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadArchive, err.Error())
+		}
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrBadArchive, err.Error())
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			content, err := io.ReadAll(io.LimitReader(totalReader{tr, &left}, MaxFileBytes+1))
+			if err == nil && len(content) > MaxFileBytes {
+				err = fmt.Errorf("file is bigger than %d bytes", MaxFileBytes)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: can't read '%s': %s", ErrBadArchive, header.Name, err.Error())
+			}
+			export.Files[header.Name] = content
+		}
+	default:
+		return nil, fmt.Errorf("%w: expected a zip or a tar.gz", ErrUnknownFormat)
+	}
+
+	data, ok := export.Files[ManifestFile]
+	delete(export.Files, ManifestFile)
+	if !ok {
+		export.ManifestErr = fmt.Errorf("there's no %s", ManifestFile)
+		return export, nil
+	}
+	var manifest model.ExportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		export.ManifestErr = fmt.Errorf("can't read %s: %w", ManifestFile, err)
+		return export, nil
+	}
+	export.Manifest = &manifest
+	return export, nil
+}
+
+// Check checks that the export is what its manifest says it is: that every note in it
+// is there, unchanged, and that there are no notes which it doesn't list. It returns
+// everything wrong, which is nothing for a good export.
+func (e *Export) Check() []string {
+	if e.Manifest == nil {
+		return []string{e.ManifestErr.Error()}
+	}
+
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	m := e.Manifest
+	if m.FormatVersion != FormatVersion {
+		problem("the format version is %d, not %d", m.FormatVersion, FormatVersion)
+	}
+	if m.UserID == "" {
+		problem("there's no user ID")
+	}
+	if m.NoteCount != len(m.Notes) {
+		problem("the note count is %d, but %d notes are listed", m.NoteCount, len(m.Notes))
+	}
+
+	listed := map[string]bool{}
+	seen := map[string]bool{}
+	for _, exported := range m.Notes {
+		if seen[exported.NoteID] {
+			problem("note '%s' is listed more than once", exported.NoteID)
+		}
+		seen[exported.NoteID] = true
+		listed[exported.File] = true
+
+		data, ok := e.Files[exported.File]
+		if !ok {
+			problem("note '%s': its file '%s' is missing", exported.NoteID, exported.File)
+			continue
+		}
+		frontMatter, text, err := UnmarshalMarkdown(data)
+		if err != nil {
+			problem("note '%s': %s", exported.NoteID, err.Error())
+			continue
+		}
+		sum := sha256.Sum256([]byte(text))
+		if frontMatter.ID != exported.NoteID {
+			problem("note '%s': its file says it's note '%s'", exported.NoteID, frontMatter.ID)
+		}
+		if len(text) != exported.Size || hex.EncodeToString(sum[:]) != exported.SHA256 {
+			problem("note '%s': its text has changed", exported.NoteID)
+		}
+		if frontMatter.Version != exported.Version {
+			problem("note '%s': its file says it's version %d, not %d", exported.NoteID, frontMatter.Version, exported.Version)
+		}
+	}
+
+	for _, name := range e.noteFiles() {
+		if !listed[name] {
+			problem("'%s' isn't in the manifest", name)
+		}
+	}
+	return problems
+}
+
+// Notes are the notes in the export's Markdown files, going by their front matter
+// rather than the manifest, in the order they were created, for the given user. A
+// note without an ID in its front matter has the one in its file name. The files which
+// can't be read as notes are problems, which say why.
+func (e *Export) Notes(userID string) (notes []*model.Note, problems []string) {
+	for _, name := range e.noteFiles() {
+		frontMatter, text, err := UnmarshalMarkdown(e.Files[name])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("'%s': %s", name, err.Error()))
+			continue
+		}
+		note := &model.Note{
+			NoteID:     frontMatter.ID,
+			NoteUserID: userID,
+			Note:       text,
+			Version:    frontMatter.Version,
+		}
+		if note.NoteID == "" {
+			note.NoteID = strings.TrimSuffix(path.Base(name), ".md")
+		}
+		if !frontMatter.Created.IsZero() {
+			note.CreationTimestamp = frontMatter.Created.Unix()
+		}
+		if !frontMatter.Updated.IsZero() {
+			note.UpdateTimestamp = frontMatter.Updated.Unix()
+		}
+		notes = append(notes, note)
+	}
+
+	// Note IDs are KSUIDs, so they go in the order they were created too.
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].CreationTimestamp != notes[j].CreationTimestamp {
+			return notes[i].CreationTimestamp < notes[j].CreationTimestamp
+		}
+		return notes[i].NoteID < notes[j].NoteID
+	})
+	return notes, problems
+}
+
+// noteFiles are the names of the Markdown files in the notes directory, sorted.
+func (e *Export) noteFiles() []string {
+	var names []string
+	for name := range e.Files {
+		if path.Dir(name) == NotesDir && path.Ext(name) == ".md" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ErrNoUser is the error for reindexing an export which doesn't say whose it is.
+var ErrNoUser = errors.New("no user ID")
+
+// Reindex writes the export again, in the given format, with a manifest made from its
+// notes' files, for when its manifest is missing or wrong. The user is the manifest's,
+// unless userID is given. It returns the files which couldn't be read as notes, which
+// are left out.
+func (e *Export) Reindex(w io.Writer, format, userID string, exportedAt time.Time) (problems []string, err error) {
+	if userID == "" && e.Manifest != nil {
+		userID = e.Manifest.UserID
+	}
+	if userID == "" {
+		return nil, fmt.Errorf("%w: the manifest doesn't say whose export it is", ErrNoUser)
+	}
+
+	aw, err := NewWriter(w, format, userID, exportedAt)
+	if err != nil {
+		return nil, err
+	}
+	notes, problems := e.Notes(userID)
+	for _, note := range notes {
+		if err := aw.WriteNote(note); err != nil {
+			return nil, err
+		}
+	}
+	return problems, aw.Close()
+}
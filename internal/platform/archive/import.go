@@ -0,0 +1,403 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// The most items an import can have.
+	MaxItems = 10000
+
+	// The biggest a file in a zip can be, once it's uncompressed, other than an ENEX,
+	// which is read a note at a time. Anything bigger is a failed item. It's also the
+	// biggest an ENEX note's content can be.
+	MaxFileBytes = 8 << 20
+)
+
+// The most that all the files in a zip can add up to, once they're uncompressed, so
+// that a zip which is mostly compressed nothing (a zip bomb) can't take all the memory.
+// It's a var so that the tests can make it small.
+var maxTotalBytes int64 = 64 << 20
+
+// ErrBadArchive is the error for an import which can't be read, e.g. a corrupt zip.
+var ErrBadArchive = errors.New("unreadable import")
+
+// An Item is something in an import: a note to import, or something which can't be.
+type Item struct {
+	Name              string // Where it came from, e.g. "notes/shopping.md", or "Notebook.enex: Shopping".
+	Text              string
+	CreationTimestamp int64  // Unix timestamp. Zero when it isn't known.
+	UpdateTimestamp   int64  // Unix timestamp. Zero when it isn't known.
+	Skip              string // Why it isn't a note to import, if it isn't, e.g. it's a picture.
+	Err               error  // Why it can't be imported, if it can't, e.g. its front matter is garbled.
+}
+
+// ReadImport reads the items in an import, which is one of:
+//   - a zip of Markdown (.md or .markdown) and text (.txt) files, with or without
+//     front matter, such as an export, and of any of the others;
+//   - an Evernote export (ENEX);
+//   - a Google Keep note from Google Takeout (JSON), or a zip of a Takeout.
+//
+// Markdown front matter, ENEX and Keep notes can have a title, which becomes a
+// heading at the top of the note, and tags (or labels), which become #hashtags at
+// the end of it (see WithTags). Attachments and pictures aren't imported.
+//
+// A file in a zip which is bigger than maxFileBytes, uncompressed, is a failed item,
+// without reading any more of it. That can be the biggest a note can be, since no
+// bigger file can be imported anyway. Zero (or more than MaxFileBytes) means MaxFileBytes.
+func ReadImport(data []byte, maxFileBytes int64) ([]*Item, error) {
+	var items []*Item
+	var err error
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\uFEFF")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		if maxFileBytes <= 0 || maxFileBytes > MaxFileBytes {
+			maxFileBytes = MaxFileBytes
+		}
+		items, err = readZip(data, maxFileBytes)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		items, err = readENEX("import.enex", bytes.NewReader(data))
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		items = []*Item{readKeep("import.json", data)}
+	default:
+		err = fmt.Errorf("%w: expected a zip, an Evernote ENEX, or a Google Keep note", ErrUnknownFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > MaxItems {
+		return nil, fmt.Errorf("%w: it has %d items, which is more than the %d allowed", ErrBadArchive, len(items), MaxItems)
+	}
+	return items, nil
+}
+
+// readZip reads the items in each of the files in the zip, up to maxTotalBytes of them.
+func readZip(data []byte, maxFileBytes int64) ([]*Item, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadArchive, err.Error())
+	}
+
+	items := []*Item{}
+	left := maxTotalBytes
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		// Directories, an export's manifest, Keep's list of labels, and what operating
+		// systems leave lying around aren't even worth saying that they were skipped.
+		if f.FileInfo().IsDir() || f.Name == ManifestFile || strings.HasPrefix(base, ".") ||
+			strings.HasPrefix(f.Name, "__MACOSX/") || f.Name == "Takeout/Keep/Labels.txt" {
+			continue
+		}
+
+		ext := strings.ToLower(path.Ext(base))
+		if ext == ".enex" {
+			enexItems, err := readZipENEX(f, &left)
+			items = append(items, enexItems...)
+			if err != nil {
+				items = append(items, &Item{Name: f.Name, Err: err})
+			}
+		} else if ext != ".md" && ext != ".markdown" && ext != ".txt" && ext != ".json" {
+			items = append(items, &Item{Name: f.Name, Skip: "not a note: only .md, .markdown, .txt, .enex and .json files are imported"})
+		} else if content, err := readZipFile(f, maxFileBytes, &left); err != nil {
+			items = append(items, &Item{Name: f.Name, Err: err})
+		} else if ext == ".json" {
+			items = append(items, readKeep(f.Name, content))
+		} else {
+			items = append(items, readMarkdown(f.Name, content, f.Modified))
+		}
+
+		if left < 0 {
+			return nil, fmt.Errorf("%w: its files add up to more than the %d bytes allowed, uncompressed",
+				ErrBadArchive, maxTotalBytes)
+		}
+		if len(items) > MaxItems {
+			break // Which is too many.
+		}
+	}
+	return items, nil
+}
+
+// totalReader reads a file in a zip, counting down what's left of the total which
+// all the files can add up to, uncompressed. Once that goes below zero, reading
+// stops, with an error.
+type totalReader struct {
+	r    io.Reader
+	left *int64
+}
+
+var errTotalTooBig = errors.New("the files add up to too many bytes")
+
+func (tr totalReader) Read(p []byte) (int, error) {
+	// One byte more than is left, to tell whether there's more.
+	if int64(len(p)) > *tr.left+1 {
+		p = p[:max(*tr.left+1, 0)]
+	}
+	n, err := tr.r.Read(p)
+	*tr.left -= int64(n)
+	if *tr.left < 0 {
+		return n, errTotalTooBig
+	}
+	return n, err
+}
+
+func readZipFile(f *zip.File, maxFileBytes int64, left *int64) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// The size in the zip might be a lie, so it's only believed as far as the limit.
+	content, err := io.ReadAll(io.LimitReader(totalReader{r, left}, maxFileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxFileBytes {
+		return nil, fmt.Errorf("file is bigger than %d bytes", maxFileBytes)
+	}
+	return content, nil
+}
+
+func readZipENEX(f *zip.File, left *int64) ([]*Item, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readENEX(f.Name, totalReader{r, left})
+}
+
+// readMarkdown reads a Markdown or text file, whose timestamps are the ones in its
+// front matter, or else when the file was last modified.
+func readMarkdown(name string, content []byte, modified time.Time) *Item {
+	item := &Item{Name: name}
+	if !utf8.Valid(content) {
+		item.Err = errors.New("not UTF-8 text")
+		return item
+	}
+	frontMatter, text, err := UnmarshalMarkdown(content)
+	if err != nil {
+		item.Err = err
+		return item
+	}
+
+	item.Text = WithTags(withTitle(frontMatter.Title, text), frontMatter.Tags)
+	if !modified.IsZero() {
+		item.CreationTimestamp, item.UpdateTimestamp = modified.Unix(), modified.Unix()
+	}
+	if !frontMatter.Created.IsZero() {
+		item.CreationTimestamp = frontMatter.Created.Unix()
+	}
+	if !frontMatter.Updated.IsZero() {
+		item.UpdateTimestamp = frontMatter.Updated.Unix()
+	}
+	return item
+}
+
+// withTitle puts the title at the top of the text, as a heading, unless it's already there.
+func withTitle(title, text string) string {
+	title = strings.TrimSpace(title)
+	if title == "" || strings.HasPrefix(text, "# "+title) {
+		return text
+	}
+	if text = strings.TrimLeft(text, " \t\r\n"); text == "" {
+		return "# " + title
+	}
+	return "# " + title + "\n\n" + text
+}
+
+// A note in an ENEX. The rest of it, e.g. its attachments, is left out.
+type enexNote struct {
+	Title   string   `xml:"title"`
+	Content string   `xml:"content"` // ENML, which is XHTML with a few extras.
+	Created string   `xml:"created"`
+	Updated string   `xml:"updated"`
+	Tags    []string `xml:"tag"`
+}
+
+const enexTimeLayout = "20060102T150405Z"
+
+// readENEX reads the notes in an Evernote export. It's read a note at a time, and
+// the notes before anything which can't be read are still returned.
+func readENEX(name string, r io.Reader) ([]*Item, error) {
+	d := xml.NewDecoder(r)
+	items := []*Item{}
+	sawExport := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return items, fmt.Errorf("%w: not a readable ENEX: %s", ErrBadArchive, err.Error())
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !sawExport {
+			if start.Name.Local != "en-export" {
+				return items, fmt.Errorf("%w: expected an Evernote ENEX, but got <%s>", ErrUnknownFormat, start.Name.Local)
+			}
+			sawExport = true
+			continue
+		}
+		if start.Name.Local != "note" {
+			continue
+		}
+
+		var note enexNote
+		if err := d.DecodeElement(&note, &start); err != nil {
+			return items, fmt.Errorf("%w: not a readable ENEX: %s", ErrBadArchive, err.Error())
+		}
+		item := &Item{Name: fmt.Sprintf("%s: note %d", name, len(items)+1)}
+		if title := strings.TrimSpace(note.Title); title != "" {
+			item.Name = name + ": " + title
+		}
+		if len(note.Content) > MaxFileBytes {
+			item.Err = fmt.Errorf("the note's content is bigger than %d bytes", MaxFileBytes)
+		} else if text, err := enmlToText(note.Content); err != nil {
+			item.Err = fmt.Errorf("can't read the note's content: %w", err)
+		} else {
+			item.Text = WithTags(withTitle(note.Title, text), note.Tags)
+		}
+		if created, err := time.Parse(enexTimeLayout, note.Created); err == nil {
+			item.CreationTimestamp = created.Unix()
+		}
+		if updated, err := time.Parse(enexTimeLayout, note.Updated); err == nil {
+			item.UpdateTimestamp = updated.Unix()
+		}
+		items = append(items, item)
+
+		if len(items) > MaxItems {
+			break // Which is too many.
+		}
+	}
+	if !sawExport {
+		return items, fmt.Errorf("%w: expected an Evernote ENEX", ErrUnknownFormat)
+	}
+	return items, nil
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// enmlToText turns a note's ENML into the plain text it shows, with its checkboxes,
+// lists and headings in Markdown.
+func enmlToText(enml string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(enml))
+	// Evernote's HTML isn't always XHTML.
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var buf strings.Builder
+	newLine := func() {
+		if s := buf.String(); s != "" && !strings.HasSuffix(s, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			// The whitespace between the elements is only there to lay out the ENML.
+			if text := string(tok); strings.TrimSpace(text) != "" || !strings.Contains(text, "\n") {
+				buf.WriteString(text)
+			}
+		case xml.StartElement:
+			switch tag := strings.ToLower(tok.Name.Local); tag {
+			case "br":
+				buf.WriteString("\n")
+			case "li":
+				newLine()
+				buf.WriteString("- ")
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				newLine()
+				buf.WriteString(strings.Repeat("#", int(tag[1]-'0')) + " ")
+			case "en-todo":
+				checked := false
+				for _, attr := range tok.Attr {
+					checked = checked || (attr.Name.Local == "checked" && attr.Value == "true")
+				}
+				if checked {
+					buf.WriteString("[x] ")
+				} else {
+					buf.WriteString("[ ] ")
+				}
+			}
+		case xml.EndElement:
+			switch strings.ToLower(tok.Name.Local) {
+			case "div", "p", "li", "ul", "ol", "h1", "h2", "h3", "h4", "h5", "h6", "tr", "blockquote", "pre", "table":
+				newLine()
+			}
+		}
+	}
+	return blankLines.ReplaceAllString(strings.TrimSpace(buf.String()), "\n\n"), nil
+}
+
+// A Google Keep note, as in a Google Takeout.
+type keepNote struct {
+	Title       string `json:"title"`
+	TextContent string `json:"textContent"`
+	ListContent []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	CreatedTimestampUsec    int64 `json:"createdTimestampUsec"`
+	UserEditedTimestampUsec int64 `json:"userEditedTimestampUsec"`
+	IsTrashed               bool  `json:"isTrashed"`
+}
+
+// readKeep reads a Google Keep note. A checklist becomes a Markdown task list.
+func readKeep(name string, content []byte) *Item {
+	item := &Item{Name: name}
+	var note keepNote
+	if err := json.Unmarshal(content, &note); err != nil {
+		item.Err = fmt.Errorf("not a Google Keep note: %w", err)
+		return item
+	}
+	if note.CreatedTimestampUsec == 0 && note.UserEditedTimestampUsec == 0 {
+		item.Err = errors.New("not a Google Keep note: it has no timestamps")
+		return item
+	}
+	if note.IsTrashed {
+		item.Skip = "in the trash"
+		return item
+	}
+
+	text := note.TextContent
+	for _, listItem := range note.ListContent {
+		if listItem.IsChecked {
+			text += "- [x] " + listItem.Text + "\n"
+		} else {
+			text += "- [ ] " + listItem.Text + "\n"
+		}
+	}
+	var labels []string
+	for _, label := range note.Labels {
+		labels = append(labels, label.Name)
+	}
+	item.Text = WithTags(withTitle(note.Title, strings.TrimRight(text, "\n")), labels)
+	item.CreationTimestamp = note.CreatedTimestampUsec / 1e6
+	item.UpdateTimestamp = note.UserEditedTimestampUsec / 1e6
+	return item
+}
@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"notably/internal/model"
+)
+
+// FrontMatter is what's said about a note at the top of its Markdown file, as YAML
+// between "---" lines.
+type FrontMatter struct {
+	ID      string    `yaml:"id,omitempty"`
+	Title   string    `yaml:"title,omitempty"` // Notes don't have one, but other apps' files might.
+	Created time.Time `yaml:"created,omitempty"`
+	Updated time.Time `yaml:"updated,omitempty"`
+	Version int64     `yaml:"version,omitempty"`
+	Tags    []string  `yaml:"tags"`
+}
+
+const frontMatterDelimiter = "---\n"
+
+// A tag is a '#' at the start of a word, followed by letters, digits, '_', '-' or '/'.
+// A Markdown heading has a space after its '#'s, so it isn't one.
+var tagPattern = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_][\p{L}\p{N}_/-]*)`)
+
+// Tags are the note text's #hashtags, without the '#', in the order they first
+// appear. Notes don't have tags of their own, so these are them. The same tag in a
+// different case is the same tag, and one of only digits (e.g. "#1") isn't one.
+func Tags(text string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, match := range tagPattern.FindAllStringSubmatch(text, -1) {
+		tag := strings.TrimRight(match[1], "-/")
+		if strings.Trim(tag, "0123456789") == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// MarshalMarkdown is the Markdown file of a note: its front matter, followed by its
+// text, as it is.
+func MarshalMarkdown(note *model.Note) ([]byte, error) {
+	frontMatter, err := yaml.Marshal(FrontMatter{
+		ID:      note.NoteID,
+		Created: time.Unix(note.CreationTimestamp, 0).UTC(),
+		Updated: time.Unix(note.UpdateTimestamp, 0).UTC(),
+		Version: note.Version,
+		Tags:    Tags(note.Note),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't write front matter of note '%s': %w", note.NoteID, err)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(2*len(frontMatterDelimiter) + len(frontMatter) + len(note.Note))
+	buf.WriteString(frontMatterDelimiter)
+	buf.Write(frontMatter)
+	buf.WriteString(frontMatterDelimiter)
+	buf.WriteString(note.Note)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalMarkdown splits a Markdown file into its front matter, if it has any,
+// and its text. A file which doesn't start with a "---" line, or has no "---" line
+// to end the front matter, has none, and is all text.
+func UnmarshalMarkdown(data []byte) (*FrontMatter, string, error) {
+	text := strings.TrimPrefix(string(data), "\uFEFF") // Some editors start with a byte order mark.
+	firstLine, rest, ok := strings.Cut(text, "\n")
+	if !ok || strings.TrimRight(firstLine, " \t\r") != "---" {
+		return &FrontMatter{}, text, nil
+	}
+
+	// The front matter goes up to the next "---" line.
+	var yamlText strings.Builder
+	for rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		if strings.TrimRight(line, " \t\r") == "---" {
+			var frontMatter FrontMatter
+			if err := yaml.Unmarshal([]byte(yamlText.String()), &frontMatter); err != nil {
+				return nil, "", fmt.Errorf("can't read front matter: %w", err)
+			}
+			return &frontMatter, rest, nil
+		}
+		yamlText.WriteString(line + "\n")
+	}
+	return &FrontMatter{}, text, nil
+}
+
+// WithTags adds the tags which aren't already among the text's #hashtags (see Tags)
+// to the end of it, as #hashtags. What can't be in a hashtag, e.g. a space, becomes
+// a '-'.
+func WithTags(text string, tags []string) string {
+	have := map[string]bool{}
+	for _, tag := range Tags(text) {
+		have[strings.ToLower(tag)] = true
+	}
+	var hashtags []string
+	for _, tag := range tags {
+		tag = strings.Trim(tagJunk.ReplaceAllString(strings.TrimLeft(tag, "#"), "-"), "-/")
+		if tag == "" || strings.Trim(tag, "0123456789") == "" || have[strings.ToLower(tag)] {
+			continue
+		}
+		have[strings.ToLower(tag)] = true
+		hashtags = append(hashtags, "#"+tag)
+	}
+	if len(hashtags) == 0 {
+		return text
+	}
+	if text = strings.TrimRight(text, " \t\r\n"); text != "" {
+		text += "\n\n"
+	}
+	return text + strings.Join(hashtags, " ")
+}
+
+// What can't be in a tag.
+var tagJunk = regexp.MustCompile(`[^\p{L}\p{N}_/-]+`)
@@ -0,0 +1,487 @@
+// Package collab is real-time collaborative editing of notes. Everybody editing a
+// note is in the note's room, which has the one true copy of the text while they
+// are. Clients send the room their edits as operations (see Operation) on the
+// revision of the text they had, which the room transforms against the edits they
+// hadn't seen yet, applies, and passes on to everybody else. This is the usual
+// client-server operational transformation, as in ot.js, whose client works with it.
+//
+// The room saves the text to the store every so often, and when the last client
+// leaves. Edits made to the note some other way meanwhile (e.g. through the REST
+// APIs) are merged in, as if they were a client's edits made on the text last saved.
+package collab
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+	ourutils "notably/internal/utils"
+)
+
+// The types of Message. Clients send MessageOp and MessageCursor, and get the rest.
+const (
+	MessageInit   = "init"   // The room as it is, to a client which has just joined.
+	MessageOp     = "op"     // An edit of the text.
+	MessageAck    = "ack"    // The client's edit has been applied, as the given revision.
+	MessageCursor = "cursor" // Where a client's cursor is.
+	MessageJoin   = "join"   // A client has joined.
+	MessageLeave  = "leave"  // A client has left.
+	MessageSaved  = "saved"  // The text as of the given revision has been saved.
+	MessageError  = "error"  // Something went wrong. See the Error codes.
+)
+
+// The codes of MessageError.
+const (
+	ErrorBadMessage    = "bad_message"    // The client sent something which isn't a message it can send.
+	ErrorInvalidOp     = "invalid_op"     // The edit doesn't fit the text.
+	ErrorStaleRevision = "stale_revision" // The edit is on a revision the room no longer has. Join again.
+	ErrorSaveFailed    = "save_failed"    // The text couldn't be saved, e.g. it's over the quota.
+	ErrorNoteDeleted   = "note_deleted"   // The note has been deleted, and the room is closed.
+)
+
+const (
+	// The default for how often a room saves its text.
+	DefaultSaveInterval = 5 * time.Second
+
+	// How many times a save goes round again, when the note is changed some other way
+	// between the room reading it and writing it, before leaving it for the next save.
+	maxSaveAttempts = 3
+
+	// The most edits a room remembers, to transform late edits against. An edit on an
+	// older revision can't be applied.
+	maxHistory = 1000
+
+	// How many messages a client can fall behind on, before it's dropped from the room.
+	sendBuffer = 256
+)
+
+// Cursor is where a client's cursor, or selection, is in the text.
+type Cursor struct {
+	Anchor int `json:"anchor"` // Where the selection starts.
+	Head   int `json:"head"`   // Where the cursor is. The same as Anchor if nothing is selected.
+}
+
+// transform moves the cursor to where it is after the operation.
+func (c *Cursor) transform(op Operation) {
+	c.Anchor, c.Head = op.TransformIndex(c.Anchor), op.TransformIndex(c.Head)
+}
+
+// Presence is a client in the room.
+type Presence struct {
+	ClientID string  `json:"client_id"`
+	UserID   string  `json:"user_id"`
+	Cursor   *Cursor `json:"cursor,omitempty"` // Nil until the client says.
+}
+
+// Message is what clients and rooms send each other, as JSON. Which fields there are
+// depends on the Type.
+type Message struct {
+	Type     string     `json:"type"`
+	Revision int        `json:"revision"`            // Of the text which the message is about.
+	ClientID string     `json:"client_id,omitempty"` // Who it's about. Empty in an op means not a client.
+	Op       Operation  `json:"op,omitempty"`
+	Cursor   *Cursor    `json:"cursor,omitempty"`
+	Text     *string    `json:"text,omitempty"`    // For MessageInit.
+	Clients  []Presence `json:"clients,omitempty"` // For MessageInit and MessageJoin. Includes the client itself.
+	Code     string     `json:"code,omitempty"`    // For MessageError.
+	Detail   string     `json:"detail,omitempty"`  // For MessageError.
+}
+
+// Store is where the notes are kept, e.g. a persistence.NotablyDB.
+type Store interface {
+	GetNoteForUser(userID, noteID string) (*model.Note, error)
+	// UpdateNoteVersionForUser only updates the note if it's still the given version,
+	// and is persistence.ErrNoteChanged otherwise.
+	UpdateNoteVersionForUser(userID, noteID, noteText string, version int64) (*model.Note, error)
+}
+
+// Hub has the rooms of the notes being edited. It is safe for concurrent use.
+type Hub struct {
+	store        Store
+	saveInterval time.Duration
+
+	mu    sync.Mutex
+	rooms map[string]*room // By note ID.
+}
+
+// NewHub returns a Hub whose rooms save to the store every saveInterval (<= 0 means
+// DefaultSaveInterval).
+func NewHub(store Store, saveInterval time.Duration) *Hub {
+	if saveInterval <= 0 {
+		saveInterval = DefaultSaveInterval
+	}
+	return &Hub{store: store, saveInterval: saveInterval, rooms: make(map[string]*room)}
+}
+
+// Rooms is how many notes are being edited.
+func (h *Hub) Rooms() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms)
+}
+
+// Join adds a client for the user to the note's room, opening the room with the note's
+// text if nobody is editing it yet. Whether the user may edit the note is up to the caller.
+// The client's first message is a MessageInit, and it must Leave() when it's done.
+func (h *Hub) Join(note *model.Note, userID string) (*Client, error) {
+	clientID, err := ourutils.GenerateKsuidAsString()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating client ID: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.rooms[note.NoteID]
+	if r == nil {
+		r = &room{
+			hub:       h,
+			noteID:    note.NoteID,
+			ownerID:   note.NoteUserID,
+			text:      note.Note,
+			savedText: note.Note,
+			clients:   make(map[string]*Client),
+			stop:      make(chan struct{}),
+		}
+		h.rooms[note.NoteID] = r
+		go r.saveEvery(h.saveInterval)
+		slog.Debug("Opened collab room", "note_id", note.NoteID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := &Client{ID: clientID, UserID: userID, room: r, send: make(chan Message, sendBuffer)}
+	r.clients[c.ID] = c
+	text := r.text
+	c.send <- Message{Type: MessageInit, Revision: r.revision, ClientID: c.ID, Text: &text, Clients: r.presenceLocked()}
+	r.broadcastLocked(Message{Type: MessageJoin, Revision: r.revision, ClientID: c.ID,
+		Clients: []Presence{c.presence()}}, c)
+	return c, nil
+}
+
+// Client is somebody editing a note, on one device.
+type Client struct {
+	ID     string
+	UserID string
+
+	room   *room
+	send   chan Message
+	cursor *Cursor // Guarded by room.mu.
+	gone   bool    // Guarded by room.mu. Whether send has been closed.
+}
+
+// Messages is what the room sends the client, in order. It's closed when the client
+// has left, or has been dropped because it fell too far behind, or the room has closed.
+func (c *Client) Messages() <-chan Message {
+	return c.send
+}
+
+// Receive handles a message from the client. Anything wrong with it is sent back as a
+// MessageError.
+func (c *Client) Receive(msg Message) {
+	r := c.room
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.gone {
+		return
+	}
+
+	switch msg.Type {
+	case MessageOp:
+		r.applyLocked(c, msg.Revision, msg.Op)
+	case MessageCursor:
+		if msg.Cursor == nil {
+			c.errorLocked(ErrorBadMessage, "A cursor message needs a cursor")
+			return
+		}
+		cursor := *msg.Cursor
+		ops, ok := r.sinceLocked(msg.Revision)
+		if !ok {
+			c.errorLocked(ErrorStaleRevision, fmt.Sprintf("Revision %d is not one the room has", msg.Revision))
+			return
+		}
+		for _, op := range ops {
+			cursor.transform(op)
+		}
+		c.cursor = &cursor
+		r.broadcastLocked(Message{Type: MessageCursor, Revision: r.revision, ClientID: c.ID, Cursor: c.presence().Cursor}, c)
+	default:
+		c.errorLocked(ErrorBadMessage, fmt.Sprintf("Clients can't send '%s' messages", msg.Type))
+	}
+}
+
+// Reject tells the client that it has sent something which isn't a message at all.
+func (c *Client) Reject(detail string) {
+	c.room.mu.Lock()
+	defer c.room.mu.Unlock()
+	c.errorLocked(ErrorBadMessage, detail)
+}
+
+// Leave takes the client out of the room. The last client out closes the room,
+// saving the text.
+func (c *Client) Leave() {
+	r := c.room
+	h := r.hub
+	h.mu.Lock()
+	r.mu.Lock()
+	r.removeLocked(c)
+	last := len(r.clients) == 0 && !r.closed
+	if last {
+		r.closed = true
+		delete(h.rooms, r.noteID)
+		close(r.stop)
+	}
+	r.mu.Unlock()
+	h.mu.Unlock()
+
+	if last {
+		r.save()
+		slog.Debug("Closed collab room", "note_id", r.noteID)
+	}
+}
+
+// presence is the client in the room. The cursor is a copy, since the room moves
+// the client's cursor along with the edits, and messages are sent unlocked.
+func (c *Client) presence() Presence {
+	presence := Presence{ClientID: c.ID, UserID: c.UserID}
+	if c.cursor != nil {
+		cursor := *c.cursor
+		presence.Cursor = &cursor
+	}
+	return presence
+}
+
+// errorLocked sends the client an error.
+func (c *Client) errorLocked(code, detail string) {
+	c.room.sendLocked(c, Message{Type: MessageError, Revision: c.room.revision, Code: code, Detail: detail})
+}
+
+// room is a note being edited.
+type room struct {
+	hub     *Hub
+	noteID  string
+	ownerID string // Who the note belongs to, and is saved for.
+
+	mu            sync.Mutex
+	text          string
+	revision      int         // How many edits have been applied to the text since the room opened.
+	history       []Operation // The last edits, the first of which took the text from historyStart.
+	historyStart  int
+	savedText     string // What's in the store, as far as we know.
+	savedRevision int    // Of the text, when it was last saved.
+	lastSaveError string // So that clients are only told once.
+	clients       map[string]*Client
+	closed        bool
+
+	saveMu sync.Mutex    // One save at a time.
+	stop   chan struct{} // Closed when the room is.
+}
+
+// sinceLocked gets the edits since the revision, if the room still has them.
+func (r *room) sinceLocked(revision int) ([]Operation, bool) {
+	if revision < r.historyStart || revision > r.revision {
+		return nil, false
+	}
+	return r.history[revision-r.historyStart:], true
+}
+
+// applyLocked applies an edit on the given revision from the client, which is nil
+// for edits made some other way.
+func (r *room) applyLocked(from *Client, revision int, op Operation) {
+	past, ok := r.sinceLocked(revision)
+	if !ok {
+		if from != nil {
+			from.errorLocked(ErrorStaleRevision, fmt.Sprintf("Revision %d is not one the room has", revision))
+		} else {
+			slog.Warn("Can't merge edit into collab room", "note_id", r.noteID, "revision", revision,
+				"error", "the room no longer has the revision")
+		}
+		return
+	}
+
+	var err error
+	for _, p := range past {
+		if op, _, err = Transform(op, p); err != nil {
+			break
+		}
+	}
+	var text string
+	if err == nil {
+		text, err = op.Apply(r.text)
+	}
+	if err != nil {
+		if from != nil {
+			from.errorLocked(ErrorInvalidOp, err.Error())
+		} else {
+			slog.Warn("Can't merge edit into collab room", "note_id", r.noteID, "revision", revision,
+				"error", err.Error())
+		}
+		return
+	}
+
+	r.text = text
+	r.revision++
+	r.history = append(r.history, op)
+	// Only the edits which haven't been saved are needed for merging other edits in,
+	// so those are always kept.
+	if drop := min(len(r.history)-maxHistory, r.savedRevision-r.historyStart); drop > 0 {
+		r.history = append([]Operation(nil), r.history[drop:]...)
+		r.historyStart += drop
+	}
+	for _, c := range r.clients {
+		if c.cursor != nil {
+			c.cursor.transform(op)
+		}
+	}
+
+	fromID := ""
+	if from != nil {
+		fromID = from.ID
+		r.sendLocked(from, Message{Type: MessageAck, Revision: r.revision})
+	}
+	r.broadcastLocked(Message{Type: MessageOp, Revision: r.revision, ClientID: fromID, Op: op}, from)
+}
+
+// presenceLocked is who's in the room.
+func (r *room) presenceLocked() []Presence {
+	presence := make([]Presence, 0, len(r.clients))
+	for _, c := range r.clients {
+		presence = append(presence, c.presence())
+	}
+	return presence
+}
+
+// sendLocked sends a client a message, dropping the client if it has fallen too far
+// behind to take it.
+func (r *room) sendLocked(c *Client, msg Message) {
+	if c.gone {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		slog.Warn("Dropping collab client which has fallen behind", "note_id", r.noteID, "client_id", c.ID)
+		r.removeLocked(c)
+	}
+}
+
+// broadcastLocked sends the message to every client but one (which can be nil).
+func (r *room) broadcastLocked(msg Message, except *Client) {
+	for _, c := range r.clients {
+		if c != except {
+			r.sendLocked(c, msg)
+		}
+	}
+}
+
+// removeLocked takes the client out of the room, telling everybody else.
+func (r *room) removeLocked(c *Client) {
+	if c.gone {
+		return
+	}
+	c.gone = true
+	close(c.send)
+	delete(r.clients, c.ID)
+	r.broadcastLocked(Message{Type: MessageLeave, Revision: r.revision, ClientID: c.ID}, nil)
+}
+
+// saveEvery saves the text every interval, until the room closes.
+func (r *room) saveEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.save()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// save merges in any edits made to the note in the store, and then saves the text,
+// if it has changed. The text is only saved over the note it was merged with, so if
+// the note changes again meanwhile, that's merged in too, and it goes round again.
+func (r *room) save() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		err := r.saveOnce()
+		if errors.Is(err, persistence.ErrNoteChanged) && attempt < maxSaveAttempts {
+			slog.Debug("Note changed outside the collab room while saving, going again", "note_id", r.noteID)
+			continue
+		}
+		if err != nil {
+			r.saveFailed(err)
+		}
+		return
+	}
+}
+
+func (r *room) saveOnce() error {
+	// The store isn't used with the room locked, so that editing carries on meanwhile.
+	stored, err := r.hub.store.GetNoteForUser(r.ownerID, r.noteID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if stored.Note != r.savedText {
+		// Edited some other way, as of the last save.
+		slog.Debug("Merging note edited outside the collab room", "note_id", r.noteID)
+		r.applyLocked(nil, r.savedRevision, Diff(r.savedText, stored.Note))
+		r.savedText = stored.Note
+	}
+	if r.text == r.savedText {
+		r.savedRevision = r.revision
+		r.mu.Unlock()
+		return nil
+	}
+	text, revision := r.text, r.revision
+	r.mu.Unlock()
+
+	if _, err := r.hub.store.UpdateNoteVersionForUser(r.ownerID, r.noteID, text, stored.Version); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.savedText, r.savedRevision, r.lastSaveError = text, revision, ""
+	r.broadcastLocked(Message{Type: MessageSaved, Revision: revision}, nil)
+	return nil
+}
+
+// saveFailed tells the clients that the text couldn't be saved, unless it's the
+// same as last time. A note which has been deleted closes the room.
+func (r *room) saveFailed(err error) {
+	if errors.Is(err, persistence.ErrNoteNotFound) {
+		r.hub.mu.Lock()
+		defer r.hub.mu.Unlock()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		slog.Info("Closing collab room for deleted note", "note_id", r.noteID)
+		for _, c := range r.clients {
+			c.errorLocked(ErrorNoteDeleted, "The note has been deleted")
+			r.removeLocked(c)
+		}
+		if !r.closed {
+			r.closed = true
+			delete(r.hub.rooms, r.noteID)
+			close(r.stop)
+		}
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err.Error() == r.lastSaveError {
+		return
+	}
+	slog.Warn("Can't save note being edited together", "note_id", r.noteID, "error", err.Error())
+	r.lastSaveError = err.Error()
+	r.broadcastLocked(Message{Type: MessageError, Revision: r.revision, Code: ErrorSaveFailed, Detail: err.Error()}, nil)
+}
@@ -0,0 +1,360 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestOperations(t *testing.T) {
+	fmt.Println("TEST COLLAB: Operations are built normalized")
+	var op Operation
+	op = op.Retain(2).Retain(3).Delete(1).Insert("ab").Insert("c").Delete(2).Retain(1)
+	want := Operation{{Retain: 5}, {Insert: "abc"}, {Delete: 3}, {Retain: 1}}
+	if fmt.Sprint(op) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v, but got %v", want, op)
+	}
+	if op.BaseLen() != 9 || op.TargetLen() != 9 {
+		t.Fatalf("Expected lengths of 9 and 9, but got %d and %d", op.BaseLen(), op.TargetLen())
+	}
+
+	fmt.Println("TEST COLLAB: Operations apply to text of the right length, counting code points")
+	text, err := op.Apply("Héllo, wörld")
+	if err == nil {
+		t.Fatalf("Expected an error applying to text of the wrong length, but got %q", text)
+	}
+	text, err = op.Apply("Héllo wörd")
+	if err == nil {
+		t.Fatalf("Expected an error applying to text of the wrong length, but got %q", text)
+	}
+	if text, err = op.Apply("Héllo wöd"); err != nil || text != "Hélloabcd" {
+		t.Fatalf("Expected 'Hélloabcd', but got %q, %v", text, err)
+	}
+
+	fmt.Println("TEST COLLAB: Operations are JSON in the ot.js form")
+	data, err := json.Marshal(op)
+	if err != nil || string(data) != `[5,"abc",-3,1]` {
+		t.Fatalf("Expected [5,\"abc\",-3,1], but got %s, %v", data, err)
+	}
+	var parsed Operation
+	if err := json.Unmarshal([]byte(`[2,3,-1,"ab",-2,"c",1]`), &parsed); err != nil || fmt.Sprint(parsed) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v, but got %v, %v", want, parsed, err)
+	}
+	for _, bad := range []string{`[0]`, `[""]`, `[1.5]`, `[true]`, `{}`,
+		// Lengths which would add up to more than there is room for, and overflow.
+		`[9223372036854775807,"x",9223372036854775807,"y",2]`, `[-9223372036854775807,-9223372036854775807,2]`,
+		`[-9223372036854775808]`, `[4611686018427387903,"x"]`} {
+		if err := json.Unmarshal([]byte(bad), &parsed); err == nil {
+			t.Fatalf("Expected an error unmarshaling %s, but got %v", bad, parsed)
+		}
+	}
+
+	fmt.Println("TEST COLLAB: An operation which goes past the end of the text is an error, not a panic")
+	overflowing := Operation{}.Retain(math.MaxInt).Insert("x").Retain(math.MaxInt).Insert("y").Retain(2)
+	if _, err := overflowing.Apply(""); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("Expected an invalid operation error, but got %v", err)
+	}
+
+	fmt.Println("TEST COLLAB: Diff makes one text into the other")
+	for _, texts := range [][2]string{{"", "new"}, {"old", ""}, {"same", "same"}, {"The cat sat", "The dog sat"}, {"aaa", "aaaa"}} {
+		op := Diff(texts[0], texts[1])
+		if text, err := op.Apply(texts[0]); err != nil || text != texts[1] {
+			t.Fatalf("Expected %v to make %q from %q, but got %q, %v", op, texts[1], texts[0], text, err)
+		}
+	}
+
+	fmt.Println("TEST COLLAB: Positions move with the edits before them")
+	op = Operation{}.Retain(2).Insert("xx").Retain(2).Delete(3).Retain(1)
+	for index, want := range map[int]int{0: 0, 2: 4, 3: 5, 4: 6, 5: 6, 7: 6, 8: 7} {
+		if got := op.TransformIndex(index); got != want {
+			t.Fatalf("Expected %d to move to %d, but got %d", index, want, got)
+		}
+	}
+}
+
+// randomOp makes a random edit of text of the given length.
+func randomOp(rnd *rand.Rand, length int) Operation {
+	var op Operation
+	for left := length; left > 0; {
+		n := 1 + rnd.Intn(left)
+		switch rnd.Intn(3) {
+		case 0:
+			op = op.Retain(n)
+		case 1:
+			op = op.Delete(n)
+		case 2:
+			op = op.Insert(string(rune('a' + rnd.Intn(26))))
+			continue
+		}
+		left -= n
+	}
+	if rnd.Intn(2) == 0 {
+		op = op.Insert("z")
+	}
+	return op
+}
+
+func TestTransform(t *testing.T) {
+	fmt.Println("TEST COLLAB: Inserts at the same place put the first operation's first")
+	a := Operation{}.Retain(1).Insert("A").Retain(1)
+	b := Operation{}.Retain(1).Insert("B").Retain(1)
+	a1, b1, err := Transform(a, b)
+	if err != nil {
+		t.Fatalf("Failed transforming: %v", err)
+	}
+	afterA, _ := a.Apply("xy")
+	afterB, _ := b.Apply("xy")
+	ab, _ := b1.Apply(afterA)
+	ba, _ := a1.Apply(afterB)
+	if ab != "xABy" || ba != "xABy" {
+		t.Fatalf("Expected both orders to make 'xABy', but got %q and %q", ab, ba)
+	}
+
+	fmt.Println("TEST COLLAB: Operations of different lengths can't be transformed")
+	if _, _, err := Transform(Operation{}.Retain(1), Operation{}.Retain(2)); err == nil {
+		t.Fatalf("Expected an error transforming operations of different lengths")
+	}
+
+	fmt.Println("TEST COLLAB: Random concurrent edits converge")
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 1000; i++ {
+		text := "The quick brown fox"[:rnd.Intn(20)]
+		a, b := randomOp(rnd, len(text)), randomOp(rnd, len(text))
+		a1, b1, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("Failed transforming %v and %v: %v", a, b, err)
+		}
+		afterA, _ := a.Apply(text)
+		afterB, _ := b.Apply(text)
+		ab, err1 := b1.Apply(afterA)
+		ba, err2 := a1.Apply(afterB)
+		if err1 != nil || err2 != nil || ab != ba {
+			t.Fatalf("Expected %v and %v on %q to converge, but got %q (%v) and %q (%v)", a, b, text, ab, err1, ba, err2)
+		}
+	}
+}
+
+// memoryStore is a Store of one user's notes, whose versions go up with every change,
+// of any note, like a change journal's sequence numbers.
+type memoryStore struct {
+	mu       sync.Mutex
+	notes    map[string]string
+	versions map[string]int64
+	seq      int64
+	saves    int
+
+	// Called just before an update, with the store locked, to change things under the room's feet.
+	beforeUpdate func()
+}
+
+func (ms *memoryStore) GetNoteForUser(userID, noteID string) (*model.Note, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	text, ok := ms.notes[noteID]
+	if !ok {
+		return nil, persistence.ErrNoteNotFound
+	}
+	return &model.Note{NoteID: noteID, NoteUserID: userID, Note: text, Version: ms.versions[noteID]}, nil
+}
+
+func (ms *memoryStore) UpdateNoteVersionForUser(userID, noteID, noteText string, version int64) (*model.Note, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.beforeUpdate != nil {
+		ms.beforeUpdate()
+	}
+	if _, ok := ms.notes[noteID]; !ok {
+		return nil, persistence.ErrNoteNotFound
+	}
+	if ms.versions[noteID] != version {
+		return nil, persistence.ErrNoteChanged
+	}
+	ms.setTextLocked(noteID, noteText)
+	ms.saves++
+	return &model.Note{NoteID: noteID, NoteUserID: userID, Note: noteText, Version: ms.versions[noteID]}, nil
+}
+
+func (ms *memoryStore) text(noteID string) string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.notes[noteID]
+}
+
+func (ms *memoryStore) setText(noteID, text string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.setTextLocked(noteID, text)
+}
+
+func (ms *memoryStore) setTextLocked(noteID, text string) {
+	if ms.versions == nil {
+		ms.versions = make(map[string]int64)
+	}
+	ms.seq++
+	ms.notes[noteID], ms.versions[noteID] = text, ms.seq
+}
+
+func TestRoom(t *testing.T) {
+	const userID, noteID = "collab@testdomain.xyz", "note1"
+	store := &memoryStore{notes: map[string]string{noteID: "Hello"}}
+	hub := NewHub(store, time.Hour) // Saved by hand.
+	note := &model.Note{NoteID: noteID, NoteUserID: userID, Note: "Hello"}
+
+	// next gets the client's next message, which has to be of the given type.
+	next := func(c *Client, wantType string) Message {
+		select {
+		case msg, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("Expected a %s message, but the client has been closed", wantType)
+			}
+			if msg.Type != wantType {
+				t.Fatalf("Expected a %s message, but got %+v", wantType, msg)
+			}
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a %s message", wantType)
+		}
+		return Message{}
+	}
+	join := func() (*Client, Message) {
+		c, err := hub.Join(note, userID)
+		if err != nil {
+			t.Fatalf("Failed joining: %v", err)
+		}
+		return c, next(c, MessageInit)
+	}
+
+	fmt.Println("TEST COLLAB: The first client opens the room with the note's text")
+	alice, init := join()
+	if *init.Text != "Hello" || init.Revision != 0 || len(init.Clients) != 1 || hub.Rooms() != 1 {
+		t.Fatalf("Expected the note's text at revision 0 with one client, but got %+v", init)
+	}
+	bob, _ := join()
+	if joined := next(alice, MessageJoin); joined.ClientID != bob.ID {
+		t.Fatalf("Expected to be told Bob joined, but got %+v", joined)
+	}
+
+	fmt.Println("TEST COLLAB: Concurrent edits are transformed and converge")
+	alice.Receive(Message{Type: MessageOp, Revision: 0, Op: Operation{}.Retain(5).Insert(", world")})
+	bob.Receive(Message{Type: MessageOp, Revision: 0, Op: Operation{}.Insert("Oh! ").Retain(5)})
+	next(alice, MessageAck)
+	if op := next(bob, MessageOp); op.ClientID != alice.ID || op.Revision != 1 {
+		t.Fatalf("Expected Alice's edit as revision 1, but got %+v", op)
+	}
+	if ack := next(bob, MessageAck); ack.Revision != 2 {
+		t.Fatalf("Expected Bob's edit to be revision 2, but got %+v", ack)
+	}
+	bobsOp := next(alice, MessageOp)
+	if fmt.Sprint(bobsOp.Op) != fmt.Sprint(Operation{}.Insert("Oh! ").Retain(12)) {
+		t.Fatalf("Expected Bob's edit transformed against Alice's, but got %v", bobsOp.Op)
+	}
+
+	fmt.Println("TEST COLLAB: Cursors move with the edits, and late joiners get everything as it is")
+	alice.Receive(Message{Type: MessageCursor, Revision: 1, Cursor: &Cursor{Anchor: 5, Head: 5}})
+	if cursor := next(bob, MessageCursor); cursor.Cursor.Head != 9 {
+		t.Fatalf("Expected Alice's cursor after Bob's insert, at 9, but got %+v", cursor.Cursor)
+	}
+	carol, init := join()
+	if *init.Text != "Oh! Hello, world" || init.Revision != 2 || len(init.Clients) != 3 {
+		t.Fatalf("Expected the merged text at revision 2 with three clients, but got %+v", init)
+	}
+	for _, p := range init.Clients {
+		if p.ClientID == alice.ID && (p.Cursor == nil || p.Cursor.Head != 9) {
+			t.Fatalf("Expected Alice's cursor at 9, but got %+v", p)
+		}
+	}
+	next(alice, MessageJoin)
+	next(bob, MessageJoin)
+
+	fmt.Println("TEST COLLAB: Bad edits are the sender's problem only")
+	carol.Receive(Message{Type: MessageOp, Revision: 2, Op: Operation{}.Retain(99)})
+	if e := next(carol, MessageError); e.Code != ErrorInvalidOp {
+		t.Fatalf("Expected an invalid op error, but got %+v", e)
+	}
+	carol.Receive(Message{Type: MessageOp, Revision: 3, Op: Operation{}.Retain(16)})
+	if e := next(carol, MessageError); e.Code != ErrorStaleRevision {
+		t.Fatalf("Expected a stale revision error, but got %+v", e)
+	}
+	carol.Receive(Message{Type: MessageSaved})
+	if e := next(carol, MessageError); e.Code != ErrorBadMessage {
+		t.Fatalf("Expected a bad message error, but got %+v", e)
+	}
+	carol.Leave()
+	next(alice, MessageLeave)
+	next(bob, MessageLeave)
+
+	fmt.Println("TEST COLLAB: Saving merges in edits made meanwhile, and saves the merged text")
+	store.setText(noteID, "Well, Hello")
+	alice.Receive(Message{Type: MessageOp, Revision: 2, Op: Operation{}.Delete(4).Retain(12).Insert(" :)")})
+	next(alice, MessageAck)
+	next(bob, MessageOp)
+	hub.rooms[noteID].save()
+	merged := next(bob, MessageOp)
+	if merged.ClientID != "" || merged.Revision != 4 {
+		t.Fatalf("Expected the outside edit as revision 4, but got %+v", merged)
+	}
+	if saved := next(bob, MessageSaved); saved.Revision != 4 || store.text(noteID) != "Well, Hello, world :)" {
+		t.Fatalf("Expected 'Well, Hello, world :)' saved as of revision 4, but got %+v and %q", saved, store.text(noteID))
+	}
+	next(alice, MessageOp)
+	next(alice, MessageSaved)
+	saves := store.saves
+	hub.rooms[noteID].save()
+	if store.saves != saves {
+		t.Fatalf("Expected no save with nothing changed")
+	}
+
+	fmt.Println("TEST COLLAB: A note changed between the room reading it and saving it isn't saved over")
+	store.beforeUpdate = func() {
+		store.beforeUpdate = nil
+		store.setTextLocked(noteID, "Well, Hello, world :) PS")
+	}
+	alice.Receive(Message{Type: MessageOp, Revision: 4, Op: Operation{}.Retain(21).Insert("?")})
+	next(alice, MessageAck)
+	next(bob, MessageOp)
+	hub.rooms[noteID].save()
+	if merged := next(bob, MessageOp); merged.ClientID != "" || merged.Revision != 6 {
+		t.Fatalf("Expected the edit made while saving as revision 6, but got %+v", merged)
+	}
+	saved := store.text(noteID)
+	if next(bob, MessageSaved).Revision != 6 || saved != "Well, Hello, world :) PS?" {
+		t.Fatalf("Expected both edits saved as of revision 6, but got %q", saved)
+	}
+	next(alice, MessageOp)
+	next(alice, MessageSaved)
+
+	fmt.Println("TEST COLLAB: The last one out closes the room, saving the text")
+	bob.Receive(Message{Type: MessageOp, Revision: 6, Op: Operation{}.Retain(len(saved)).Insert("!")})
+	next(bob, MessageAck)
+	bob.Leave()
+	alice.Leave()
+	if hub.Rooms() != 0 || store.text(noteID) != saved+"!" {
+		t.Fatalf("Expected the room closed and the text saved, but got %d rooms and %q", hub.Rooms(), store.text(noteID))
+	}
+
+	fmt.Println("TEST COLLAB: Deleting the note closes its room")
+	dave, _ := join()
+	store.mu.Lock()
+	delete(store.notes, noteID)
+	store.mu.Unlock()
+	hub.rooms[noteID].save()
+	if e := next(dave, MessageError); e.Code != ErrorNoteDeleted {
+		t.Fatalf("Expected a note deleted error, but got %+v", e)
+	}
+	if _, ok := <-dave.Messages(); ok || hub.Rooms() != 0 {
+		t.Fatalf("Expected the client and the room to be closed")
+	}
+	dave.Leave()
+}
@@ -0,0 +1,303 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidOperation is for an operation which doesn't fit the text it's applied to,
+// or can't be transformed against another.
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// The longest text an operation from JSON can apply to, or make, which is far longer
+// than any note, but short enough that adding up its lengths can't overflow.
+const maxOperationLen = math.MaxInt / 2
+
+// Component is one step of an Operation, which does exactly one of these.
+type Component struct {
+	Retain int    // Keep this many characters.
+	Insert string // Insert this text.
+	Delete int    // Delete this many characters.
+}
+
+// Operation is an edit of the whole text, as a sequence of components which walk
+// through the text from the start, to the end. Lengths and positions are in Unicode
+// code points, which are the same as JavaScript string indexes for text with no
+// characters outside the Basic Multilingual Plane (e.g. emoji).
+//
+// It's the same as ot.js's TextOperation, and has the same JSON form: an array of
+// positive numbers to retain, negative numbers to delete, and strings to insert,
+// e.g. [5, "Hello", -3].
+type Operation []Component
+
+// Retain adds a step which keeps n characters.
+func (op Operation) Retain(n int) Operation {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].Retain > 0 {
+		op[last].Retain += n
+		return op
+	}
+	return append(op, Component{Retain: n})
+}
+
+// Insert adds a step which inserts the text. An insert next to a delete always goes
+// first, so that the same edit always makes the same operation.
+func (op Operation) Insert(text string) Operation {
+	if text == "" {
+		return op
+	}
+	last := len(op) - 1
+	if last >= 0 && op[last].Insert != "" {
+		op[last].Insert += text
+		return op
+	}
+	if last >= 0 && op[last].Delete > 0 {
+		if last >= 1 && op[last-1].Insert != "" {
+			op[last-1].Insert += text
+			return op
+		}
+		op = append(op, op[last])
+		op[last] = Component{Insert: text}
+		return op
+	}
+	return append(op, Component{Insert: text})
+}
+
+// Delete adds a step which deletes n characters.
+func (op Operation) Delete(n int) Operation {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].Delete > 0 {
+		op[last].Delete += n
+		return op
+	}
+	return append(op, Component{Delete: n})
+}
+
+// BaseLen is the length of the text which the operation applies to.
+func (op Operation) BaseLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// TargetLen is the length of the text which the operation makes.
+func (op Operation) TargetLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + utf8.RuneCountInString(c.Insert)
+	}
+	return n
+}
+
+// Apply applies the operation to the text, which must be as long as its BaseLen.
+func (op Operation) Apply(text string) (string, error) {
+	runes := []rune(text)
+	if len(runes) != op.BaseLen() {
+		return "", fmt.Errorf("%w: it applies to text of length %d, not %d",
+			ErrInvalidOperation, op.BaseLen(), len(runes))
+	}
+
+	var sb strings.Builder
+	pos := 0
+	for _, c := range op {
+		if c.Retain+c.Delete > len(runes)-pos {
+			// Only if BaseLen() has overflowed.
+			return "", fmt.Errorf("%w: it goes past the end of the text", ErrInvalidOperation)
+		}
+		switch {
+		case c.Retain > 0:
+			sb.WriteString(string(runes[pos : pos+c.Retain]))
+			pos += c.Retain
+		case c.Insert != "":
+			sb.WriteString(c.Insert)
+		case c.Delete > 0:
+			pos += c.Delete
+		}
+	}
+	return sb.String(), nil
+}
+
+// Transform takes two operations, a and b, made at once to the same text, and makes
+// a1 and b1, such that applying a then b1 is the same as applying b then a1.
+// When both insert at the same place, a's insert goes first.
+func Transform(a, b Operation) (a1, b1 Operation, err error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, fmt.Errorf("%w: can't transform operations on texts of lengths %d and %d",
+			ErrInvalidOperation, a.BaseLen(), b.BaseLen())
+	}
+
+	// The components being worked on, which are used up a bit at a time.
+	i, j := 0, 0
+	var ca, cb *Component
+	nextA := func() {
+		ca = nil
+		if i < len(a) {
+			c := a[i]
+			ca, i = &c, i+1
+		}
+	}
+	nextB := func() {
+		cb = nil
+		if j < len(b) {
+			c := b[j]
+			cb, j = &c, j+1
+		}
+	}
+	nextA()
+	nextB()
+
+	for ca != nil || cb != nil {
+		// Inserts are unaffected by the other operation, which has to skip over them.
+		if ca != nil && ca.Insert != "" {
+			a1 = a1.Insert(ca.Insert)
+			b1 = b1.Retain(utf8.RuneCountInString(ca.Insert))
+			nextA()
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			a1 = a1.Retain(utf8.RuneCountInString(cb.Insert))
+			b1 = b1.Insert(cb.Insert)
+			nextB()
+			continue
+		}
+		if ca == nil || cb == nil {
+			// Can't happen, given the lengths match.
+			return nil, nil, fmt.Errorf("%w: one operation is shorter than the other", ErrInvalidOperation)
+		}
+
+		n := min(ca.Retain+ca.Delete, cb.Retain+cb.Delete)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			a1 = a1.Retain(n)
+			b1 = b1.Retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			a1 = a1.Delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			b1 = b1.Delete(n)
+		}
+		// Both deleting the same characters leaves nothing for either to do.
+
+		ca.Retain, ca.Delete = max(ca.Retain-n, 0), max(ca.Delete-n, 0)
+		if ca.Retain == 0 && ca.Delete == 0 {
+			nextA()
+		}
+		cb.Retain, cb.Delete = max(cb.Retain-n, 0), max(cb.Delete-n, 0)
+		if cb.Retain == 0 && cb.Delete == 0 {
+			nextB()
+		}
+	}
+	return a1, b1, nil
+}
+
+// TransformIndex moves a position in the text (e.g. a cursor) to where it is once
+// the operation has been applied. Text inserted at the position goes before it.
+func (op Operation) TransformIndex(index int) int {
+	newIndex, pos := index, 0
+	for _, c := range op {
+		if pos > index {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+		case c.Insert != "":
+			newIndex += utf8.RuneCountInString(c.Insert)
+		case c.Delete > 0:
+			newIndex -= min(c.Delete, index-pos)
+			pos += c.Delete
+		}
+	}
+	return newIndex
+}
+
+// Diff makes an operation which turns one text into the other, by replacing
+// whatever's between what they start and end with in common.
+func Diff(from, to string) Operation {
+	a, b := []rune(from), []rune(to)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op Operation
+	return op.Retain(prefix).
+		Delete(len(a) - prefix - suffix).
+		Insert(string(b[prefix : len(b)-suffix])).
+		Retain(suffix)
+}
+
+// MarshalJSON implements json.Marshaler, in the ot.js form.
+func (op Operation) MarshalJSON() ([]byte, error) {
+	components := make([]interface{}, 0, len(op))
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			components = append(components, c.Retain)
+		case c.Insert != "":
+			components = append(components, c.Insert)
+		case c.Delete > 0:
+			components = append(components, -c.Delete)
+		}
+	}
+	return json.Marshal(components)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, from the ot.js form.
+func (op *Operation) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidOperation, err.Error())
+	}
+
+	var parsed Operation
+	baseLen, targetLen := 0, 0
+	tooLong := fmt.Errorf("%w: it's longer than any text can be", ErrInvalidOperation)
+	for _, r := range raw {
+		var text string
+		if err := json.Unmarshal(r, &text); err == nil {
+			if text == "" {
+				return fmt.Errorf("%w: empty insert", ErrInvalidOperation)
+			}
+			n := utf8.RuneCountInString(text)
+			if n > maxOperationLen-targetLen {
+				return tooLong
+			}
+			targetLen += n
+			parsed = parsed.Insert(text)
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(r, &n); err != nil || n == 0 || n == math.MinInt {
+			return fmt.Errorf("%w: %s is not a non-zero whole number or a string", ErrInvalidOperation, r)
+		}
+		if n > 0 {
+			if n > maxOperationLen-baseLen || n > maxOperationLen-targetLen {
+				return tooLong
+			}
+			baseLen, targetLen = baseLen+n, targetLen+n
+			parsed = parsed.Retain(n)
+		} else {
+			if -n > maxOperationLen-baseLen {
+				return tooLong
+			}
+			baseLen -= n
+			parsed = parsed.Delete(-n)
+		}
+	}
+	*op = parsed
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package metrics is what notablyd tells Prometheus about itself: HTTP requests,
+// logins, sessions, persistence operations, and the Go runtime.
+//
+// Everything is registered in Registry, which Handler() serves in the Prometheus
+// text format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The prefix of all our own metric names.
+const namespace = "notably"
+
+// The values of the "result" label of the logins counter.
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
+
+// Registry has all the metrics. We don't use the prometheus default registry, so
+// that nothing else can sneak metrics in there.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took, by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts, by API version and result (success or failure).",
+	}, []string{"api", "result"})
+
+	persistenceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "persistence_operation_duration_seconds",
+		Help:      "How long persistence operations took, by method.",
+		// They're all in memory, so they're quick.
+		Buckets: []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	}, []string{"method"})
+
+	persistenceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "persistence_operation_errors_total",
+		Help:      "Persistence operations which returned an error (including not found), by method.",
+	}, []string{"method"})
+
+	webhookAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_delivery_attempts_total",
+		Help:      "Attempts to deliver webhook events, by what the delivery is after (pending, delivered or dead).",
+	}, []string{"status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		logins,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sessions",
+			Help: "Users who have logged in, and whose login cookie has neither expired nor been logged out. " +
+				"The login cookie is all there is to a session, so this is an estimate.",
+		}, sessions.count),
+		persistenceDuration,
+		persistenceErrors,
+		webhookAttempts,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveHTTPRequest records a finished HTTP request. route is the route pattern,
+// e.g. "/api/v2/notes/:id", rather than the path, so that note IDs don't each get
+// their own time series.
+func ObserveHTTPRequest(method, route string, status int, duration time.Duration) {
+	statusLabel := strconv.Itoa(status)
+	httpRequests.WithLabelValues(method, route, statusLabel).Inc()
+	httpRequestDuration.WithLabelValues(method, route, statusLabel).Observe(duration.Seconds())
+}
+
+// ObserveLogin records a login attempt with the given API version, e.g. "v1".
+func ObserveLogin(api string, success bool) {
+	result := LoginFailure
+	if success {
+		result = LoginSuccess
+	}
+	logins.WithLabelValues(api, result).Inc()
+}
+
+// SessionStarted starts the user's session, which lasts maxAgeSecs unless they log out.
+func SessionStarted(userID string, maxAgeSecs int) {
+	sessions.start(userID, time.Duration(maxAgeSecs)*time.Second)
+}
+
+// SessionEnded ends the user's session.
+func SessionEnded(userID string) {
+	sessions.end(userID)
+}
+
+// ObservePersistence records a persistence operation, e.g. "AddNoteForUser".
+func ObservePersistence(method string, duration time.Duration, err error) {
+	persistenceDuration.WithLabelValues(method).Observe(duration.Seconds())
+	if err != nil {
+		persistenceErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// ObserveWebhookAttempt records an attempt to deliver a webhook event, after which
+// the delivery has the given status, e.g. "pending" if it's to be tried again.
+func ObserveWebhookAttempt(status string) {
+	webhookAttempts.WithLabelValues(status).Inc()
+}
+
+// sessionTracker keeps track of when each logged in user's login cookie expires.
+// The login cookie is just the user ID, so a user logged in twice (say, in two
+// browsers) is one session as far as we can tell.
+type sessionTracker struct {
+	mu      sync.Mutex
+	expires map[string]time.Time // By user ID.
+}
+
+var sessions = &sessionTracker{expires: make(map[string]time.Time)}
+
+func (st *sessionTracker) start(userID string, maxAge time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.expires[userID] = time.Now().Add(maxAge)
+}
+
+func (st *sessionTracker) end(userID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.expires, userID)
+}
+
+// count counts the unexpired sessions, forgetting the expired ones.
+func (st *sessionTracker) count() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for userID, expires := range st.expires {
+		if now.After(expires) {
+			delete(st.expires, userID)
+		}
+	}
+	return float64(len(st.expires))
+}
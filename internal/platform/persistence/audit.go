@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"notably/internal/model"
+)
+
+const (
+	// Page sizes for GetAuditPage().
+	DefaultAuditPageLimit = 100
+	MaxAuditPageLimit     = 1000
+)
+
+// AddAuditEvent appends an event to the audit log, giving it its sequence number and
+// timestamp. Events from before keepSince (a Unix timestamp) are past their retention,
+// and are dropped from the log while we're at it. Zero keeps them all.
+// The user's account events, like logging in, go to the webhooks which want them.
+func (db *NotablyDB) AddAuditEvent(event model.AuditEvent, keepSince int64) (_ *model.AuditEvent, err error) {
+	db, done := db.observe("AddAuditEvent")
+	defer done(&err)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	last, err := txn.Last(auditTableName, "id")
+	if err != nil {
+		return nil, fmt.Errorf("failed getting the last audit event: %s", err.Error())
+	}
+	event.Seq = 1
+	if last != nil {
+		event.Seq = last.(model.AuditEvent).Seq + 1
+	}
+	event.Timestamp = time.Now().Unix() // seconds since Unix epoch
+
+	// The oldest events are first, so we only look at the ones we drop, and the one after.
+	if keepSince > 0 {
+		iter, err := txn.Get(auditTableName, "id")
+		if err != nil {
+			return nil, fmt.Errorf("failed getting the audit events: %s", err.Error())
+		}
+		var expired []interface{}
+		for obj := iter.Next(); obj != nil && obj.(model.AuditEvent).Timestamp < keepSince; obj = iter.Next() {
+			expired = append(expired, obj)
+		}
+		for _, obj := range expired {
+			if err := txn.Delete(auditTableName, obj); err != nil {
+				return nil, fmt.Errorf("failed dropping an expired audit event: %s", err.Error())
+			}
+		}
+	}
+
+	if err := txn.Insert(auditTableName, event); err != nil {
+		return nil, fmt.Errorf("failed adding audit event: %s", err.Error())
+	}
+
+	// The user's account events go to the webhooks too, when they succeed.
+	if event.Outcome == model.AuditOutcomeSuccess && event.TargetUserID != "" &&
+		slices.Contains(auditWebhookEvents, event.Action) {
+		webhookEvent := model.WebhookEvent{Type: event.Action, Timestamp: event.Timestamp, UserID: event.TargetUserID}
+		if err := enqueueWebhookEvent(txn, webhookEvent); err != nil {
+			return nil, err
+		}
+	}
+	txn.Commit()
+
+	return &event, nil
+}
+
+// auditEventMatches applies the (optional) filters in the list options to an event.
+func auditEventMatches(event *model.AuditEvent, opts *model.AuditListOptions) bool {
+	return (opts.Action == "" || event.Action == opts.Action) &&
+		(opts.Outcome == "" || event.Outcome == opts.Outcome) &&
+		(opts.ActorUserID == "" || event.ActorUserID == opts.ActorUserID) &&
+		(opts.TargetUserID == "" || event.TargetUserID == opts.TargetUserID) &&
+		(opts.TargetNoteID == "" || event.TargetNoteID == opts.TargetNoteID) &&
+		(opts.Since <= 0 || event.Timestamp >= opts.Since) &&
+		(opts.Until <= 0 || event.Timestamp < opts.Until)
+}
+
+// GetAuditPage returns one page of the audit log, newest first, with the events which
+// match the filters in the list options, and a cursor for the next page.
+// The cursor is the sequence number of the last event on the page.
+func (db *NotablyDB) GetAuditPage(opts model.AuditListOptions) (_ *model.AuditPage, err error) {
+	db, done := db.observe("GetAuditPage")
+	defer done(&err)
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultAuditPageLimit
+	} else if limit > MaxAuditPageLimit {
+		limit = MaxAuditPageLimit
+	}
+	var before int64
+	if opts.Cursor != "" {
+		before, err = strconv.ParseInt(opts.Cursor, 10, 64)
+		if err != nil || before <= 0 {
+			return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+		}
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	var iter memdb.ResultIterator
+	if before > 0 {
+		iter, err = txn.ReverseLowerBound(auditTableName, "id", before-1)
+	} else {
+		iter, err = txn.GetReverse(auditTableName, "id")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting the audit events: %s", err.Error())
+	}
+
+	page := &model.AuditPage{Events: []*model.AuditEvent{}}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		event := obj.(model.AuditEvent)
+		if !auditEventMatches(&event, &opts) {
+			continue
+		}
+		if len(page.Events) == limit {
+			// There's at least one more, so there's a next page.
+			page.NextCursor = strconv.FormatInt(page.Events[limit-1].Seq, 10)
+			break
+		}
+		page.Events = append(page.Events, &event)
+	}
+	return page, nil
+}
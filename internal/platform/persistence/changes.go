@@ -0,0 +1,181 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// Page sizes for GetNoteChangesForUser().
+	DefaultChangePageLimit = 100
+	MaxChangePageLimit     = 1000
+)
+
+// How many changes the change journal keeps, across all users. Once it's full, the
+// oldest change is dropped for each new one. It's a var so that the tests can make it small.
+var changeJournalSize int64 = 10000
+
+// JournalID identifies the change journal, which starts afresh whenever the database
+// is opened, so that a sequence number from another one (say, in a sync token from
+// before a restart) can be told from one of its own.
+func (db *NotablyDB) JournalID() string {
+	return db.journalID
+}
+
+// journalBounds gets the sequence numbers of the first and last changes in the journal,
+// as of the transaction. Both are zero if the journal is empty.
+func journalBounds(txn *tracedTxn) (first, last int64, err error) {
+	raw, err := txn.First(changeTableName, "id")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed getting the first note change: %s", err.Error())
+	}
+	if raw != nil {
+		first = raw.(model.NoteChange).Seq
+	}
+	raw, err = txn.Last(changeTableName, "id")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed getting the last note change: %s", err.Error())
+	}
+	if raw != nil {
+		last = raw.(model.NoteChange).Seq
+	}
+	return first, last, nil
+}
+
+// recordChange adds a change to one of the user's notes to the change journal, in the
+// write transaction which makes the change, so that the journal has the changes in the
+// order they were committed, and only those which were. The change's sequence number
+// is the note's new version, which is set on the note, unless it was deleted (nil).
+// The change goes to the webhooks which want it too, in the same transaction.
+func recordChange(txn *tracedTxn, changeType, userID, noteID string, note *model.Note) error {
+	first, last, err := journalBounds(txn)
+	if err != nil {
+		return err
+	}
+
+	change := model.NoteChange{
+		Seq:       last + 1,
+		Timestamp: time.Now().Unix(), // seconds since Unix epoch
+		Type:      changeType,
+		UserID:    userID,
+		NoteID:    noteID,
+	}
+	if err := txn.Insert(changeTableName, change); err != nil {
+		return fmt.Errorf("failed recording %s change of note '%s' for user '%s': %s",
+			changeType, noteID, userID, err.Error())
+	}
+
+	// The sequence numbers have no gaps, so the ones to drop are easy to find.
+	for seq := first; seq > 0 && seq <= change.Seq-changeJournalSize; seq++ {
+		if _, err := txn.DeleteAll(changeTableName, "id", seq); err != nil {
+			return fmt.Errorf("failed dropping an old note change: %s", err.Error())
+		}
+	}
+
+	event := model.WebhookEvent{Type: changeType, Timestamp: change.Timestamp, UserID: userID, NoteID: noteID}
+	if note != nil {
+		note.Version = change.Seq
+		sent := *note
+		event.Note = &sent
+	}
+	return enqueueWebhookEvent(txn, event)
+}
+
+// GetNoteChangesForUser gets the changes to the user's notes after the change with the
+// given sequence number, oldest first, up to limit of them (<= 0 means the default).
+// Zero gets them from the start of the journal, and less than zero gets none, only
+// where the journal is up to, for getting the changes from now on.
+//
+// It also returns a channel which is closed when there might be more changes for the
+// user, so that they can be waited for. It's closed by anything committed after the
+// changes were read, so none can be missed in between.
+func (db *NotablyDB) GetNoteChangesForUser(userID string, afterSeq int64, limit int) (
+	_ *model.NoteChangePage, _ <-chan struct{}, err error) {
+	db, done := db.observe("GetNoteChangesForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: cannot get note changes for blank/empty user", ErrInvalidInput)
+	}
+	if limit <= 0 {
+		limit = DefaultChangePageLimit
+	}
+	if limit > MaxChangePageLimit {
+		limit = MaxChangePageLimit
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	// Ensure that the given userID exists in the system.
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, nil, fmt.Errorf("cannot get note changes for user '%s': %w", userID, ErrUserNotFound)
+	}
+
+	// The LowerBound() iterator below can't be watched, but the user's prefix of the
+	// same index can. It's the same snapshot, so the watch starts where the read does.
+	prefix, err := txn.Get(changeTableName, "userSeq_prefix", userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error watching note changes for user '%s': %s", userID, err.Error())
+	}
+	watch := prefix.WatchCh()
+
+	first, last, err := journalBounds(txn)
+	if err != nil {
+		return nil, nil, err
+	}
+	page := &model.NoteChangePage{Changes: []*model.NoteChange{}, Seq: last}
+	if afterSeq < 0 {
+		return page, watch, nil
+	}
+
+	// A change the journal has dropped, or has never had (since it starts afresh
+	// when we do), leaves no telling what the reader has missed.
+	if afterSeq > last || (first > 0 && afterSeq < first-1) {
+		page.Truncated = true
+		db.log().Debug("Note changes truncated", "user_id", userID, "after_seq", afterSeq,
+			"first_seq", first, "last_seq", last)
+		return page, watch, nil
+	}
+
+	iter, err := txn.LowerBound(changeTableName, "userSeq", userID, afterSeq+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting note changes for user '%s': %s", userID, err.Error())
+	}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		change := obj.(model.NoteChange)
+		if change.UserID != userID {
+			// Past the end of their changes.
+			break
+		}
+		if len(page.Changes) == limit {
+			// There are more, which the reader can get next time.
+			page.Seq = page.Changes[limit-1].Seq
+			break
+		}
+
+		raw, err := txn.First(notesTableName, "id", change.NoteID, userID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting note with ID '%s' for user '%s': %s",
+				change.NoteID, userID, err.Error())
+		}
+		if raw != nil {
+			note := raw.(model.Note)
+			change.Note = &note
+		}
+		page.Changes = append(page.Changes, &change)
+	}
+
+	db.log().Debug("Got note changes", "user_id", userID, "after_seq", afterSeq, "count", len(page.Changes))
+	return page, watch, nil
+}
@@ -0,0 +1,47 @@
+package persistence
+
+import "errors"
+
+// Sentinel errors returned (wrapped) by the persistence methods.
+// Callers should check for these using errors.Is() rather than by looking at the
+// error text, which is meant for humans and may change.
+var (
+	// A user with the given user ID does not exist.
+	ErrUserNotFound = errors.New("user not found")
+
+	// A note with the given note ID does not exist (for the given user, if any).
+	ErrNoteNotFound = errors.New("note not found")
+
+	// A user with the given user ID already exists.
+	ErrUserExists = errors.New("user already exists")
+
+	// A method was called with an empty/blank or otherwise invalid argument,
+	// e.g. a blank user ID, an unknown sort field, or a garbled page cursor.
+	ErrInvalidInput = errors.New("invalid input")
+
+	// A note patch is malformed, of an unknown type, or could not be applied.
+	ErrInvalidPatch = errors.New("invalid patch")
+
+	// The note which would result from a create, update or patch is not valid,
+	// e.g. its text is empty.
+	ErrInvalidNote = errors.New("invalid note")
+
+	// The note has changed since the version the caller had, so it wasn't updated.
+	ErrNoteChanged = errors.New("note changed")
+
+	// The note's text is bigger than the quota allows for one note.
+	ErrNoteTooLarge = errors.New("note too large")
+
+	// The user would have more notes, or more note text, than their quota allows.
+	// Or more webhooks than anybody can have.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// A webhook with the given webhook ID does not exist (for the given user, if any).
+	ErrWebhookNotFound = errors.New("webhook not found")
+
+	// A delivery with the given delivery ID does not exist (for the given webhook).
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+	// An import with the given import ID does not exist (for the given user).
+	ErrImportNotFound = errors.New("import not found")
+)
@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"fmt"
+)
+
+// Ping checks that the store can be used, by reading from it in a transaction,
+// like database/sql's DB.Ping().
+func (db *NotablyDB) Ping() (err error) {
+	db, done := db.observe("Ping")
+	defer done(&err)
+
+	txn := db.txn(false)
+	defer txn.Abort()
+
+	if _, err := txn.First(usersTableName, "id"); err != nil {
+		return fmt.Errorf("failed reading from the store: %s", err.Error())
+	}
+	return nil
+}
+
+// CountUsersAndNotes counts all the users and all the notes, as of the same moment.
+func (db *NotablyDB) CountUsersAndNotes() (users, notes int, err error) {
+	db, done := db.observe("CountUsersAndNotes")
+	defer done(&err)
+
+	txn := db.txn(false)
+	defer txn.Abort()
+
+	for table, count := range map[string]*int{usersTableName: &users, notesTableName: &notes} {
+		iter, err := txn.Get(table, "id")
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed counting %s: %s", table, err.Error())
+		}
+		for obj := iter.Next(); obj != nil; obj = iter.Next() {
+			*count++
+		}
+	}
+	return users, notes, nil
+}
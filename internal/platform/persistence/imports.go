@@ -0,0 +1,193 @@
+package persistence
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+// How many of each user's imports are kept, to see how they went. Once there are
+// more, the oldest which are done are dropped.
+const MaxImports = 20
+
+// ImportNoteForUser adds a note for the user, like AddNoteForUser, but with the
+// timestamps it had wherever it was imported from (Unix timestamps). A zero (or
+// future) timestamp means now, and a note can't have been updated before it was
+// created. The note gets a new note ID, whatever it had before.
+func (db *NotablyDB) ImportNoteForUser(userID, noteText string, creationTimestamp, updateTimestamp int64) (_ *model.Note, err error) {
+	db, done := db.observe("ImportNoteForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	if noteText == "" {
+		return nil, fmt.Errorf("%w: cannot import a note when the note text is empty", ErrInvalidNote)
+	}
+	if err := db.checkNoteSize(noteText); err != nil {
+		return nil, err
+	}
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return nil, fmt.Errorf("%w: need a user ID to import note", ErrInvalidInput)
+	}
+
+	now := time.Now().Unix() // seconds since Unix epoch
+	if creationTimestamp <= 0 || creationTimestamp > now {
+		creationTimestamp = now
+	}
+	if updateTimestamp <= 0 || updateTimestamp > now {
+		updateTimestamp = now
+	}
+	updateTimestamp = max(updateTimestamp, creationTimestamp)
+
+	noteID, err := ourutils.GenerateKsuidAsString()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating noteID: %v", err)
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, fmt.Errorf("cannot import note for user '%s': %w", userID, ErrUserNotFound)
+	}
+
+	// The same as any new note, but for the timestamps.
+	theNote := model.Note{
+		NoteID:            noteID,
+		NoteUserID:        userID,
+		CreationTimestamp: creationTimestamp,
+		UpdateTimestamp:   updateTimestamp,
+		Note:              noteText,
+	}
+	if err := db.insertNote(txn, &theNote, nil); err != nil {
+		return nil, err
+	}
+
+	txn.Commit()
+	db.log().Debug("Imported note", "user_id", userID, "note_id", noteID, "note_length", len(noteText))
+	return &theNote, nil
+}
+
+// AddImport starts an import of the given number of items for the user. It's
+// running until UpdateImport says it's done.
+func (db *NotablyDB) AddImport(userID string, total int) (_ *model.Import, err error) {
+	db, done := db.observe("AddImport", tracing.User(userID))
+	defer done(&err)
+
+	importID, err := ourutils.GenerateKsuidAsString()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating importID: %v", err)
+	}
+	imp := model.Import{
+		ImportID:          importID,
+		UserID:            userID,
+		Status:            model.ImportRunning,
+		Total:             total,
+		CreationTimestamp: time.Now().Unix(), // seconds since Unix epoch
+		Results:           []*model.ImportResult{},
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, fmt.Errorf("cannot start import for user '%s': %w", userID, ErrUserNotFound)
+	}
+
+	if err := txn.Insert(importsTableName, imp); err != nil {
+		return nil, fmt.Errorf("failed adding import for user '%s': %s", userID, err.Error())
+	}
+	if err := trimImports(txn, userID); err != nil {
+		return nil, err
+	}
+
+	txn.Commit()
+	db.log().Debug("Started import", "user_id", userID, "import_id", importID, "total", total)
+	return &imp, nil
+}
+
+// trimImports drops the user's oldest imports which are done, so that they have no
+// more than MaxImports.
+func trimImports(txn *tracedTxn, userID string) error {
+	iter, err := txn.Get(importsTableName, "user_prefix", userID)
+	if err != nil {
+		return fmt.Errorf("error getting the imports of user '%s': %s", userID, err.Error())
+	}
+	var imports []model.Import
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		// The prefix scan will also pick up user IDs which merely start with our user ID.
+		if imp := obj.(model.Import); imp.UserID == userID {
+			imports = append(imports, imp)
+		}
+	}
+	for i := 0; i < len(imports) && len(imports) > MaxImports; {
+		if imports[i].Status == model.ImportRunning {
+			i++
+			continue
+		}
+		if err := txn.Delete(importsTableName, imports[i]); err != nil {
+			return fmt.Errorf("failed dropping an old import of user '%s': %s", userID, err.Error())
+		}
+		imports = slices.Delete(imports, i, i+1)
+	}
+	return nil
+}
+
+// UpdateImport saves how far an import has got.
+func (db *NotablyDB) UpdateImport(imp *model.Import) (err error) {
+	db, done := db.observe("UpdateImport", tracing.User(imp.UserID))
+	defer done(&err)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	if _, err := ownImport(txn, imp.UserID, imp.ImportID); err != nil {
+		return err
+	}
+	// The results so far are shared with whoever gets the import, so they're clipped,
+	// so that appending more to the importer's copy doesn't touch the stored one.
+	saved := *imp
+	saved.Results = slices.Clip(saved.Results)
+	if err := txn.Insert(importsTableName, saved); err != nil {
+		return fmt.Errorf("failed saving import '%s': %s", imp.ImportID, err.Error())
+	}
+
+	txn.Commit()
+	return nil
+}
+
+// GetImport gets one of the user's imports, as far as it has got.
+func (db *NotablyDB) GetImport(userID, importID string) (_ *model.Import, err error) {
+	db, done := db.observe("GetImport", tracing.User(userID))
+	defer done(&err)
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	return ownImport(txn, userID, importID)
+}
+
+// ownImport gets the import, if it's the user's. Somebody else's is as good as not there.
+func ownImport(txn *tracedTxn, userID, importID string) (*model.Import, error) {
+	raw, err := txn.First(importsTableName, "id", importID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting import '%s': %s", importID, err.Error())
+	}
+	if raw == nil || raw.(model.Import).UserID != userID {
+		return nil, fmt.Errorf("%w: no import '%s' for user '%s'", ErrImportNotFound, importID, userID)
+	}
+	imp := raw.(model.Import)
+	return &imp, nil
+}
@@ -1,11 +1,11 @@
 package persistence
 
 import (
-	"errors"
 	"fmt"
 	"time"
 
 	"notably/internal/model"
+	"notably/internal/platform/tracing"
 	ourutils "notably/internal/utils"
 )
 
@@ -14,41 +14,35 @@ import (
 // TODO: method to get all notes for all users. This would be an admin user functionality
 
 // Private helper function.
-func (db *NotablyDB) addOrUpdateNoteForUser(userID, noteID, noteText string, update bool) (*model.Note, error) {
-	var creationTimestamp, updateTimestamp int64
+// The note and the user's usage are read, checked against their quota, and written
+// back under a single write transaction, so that two requests at once can't both
+// squeeze under the quota.
+// addOrUpdateNoteForUser adds a note, or updates one if update. An update with a
+// version only happens if the note is still that version; zero means whatever it is.
+func (db *NotablyDB) addOrUpdateNoteForUser(userID, noteID, noteText string, update bool, version int64) (*model.Note, error) {
 	var err error
 	var ok bool
 
 	if noteText == "" {
-		return nil, errors.New("cannot create/update a note when the note text is empty")
+		return nil, fmt.Errorf("%w: cannot create/update a note when the note text is empty", ErrInvalidNote)
+	}
+	if err := db.checkNoteSize(noteText); err != nil {
+		return nil, err
 	}
 
-	// Calisthenics necessitated by txn.Insert() actually being an upsert. Oh, go-memdb...
 	if update {
 		// Sanity checks for update
-		userID, noteID, err := ourutils.ValidateUserIDAndNoteID(userID, noteID)
-		if err != nil {
-			return nil, fmt.Errorf("cannot add note: %s", err.Error())
-		}
-
-		// Ensure that the noteID exists, since this is an update to an ostensibly existing note.
-		tempNote, err := db.GetNoteForUser(userID, noteID)
+		userID, noteID, err = ourutils.ValidateUserIDAndNoteID(userID, noteID)
 		if err != nil {
-			return nil, fmt.Errorf("note not found: Error finding note to update for userID='%s', noteID='%s': %s",
-				userID, noteID, err.Error())
+			return nil, fmt.Errorf("cannot add note: %w: %w", ErrInvalidInput, err)
 		}
-
-		// If we got here, the update can proceed.
-		// Set the timestamps accordingly.
-		creationTimestamp = tempNote.CreationTimestamp
-		updateTimestamp = time.Now().Unix() // seconds since Unix epoch
 	} else {
 		// This is an add.
 		// Sanity check the userID.
 		// If we were called in "add" mode, we would not (should not) have been passed a noteID.
 		userID, ok = ourutils.ValidateStringNotempty(userID)
 		if !ok {
-			return nil, fmt.Errorf("need a user ID to add note")
+			return nil, fmt.Errorf("%w: need a user ID to add note", ErrInvalidInput)
 		}
 
 		// Generate a note ID using our inbuilt utility function.
@@ -56,20 +50,70 @@ func (db *NotablyDB) addOrUpdateNoteForUser(userID, noteID, noteText string, upd
 		if err != nil {
 			return nil, fmt.Errorf("failed generating noteID: %v", err)
 		}
-
-		creationTimestamp = time.Now().Unix() // seconds since Unix epoch
 	}
 
+	txn := db.txn(true) // Create a write transaction
+	defer txn.Abort()   // A no-op once we have committed. go-memdb should have called this method Rollback(). Oh well.
+
 	// Ensure that the given userID exists in the system.
 	// We need this because I haven't found a way to do table joins with go-memdb,
 	// or even know if that's possible in go-memdb.
-	_, err = db.GetUserByID(userID)
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, fmt.Errorf("cannot add note with ID '%s' for user '%s': %w", noteID, userID, ErrUserNotFound)
+	}
+
+	// Calisthenics necessitated by txn.Insert() actually being an upsert. Oh, go-memdb...
+	var oldNote *model.Note
+	if update {
+		// Ensure that the noteID exists, since this is an update to an ostensibly existing note.
+		raw, err := txn.First(notesTableName, "id", noteID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("error finding note to update for userID='%s', noteID='%s': %s",
+				userID, noteID, err.Error())
+		}
+		if raw == nil {
+			return nil, fmt.Errorf("error finding note to update for userID='%s', noteID='%s': %w",
+				userID, noteID, ErrNoteNotFound)
+		}
+		found := raw.(model.Note) // The go-memdb example is wrong here.
+		if version != 0 && found.Version != version {
+			return nil, fmt.Errorf("cannot update note with ID '%s' for user '%s': %w: it's version %d, not %d",
+				noteID, userID, ErrNoteChanged, found.Version, version)
+		}
+		oldNote = &found
+	}
+
+	// If we got here, the create or update can proceed.
+	theNote, err := db.putNote(txn, userID, noteID, noteText, oldNote)
 	if err != nil {
-		return nil, fmt.Errorf("cannot add note with ID '%s' for user '%s', user was not found",
-			noteID, userID)
+		return nil, err
+	}
+
+	txn.Commit()
+	db.log().Debug("Saved note", "user_id", userID, "note_id", noteID, "update", update, "note_length", len(noteText))
+	return theNote, nil
+}
+
+// putNote writes the note's text, in a write transaction which has found the note
+// (oldNote), or found that there's none, when it's a new note. The user's usage is
+// charged for it, and it goes in the change journal (and to the webhooks).
+func (db *NotablyDB) putNote(txn *tracedTxn, userID, noteID, noteText string, oldNote *model.Note) (*model.Note, error) {
+	// Set the timestamps accordingly.
+	var creationTimestamp, updateTimestamp int64
+	if oldNote != nil {
+		creationTimestamp = oldNote.CreationTimestamp
+		updateTimestamp = time.Now().Unix() // seconds since Unix epoch
+	} else {
+		creationTimestamp = time.Now().Unix() // seconds since Unix epoch
+		// A brand new note was last modified when it was created.
+		// This keeps it in the right place when notes are sorted by update time.
+		updateTimestamp = creationTimestamp
 	}
 
-	// If we got here, we can proceed with the create or update.
 	// The note text will be added as-is.
 	theNote := model.Note{
 		NoteID:            noteID,
@@ -78,32 +122,68 @@ func (db *NotablyDB) addOrUpdateNoteForUser(userID, noteID, noteText string, upd
 		UpdateTimestamp:   updateTimestamp,
 		Note:              noteText,
 	}
+	if err := db.insertNote(txn, &theNote, oldNote); err != nil {
+		return nil, err
+	}
+	return &theNote, nil
+}
 
-	txn := db.Txn(true) // Create a write transaction
-	err = txn.Insert(notesTableName, theNote)
-	if err != nil {
-		txn.Abort() // go-memdb should have called this method Rollback() to be in line with database/sql. Oh well.
-		return nil, fmt.Errorf("failed adding note with ID '%s' for user '%s': %s",
-			noteID, userID, err.Error())
+// insertNote writes the note, timestamps and all, for putNote, or for an import,
+// whose notes keep the timestamps they came with.
+func (db *NotablyDB) insertNote(txn *tracedTxn, note, oldNote *model.Note) error {
+	notes, bytes := 1, int64(len(note.Note))
+	changeType := model.NoteChangeCreated
+	if oldNote != nil {
+		notes, bytes = 0, bytes-int64(len(oldNote.Note))
+		changeType = model.NoteChangeUpdated
 	}
 
-	txn.Commit()
-	return &theNote, nil
+	if err := db.chargeUsage(txn, note.NoteUserID, notes, bytes); err != nil {
+		return fmt.Errorf("cannot save note with ID '%s' for user '%s': %w", note.NoteID, note.NoteUserID, err)
+	}
+
+	if err := recordChange(txn, changeType, note.NoteUserID, note.NoteID, note); err != nil {
+		return err
+	}
+	if err := txn.Insert(notesTableName, *note); err != nil {
+		return fmt.Errorf("failed adding note with ID '%s' for user '%s': %s",
+			note.NoteID, note.NoteUserID, err.Error())
+	}
+	return nil
+}
+
+func (db *NotablyDB) AddNoteForUser(userID, noteText string) (_ *model.Note, err error) {
+	db, done := db.observe("AddNoteForUser", tracing.User(userID))
+	defer done(&err)
+
+	return db.addOrUpdateNoteForUser(userID, "", noteText, false, 0)
 }
 
-func (db *NotablyDB) AddNoteForUser(userID, noteText string) (*model.Note, error) {
-	return db.addOrUpdateNoteForUser(userID, "", noteText, false)
+func (db *NotablyDB) UpdateNoteForUser(userID, noteID, noteText string) (_ *model.Note, err error) {
+	db, done := db.observe("UpdateNoteForUser", tracing.User(userID), tracing.NoteID(noteID))
+	defer done(&err)
+
+	return db.addOrUpdateNoteForUser(userID, noteID, noteText, true, 0)
 }
 
-func (db *NotablyDB) UpdateNoteForUser(userID, noteID, noteText string) (*model.Note, error) {
-	return db.addOrUpdateNoteForUser(userID, noteID, noteText, true)
+// UpdateNoteVersionForUser is UpdateNoteForUser, but only if the note is still the
+// given version, i.e. nobody else has changed it since it was read. Otherwise it's
+// ErrNoteChanged.
+func (db *NotablyDB) UpdateNoteVersionForUser(userID, noteID, noteText string, version int64) (_ *model.Note, err error) {
+	db, done := db.observe("UpdateNoteVersionForUser", tracing.User(userID), tracing.NoteID(noteID))
+	defer done(&err)
+
+	return db.addOrUpdateNoteForUser(userID, noteID, noteText, true, version)
 }
 
-func (db *NotablyDB) GetNoteForUser(userID, noteID string) (*model.Note, error) {
+func (db *NotablyDB) GetNoteForUser(userID, noteID string) (_ *model.Note, err error) {
+	db, done := db.observe("GetNoteForUser", tracing.User(userID), tracing.NoteID(noteID))
+	defer done(&err)
+
 	// Sanity checks
-	userID, noteID, err := ourutils.ValidateUserIDAndNoteID(userID, noteID)
+	userID, noteID, err = ourutils.ValidateUserIDAndNoteID(userID, noteID)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get note: %s", err.Error())
+		return nil, fmt.Errorf("cannot get note: %w: %w", ErrInvalidInput, err)
 	}
 
 	// Ensure that the given userID exists in the system.
@@ -111,13 +191,13 @@ func (db *NotablyDB) GetNoteForUser(userID, noteID string) (*model.Note, error)
 	// or even know if that's possible in go-memdb.
 	_, err = db.GetUserByID(userID)
 	if err != nil {
-		return nil, fmt.Errorf("cannot add note with ID '%s' for user '%s', user does not exist",
-			noteID, userID)
+		return nil, fmt.Errorf("cannot get note with ID '%s' for user '%s': %w",
+			noteID, userID, err)
 	}
 
 	// Create read-only transaction.
 	// For go-memdb, RO txn abort is basically a no-op, and one does not commit a RO txn.
-	txn := db.Txn(false)
+	txn := db.txn(false)
 	defer txn.Abort()
 
 	// the "id" index is a compound index comprising the noteID string index and the
@@ -128,38 +208,70 @@ func (db *NotablyDB) GetNoteForUser(userID, noteID string) (*model.Note, error)
 	}
 
 	if raw == nil {
-		return nil, fmt.Errorf("note not found: Nil result from DB for note with id '%s' for user '%s'", noteID, userID)
+		return nil, fmt.Errorf("%w: Nil result from DB for note with id '%s' for user '%s'", ErrNoteNotFound, noteID, userID)
 	}
 
 	theNote := raw.(model.Note) // The go-memdb example is wrong here.
 
 	// Now validate that the NoteUserID is the same as userID
 	if theNote.NoteUserID != userID {
-		return nil, fmt.Errorf("note user ID mismatch for note ID '%s', expected user '%s' but got '%s'",
-			noteID, userID, theNote.NoteUserID)
+		return nil, fmt.Errorf("%w: note user ID mismatch for note ID '%s', expected user '%s' but got '%s'",
+			ErrNoteNotFound, noteID, userID, theNote.NoteUserID)
 	}
 
 	// If we got here, we have the note.
 	return &theNote, nil
 }
 
-func (db *NotablyDB) GetAllNotesForUser(userID string) ([]*model.Note, error) {
+// GetNoteByID gets a note by its note ID alone, whoever it belongs to.
+// This is NOT for showing notes to users. It lets the API tell apart a note which
+// does not exist from one which belongs to somebody else.
+func (db *NotablyDB) GetNoteByID(noteID string) (_ *model.Note, err error) {
+	db, done := db.observe("GetNoteByID", tracing.NoteID(noteID))
+	defer done(&err)
+
+	// Sanity checks
+	noteID, ok := ourutils.ValidateStringNotempty(noteID)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot get note because noteID is empty", ErrInvalidInput)
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	raw, err := txn.First(notesTableName, "noteID", noteID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting note with ID '%s': %s", noteID, err.Error())
+	}
+
+	if raw == nil {
+		return nil, fmt.Errorf("%w: Nil result from DB for note with id '%s'", ErrNoteNotFound, noteID)
+	}
+
+	theNote := raw.(model.Note) // The go-memdb example is wrong here.
+	return &theNote, nil
+}
+
+func (db *NotablyDB) GetAllNotesForUser(userID string) (_ []*model.Note, err error) {
+	db, done := db.observe("GetAllNotesForUser", tracing.User(userID))
+	defer done(&err)
+
 	// Sanity
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		// This is not OK (heh heh)
-		return nil, errors.New("cannot get all notes for blank/empty user")
+		return nil, fmt.Errorf("%w: cannot get all notes for blank/empty user", ErrInvalidInput)
 	}
 
 	// Ensure that the given userID exists in the system.
-	_, err := db.GetUserByID(userID)
+	_, err = db.GetUserByID(userID)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get all notes for user '%s', error getting user: %s", userID, err.Error())
+		return nil, fmt.Errorf("cannot get all notes for user '%s', error getting user: %w", userID, err)
 	}
 
 	var noteList []*model.Note
 
-	txn := db.Txn(false) // RO txn
+	txn := db.txn(false) // RO txn
 	defer txn.Abort()
 
 	iter, err := txn.Get(notesTableName, "noteUserID", userID)
@@ -168,7 +280,6 @@ func (db *NotablyDB) GetAllNotesForUser(userID string) ([]*model.Note, error) {
 	}
 	for obj := iter.Next(); obj != nil; obj = iter.Next() {
 		note := obj.(model.Note) // Runtime type assertion. See https://go.dev/ref/spec#Type_assertions
-		fmt.Println("DEBUG: GET ALL NOTES:", userID, ":", note)
 		if note.NoteUserID != userID {
 			continue
 		}
@@ -177,23 +288,90 @@ func (db *NotablyDB) GetAllNotesForUser(userID string) ([]*model.Note, error) {
 		noteList = append(noteList, &note)
 	}
 
+	db.log().Debug("Got all notes", "user_id", userID, "count", len(noteList))
 	return noteList, nil
 }
 
+// WalkNotesForUser calls fn with each of the user's notes, oldest first, stopping at
+// the first error from fn, which it returns. Unlike GetAllNotesForUser, the notes are
+// never all in a slice at once, so it's for going through a lot of them, e.g. for an
+// export. They're as they were when it started, whatever changes meanwhile.
+func (db *NotablyDB) WalkNotesForUser(userID string, fn func(note *model.Note) error) (err error) {
+	db, done := db.observe("WalkNotesForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return fmt.Errorf("%w: cannot walk notes for blank/empty user", ErrInvalidInput)
+	}
+
+	// Ensure that the given userID exists in the system.
+	_, err = db.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("cannot walk notes for user '%s', error getting user: %w", userID, err)
+	}
+
+	// A read transaction is a snapshot, which it's fine to hang on to.
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	// See GetNotesPageForUser for the ordering.
+	iter, err := txn.Get(notesTableName, "userCreation_prefix", userID)
+	if err != nil {
+		return fmt.Errorf("cannot walk notes for user '%s', error in DB txn: %s", userID, err.Error())
+	}
+	count := 0
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		note := obj.(model.Note) // Runtime type assertion. See https://go.dev/ref/spec#Type_assertions
+		// The prefix scan will also pick up user IDs which merely start with our user ID.
+		if note.NoteUserID != userID {
+			continue
+		}
+		if err := fn(&note); err != nil {
+			return err
+		}
+		count++
+	}
+
+	db.log().Debug("Walked notes", "user_id", userID, "count", count)
+	return nil
+}
+
 // Returns the number of notes deleted. This is usually 1 or 0 (negative when there re errors).
-func (db *NotablyDB) DeleteNoteForUser(userID, noteID string) (int, error) {
+func (db *NotablyDB) DeleteNoteForUser(userID, noteID string) (_ int, err error) {
+	db, done := db.observe("DeleteNoteForUser", tracing.User(userID), tracing.NoteID(noteID))
+	defer done(&err)
+
 	// Sanity checks
-	userID, noteID, err := ourutils.ValidateUserIDAndNoteID(userID, noteID)
+	userID, noteID, err = ourutils.ValidateUserIDAndNoteID(userID, noteID)
 	if err != nil {
-		return -1, fmt.Errorf("cannot delete note due to userID/noteID validation failure: %s", err.Error())
+		return -1, fmt.Errorf("cannot delete note due to userID/noteID validation failure: %w: %w", ErrInvalidInput, err)
 	}
 
-	txn := db.Txn(true) // Write txn
-
 	// Ensure that the given userID exists in the system.
+	// This must be done before starting the write txn, since bailing out with the
+	// write txn neither committed nor aborted would leave the DB locked for writes.
 	_, err = db.GetUserByID(userID)
 	if err != nil {
-		return -1, fmt.Errorf("cannot get all notes for user '%s', error getting user: %s", userID, err.Error())
+		return -1, fmt.Errorf("cannot delete note for user '%s', error getting user: %w", userID, err)
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	// The note's size comes off the user's usage, if there is such a note.
+	raw, err := txn.First(notesTableName, "id", noteID, userID)
+	if err != nil {
+		return -1, fmt.Errorf("error getting note with ID '%s' for user '%s': %s", noteID, userID, err.Error())
+	}
+	if raw != nil {
+		if err := db.chargeUsage(txn, userID, -1, -int64(len(raw.(model.Note).Note))); err != nil {
+			return -1, fmt.Errorf("cannot delete note for user '%s' noteID '%s': %w", userID, noteID, err)
+		}
+		if err := recordChange(txn, model.NoteChangeDeleted, userID, noteID, nil); err != nil {
+			return -1, err
+		}
 	}
 
 	// NOTE: txn.DeleteAll(notesTableName, "id", noteID, userID)
@@ -202,36 +380,60 @@ func (db *NotablyDB) DeleteNoteForUser(userID, noteID string) (int, error) {
 	// still leaves the DB consistent :-)
 	numDel, err := txn.DeleteAll(notesTableName, "id", noteID, userID)
 	if err != nil {
-		txn.Abort()
 		return -1, fmt.Errorf("error deleting note for user '%s' noteID '%s': %s", userID, noteID, err.Error())
 	}
 
 	txn.Commit()
+	db.log().Debug("Deleted note", "user_id", userID, "note_id", noteID, "count", numDel)
 	return numDel, nil
 }
 
 // Returns the number of notes deleted, which will be negative on errors.
-func (db *NotablyDB) DeleteAllNotesForUser(userID string) (int, error) {
+func (db *NotablyDB) DeleteAllNotesForUser(userID string) (_ int, err error) {
+	db, done := db.observe("DeleteAllNotesForUser", tracing.User(userID))
+	defer done(&err)
+
 	// Sanity
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
 		// This is not OK (heh heh)
-		return -1, errors.New("cannot delete all notes for blank/empty user")
+		return -1, fmt.Errorf("%w: cannot delete all notes for blank/empty user", ErrInvalidInput)
 	}
 
 	// Ensure that the given userID exists in the system.
-	_, err := db.GetUserByID(userID)
+	_, err = db.GetUserByID(userID)
+	if err != nil {
+		return -1, fmt.Errorf("cannot delete all notes for user '%s', error getting user: %w", userID, err)
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	// Each note's deletion goes in the change journal.
+	iter, err := txn.Get(notesTableName, "noteUserID", userID)
 	if err != nil {
-		return -1, fmt.Errorf("cannot get all notes for user '%s', error getting user: %s", userID, err.Error())
+		return -1, fmt.Errorf("error getting all notes for user '%s': %s", userID, err.Error())
+	}
+	var noteIDs []string
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		noteIDs = append(noteIDs, obj.(model.Note).NoteID)
+	}
+	for _, noteID := range noteIDs {
+		if err := recordChange(txn, model.NoteChangeDeleted, userID, noteID, nil); err != nil {
+			return -1, err
+		}
 	}
 
-	txn := db.Txn(true) // Write txn
 	numDeleted, err := txn.DeleteAll(notesTableName, "noteUserID", userID)
 	if err != nil {
-		txn.Abort()
 		return -1, fmt.Errorf("error deleting all notes for user '%s': %s", userID, err.Error())
 	}
+	// With no notes, there's no usage.
+	if _, err := txn.DeleteAll(usageTableName, "id", userID); err != nil {
+		return -1, fmt.Errorf("error deleting usage for user '%s': %s", userID, err.Error())
+	}
 
 	txn.Commit()
+	db.log().Debug("Deleted all notes", "user_id", userID, "count", numDeleted)
 	return numDeleted, nil
 }
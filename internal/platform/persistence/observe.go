@@ -0,0 +1,70 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"notably/internal/platform/metrics"
+	"notably/internal/platform/tracing"
+)
+
+// observe starts a span for a persistence operation, with the given attributes.
+// It returns the database to carry on with, whose transactions are child spans of
+// the operation's, and the function to call when the operation is done, which ends
+// the span and records the operation in the metrics. Every exported method starts with:
+//
+//	db, done := db.observe("MethodName", attributes...)
+//	defer done(&err)
+func (db *NotablyDB) observe(method string, attributes ...attribute.KeyValue) (*NotablyDB, func(err *error)) {
+	start := time.Now()
+	ctx, span := db.tracer().Start(db.context(), "NotablyDB."+method,
+		trace.WithAttributes(semconv.DBSystemKey.String("memdb"), semconv.DBOperationName(method)),
+		trace.WithAttributes(attributes...))
+
+	return db.WithContext(ctx), func(err *error) {
+		metrics.ObservePersistence(method, time.Since(start), *err)
+
+		switch {
+		case *err == nil:
+			span.SetAttributes(tracing.Result(tracing.ResultOK))
+		case errors.Is(*err, ErrUserNotFound) || errors.Is(*err, ErrNoteNotFound):
+			span.SetAttributes(tracing.Result(tracing.ResultNotFound))
+		default:
+			span.SetAttributes(tracing.Result(tracing.ResultError))
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
+
+// tracedTxn is a memdb transaction with a span, which ends when the transaction is
+// committed or aborted. Aborting after committing, which we do a lot, is fine.
+type tracedTxn struct {
+	*memdb.Txn
+	span trace.Span
+}
+
+// txn starts a transaction, like memdb's Txn(), which is a child span of the operation.
+func (db *NotablyDB) txn(write bool) *tracedTxn {
+	_, span := db.tracer().Start(db.context(), "memdb.Txn",
+		trace.WithAttributes(attribute.Bool("notably.txn.write", write)))
+	return &tracedTxn{Txn: db.Txn(write), span: span}
+}
+
+func (t *tracedTxn) Commit() {
+	t.Txn.Commit()
+	t.span.SetAttributes(attribute.Bool("notably.txn.committed", true))
+	t.span.End()
+}
+
+func (t *tracedTxn) Abort() {
+	t.Txn.Abort()
+	t.span.End()
+}
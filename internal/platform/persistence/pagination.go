@@ -0,0 +1,198 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// The sort fields understood by GetNotesPageForUser().
+	NoteSortCreated = "created"
+	NoteSortUpdated = "updated"
+
+	// Page sizes for GetNotesPageForUser().
+	DefaultNotePageLimit = 50
+	MaxNotePageLimit     = 500
+)
+
+// noteCursor is what an opaque page cursor decodes to: the sort key and KSUID
+// of the last note on the previous page, plus the sort order it was issued for.
+// The short JSON keys keep the encoded cursor small.
+type noteCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Key        int64  `json:"k"`
+	NoteID     string `json:"n"`
+}
+
+func (nc noteCursor) encode() string {
+	data, _ := json.Marshal(nc) // Can't fail for a struct of plain fields.
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeNoteCursor(cursor string) (*noteCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+	}
+
+	var nc noteCursor
+	if err := json.Unmarshal(data, &nc); err != nil || nc.NoteID == "" {
+		return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+	}
+
+	return &nc, nil
+}
+
+// noteSortKey returns the value a note is ordered by for the given sort field.
+func noteSortKey(note *model.Note, sortBy string) int64 {
+	if sortBy == NoteSortUpdated {
+		return note.UpdateTimestamp
+	}
+	return note.CreationTimestamp
+}
+
+// isAfterCursor tells us whether a note comes strictly after the cursor position
+// in the requested sort order. Notes having the same timestamp are ordered by
+// their note ID, which is a KSUID and hence also sorts by creation time.
+func isAfterCursor(note *model.Note, nc *noteCursor) bool {
+	key := noteSortKey(note, nc.SortBy)
+	if key == nc.Key {
+		if nc.Descending {
+			return note.NoteID < nc.NoteID
+		}
+		return note.NoteID > nc.NoteID
+	}
+
+	if nc.Descending {
+		return key < nc.Key
+	}
+	return key > nc.Key
+}
+
+// noteMatchesFilters applies the (optional) filters in the list options to a note.
+func noteMatchesFilters(note *model.Note, opts *model.NoteListOptions) bool {
+	if opts.CreatedAfter > 0 && note.CreationTimestamp <= opts.CreatedAfter {
+		return false
+	}
+	if opts.CreatedBefore > 0 && note.CreationTimestamp >= opts.CreatedBefore {
+		return false
+	}
+	if opts.Query != "" && !ourutils.StrContainsInsensitive(note.Note, opts.Query) {
+		return false
+	}
+	return true
+}
+
+// GetNotesPageForUser returns one page of the notes for a user, in the order
+// given by the list options, along with the total number of notes which match
+// the filters and a cursor for the next page.
+//
+// The notes are walked in order using the per-user timestamp indexes, so there
+// is no sorting to be done here. Since we need the total count anyway, we walk
+// all the user's notes and only keep the ones which belong on the page.
+func (db *NotablyDB) GetNotesPageForUser(userID string, opts model.NoteListOptions) (_ *model.NotePage, err error) {
+	db, done := db.observe("GetNotesPageForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot get notes for blank/empty user", ErrInvalidInput)
+	}
+
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = NoteSortCreated
+	}
+	var indexName string
+	switch sortBy {
+	case NoteSortCreated:
+		indexName = "userCreation"
+	case NoteSortUpdated:
+		indexName = "userUpdate"
+	default:
+		return nil, fmt.Errorf("%w: cannot sort notes by '%s', must be one of '%s' or '%s'",
+			ErrInvalidInput, sortBy, NoteSortCreated, NoteSortUpdated)
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultNotePageLimit
+	}
+	if limit > MaxNotePageLimit {
+		limit = MaxNotePageLimit
+	}
+
+	var after *noteCursor
+	if opts.Cursor != "" {
+		nc, err := decodeNoteCursor(opts.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get notes for user '%s': %w", userID, err)
+		}
+		// A cursor is only meaningful for the sort order it was issued for.
+		if nc.SortBy != sortBy || nc.Descending != opts.Descending {
+			return nil, fmt.Errorf("%w: cannot get notes for user '%s': cursor does not match the requested sort order",
+				ErrInvalidInput, userID)
+		}
+		after = nc
+	}
+
+	// Ensure that the given userID exists in the system.
+	_, err = db.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get notes for user '%s', error getting user: %w", userID, err)
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	// The compound index is (user ID, timestamp), and go-memdb tacks the primary key
+	// (note ID, user ID) onto non-unique index entries, so a prefix scan on the user ID
+	// gives us that user's notes ordered by timestamp and then by note ID.
+	indexName += "_prefix"
+	iter, err := txn.Get(notesTableName, indexName, userID)
+	if opts.Descending {
+		iter, err = txn.GetReverse(notesTableName, indexName, userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get notes for user '%s', error in DB txn: %s", userID, err.Error())
+	}
+
+	page := model.NotePage{Notes: []*model.Note{}}
+	var hasMore bool
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		note := obj.(model.Note) // Runtime type assertion. See https://go.dev/ref/spec#Type_assertions
+		// The prefix scan will also pick up user IDs which merely start with our user ID.
+		if note.NoteUserID != userID || !noteMatchesFilters(&note, &opts) {
+			continue
+		}
+
+		page.TotalCount++
+		if after != nil && !isAfterCursor(&note, after) {
+			continue
+		}
+		if len(page.Notes) == limit {
+			hasMore = true
+			continue
+		}
+		page.Notes = append(page.Notes, &note)
+	}
+
+	if hasMore {
+		last := page.Notes[len(page.Notes)-1]
+		page.NextCursor = noteCursor{
+			SortBy:     sortBy,
+			Descending: opts.Descending,
+			Key:        noteSortKey(last, sortBy),
+			NoteID:     last.NoteID,
+		}.encode()
+	}
+
+	return &page, nil
+}
@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// The kinds of patch understood by PatchNoteForUser(). These are also the
+	// media types the patch comes in over HTTP.
+	PatchTypeMerge = "application/merge-patch+json" // JSON Merge Patch, RFC 7396
+	PatchTypeJSON  = "application/json-patch+json"  // JSON Patch, RFC 6902
+)
+
+// notePatchDoc is the JSON document which a note patch is applied to.
+// It only has the fields of a note which clients are allowed to change; the IDs
+// and timestamps belong to us. Any patch which tries to add other fields will fail
+// validation, since the patched document won't unmarshal back into this struct.
+type notePatchDoc struct {
+	Note string `json:"note"`
+}
+
+// applyNotePatch applies a patch of the given type to a note's patchable fields,
+// and validates the result.
+func applyNotePatch(note *model.Note, patchType string, patch []byte) (*notePatchDoc, error) {
+	doc, err := json.Marshal(notePatchDoc{Note: note.Note})
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing note for patching: %s", err.Error())
+	}
+
+	var patched []byte
+	switch patchType {
+	case PatchTypeMerge:
+		patched, err = jsonpatch.MergePatch(doc, patch)
+	case PatchTypeJSON:
+		var ops jsonpatch.Patch
+		ops, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			patched, err = ops.Apply(doc)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported patch type '%s'", ErrInvalidPatch, patchType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err.Error())
+	}
+
+	// Validate the patched note.
+	var result notePatchDoc
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w after patching: %s", ErrInvalidNote, err.Error())
+	}
+	if result.Note == "" {
+		return nil, fmt.Errorf("%w after patching: the note text is empty", ErrInvalidNote)
+	}
+
+	return &result, nil
+}
+
+// PatchNoteForUser applies a JSON Merge Patch or JSON Patch (see the PatchType
+// constants) to the patchable fields of a user's note.
+// The note is read, patched, validated and written back under a single write
+// transaction, so no other change to the note can sneak in between.
+func (db *NotablyDB) PatchNoteForUser(userID, noteID, patchType string, patch []byte) (_ *model.Note, err error) {
+	db, done := db.observe("PatchNoteForUser", tracing.User(userID), tracing.NoteID(noteID))
+	defer done(&err)
+
+	// Sanity checks
+	userID, noteID, err = ourutils.ValidateUserIDAndNoteID(userID, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot patch note: %w: %w", ErrInvalidInput, err)
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	// Ensure that the given userID exists in the system.
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, fmt.Errorf("cannot patch note with ID '%s' for user '%s': %w",
+			noteID, userID, ErrUserNotFound)
+	}
+
+	raw, err := txn.First(notesTableName, "id", noteID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting note with ID '%s' for user '%s': %s", noteID, userID, err.Error())
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("%w: Nil result from DB for note with id '%s' for user '%s'", ErrNoteNotFound, noteID, userID)
+	}
+	theNote := raw.(model.Note) // The go-memdb example is wrong here.
+
+	patched, err := applyNotePatch(&theNote, patchType, patch)
+	if err != nil {
+		return nil, fmt.Errorf("cannot patch note with ID '%s' for user '%s': %w", noteID, userID, err)
+	}
+
+	if err := db.checkNoteSize(patched.Note); err != nil {
+		return nil, fmt.Errorf("cannot patch note with ID '%s' for user '%s': %w", noteID, userID, err)
+	}
+	if err := db.chargeUsage(txn, userID, 0, int64(len(patched.Note)-len(theNote.Note))); err != nil {
+		return nil, fmt.Errorf("cannot patch note with ID '%s' for user '%s': %w", noteID, userID, err)
+	}
+
+	theNote.Note = patched.Note
+	theNote.UpdateTimestamp = time.Now().Unix() // seconds since Unix epoch
+	if err := recordChange(txn, model.NoteChangeUpdated, userID, noteID, &theNote); err != nil {
+		return nil, err
+	}
+
+	err = txn.Insert(notesTableName, theNote)
+	if err != nil {
+		return nil, fmt.Errorf("failed patching note with ID '%s' for user '%s': %s",
+			noteID, userID, err.Error())
+	}
+
+	txn.Commit()
+	db.log().Debug("Patched note", "user_id", userID, "note_id", noteID, "patch_type", patchType,
+		"note_length", len(theNote.Note))
+	return &theNote, nil
+}
@@ -1,8 +1,14 @@
 package persistence
 
 import (
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"testing"
+	"time"
+
+	"notably/internal/model"
 )
 
 // To see the info messages, run as:
@@ -144,6 +150,19 @@ Multiline note text line 3 of 3`
 			fmt.Println("TEST PERSISTENCE: NOTES: Got UPDATED note:", theNote)
 		}
 
+		// Update the note only if it's still the version we have, which it is, and then
+		// again with the version we had before, which it isn't. Should succeed, then fail.
+		theNote, err = db.UpdateNoteVersionForUser(userID, noteID, "Version checked", theNote.Version)
+		if err != nil {
+			t.Fatalf("Failed updating the note's current version: %v", err)
+		}
+		if _, err = db.UpdateNoteVersionForUser(userID, noteID, "Stale", theNote.Version-1); !errors.Is(err, ErrNoteChanged) {
+			t.Fatalf("Expected updating an old version of the note to fail with ErrNoteChanged, but got: %v", err)
+		}
+		if stored, _ := db.GetNoteForUser(userID, noteID); stored == nil || stored.Note != "Version checked" {
+			t.Fatalf("Expected the stale update not to have been made, but got: %+v", stored)
+		}
+
 		// Add a note for a user who does not exist in the system. Should fail.
 		_, err = db.AddNoteForUser("nonexistent_user", "a note")
 		if err == nil {
@@ -307,3 +326,969 @@ Multiline note text line 3 of 3`
 		}
 	})
 }
+
+func TestNotePaging(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	userID := "pager@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding a valid user: %v", err)
+	}
+	// A user whose ID starts with our user ID, to make sure their notes don't leak in.
+	if _, err := db.AddUser(userID+"x", "cafed00d"); err != nil {
+		t.Fatalf("Failed adding a valid user: %v", err)
+	}
+	if _, err := db.AddNoteForUser(userID+"x", "not ours"); err != nil {
+		t.Fatalf("Error adding note: %v", err)
+	}
+
+	// Add enough notes for a few pages. They'll mostly share a creation timestamp,
+	// so this also exercises the tie-breaking on note ID.
+	var notes []*model.Note
+	for i := 0; i < 7; i++ {
+		text := fmt.Sprintf("note number %d", i)
+		if i%2 == 0 {
+			text += " EVEN"
+		}
+		note, err := db.AddNoteForUser(userID, text)
+		if err != nil {
+			t.Fatalf("Error adding note %d: %v", i, err)
+		}
+		notes = append(notes, note)
+	}
+
+	// KSUIDs created within the same second are not ordered amongst themselves,
+	// so the order we expect is by timestamp and then by note ID.
+	sort.Slice(notes, func(i, j int) bool {
+		if notes[i].CreationTimestamp != notes[j].CreationTimestamp {
+			return notes[i].CreationTimestamp < notes[j].CreationTimestamp
+		}
+		return notes[i].NoteID < notes[j].NoteID
+	})
+	var noteIDs []string
+	for _, note := range notes {
+		noteIDs = append(noteIDs, note.NoteID)
+	}
+
+	// Walk all the pages in both directions, and make sure we see every note exactly once, in order.
+	for _, descending := range []bool{false, true} {
+		var seen []string
+		opts := model.NoteListOptions{Limit: 3, Descending: descending}
+		for numPages := 1; ; numPages++ {
+			page, err := db.GetNotesPageForUser(userID, opts)
+			if err != nil {
+				t.Fatalf("Error getting page %d of notes (descending=%v): %v", numPages, descending, err)
+			}
+			if page.TotalCount != len(noteIDs) {
+				t.Fatalf("Expected a total count of %d but got %d", len(noteIDs), page.TotalCount)
+			}
+			for _, note := range page.Notes {
+				seen = append(seen, note.NoteID)
+			}
+			if page.NextCursor == "" {
+				if numPages != 3 {
+					t.Fatalf("Expected 3 pages of notes but got %d", numPages)
+				}
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+
+		if len(seen) != len(noteIDs) {
+			t.Fatalf("Expected to page through %d notes but got %d", len(noteIDs), len(seen))
+		}
+		for i := range seen {
+			want := noteIDs[i]
+			if descending {
+				want = noteIDs[len(noteIDs)-1-i]
+			}
+			if seen[i] != want {
+				t.Fatalf("Note %d out of order (descending=%v): expected '%s' but got '%s'", i, descending, want, seen[i])
+			}
+		}
+	}
+
+	// Walking them goes in the same order, and stops at the first error.
+	var walked []string
+	err = db.WalkNotesForUser(userID, func(note *model.Note) error {
+		walked = append(walked, note.NoteID)
+		return nil
+	})
+	if err != nil || !slices.Equal(walked, noteIDs) {
+		t.Fatalf("Expected to walk the notes in order, but got %v: %v", walked, err)
+	}
+	errStop := errors.New("stop")
+	walked = nil
+	err = db.WalkNotesForUser(userID, func(note *model.Note) error {
+		walked = append(walked, note.NoteID)
+		return errStop
+	})
+	if !errors.Is(err, errStop) || len(walked) != 1 {
+		t.Fatalf("Expected the walk stopped after the first note, but walked %v: %v", walked, err)
+	}
+	if err := db.WalkNotesForUser("nobody@testdomain.xyz", func(*model.Note) error { return nil }); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound walking a nonexistent user's notes, but got: %v", err)
+	}
+
+	// Filter on the note text.
+	page, err := db.GetNotesPageForUser(userID, model.NoteListOptions{Query: "even"})
+	if err != nil {
+		t.Fatalf("Error getting filtered notes: %v", err)
+	}
+	if page.TotalCount != 4 || len(page.Notes) != 4 || page.NextCursor != "" {
+		t.Fatalf("Expected 4 filtered notes on a single page, but got %d of %d", len(page.Notes), page.TotalCount)
+	}
+
+	// A cursor issued for one sort order can't be used with another.
+	page, err = db.GetNotesPageForUser(userID, model.NoteListOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("Error getting first page: %v", err)
+	}
+	_, err = db.GetNotesPageForUser(userID, model.NoteListOptions{Cursor: page.NextCursor, SortBy: NoteSortUpdated})
+	if err == nil {
+		t.Fatal("Should have encountered an error using a cursor with a different sort order, but didn't")
+	}
+
+	// Garbage cursors and sort fields are errors.
+	_, err = db.GetNotesPageForUser(userID, model.NoteListOptions{Cursor: "bogus!"})
+	if err == nil {
+		t.Fatal("Should have encountered an error using a bogus cursor, but didn't")
+	}
+	_, err = db.GetNotesPageForUser(userID, model.NoteListOptions{SortBy: "bogus"})
+	if err == nil {
+		t.Fatal("Should have encountered an error using a bogus sort field, but didn't")
+	}
+}
+
+func TestNotePatching(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	userID := "patcher@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding a valid user: %v", err)
+	}
+	theNote, err := db.AddNoteForUser(userID, "original text")
+	if err != nil {
+		t.Fatalf("Error adding note: %v", err)
+	}
+	noteID := theNote.NoteID
+
+	// A JSON Merge Patch which changes the text. Should succeed.
+	theNote, err = db.PatchNoteForUser(userID, noteID, PatchTypeMerge, []byte(`{"note": "merged text"}`))
+	if err != nil {
+		t.Fatalf("Error applying merge patch: %v", err)
+	}
+	if theNote.Note != "merged text" || theNote.NoteID != noteID || theNote.NoteUserID != userID {
+		t.Fatalf("Merge patch gave the wrong note: %v", theNote)
+	}
+
+	// A JSON Patch which changes the text. Should succeed.
+	theNote, err = db.PatchNoteForUser(userID, noteID, PatchTypeJSON,
+		[]byte(`[{"op": "test", "path": "/note", "value": "merged text"}, {"op": "replace", "path": "/note", "value": "json patched"}]`))
+	if err != nil {
+		t.Fatalf("Error applying JSON patch: %v", err)
+	}
+	theNote, err = db.GetNoteForUser(userID, noteID)
+	if err != nil {
+		t.Fatalf("Error getting patched note: %v", err)
+	}
+	if theNote.Note != "json patched" {
+		t.Fatalf("JSON patch was not saved, note is now: %v", theNote)
+	}
+
+	// Patches which should fail, leaving the note alone.
+	badPatches := []struct {
+		patchType string
+		patch     string
+	}{
+		{PatchTypeMerge, `{"note": null}`},                                              // Empties the note.
+		{PatchTypeMerge, `{"note_id": "mine now"}`},                                     // Not a patchable field.
+		{PatchTypeMerge, `not JSON`},                                                    // Not a patch.
+		{PatchTypeJSON, `[{"op": "remove", "path": "/note"}]`},                          // Empties the note.
+		{PatchTypeJSON, `[{"op": "test", "path": "/note", "value": "stale text"}]`},     // Failed test.
+		{PatchTypeJSON, `[{"op": "add", "path": "/note_user_id", "value": "a@b.xyz"}]`}, // Not a patchable field.
+		{"text/plain", `{"note": "whatever"}`},                                          // Not a patch type.
+	}
+	for _, bad := range badPatches {
+		_, err = db.PatchNoteForUser(userID, noteID, bad.patchType, []byte(bad.patch))
+		if err == nil {
+			t.Fatalf("Should have encountered an error applying %s patch '%s', but didn't", bad.patchType, bad.patch)
+		}
+	}
+	theNote, err = db.GetNoteForUser(userID, noteID)
+	if err != nil {
+		t.Fatalf("Error getting note: %v", err)
+	}
+	if theNote.Note != "json patched" {
+		t.Fatalf("A failed patch changed the note: %v", theNote)
+	}
+
+	// Patching a note which does not exist. Should fail.
+	_, err = db.PatchNoteForUser(userID, "bogusNoteID", PatchTypeMerge, []byte(`{"note": "x"}`))
+	if err == nil {
+		t.Fatal("Should have encountered an error patching a nonexistent note, but didn't")
+	}
+}
+
+func TestPingAndCount(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	// Empty, but usable.
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Failed pinging an empty DB: %v", err)
+	}
+
+	for _, userID := range []string{"counted1@testdomain.xyz", "counted2@testdomain.xyz"} {
+		if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+			t.Fatalf("Failed adding user '%s': %v", userID, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.AddNoteForUser("counted1@testdomain.xyz", fmt.Sprintf("Note %d", i)); err != nil {
+			t.Fatalf("Failed adding note %d: %v", i, err)
+		}
+	}
+
+	users, notes, err := db.CountUsersAndNotes()
+	if err != nil {
+		t.Fatalf("Failed counting users and notes: %v", err)
+	}
+	fmt.Printf("TEST PERSISTENCE: COUNT: %d users, %d notes\n", users, notes)
+	if users != 2 || notes != 3 {
+		t.Fatalf("Expected 2 users and 3 notes, but got %d users and %d notes", users, notes)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Failed pinging the DB: %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	// Some logins, and a note.
+	for i := 0; i < 5; i++ {
+		outcome := model.AuditOutcomeSuccess
+		if i%2 == 1 {
+			outcome = model.AuditOutcomeFailure
+		}
+		_, err := db.AddAuditEvent(model.AuditEvent{Action: model.AuditActionLogin, Outcome: outcome,
+			TargetUserID: "audited@testdomain.xyz", ClientIP: "192.0.2.1"}, 0)
+		if err != nil {
+			t.Fatalf("Failed adding audit event %d: %v", i, err)
+		}
+	}
+	event, err := db.AddAuditEvent(model.AuditEvent{Action: model.AuditActionNoteCreate, Outcome: model.AuditOutcomeSuccess,
+		ActorUserID: "audited@testdomain.xyz", TargetNoteID: "note1"}, 0)
+	if err != nil {
+		t.Fatalf("Failed adding audit event: %v", err)
+	}
+	fmt.Printf("TEST PERSISTENCE: AUDIT: Added event: %+v\n", event)
+	if event.Seq != 6 || event.Timestamp == 0 {
+		t.Fatalf("Expected the 6th event to have sequence number 6 and a timestamp, but got %+v", event)
+	}
+
+	// Newest first, a page at a time.
+	var seqs []int64
+	opts := model.AuditListOptions{Limit: 4}
+	for {
+		page, err := db.GetAuditPage(opts)
+		if err != nil {
+			t.Fatalf("Failed getting a page of the audit log: %v", err)
+		}
+		for _, event := range page.Events {
+			seqs = append(seqs, event.Seq)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if fmt.Sprint(seqs) != "[6 5 4 3 2 1]" {
+		t.Fatalf("Expected all the events, newest first, but got %v", seqs)
+	}
+
+	// Filtered.
+	page, err := db.GetAuditPage(model.AuditListOptions{Action: model.AuditActionLogin, Outcome: model.AuditOutcomeFailure})
+	if err != nil || len(page.Events) != 2 || page.Events[0].Seq != 4 || page.NextCursor != "" {
+		t.Fatalf("Expected the 2 failed logins, but got %+v, error: %v", page, err)
+	}
+	page, err = db.GetAuditPage(model.AuditListOptions{TargetNoteID: "note1"})
+	if err != nil || len(page.Events) != 1 || page.Events[0].Action != model.AuditActionNoteCreate {
+		t.Fatalf("Expected the note's one event, but got %+v, error: %v", page, err)
+	}
+	if _, err = db.GetAuditPage(model.AuditListOptions{Cursor: "nope"}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("Expected a bad cursor to be invalid input, but got: %v", err)
+	}
+
+	// Everything so far is past its retention, and dropped when the next event is added.
+	if _, err = db.AddAuditEvent(model.AuditEvent{Action: model.AuditActionLogout}, time.Now().Unix()+1); err != nil {
+		t.Fatalf("Failed adding audit event: %v", err)
+	}
+	page, err = db.GetAuditPage(model.AuditListOptions{})
+	if err != nil || len(page.Events) != 1 || page.Events[0].Seq != 7 {
+		t.Fatalf("Expected only the newest event to be kept, but got %+v, error: %v", page, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	db = db.WithQuota(model.Quota{MaxNoteBytes: 10, MaxNotes: 3, MaxTotalBytes: 19})
+
+	userID := "quota@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding user: %v", err)
+	}
+
+	// checkUsage checks the user's usage.
+	checkUsage := func(wantNotes int, wantBytes int64) {
+		usage, err := db.GetUsageForUser(userID)
+		if err != nil {
+			t.Fatalf("Failed getting usage: %v", err)
+		}
+		fmt.Printf("TEST PERSISTENCE: QUOTA: usage %+v\n", *usage)
+		if usage.Notes != wantNotes || usage.Bytes != wantBytes {
+			t.Fatalf("Expected %d notes of %d bytes, but got %+v", wantNotes, wantBytes, *usage)
+		}
+	}
+	checkUsage(0, 0)
+
+	// One note too big, whether added, updated or patched.
+	if _, err := db.AddNoteForUser(userID, "Eleven long"); !errors.Is(err, ErrNoteTooLarge) {
+		t.Fatalf("Expected a note too large error, but got: %v", err)
+	}
+	note1, err := db.AddNoteForUser(userID, "Ten bytes!")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if _, err := db.UpdateNoteForUser(userID, note1.NoteID, "Eleven long"); !errors.Is(err, ErrNoteTooLarge) {
+		t.Fatalf("Expected a note too large error updating, but got: %v", err)
+	}
+	if _, err := db.PatchNoteForUser(userID, note1.NoteID, PatchTypeMerge, []byte(`{"note": "Eleven long"}`)); !errors.Is(err, ErrNoteTooLarge) {
+		t.Fatalf("Expected a note too large error patching, but got: %v", err)
+	}
+	checkUsage(1, 10)
+
+	// Too many bytes all told.
+	note2, err := db.AddNoteForUser(userID, "Nine byte")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if _, err := db.AddNoteForUser(userID, "Two"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected a quota exceeded error for the total bytes, but got: %v", err)
+	}
+	if _, err := db.UpdateNoteForUser(userID, note2.NoteID, "Ten bytes!"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected a quota exceeded error for growing a note, but got: %v", err)
+	}
+	checkUsage(2, 19)
+
+	// Shrinking is always fine, and makes room.
+	if _, err := db.PatchNoteForUser(userID, note1.NoteID, PatchTypeMerge, []byte(`{"note": "Five!"}`)); err != nil {
+		t.Fatalf("Failed shrinking a note: %v", err)
+	}
+	checkUsage(2, 14)
+	if _, err := db.AddNoteForUser(userID, "Two"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	checkUsage(3, 17)
+
+	// Too many notes.
+	if _, err := db.AddNoteForUser(userID, "1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected a quota exceeded error for the number of notes, but got: %v", err)
+	}
+
+	// Deleting gives it back.
+	if _, err := db.DeleteNoteForUser(userID, note2.NoteID); err != nil {
+		t.Fatalf("Failed deleting note: %v", err)
+	}
+	checkUsage(2, 8)
+	if _, err := db.DeleteNoteForUser(userID, note2.NoteID); err != nil {
+		t.Fatalf("Failed deleting deleted note: %v", err)
+	}
+	checkUsage(2, 8)
+	if _, err := db.DeleteAllNotesForUser(userID); err != nil {
+		t.Fatalf("Failed deleting all notes: %v", err)
+	}
+	checkUsage(0, 0)
+
+	// No quota, no limits.
+	if _, err := db.WithQuota(model.Quota{}).AddNoteForUser(userID, "Much more than ten bytes"); err != nil {
+		t.Fatalf("Failed adding a big note without a quota: %v", err)
+	}
+
+	if _, err := db.GetUsageForUser("nobody@testdomain.xyz"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected a user not found error, but got: %v", err)
+	}
+}
+
+func TestNoteChanges(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	userID, otherUserID := "changes@testdomain.xyz", "otherchanges@testdomain.xyz"
+	for _, id := range []string{userID, otherUserID} {
+		if _, err := db.AddUser(id, "cafed00d"); err != nil {
+			t.Fatalf("Failed adding user: %v", err)
+		}
+	}
+
+	// getChanges gets the user's changes after the given one, checking their types.
+	getChanges := func(afterSeq int64, limit int, wantTypes ...string) (*model.NoteChangePage, <-chan struct{}) {
+		page, watch, err := db.GetNoteChangesForUser(userID, afterSeq, limit)
+		if err != nil {
+			t.Fatalf("Failed getting note changes: %v", err)
+		}
+		fmt.Printf("TEST PERSISTENCE: NOTE CHANGES: after %d got %d changes up to %d, truncated %v\n",
+			afterSeq, len(page.Changes), page.Seq, page.Truncated)
+		if len(page.Changes) != len(wantTypes) {
+			t.Fatalf("Expected %d changes, but got %d", len(wantTypes), len(page.Changes))
+		}
+		for i, change := range page.Changes {
+			if change.Type != wantTypes[i] || change.UserID != userID {
+				t.Fatalf("Expected change %d to be %s for our user, but got %+v", i, wantTypes[i], *change)
+			}
+		}
+		return page, watch
+	}
+	closed := func(watch <-chan struct{}) bool {
+		select {
+		case <-watch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	page, watch := getChanges(0, 0)
+	if page.Seq != 0 || page.Truncated {
+		t.Fatalf("Expected an empty journal, but got %+v", *page)
+	}
+
+	note, err := db.AddNoteForUser(userID, "First")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if !closed(watch) {
+		t.Fatalf("Expected adding a note to close the watch channel")
+	}
+	if _, err := db.AddNoteForUser(otherUserID, "Not ours"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if _, err := db.UpdateNoteForUser(userID, note.NoteID, "Second"); err != nil {
+		t.Fatalf("Failed updating note: %v", err)
+	}
+	if _, err := db.PatchNoteForUser(userID, note.NoteID, PatchTypeMerge, []byte(`{"note":"Third"}`)); err != nil {
+		t.Fatalf("Failed patching note: %v", err)
+	}
+
+	// The changes come with the note as it is now.
+	page, watch = getChanges(0, 0, model.NoteChangeCreated, model.NoteChangeUpdated, model.NoteChangeUpdated)
+	if page.Seq != 4 || page.Changes[0].Note == nil || page.Changes[0].Note.Note != "Third" {
+		t.Fatalf("Expected the changes to go up to 4 with the latest note, but got %+v", *page)
+	}
+
+	// From now on, there are none yet.
+	page, _ = getChanges(-1, 0)
+	if page.Seq != 4 || page.Truncated {
+		t.Fatalf("Expected no changes up to 4, but got %+v", *page)
+	}
+
+	// A page at a time.
+	page, _ = getChanges(0, 2, model.NoteChangeCreated, model.NoteChangeUpdated)
+	if page.Seq != 3 {
+		t.Fatalf("Expected the page to go up to change 3, but got %d", page.Seq)
+	}
+	getChanges(page.Seq, 2, model.NoteChangeUpdated)
+
+	if _, err := db.DeleteNoteForUser(userID, note.NoteID); err != nil {
+		t.Fatalf("Failed deleting note: %v", err)
+	}
+	if !closed(watch) {
+		t.Fatalf("Expected deleting a note to close the watch channel")
+	}
+	page, _ = getChanges(4, 0, model.NoteChangeDeleted)
+	if page.Changes[0].Note != nil {
+		t.Fatalf("Expected no note with the deletion, but got %+v", *page.Changes[0].Note)
+	}
+
+	// Deleting a note which isn't there changes nothing.
+	if _, err := db.DeleteNoteForUser(userID, note.NoteID); err != nil {
+		t.Fatalf("Failed deleting note: %v", err)
+	}
+	getChanges(5, 0)
+
+	// Deleting them all is a deletion of each.
+	for _, text := range []string{"Fourth", "Fifth"} {
+		if _, err := db.AddNoteForUser(userID, text); err != nil {
+			t.Fatalf("Failed adding note: %v", err)
+		}
+	}
+	if _, err := db.DeleteAllNotesForUser(userID); err != nil {
+		t.Fatalf("Failed deleting all notes: %v", err)
+	}
+	page, _ = getChanges(5, 0, model.NoteChangeCreated, model.NoteChangeCreated,
+		model.NoteChangeDeleted, model.NoteChangeDeleted)
+
+	// A point the journal doesn't know of, e.g. from before a restart.
+	page, _ = getChanges(page.Seq+1, 0)
+	if !page.Truncated || page.Seq != 9 {
+		t.Fatalf("Expected truncated changes up to 9, but got %+v", *page)
+	}
+
+	// After a restart, the journal starts again from 1, so it has an ID of its own.
+	reopened, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	if db.JournalID() == "" || reopened.JournalID() == db.JournalID() ||
+		db.WithoutTracing().JournalID() != db.JournalID() {
+		t.Fatalf("Expected a change journal ID for each opening, but got '%s' and '%s'",
+			db.JournalID(), reopened.JournalID())
+	}
+
+	// The journal drops the oldest changes once it's full.
+	defer func(size int64) { changeJournalSize = size }(changeJournalSize)
+	changeJournalSize = 3
+	if _, err := db.AddNoteForUser(userID, "Sixth"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	page, _ = getChanges(6, 0)
+	if !page.Truncated {
+		t.Fatalf("Expected the changes after 6 to be truncated, but got %+v", *page)
+	}
+	getChanges(7, 0, model.NoteChangeDeleted, model.NoteChangeDeleted, model.NoteChangeCreated)
+
+	if _, _, err := db.GetNoteChangesForUser("nobody@testdomain.xyz", 0, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected a user not found error, but got: %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	db = db.WithQuota(model.Quota{MaxNoteBytes: 20})
+
+	userID := "sync@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding user: %v", err)
+	}
+
+	// sync syncs the changes, checking the results' statuses.
+	sync := func(afterSeq int64, changes []model.SyncChange, wantStatuses ...string) *model.NoteSync {
+		noteSync, err := db.SyncNotesForUser(userID, afterSeq, changes)
+		if err != nil {
+			t.Fatalf("Failed syncing: %v", err)
+		}
+		fmt.Printf("TEST PERSISTENCE: SYNC: after %d got %d notes up to %d, reset %v\n",
+			afterSeq, len(noteSync.Notes), noteSync.Seq, noteSync.Reset)
+		if len(noteSync.Results) != len(wantStatuses) {
+			t.Fatalf("Expected %d results, but got %d", len(wantStatuses), len(noteSync.Results))
+		}
+		for i, result := range noteSync.Results {
+			fmt.Printf("TEST PERSISTENCE: SYNC: result %d: %+v\n", i, *result)
+			if result.Status != wantStatuses[i] {
+				t.Fatalf("Expected result %d to be %s, but got %+v", i, wantStatuses[i], *result)
+			}
+		}
+		return noteSync
+	}
+
+	// Every change to a note is a new version.
+	note, err := db.AddNoteForUser(userID, "Server note")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if note.Version != 1 {
+		t.Fatalf("Expected the new note to be version 1, but got %d", note.Version)
+	}
+
+	// The first sync gets everything, including what the client made offline.
+	first := sync(-1, []model.SyncChange{{ClientRef: "local-1", Note: "Offline note"}}, model.SyncStatusApplied)
+	if !first.Reset || len(first.Notes) != 2 || first.Seq != 2 {
+		t.Fatalf("Expected both notes up to 2, as a reset, but got %+v", *first)
+	}
+	offline := first.Results[0]
+	if offline.ClientRef != "local-1" || offline.Note == nil || offline.Note.Version != 2 || offline.NoteID != offline.Note.NoteID {
+		t.Fatalf("Expected the offline note to be version 2, but got %+v", *offline)
+	}
+
+	// Somebody else changes both notes.
+	note, err = db.UpdateNoteForUser(userID, note.NoteID, "Server edit")
+	if err != nil {
+		t.Fatalf("Failed updating note: %v", err)
+	}
+	if _, err := db.DeleteNoteForUser(userID, offline.NoteID); err != nil {
+		t.Fatalf("Failed deleting note: %v", err)
+	}
+
+	// Nothing sent, only the changes since.
+	changed := sync(first.Seq, nil)
+	if changed.Reset || changed.Seq != 4 || len(changed.Notes) != 2 {
+		t.Fatalf("Expected two changed notes up to 4, but got %+v", *changed)
+	}
+	if got := changed.Notes[0]; got.NoteID != note.NoteID || got.Version != 3 || got.Deleted || got.Note.Note != "Server edit" {
+		t.Fatalf("Expected the edited note, but got %+v", *got)
+	}
+	if got := changed.Notes[1]; got.NoteID != offline.NoteID || got.Version != 4 || !got.Deleted || got.Note != nil {
+		t.Fatalf("Expected the deleted note's tombstone, but got %+v", *got)
+	}
+
+	// Conflicts, as the client had made changes on the old versions meanwhile.
+	conflicts := sync(first.Seq, []model.SyncChange{
+		{NoteID: note.NoteID, BaseVersion: 1, Note: "Client edit"},
+		{NoteID: offline.NoteID, BaseVersion: 2, Note: "Edited, not deleted"},
+		{NoteID: note.NoteID, BaseVersion: 1, Deleted: true},
+		{NoteID: note.NoteID, BaseVersion: 1, Note: "Server edit"}, // The same edit, which is fine.
+	}, model.SyncStatusConflict, model.SyncStatusConflict, model.SyncStatusConflict, model.SyncStatusApplied)
+	for i, want := range []string{model.SyncResolutionCopied, model.SyncResolutionRecreated, model.SyncResolutionKept} {
+		if conflicts.Results[i].Resolution != want {
+			t.Fatalf("Expected conflict %d to be resolved as %s, but got %+v", i, want, *conflicts.Results[i])
+		}
+	}
+	if copied := conflicts.Results[0]; copied.NoteID == note.NoteID || copied.Note.Note != "Client edit" {
+		t.Fatalf("Expected the client's edit as a new note, but got %+v", *copied)
+	}
+	if kept := conflicts.Results[2]; kept.Note == nil || kept.Note.Note != "Server edit" {
+		t.Fatalf("Expected the note to be kept, but got %+v", *kept)
+	}
+	// The two new notes, besides the two changed before.
+	if len(conflicts.Notes) != 4 || conflicts.Seq != 6 {
+		t.Fatalf("Expected four changed notes up to 6, but got %+v", *conflicts)
+	}
+
+	// No conflicts with the latest versions, and changes which can't be made fail alone.
+	applied := sync(conflicts.Seq, []model.SyncChange{
+		{NoteID: note.NoteID, BaseVersion: 3, Note: "Client edit, again"},
+		{Note: "Far too long for the quota"},
+		{Note: ""},
+		{Deleted: true},
+		{NoteID: offline.NoteID, BaseVersion: 4, Deleted: true},
+		{NoteID: conflicts.Results[0].NoteID, BaseVersion: 5, Deleted: true},
+	}, model.SyncStatusApplied, model.SyncStatusFailed, model.SyncStatusFailed, model.SyncStatusFailed,
+		model.SyncStatusApplied, model.SyncStatusApplied)
+	for i, want := range []error{ErrNoteTooLarge, ErrInvalidNote, ErrInvalidInput} {
+		if err := applied.Results[i+1].Err; !errors.Is(err, want) {
+			t.Fatalf("Expected result %d to fail with %v, but got %v", i+1, want, err)
+		}
+	}
+	if len(applied.Notes) != 2 || applied.Seq != 8 || !applied.Notes[1].Deleted {
+		t.Fatalf("Expected the edit and the deletion up to 8, but got %+v", *applied)
+	}
+
+	// Syncing from a point the journal doesn't know of starts again.
+	if reset := sync(42, nil); !reset.Reset || len(reset.Notes) != 2 {
+		t.Fatalf("Expected a reset with both notes, but got %+v", *reset)
+	}
+
+	if _, err := db.SyncNotesForUser(userID, 0, make([]model.SyncChange, MaxSyncChanges+1)); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("Expected an invalid input error for too many changes, but got: %v", err)
+	}
+	if _, err := db.SyncNotesForUser("nobody@testdomain.xyz", 0, nil); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected a user not found error, but got: %v", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+
+	userID, otherUserID := "hooked@testdomain.xyz", "other@testdomain.xyz"
+	for _, id := range []string{userID, otherUserID} {
+		if _, err := db.AddUser(id, "cafed00d"); err != nil {
+			t.Fatalf("Failed adding user '%s': %v", id, err)
+		}
+	}
+
+	// Bad URLs and event types are no good.
+	for _, url := range []string{"", "example.com/hook", "ftp://example.com/hook", "http:///hook"} {
+		if _, err := db.AddWebhook(userID, url, nil); !errors.Is(err, ErrInvalidInput) {
+			t.Fatalf("Expected ErrInvalidInput adding webhook for '%s', but got: %v", url, err)
+		}
+	}
+	if _, err := db.AddWebhook(userID, "https://example.com/hook", []string{"note.exploded"}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("Expected ErrInvalidInput adding webhook for a nonexistent event, but got: %v", err)
+	}
+	if _, err := db.AddWebhook("nobody@testdomain.xyz", "https://example.com/hook", nil); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound adding webhook for a nonexistent user, but got: %v", err)
+	}
+
+	// The user's webhook only wants some of their events, and the admins' wants everybody's.
+	userHook, err := db.AddWebhook(userID, "https://example.com/user", []string{model.NoteChangeDeleted, model.NoteChangeCreated})
+	if err != nil {
+		t.Fatalf("Failed adding user's webhook: %v", err)
+	}
+	adminHook, err := db.AddWebhook("", "https://example.com/admin", nil)
+	if err != nil {
+		t.Fatalf("Failed adding admins' webhook: %v", err)
+	}
+	fmt.Printf("TEST PERSISTENCE: WEBHOOKS: Added %+v and %+v\n", *userHook, *adminHook)
+	if userHook.Secret == "" || userHook.Secret == adminHook.Secret {
+		t.Fatalf("Expected the webhooks to have their own secrets")
+	}
+	hooks, err := db.GetWebhooks(userID)
+	if err != nil || len(hooks) != 1 || hooks[0].WebhookID != userHook.WebhookID || hooks[0].Secret != "" {
+		t.Fatalf("Expected the user's webhook, without its secret, but got %v: %v", hooks, err)
+	}
+	if _, err := db.GetWebhook(otherUserID, userHook.WebhookID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("Expected ErrWebhookNotFound getting somebody else's webhook, but got: %v", err)
+	}
+	if _, err := db.GetWebhook(userID, adminHook.WebhookID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("Expected ErrWebhookNotFound getting the admins' webhook as a user, but got: %v", err)
+	}
+
+	// Some events, which are queued in the outbox.
+	note, err := db.AddNoteForUser(userID, "Hooked")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	if _, err := db.UpdateNoteForUser(userID, note.NoteID, "Hooked, updated"); err != nil {
+		t.Fatalf("Failed updating note: %v", err)
+	}
+	if _, err := db.AddNoteForUser(otherUserID, "Not hooked"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	for _, outcome := range []string{model.AuditOutcomeSuccess, model.AuditOutcomeFailure} {
+		if _, err := db.AddAuditEvent(model.AuditEvent{Action: model.AuditActionLogin, Outcome: outcome, TargetUserID: userID}, 0); err != nil {
+			t.Fatalf("Failed adding audit event: %v", err)
+		}
+	}
+
+	due, nextMillis, _, err := db.GetDueWebhookDeliveries(time.Now().UnixMilli(), 100)
+	if err != nil {
+		t.Fatalf("Failed getting due deliveries: %v", err)
+	}
+	var got []string
+	for _, d := range due {
+		got = append(got, d.Webhook.URL+" "+d.Delivery.Event.Type)
+	}
+	fmt.Printf("TEST PERSISTENCE: WEBHOOKS: Due %v, next %d\n", got, nextMillis)
+	want := []string{"https://example.com/user note.created", "https://example.com/admin note.created",
+		"https://example.com/admin note.updated", "https://example.com/admin note.created", "https://example.com/admin session.login"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) || nextMillis != 0 {
+		t.Fatalf("Expected due deliveries %v, and none after, but got %v, and %d", want, got, nextMillis)
+	}
+	for _, d := range due {
+		event := d.Delivery.Event
+		if event.EventID == "" || d.Webhook.Secret == "" {
+			t.Fatalf("Expected an event ID, and the webhook's secret, but got %+v", *d)
+		}
+		if event.Type == model.NoteChangeUpdated && (event.Note == nil || event.Note.Note != "Hooked, updated" || event.Note.Version != 2) {
+			t.Fatalf("Expected the updated note in the event, but got %+v", event)
+		}
+	}
+
+	// One is delivered, one is to be retried later, and one is dead. The rest stay due.
+	later := time.Now().Add(time.Hour).UnixMilli()
+	attempts := []model.WebhookAttempt{
+		{Status: model.WebhookDeliveryDelivered, StatusCode: 200},
+		{Status: model.WebhookDeliveryPending, StatusCode: 500, Error: "oops", NextAttemptMillis: later},
+		{Status: model.WebhookDeliveryDead, StatusCode: 500, Error: "oops again"},
+	}
+	for i, attempt := range attempts {
+		delivery, err := db.RecordWebhookAttempt(due[i].Delivery.DeliveryID, attempt)
+		if err != nil || delivery.Attempts != 1 || delivery.Status != attempt.Status {
+			t.Fatalf("Expected the attempt recorded, but got %+v: %v", delivery, err)
+		}
+	}
+	stillDue, nextMillis, _, err := db.GetDueWebhookDeliveries(time.Now().UnixMilli(), 100)
+	if err != nil || len(stillDue) != len(due)-len(attempts) || nextMillis != later {
+		t.Fatalf("Expected %d due deliveries, and the next at %d, but got %d, and %d: %v",
+			len(due)-len(attempts), later, len(stillDue), nextMillis, err)
+	}
+	if _, err := db.RecordWebhookAttempt("nosuchdelivery", attempts[0]); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Fatalf("Expected ErrDeliveryNotFound recording an attempt, but got: %v", err)
+	}
+
+	// The delivery logs, a page at a time, newest first.
+	var all []*model.WebhookDelivery
+	opts := model.WebhookDeliveryListOptions{Limit: 3}
+	for {
+		page, err := db.GetWebhookDeliveriesPage("", adminHook.WebhookID, opts)
+		if err != nil {
+			t.Fatalf("Failed getting the admins' webhook's deliveries: %v", err)
+		}
+		all = append(all, page.Deliveries...)
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if len(all) != 4 {
+		t.Fatalf("Expected 4 deliveries for the admins' webhook, but got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Seq <= all[i].Seq {
+			t.Fatalf("Expected the deliveries newest first, but got %d before %d", all[i-1].Seq, all[i].Seq)
+		}
+	}
+	if _, err := db.GetWebhookDeliveriesPage(otherUserID, userHook.WebhookID, model.WebhookDeliveryListOptions{}); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("Expected ErrWebhookNotFound getting somebody else's deliveries, but got: %v", err)
+	}
+
+	// The dead one can be retried.
+	dead := due[2].Delivery
+	deadLog, err := db.GetWebhookDeliveriesPage(due[2].Webhook.UserID, dead.WebhookID,
+		model.WebhookDeliveryListOptions{Status: model.WebhookDeliveryDead})
+	if err != nil || len(deadLog.Deliveries) != 1 || deadLog.Deliveries[0].DeliveryID != dead.DeliveryID {
+		t.Fatalf("Expected the dead delivery, but got %+v: %v", deadLog, err)
+	}
+	retried, err := db.RetryWebhookDelivery(due[2].Webhook.UserID, dead.WebhookID, dead.DeliveryID)
+	if err != nil || retried.Status != model.WebhookDeliveryPending || retried.Attempts != 0 {
+		t.Fatalf("Expected the dead delivery to be pending again, but got %+v: %v", retried, err)
+	}
+	if _, err := db.RetryWebhookDelivery(due[2].Webhook.UserID, dead.WebhookID, "nosuchdelivery"); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Fatalf("Expected ErrDeliveryNotFound retrying a nonexistent delivery, but got: %v", err)
+	}
+
+	// Deleting a webhook deletes its deliveries, including any still to be delivered.
+	if err := db.DeleteWebhook(otherUserID, userHook.WebhookID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("Expected ErrWebhookNotFound deleting somebody else's webhook, but got: %v", err)
+	}
+	if err := db.DeleteWebhook("", adminHook.WebhookID); err != nil {
+		t.Fatalf("Failed deleting the admins' webhook: %v", err)
+	}
+	due, _, _, err = db.GetDueWebhookDeliveries(time.Now().UnixMilli(), 100)
+	if err != nil {
+		t.Fatalf("Failed getting due deliveries: %v", err)
+	}
+	for _, d := range due {
+		if d.Delivery.WebhookID == adminHook.WebhookID {
+			t.Fatalf("Expected no deliveries for the deleted webhook, but got %+v", *d.Delivery)
+		}
+	}
+
+	// There's only so many webhooks anybody can have.
+	for i := 1; i < MaxWebhooks; i++ {
+		if _, err := db.AddWebhook(userID, fmt.Sprintf("https://example.com/%d", i), nil); err != nil {
+			t.Fatalf("Failed adding webhook %d: %v", i, err)
+		}
+	}
+	if _, err := db.AddWebhook(userID, "https://example.com/toomany", nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded adding too many webhooks, but got: %v", err)
+	}
+}
+
+func TestImports(t *testing.T) {
+	db, err := Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	db = db.WithQuota(model.Quota{MaxNotes: 3})
+
+	userID, otherUserID := "importer@testdomain.xyz", "other@testdomain.xyz"
+	for _, id := range []string{userID, otherUserID} {
+		if _, err := db.AddUser(id, "cafed00d"); err != nil {
+			t.Fatalf("Failed adding user '%s': %v", id, err)
+		}
+	}
+
+	// Imported notes keep their timestamps, as far as they make sense.
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		created, updated         int64
+		wantCreated, wantUpdated int64
+	}{
+		{1700000000, 1700000100, 1700000000, 1700000100},
+		{1700000000, 1600000000, 1700000000, 1700000000}, // Updated before it was created.
+		{0, now + 3600, now, now},                        // Unknown, and in the future.
+	} {
+		note, err := db.ImportNoteForUser(userID, "Imported", tc.created, tc.updated)
+		if err != nil {
+			t.Fatalf("Failed importing note: %v", err)
+		}
+		fmt.Printf("TEST PERSISTENCE: IMPORTS: imported %d/%d as %+v\n", tc.created, tc.updated, *note)
+		got, err := db.GetNoteForUser(userID, note.NoteID)
+		if err != nil || got.Version == 0 || got.CreationTimestamp < tc.wantCreated || got.CreationTimestamp > tc.wantCreated+1 ||
+			got.UpdateTimestamp < tc.wantUpdated || got.UpdateTimestamp > tc.wantUpdated+1 {
+			t.Fatalf("Expected the note created at %d and updated at %d, but got %+v, error: %v",
+				tc.wantCreated, tc.wantUpdated, got, err)
+		}
+	}
+
+	// Like any other new note, as far as sanity and the quota go.
+	if _, err := db.ImportNoteForUser(userID, "", 0, 0); !errors.Is(err, ErrInvalidNote) {
+		t.Fatalf("Expected an invalid note error, but got: %v", err)
+	}
+	if _, err := db.ImportNoteForUser(userID, "One too many", 0, 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected a quota exceeded error, but got: %v", err)
+	}
+	if _, err := db.ImportNoteForUser("nobody@testdomain.xyz", "Imported", 0, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected a user not found error, but got: %v", err)
+	}
+
+	// Keeping track of an import.
+	if _, err := db.AddImport("nobody@testdomain.xyz", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected a user not found error starting an import, but got: %v", err)
+	}
+	running, err := db.AddImport(userID, 2)
+	if err != nil || running.Status != model.ImportRunning || running.Total != 2 || running.Results == nil {
+		t.Fatalf("Expected a running import, but got %+v, error: %v", running, err)
+	}
+	running.Processed, running.Imported = 1, 1
+	running.Results = append(running.Results, &model.ImportResult{Item: "a.md", Status: model.ImportStatusImported, NoteID: "a"})
+	if err := db.UpdateImport(running); err != nil {
+		t.Fatalf("Failed updating import: %v", err)
+	}
+	got, err := db.GetImport(userID, running.ImportID)
+	if err != nil || got.Processed != 1 || len(got.Results) != 1 || got.Results[0].NoteID != "a" {
+		t.Fatalf("Expected the import as far as it got, but got %+v, error: %v", got, err)
+	}
+	// Somebody else's import is as good as not there.
+	if _, err := db.GetImport(otherUserID, running.ImportID); !errors.Is(err, ErrImportNotFound) {
+		t.Fatalf("Expected an import not found error for another user, but got: %v", err)
+	}
+	other := *running
+	other.UserID = otherUserID
+	if err := db.UpdateImport(&other); !errors.Is(err, ErrImportNotFound) {
+		t.Fatalf("Expected an import not found error updating another user's import, but got: %v", err)
+	}
+
+	// Only the last few are kept, but never one which is still running.
+	importIDs := []string{running.ImportID}
+	for i := 0; i < MaxImports; i++ {
+		imp, err := db.AddImport(userID, 0)
+		if err != nil {
+			t.Fatalf("Failed starting import: %v", err)
+		}
+		imp.Status = model.ImportDone
+		if err := db.UpdateImport(imp); err != nil {
+			t.Fatalf("Failed finishing import: %v", err)
+		}
+		importIDs = append(importIDs, imp.ImportID)
+	}
+	kept := 0
+	for _, importID := range importIDs {
+		if _, err := db.GetImport(userID, importID); err == nil {
+			kept++
+		}
+	}
+	fmt.Printf("TEST PERSISTENCE: IMPORTS: kept %d of %d\n", kept, len(importIDs))
+	if kept != MaxImports {
+		t.Fatalf("Expected %d imports to be kept, but got %d", MaxImports, kept)
+	}
+	if _, err := db.GetImport(userID, running.ImportID); err != nil {
+		t.Fatalf("Expected the running import to be kept, but got: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"fmt"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+// checkNoteSize checks that the note text isn't too big for one note.
+func (db *NotablyDB) checkNoteSize(noteText string) error {
+	if db.quota.MaxNoteBytes > 0 && int64(len(noteText)) > db.quota.MaxNoteBytes {
+		return fmt.Errorf("%w: the note text is %d bytes, and the most a note can have is %d",
+			ErrNoteTooLarge, len(noteText), db.quota.MaxNoteBytes)
+	}
+	return nil
+}
+
+// usageInTxn gets the user's usage, as of the transaction.
+func usageInTxn(txn *tracedTxn, userID string) (model.Usage, error) {
+	raw, err := txn.First(usageTableName, "id", userID)
+	if err != nil {
+		return model.Usage{}, fmt.Errorf("error getting usage for user '%s': %s", userID, err.Error())
+	}
+	if raw == nil {
+		// They have no notes.
+		return model.Usage{UserID: userID}, nil
+	}
+	return raw.(model.Usage), nil
+}
+
+// chargeUsage changes the user's usage by the given number of notes and bytes, in the
+// write transaction which makes the change to their notes. If their usage goes up,
+// it mustn't go over their quota. If it goes down, it's fine, even if they're still
+// over their quota (say, because it has been lowered), so that they can get back under.
+func (db *NotablyDB) chargeUsage(txn *tracedTxn, userID string, notes int, bytes int64) error {
+	usage, err := usageInTxn(txn, userID)
+	if err != nil {
+		return err
+	}
+
+	usage.Notes += notes
+	usage.Bytes += bytes
+	if notes > 0 && db.quota.MaxNotes > 0 && usage.Notes > db.quota.MaxNotes {
+		return fmt.Errorf("%w: user '%s' can have at most %d notes", ErrQuotaExceeded, userID, db.quota.MaxNotes)
+	}
+	if bytes > 0 && db.quota.MaxTotalBytes > 0 && usage.Bytes > db.quota.MaxTotalBytes {
+		return fmt.Errorf("%w: user '%s' can have at most %d bytes of notes, and this would make it %d",
+			ErrQuotaExceeded, userID, db.quota.MaxTotalBytes, usage.Bytes)
+	}
+
+	if usage.Notes <= 0 {
+		_, err = txn.DeleteAll(usageTableName, "id", userID)
+	} else {
+		err = txn.Insert(usageTableName, usage)
+	}
+	if err != nil {
+		return fmt.Errorf("failed updating usage for user '%s': %s", userID, err.Error())
+	}
+	return nil
+}
+
+// GetUsageForUser gets how many notes the user has, and how big they are all told.
+func (db *NotablyDB) GetUsageForUser(userID string) (_ *model.Usage, err error) {
+	db, done := db.observe("GetUsageForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot get usage for blank/empty user", ErrInvalidInput)
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	// Ensure that the given userID exists in the system.
+	rawUser, err := txn.First(usersTableName, "id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+	}
+	if rawUser == nil {
+		return nil, fmt.Errorf("cannot get usage for user '%s': %w", userID, ErrUserNotFound)
+	}
+
+	usage, err := usageInTxn(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -4,11 +4,22 @@ import (
 	"fmt"
 
 	"github.com/hashicorp/go-memdb"
+
+	"notably/internal/model"
+	ourutils "notably/internal/utils"
 )
 
 const (
-	usersTableName = "users"
-	notesTableName = "notes"
+	usersTableName  = "users"
+	notesTableName  = "notes"
+	auditTableName  = "audit"
+	usageTableName  = "usage"
+	changeTableName = "changes"
+
+	webhooksTableName   = "webhooks"
+	deliveriesTableName = "webhookDeliveries"
+
+	importsTableName = "imports"
 )
 
 // In real life, this would be an sql.Open() call to an existing DB from an ACID-compliant database.
@@ -60,6 +71,15 @@ func Open() (*NotablyDB, error) {
 				},
 			},
 
+			// Note IDs are KSUIDs and hence unique on their own.
+			// This lets us find a note without knowing who it belongs to.
+			"noteID": &memdb.IndexSchema{
+				Name:         "noteID",
+				Unique:       true,
+				AllowMissing: false,
+				Indexer:      &memdb.StringFieldIndex{Field: "NoteID"},
+			},
+
 			"noteUserID": &memdb.IndexSchema{
 				Name:         "noteUserID",
 				Unique:       false,
@@ -81,6 +101,29 @@ func Open() (*NotablyDB, error) {
 				Indexer: &memdb.IntFieldIndex{Field: "UpdateTimestamp"},
 			},
 
+			// The same two timestamps, but per user. These let us walk a user's notes
+			// in timestamp order when listing them a page at a time.
+			"userCreation": &memdb.IndexSchema{
+				Name:   "userCreation",
+				Unique: false,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "NoteUserID"},
+						&memdb.IntFieldIndex{Field: "CreationTimestamp"},
+					},
+				},
+			},
+			"userUpdate": &memdb.IndexSchema{
+				Name:   "userUpdate",
+				Unique: false,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "NoteUserID"},
+						&memdb.IntFieldIndex{Field: "UpdateTimestamp"},
+					},
+				},
+			},
+
 			// The contents of the note item
 			// A user can save an empty note if they wish, although it would be pointless, eh...
 			"note": &memdb.IndexSchema{
@@ -92,11 +135,175 @@ func Open() (*NotablyDB, error) {
 		},
 	}
 
+	// The audit log is only ever appended to, except for dropping the oldest events
+	// once they're past their retention.
+	auditTable := &memdb.TableSchema{
+		Name: auditTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.AuditEvent.Seq, which goes up by one for each event.
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.IntFieldIndex{Field: "Seq"},
+			},
+		},
+	}
+
+	// How much each user with notes is storing, which is kept up to date along with
+	// their notes, in the same write transactions.
+	usageTable := &memdb.TableSchema{
+		Name: usageTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.Usage.UserID
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.StringFieldIndex{Field: "UserID"},
+			},
+		},
+	}
+
+	// The change journal, of the changes to everybody's notes, in the order they were
+	// committed. Only the most recent changes are kept.
+	changeTable := &memdb.TableSchema{
+		Name: changeTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.NoteChange.Seq, which goes up by one for each change.
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.IntFieldIndex{Field: "Seq"},
+			},
+
+			// A user's changes, in order. This lets us read their changes since a given
+			// one, and watch for more.
+			"userSeq": &memdb.IndexSchema{
+				Name:   "userSeq",
+				Unique: true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "UserID"},
+						&memdb.IntFieldIndex{Field: "Seq"},
+					},
+				},
+			},
+		},
+	}
+
+	webhooksTable := &memdb.TableSchema{
+		Name: webhooksTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.Webhook.WebhookID, a KSUID.
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.StringFieldIndex{Field: "WebhookID"},
+			},
+
+			// The users' own webhooks, which get their events.
+			"userID": &memdb.IndexSchema{
+				Name:         "userID",
+				Unique:       false,
+				AllowMissing: true, // The admins' webhooks.
+				Indexer:      &memdb.StringFieldIndex{Field: "UserID"},
+			},
+
+			// The admins' webhooks, which get everybody's events.
+			"admin": &memdb.IndexSchema{
+				Name:   "admin",
+				Unique: false,
+				Indexer: &memdb.ConditionalIndex{
+					Conditional: func(obj interface{}) (bool, error) {
+						return obj.(model.Webhook).UserID == "", nil
+					},
+				},
+			},
+		},
+	}
+
+	// The webhook deliveries are both the outbox, of those still to be delivered,
+	// and the delivery log, of those which have been (or have been given up on).
+	deliveriesTable := &memdb.TableSchema{
+		Name: deliveriesTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.WebhookDelivery.DeliveryID, a KSUID.
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.StringFieldIndex{Field: "DeliveryID"},
+			},
+
+			// model.WebhookDelivery.Seq, which goes up by one for each delivery.
+			"seq": &memdb.IndexSchema{
+				Name:    "seq",
+				Unique:  true,
+				Indexer: &memdb.IntFieldIndex{Field: "Seq"},
+			},
+
+			// A webhook's deliveries, in order. This lets us page through its delivery log.
+			"webhook": &memdb.IndexSchema{
+				Name:   "webhook",
+				Unique: true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "WebhookID"},
+						&memdb.IntFieldIndex{Field: "Seq"},
+					},
+				},
+			},
+
+			// The deliveries in each state, in the order they're next to be tried.
+			// This lets us find the pending ones which are due, and watch for more.
+			"due": &memdb.IndexSchema{
+				Name:   "due",
+				Unique: false,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "Status"},
+						&memdb.IntFieldIndex{Field: "NextAttemptMillis"},
+					},
+				},
+			},
+		},
+	}
+
+	importsTable := &memdb.TableSchema{
+		Name: importsTableName,
+		Indexes: map[string]*memdb.IndexSchema{
+			// id = model.Import.ImportID, a KSUID.
+			"id": &memdb.IndexSchema{
+				Name:    "id",
+				Unique:  true,
+				Indexer: &memdb.StringFieldIndex{Field: "ImportID"},
+			},
+
+			// The user's imports, oldest first (near enough, as they're KSUIDs).
+			"user": &memdb.IndexSchema{
+				Name:   "user",
+				Unique: true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "UserID"},
+						&memdb.StringFieldIndex{Field: "ImportID"},
+					},
+				},
+			},
+		},
+	}
+
 	// The main DB schema
 	schema := &memdb.DBSchema{
 		Tables: map[string]*memdb.TableSchema{
-			usersTableName: usersTable,
-			notesTableName: notesTable,
+			usersTableName:  usersTable,
+			notesTableName:  notesTable,
+			auditTableName:  auditTable,
+			usageTableName:  usageTable,
+			changeTableName: changeTable,
+
+			webhooksTableName:   webhooksTable,
+			deliveriesTableName: deliveriesTable,
+
+			importsTableName: importsTable,
 		},
 	}
 
@@ -105,6 +312,13 @@ func Open() (*NotablyDB, error) {
 		return nil, fmt.Errorf("failed to open DB: %s", err.Error())
 	}
 
-	ourDB := NotablyDB{theDB}
+	// The change journal starts afresh, with sequence numbers from 1 again, so it gets
+	// an ID of its own, for telling its sequence numbers from those of any before it.
+	journalID, err := ourutils.GenerateKsuidAsString()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB, error generating the change journal ID: %s", err.Error())
+	}
+
+	ourDB := NotablyDB{MemDB: theDB, journalID: journalID}
 	return &ourDB, nil
 }
@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"fmt"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+// The most changes a client can send in one sync.
+const MaxSyncChanges = 1000
+
+// SyncNotesForUser syncs a client's copy of the user's notes. The changes the client
+// made are made first, each on its own, so that one which fails (say, because it would
+// take the user over their quota) doesn't hold up the others. Then come all the changes
+// to the user's notes after the change with the given sequence number, which include
+// the client's own. Less than zero means the client has never synced, and gets all the
+// notes, as it does when the change journal no longer goes back that far.
+//
+// A change which was made on a version of the note which isn't the latest is a conflict,
+// which is resolved without losing anybody's text (see the model.SyncResolutions):
+// edits always win over deletes, and an edit which clashes with another edit is saved
+// as a new note, for the user to sort out.
+func (db *NotablyDB) SyncNotesForUser(userID string, afterSeq int64, changes []model.SyncChange) (
+	_ *model.NoteSync, err error) {
+	db, done := db.observe("SyncNotesForUser", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	userID, ok := ourutils.ValidateStringNotempty(userID)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot sync notes for blank/empty user", ErrInvalidInput)
+	}
+	if len(changes) > MaxSyncChanges {
+		return nil, fmt.Errorf("%w: can sync at most %d changes at once, not %d",
+			ErrInvalidInput, MaxSyncChanges, len(changes))
+	}
+
+	// Ensure that the given userID exists in the system.
+	_, err = db.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sync notes for user '%s', error getting user: %w", userID, err)
+	}
+
+	noteSync := &model.NoteSync{Results: []*model.SyncResult{}, Notes: []*model.SyncedNote{}}
+	for _, change := range changes {
+		result := db.syncChange(userID, change)
+		if result.Err != nil {
+			db.log().Debug("Sync change failed", "user_id", userID, "note_id", change.NoteID,
+				"client_ref", change.ClientRef, "error", result.Err.Error())
+		}
+		noteSync.Results = append(noteSync.Results, result)
+	}
+
+	page, _, err := db.GetNoteChangesForUser(userID, afterSeq, MaxChangePageLimit)
+	if err != nil {
+		return nil, err
+	}
+	noteSync.Seq = page.Seq
+
+	if afterSeq < 0 || page.Truncated {
+		// The notes are read after where the journal is up to, so none of the changes
+		// in between can be missed. Some may be sent again next time, which is harmless.
+		notes, err := db.GetAllNotesForUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			noteSync.Notes = append(noteSync.Notes, &model.SyncedNote{NoteID: note.NoteID, Version: note.Version, Note: note})
+		}
+		noteSync.Reset = true
+		db.log().Debug("Synced all notes", "user_id", userID, "after_seq", afterSeq, "seq", noteSync.Seq,
+			"changes", len(changes), "count", len(noteSync.Notes))
+		return noteSync, nil
+	}
+
+	// Each note is sent once, as it is now, however many times it has changed.
+	index := make(map[string]int)
+	for _, change := range page.Changes {
+		synced := &model.SyncedNote{NoteID: change.NoteID, Version: change.Seq, Deleted: change.Note == nil, Note: change.Note}
+		if change.Note != nil {
+			synced.Version = change.Note.Version
+		}
+		if i, ok := index[change.NoteID]; ok {
+			noteSync.Notes[i] = synced
+			continue
+		}
+		index[change.NoteID] = len(noteSync.Notes)
+		noteSync.Notes = append(noteSync.Notes, synced)
+	}
+	// A full page means there may be more.
+	noteSync.HasMore = len(page.Changes) == MaxChangePageLimit
+
+	db.log().Debug("Synced notes", "user_id", userID, "after_seq", afterSeq, "seq", noteSync.Seq,
+		"changes", len(changes), "count", len(noteSync.Notes), "has_more", noteSync.HasMore)
+	return noteSync, nil
+}
+
+// syncChange makes one of the changes of a sync, in a write transaction of its own.
+func (db *NotablyDB) syncChange(userID string, change model.SyncChange) *model.SyncResult {
+	result := &model.SyncResult{ClientRef: change.ClientRef, NoteID: change.NoteID}
+	fail := func(err error) *model.SyncResult {
+		result.Status, result.Note, result.Err = model.SyncStatusFailed, nil, err
+		return result
+	}
+
+	if !change.Deleted {
+		if change.Note == "" {
+			return fail(fmt.Errorf("%w: cannot sync a note when the note text is empty", ErrInvalidNote))
+		}
+		if err := db.checkNoteSize(change.Note); err != nil {
+			return fail(err)
+		}
+	}
+	if change.NoteID == "" && change.Deleted {
+		return fail(fmt.Errorf("%w: need a note ID to delete a note", ErrInvalidInput))
+	}
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	var current *model.Note
+	if change.NoteID != "" {
+		raw, err := txn.First(notesTableName, "id", change.NoteID, userID)
+		if err != nil {
+			return fail(fmt.Errorf("error getting note with ID '%s' for user '%s': %s",
+				change.NoteID, userID, err.Error()))
+		}
+		if raw != nil {
+			found := raw.(model.Note)
+			current = &found
+		}
+	}
+
+	// newNote saves the change's text as a new note.
+	newNote := func() error {
+		noteID, err := ourutils.GenerateKsuidAsString()
+		if err != nil {
+			return fmt.Errorf("failed generating noteID: %v", err)
+		}
+		result.NoteID = noteID
+		result.Note, err = db.putNote(txn, userID, noteID, change.Note, nil)
+		return err
+	}
+
+	var err error
+	switch {
+	case change.NoteID == "":
+		result.Status = model.SyncStatusApplied
+		err = newNote()
+
+	case change.Deleted && current == nil:
+		// Already gone, which is what the client wanted.
+		result.Status = model.SyncStatusApplied
+
+	case change.Deleted && current.Version != change.BaseVersion:
+		// The client deleted a note it hadn't seen the latest of, which stays.
+		result.Status, result.Resolution, result.Note = model.SyncStatusConflict, model.SyncResolutionKept, current
+
+	case change.Deleted:
+		result.Status = model.SyncStatusApplied
+		if err = db.chargeUsage(txn, userID, -1, -int64(len(current.Note))); err != nil {
+			break
+		}
+		if err = recordChange(txn, model.NoteChangeDeleted, userID, current.NoteID, nil); err != nil {
+			break
+		}
+		if _, err = txn.DeleteAll(notesTableName, "id", current.NoteID, userID); err != nil {
+			err = fmt.Errorf("error deleting note for user '%s' noteID '%s': %s", userID, current.NoteID, err.Error())
+		}
+
+	case current == nil:
+		// Deleted meanwhile (or never there at all). The client's edit lives on.
+		result.Status, result.Resolution = model.SyncStatusConflict, model.SyncResolutionRecreated
+		err = newNote()
+
+	case current.Version == change.BaseVersion:
+		result.Status = model.SyncStatusApplied
+		result.Note, err = db.putNote(txn, userID, current.NoteID, change.Note, current)
+
+	case current.Note == change.Note:
+		// Both sides made the same edit, which is no conflict at all.
+		result.Status, result.Note = model.SyncStatusApplied, current
+
+	default:
+		// Edited on both sides. The note keeps the other edit, and this one becomes a new note.
+		result.Status, result.Resolution = model.SyncStatusConflict, model.SyncResolutionCopied
+		err = newNote()
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	txn.Commit()
+	return result
+}
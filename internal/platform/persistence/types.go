@@ -1,7 +1,15 @@
 package persistence
 
 import (
+	"context"
+	"log/slog"
+
 	"github.com/hashicorp/go-memdb"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
 )
 
 // This will be used as a method receiver for persistence operations.
@@ -13,4 +21,73 @@ import (
 // persistence methods.
 type NotablyDB struct {
 	*memdb.MemDB
+
+	logger *slog.Logger    // Nil means slog.Default().
+	ctx    context.Context // Of the request, for tracing. Nil means context.Background().
+	quota  model.Quota     // The zero value means no limits.
+
+	journalID string // See JournalID().
+
+	untraced bool // For background work, which would only clutter the traces.
+}
+
+// WithLogger returns the same database, logging with the given logger, e.g. one
+// which tags every log line with the request ID.
+func (db *NotablyDB) WithLogger(logger *slog.Logger) *NotablyDB {
+	withLogger := *db
+	withLogger.logger = logger
+	return &withLogger
+}
+
+// WithContext returns the same database, whose operations are traced as part of
+// the trace in the given context, e.g. the request's.
+func (db *NotablyDB) WithContext(ctx context.Context) *NotablyDB {
+	withContext := *db
+	withContext.ctx = ctx
+	return &withContext
+}
+
+// WithoutTracing returns the same database, whose operations aren't traced, e.g. for
+// background work which would only clutter the traces. They're still in the metrics.
+func (db *NotablyDB) WithoutTracing() *NotablyDB {
+	withoutTracing := *db
+	withoutTracing.untraced = true
+	return &withoutTracing
+}
+
+// WithQuota returns the same database, which holds each user to the given quota
+// when adding and updating notes.
+func (db *NotablyDB) WithQuota(quota model.Quota) *NotablyDB {
+	withQuota := *db
+	withQuota.quota = quota
+	return &withQuota
+}
+
+// Quota is the quota which users are held to.
+func (db *NotablyDB) Quota() model.Quota {
+	return db.quota
+}
+
+// context is the context to trace operations in.
+func (db *NotablyDB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+// tracer is the tracer to trace operations with.
+func (db *NotablyDB) tracer() trace.Tracer {
+	if db.untraced {
+		return noop.NewTracerProvider().Tracer(tracing.Name)
+	}
+	return tracing.Tracer()
+}
+
+// log is the logger to use. Never log note text or password hashes.
+func (db *NotablyDB) log() *slog.Logger {
+	if db.logger == nil {
+		return slog.Default()
+	}
+	return db.logger
 }
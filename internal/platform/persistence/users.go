@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"notably/internal/model"
+	"notably/internal/platform/tracing"
 	ourutils "notably/internal/utils"
 )
 
@@ -14,31 +15,37 @@ import (
 // need to be *sql.DB (assuming the use of the database/sql package)
 // NOTE: IMPORTANT: in go-memdb, txn.Insert() is actually an upsert.
 
-func (db *NotablyDB) AddUser(userID, passwordHash string) (*model.User, error) {
+func (db *NotablyDB) AddUser(userID, passwordHash string) (_ *model.User, err error) {
+	db, done := db.observe("AddUser", tracing.User(userID))
+	defer done(&err)
+
 	// TODO: When implementing user update/modify properly, refactor this method to be like AddOrUpdateNoteForUser()
 	// Sanity checks
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
-		return nil, errors.New("cannot add user because userID is empty/blank")
+		return nil, fmt.Errorf("%w: cannot add user because userID is empty/blank", ErrInvalidInput)
 	}
 
 	passwordHash, ok = ourutils.ValidateStringNotempty(passwordHash)
 	if !ok {
-		return nil, errors.New("cannot add user because password hash is empty/blank")
+		return nil, fmt.Errorf("%w: cannot add user because password hash is empty/blank", ErrInvalidInput)
 	}
 
 	// Check whether user already exists
-	_, err := db.GetUserByID(userID)
+	_, err = db.GetUserByID(userID)
 	if err == nil {
 		// Uh oh...
-		return nil, fmt.Errorf("user '%s' already exists", userID)
+		return nil, fmt.Errorf("%w: '%s'", ErrUserExists, userID)
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, fmt.Errorf("failed adding user '%s': %w", userID, err)
 	}
 
 	// Set the creation timestamp to  the current time, as seconds after Unix epoch
 	creationTimestamp := time.Now().Unix()
 
 	user := model.User{UserID: userID, PasswordHash: passwordHash, CreationTimestamp: creationTimestamp}
-	txn := db.Txn(true) // Create a write transaction
+	txn := db.txn(true) // Create a write transaction
 	err = txn.Insert(usersTableName, user)
 	if err != nil {
 		txn.Abort() // go-memdb should have called this method Rollback() to be in line with database/sql. Oh well.
@@ -46,19 +53,23 @@ func (db *NotablyDB) AddUser(userID, passwordHash string) (*model.User, error) {
 	}
 
 	txn.Commit()
+	db.log().Debug("Added user", "user_id", userID)
 	return &user, nil
 }
 
-func (db *NotablyDB) GetUserByID(userID string) (*model.User, error) {
+func (db *NotablyDB) GetUserByID(userID string) (_ *model.User, err error) {
+	db, done := db.observe("GetUserByID", tracing.User(userID))
+	defer done(&err)
+
 	// Sanity checks
 	userID, ok := ourutils.ValidateStringNotempty(userID)
 	if !ok {
-		return nil, errors.New("cannot search for user because userID is empty")
+		return nil, fmt.Errorf("%w: cannot search for user because userID is empty", ErrInvalidInput)
 	}
 
 	// Create read-only transaction.
 	// For go-memdb, RO txn abort is basically a no-op, and one does not commit a RO txn.
-	txn := db.Txn(false)
+	txn := db.txn(false)
 	defer txn.Abort()
 
 	raw, err := txn.First(usersTableName, "id", userID)
@@ -67,16 +78,19 @@ func (db *NotablyDB) GetUserByID(userID string) (*model.User, error) {
 	}
 
 	if raw == nil {
-		return nil, fmt.Errorf("user not found: Nil result from DB for user '%s'", userID)
+		return nil, fmt.Errorf("%w: Nil result from DB for user '%s'", ErrUserNotFound, userID)
 	}
 
 	user := raw.(model.User) // The go-memdb example is wrong here.
 	return &user, nil
 }
 
-func (db *NotablyDB) GetAllUsers() ([]*model.User, error) {
+func (db *NotablyDB) GetAllUsers() (_ []*model.User, err error) {
+	db, done := db.observe("GetAllUsers")
+	defer done(&err)
+
 	// See note above on read-only txns
-	txn := db.Txn(false)
+	txn := db.txn(false)
 	defer txn.Abort()
 
 	iter, err := txn.Get(usersTableName, "id")
@@ -0,0 +1,482 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+
+	"notably/internal/model"
+	"notably/internal/platform/tracing"
+	ourutils "notably/internal/utils"
+)
+
+const (
+	// The most webhooks a user can have, as can the admins, between them.
+	MaxWebhooks = 10
+
+	// How many deliveries each webhook's delivery log keeps. Once it's full, the oldest
+	// delivered or dead one is dropped for each new one. Pending ones are never dropped.
+	MaxWebhookDeliveries = 1000
+
+	// Page sizes for GetWebhookDeliveriesPage().
+	DefaultDeliveryPageLimit = 100
+	MaxDeliveryPageLimit     = 1000
+)
+
+// The webhook events which come from the audit log: a user's account events.
+var auditWebhookEvents = []string{
+	model.WebhookEventUserRegister, model.WebhookEventSessionLogin, model.WebhookEventSessionLogout,
+}
+
+// AddWebhook registers a webhook for the user, or for the admins, when the user ID is
+// empty. It gets the webhook's ID and secret, which is only ever given out here.
+func (db *NotablyDB) AddWebhook(userID, webhookURL string, events []string) (_ *model.Webhook, err error) {
+	db, done := db.observe("AddWebhook", tracing.User(userID))
+	defer done(&err)
+
+	// Sanity
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: webhook URL '%s' is not an absolute http(s) URL", ErrInvalidInput, webhookURL)
+	}
+	for _, event := range events {
+		if !slices.Contains(model.WebhookEventTypes, event) {
+			return nil, fmt.Errorf("%w: '%s' is not a webhook event type", ErrInvalidInput, event)
+		}
+	}
+
+	webhookID, err := ourutils.GenerateKsuidAsString()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating webhookID: %v", err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed generating webhook secret: %v", err)
+	}
+	webhook := model.Webhook{
+		WebhookID:         webhookID,
+		UserID:            userID,
+		URL:               u.String(),
+		Events:            slices.Clone(events),
+		Secret:            hex.EncodeToString(secret),
+		CreationTimestamp: time.Now().Unix(), // seconds since Unix epoch
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	slices.Sort(webhook.Events)
+	webhook.Events = slices.Compact(webhook.Events)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	if userID != "" {
+		// Ensure that the given userID exists in the system.
+		rawUser, err := txn.First(usersTableName, "id", userID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting user with ID '%s': %s", userID, err.Error())
+		}
+		if rawUser == nil {
+			return nil, fmt.Errorf("cannot add webhook for user '%s': %w", userID, ErrUserNotFound)
+		}
+	}
+
+	existing, err := ownWebhooks(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= MaxWebhooks {
+		return nil, fmt.Errorf("%w: can have at most %d webhooks", ErrQuotaExceeded, MaxWebhooks)
+	}
+
+	if err := txn.Insert(webhooksTableName, webhook); err != nil {
+		return nil, fmt.Errorf("failed adding webhook for user '%s': %s", userID, err.Error())
+	}
+
+	txn.Commit()
+	db.log().Debug("Added webhook", "user_id", userID, "webhook_id", webhookID, "events", webhook.Events)
+	return &webhook, nil
+}
+
+// ownWebhooks gets the user's webhooks, or the admins', when the user ID is empty,
+// oldest first.
+func ownWebhooks(txn *tracedTxn, userID string) ([]*model.Webhook, error) {
+	var iter memdb.ResultIterator
+	var err error
+	if userID == "" {
+		iter, err = txn.Get(webhooksTableName, "admin", true)
+	} else {
+		iter, err = txn.Get(webhooksTableName, "userID", userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhooks for user '%s': %s", userID, err.Error())
+	}
+	webhooks := []*model.Webhook{}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		webhook := obj.(model.Webhook)
+		webhooks = append(webhooks, &webhook)
+	}
+	slices.SortFunc(webhooks, func(a, b *model.Webhook) int {
+		return strings.Compare(a.WebhookID, b.WebhookID)
+	})
+	return webhooks, nil
+}
+
+// ownWebhook gets one of the user's webhooks, or one of the admins', when the user
+// ID is empty. Anybody else's is not found.
+func ownWebhook(txn *tracedTxn, userID, webhookID string) (*model.Webhook, error) {
+	webhook, err := webhookByID(txn, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil || webhook.UserID != userID {
+		return nil, fmt.Errorf("%w: no webhook with ID '%s' for user '%s'", ErrWebhookNotFound, webhookID, userID)
+	}
+	return webhook, nil
+}
+
+// webhookByID gets a webhook, whoever's it is, or nil if there's no such webhook.
+func webhookByID(txn *tracedTxn, webhookID string) (*model.Webhook, error) {
+	raw, err := txn.First(webhooksTableName, "id", webhookID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhook with ID '%s': %s", webhookID, err.Error())
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	webhook := raw.(model.Webhook)
+	return &webhook, nil
+}
+
+// GetWebhooks gets the user's webhooks, or the admins', when the user ID is empty,
+// oldest first, without their secrets.
+func (db *NotablyDB) GetWebhooks(userID string) (_ []*model.Webhook, err error) {
+	db, done := db.observe("GetWebhooks", tracing.User(userID))
+	defer done(&err)
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	webhooks, err := ownWebhooks(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	return webhooks, nil
+}
+
+// GetWebhook gets one of the user's webhooks, or one of the admins', when the user
+// ID is empty, without its secret.
+func (db *NotablyDB) GetWebhook(userID, webhookID string) (_ *model.Webhook, err error) {
+	db, done := db.observe("GetWebhook", tracing.User(userID))
+	defer done(&err)
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	webhook, err := ownWebhook(txn, userID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Secret = ""
+	return webhook, nil
+}
+
+// DeleteWebhook deletes one of the user's webhooks, or one of the admins', when the
+// user ID is empty, along with its deliveries, including any still to be delivered.
+func (db *NotablyDB) DeleteWebhook(userID, webhookID string) (err error) {
+	db, done := db.observe("DeleteWebhook", tracing.User(userID))
+	defer done(&err)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	if _, err := ownWebhook(txn, userID, webhookID); err != nil {
+		return err
+	}
+	if _, err := txn.DeleteAll(webhooksTableName, "id", webhookID); err != nil {
+		return fmt.Errorf("error deleting webhook '%s': %s", webhookID, err.Error())
+	}
+	numDel, err := txn.DeleteAll(deliveriesTableName, "webhook_prefix", webhookID)
+	if err != nil {
+		return fmt.Errorf("error deleting the deliveries of webhook '%s': %s", webhookID, err.Error())
+	}
+
+	txn.Commit()
+	db.log().Debug("Deleted webhook", "user_id", userID, "webhook_id", webhookID, "deliveries", numDel)
+	return nil
+}
+
+// enqueueWebhookEvent puts the event in the outbox, for each of the webhooks which want
+// it: the user's own, and the admins'. It's done in the write transaction which makes
+// the change the event is about, so that the webhooks get every change which was
+// committed, and only those.
+func enqueueWebhookEvent(txn *tracedTxn, event model.WebhookEvent) error {
+	webhooks, err := ownWebhooks(txn, "")
+	if err != nil {
+		return err
+	}
+	if event.UserID != "" {
+		users, err := ownWebhooks(txn, event.UserID)
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, users...)
+	}
+
+	var seq int64
+	last, err := txn.Last(deliveriesTableName, "seq")
+	if err != nil {
+		return fmt.Errorf("failed getting the last webhook delivery: %s", err.Error())
+	}
+	if last != nil {
+		seq = last.(model.WebhookDelivery).Seq
+	}
+
+	now := time.Now()
+	for _, webhook := range webhooks {
+		if len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event.Type) {
+			continue
+		}
+		if event.EventID == "" {
+			// Only made when there's a webhook to send it to.
+			if event.EventID, err = ourutils.GenerateKsuidAsString(); err != nil {
+				return fmt.Errorf("failed generating webhook event ID: %v", err)
+			}
+		}
+		deliveryID, err := ourutils.GenerateKsuidAsString()
+		if err != nil {
+			return fmt.Errorf("failed generating webhook deliveryID: %v", err)
+		}
+		seq++
+		delivery := model.WebhookDelivery{
+			DeliveryID:        deliveryID,
+			Seq:               seq,
+			WebhookID:         webhook.WebhookID,
+			Event:             event,
+			Status:            model.WebhookDeliveryPending,
+			CreationTimestamp: now.Unix(),
+			NextAttemptMillis: now.UnixMilli(),
+		}
+		if err := txn.Insert(deliveriesTableName, delivery); err != nil {
+			return fmt.Errorf("failed adding %s delivery for webhook '%s': %s", event.Type, webhook.WebhookID, err.Error())
+		}
+		if err := trimDeliveryLog(txn, webhook.WebhookID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimDeliveryLog drops the webhook's oldest finished deliveries, when it has more than
+// MaxWebhookDeliveries.
+func trimDeliveryLog(txn *tracedTxn, webhookID string) error {
+	iter, err := txn.Get(deliveriesTableName, "webhook_prefix", webhookID)
+	if err != nil {
+		return fmt.Errorf("error getting the deliveries of webhook '%s': %s", webhookID, err.Error())
+	}
+	var deliveries []interface{}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		deliveries = append(deliveries, obj)
+	}
+	for _, obj := range deliveries {
+		if len(deliveries) <= MaxWebhookDeliveries {
+			break
+		}
+		if obj.(model.WebhookDelivery).Status == model.WebhookDeliveryPending {
+			continue
+		}
+		if err := txn.Delete(deliveriesTableName, obj); err != nil {
+			return fmt.Errorf("failed dropping an old delivery of webhook '%s': %s", webhookID, err.Error())
+		}
+		deliveries = deliveries[1:]
+	}
+	return nil
+}
+
+// GetDueWebhookDeliveries gets the pending deliveries which are due to be tried as of
+// the given time (Unix time in milliseconds), the soonest first, up to limit of them,
+// each with the webhook it's to. It also returns when the next of the others is due
+// (zero if none are), and a channel which is closed when there might be more.
+func (db *NotablyDB) GetDueWebhookDeliveries(nowMillis int64, limit int) (
+	_ []*model.DueWebhookDelivery, nextMillis int64, _ <-chan struct{}, err error) {
+	db, done := db.observe("GetDueWebhookDeliveries")
+	defer done(&err)
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	// As in GetNoteChangesForUser(), the prefix can be watched, and it's the same snapshot.
+	prefix, err := txn.Get(deliveriesTableName, "due_prefix", model.WebhookDeliveryPending)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("error watching webhook deliveries: %s", err.Error())
+	}
+	watch := prefix.WatchCh()
+
+	iter, err := txn.LowerBound(deliveriesTableName, "due", model.WebhookDeliveryPending, int64(0))
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("error getting due webhook deliveries: %s", err.Error())
+	}
+	due := []*model.DueWebhookDelivery{}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		delivery := obj.(model.WebhookDelivery)
+		if delivery.Status != model.WebhookDeliveryPending {
+			break
+		}
+		if delivery.NextAttemptMillis > nowMillis || len(due) == limit {
+			nextMillis = delivery.NextAttemptMillis
+			break
+		}
+		webhook, err := webhookByID(txn, delivery.WebhookID)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if webhook == nil {
+			continue // Can't happen: a webhook's deliveries are deleted along with it.
+		}
+		due = append(due, &model.DueWebhookDelivery{Delivery: &delivery, Webhook: webhook})
+	}
+	return due, nextMillis, watch, nil
+}
+
+// RecordWebhookAttempt records how an attempt to send a delivery went, and what's next
+// for it. A delivery which is gone, because its webhook was deleted meanwhile, is not found.
+func (db *NotablyDB) RecordWebhookAttempt(deliveryID string, attempt model.WebhookAttempt) (
+	_ *model.WebhookDelivery, err error) {
+	db, done := db.observe("RecordWebhookAttempt")
+	defer done(&err)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	raw, err := txn.First(deliveriesTableName, "id", deliveryID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhook delivery with ID '%s': %s", deliveryID, err.Error())
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("%w: no webhook delivery with ID '%s'", ErrDeliveryNotFound, deliveryID)
+	}
+	delivery := raw.(model.WebhookDelivery)
+	delivery.Status = attempt.Status
+	delivery.Attempts++
+	delivery.LastAttemptTimestamp = time.Now().Unix() // seconds since Unix epoch
+	delivery.LastStatusCode = attempt.StatusCode
+	delivery.LastError = attempt.Error
+	delivery.NextAttemptMillis = 0
+	if delivery.Status == model.WebhookDeliveryPending {
+		delivery.NextAttemptMillis = attempt.NextAttemptMillis
+	}
+	if err := txn.Insert(deliveriesTableName, delivery); err != nil {
+		return nil, fmt.Errorf("failed updating webhook delivery with ID '%s': %s", deliveryID, err.Error())
+	}
+
+	txn.Commit()
+	return &delivery, nil
+}
+
+// GetWebhookDeliveriesPage returns one page of the delivery log of one of the user's
+// webhooks, or one of the admins', when the user ID is empty, newest first, with a
+// cursor for the next page. The cursor is the sequence number of the last delivery on
+// the page.
+func (db *NotablyDB) GetWebhookDeliveriesPage(userID, webhookID string, opts model.WebhookDeliveryListOptions) (
+	_ *model.WebhookDeliveryPage, err error) {
+	db, done := db.observe("GetWebhookDeliveriesPage", tracing.User(userID))
+	defer done(&err)
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultDeliveryPageLimit
+	} else if limit > MaxDeliveryPageLimit {
+		limit = MaxDeliveryPageLimit
+	}
+
+	var before int64
+	if opts.Cursor != "" {
+		before, err = strconv.ParseInt(opts.Cursor, 10, 64)
+		if err != nil || before <= 0 {
+			return nil, fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+		}
+	}
+
+	txn := db.txn(false) // RO txn
+	defer txn.Abort()
+
+	if _, err := ownWebhook(txn, userID, webhookID); err != nil {
+		return nil, err
+	}
+
+	var iter memdb.ResultIterator
+	if before > 0 {
+		iter, err = txn.ReverseLowerBound(deliveriesTableName, "webhook", webhookID, before-1)
+	} else {
+		iter, err = txn.GetReverse(deliveriesTableName, "webhook_prefix", webhookID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting the deliveries of webhook '%s': %s", webhookID, err.Error())
+	}
+
+	page := &model.WebhookDeliveryPage{Deliveries: []*model.WebhookDelivery{}}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		delivery := obj.(model.WebhookDelivery)
+		if delivery.WebhookID != webhookID {
+			break
+		}
+		if opts.Status != "" && delivery.Status != opts.Status {
+			continue
+		}
+		if len(page.Deliveries) == limit {
+			// There's at least one more, so there's a next page.
+			page.NextCursor = strconv.FormatInt(page.Deliveries[limit-1].Seq, 10)
+			break
+		}
+		page.Deliveries = append(page.Deliveries, &delivery)
+	}
+	return page, nil
+}
+
+// RetryWebhookDelivery sends a delivery of one of the user's webhooks, or one of the
+// admins', when the user ID is empty, again, from its first attempt. It's for dead
+// deliveries, once the webhook is fixed, but delivered ones can be sent again too.
+// One which is still pending is left as it is.
+func (db *NotablyDB) RetryWebhookDelivery(userID, webhookID, deliveryID string) (_ *model.WebhookDelivery, err error) {
+	db, done := db.observe("RetryWebhookDelivery", tracing.User(userID))
+	defer done(&err)
+
+	txn := db.txn(true) // Write txn
+	defer txn.Abort()   // A no-op once we have committed.
+
+	if _, err := ownWebhook(txn, userID, webhookID); err != nil {
+		return nil, err
+	}
+	raw, err := txn.First(deliveriesTableName, "id", deliveryID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhook delivery with ID '%s': %s", deliveryID, err.Error())
+	}
+	if raw == nil || raw.(model.WebhookDelivery).WebhookID != webhookID {
+		return nil, fmt.Errorf("%w: no delivery with ID '%s' for webhook '%s'", ErrDeliveryNotFound, deliveryID, webhookID)
+	}
+	delivery := raw.(model.WebhookDelivery)
+	if delivery.Status == model.WebhookDeliveryPending {
+		return &delivery, nil
+	}
+
+	delivery.Status = model.WebhookDeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptMillis = time.Now().UnixMilli()
+	if err := txn.Insert(deliveriesTableName, delivery); err != nil {
+		return nil, fmt.Errorf("failed updating webhook delivery with ID '%s': %s", deliveryID, err.Error())
+	}
+
+	txn.Commit()
+	db.log().Debug("Retrying webhook delivery", "user_id", userID, "webhook_id", webhookID, "delivery_id", deliveryID)
+	return &delivery, nil
+}
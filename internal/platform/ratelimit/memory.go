@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How often MemoryStore forgets the buckets which have refilled, since a full bucket
+// is the same as no bucket.
+const sweepInterval = time.Minute
+
+// MemoryStore is a Store which keeps the buckets in memory, so they aren't shared
+// with any other instance.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSwept time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	full time.Time // When it'll be full again.
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+// Take implements Store.
+func (ms *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if now.Sub(ms.lastSwept) >= sweepInterval {
+		ms.sweep(now)
+	}
+
+	bucket, ok := ms.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{}
+		ms.buckets[key] = bucket
+	}
+	result := bucket.Take(limit, now)
+	bucket.full = bucket.Full(limit)
+	return result, nil
+}
+
+// Len is how many buckets there are, including any full ones which haven't been forgotten yet.
+func (ms *MemoryStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.buckets)
+}
+
+func (ms *MemoryStore) sweep(now time.Time) {
+	for key, bucket := range ms.buckets {
+		if !now.Before(bucket.full) {
+			delete(ms.buckets, key)
+		}
+	}
+	ms.lastSwept = now
+}
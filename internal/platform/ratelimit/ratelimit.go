@@ -0,0 +1,87 @@
+// Package ratelimit is token bucket rate limiting. Each client (say, a user, or an IP
+// address) has a bucket of tokens, which refills at a steady rate up to its burst
+// size, and each request takes a token. No token, no request.
+//
+// The buckets are kept in a Store. MemoryStore keeps them in memory, which is fine
+// for one instance of notablyd. For several instances to share their limits, they
+// need a Store which they share, e.g. one backed by Redis, which can do the sums
+// with Bucket.Take, the same as MemoryStore does.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit is how fast a bucket refills, and how many tokens it holds.
+type Limit struct {
+	Rate  float64 // Tokens per second.
+	Burst int     // The most tokens a bucket holds, i.e. the most requests at once.
+}
+
+// PerMinute is the limit of perMinute requests a minute, on average, and burst at once.
+func PerMinute(perMinute float64, burst int) Limit {
+	return Limit{Rate: perMinute / 60, Burst: burst}
+}
+
+// Unlimited tells whether the limit doesn't limit anything.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Result is how taking a token went.
+type Result struct {
+	Allowed    bool          // Whether there was a token.
+	Limit      int           // The burst size.
+	Remaining  int           // The whole tokens left.
+	RetryAfter time.Duration // Until there's a token, if there wasn't one. Otherwise 0.
+	ResetAfter time.Duration // Until the bucket is full again.
+}
+
+// Store keeps the buckets, by key. It is safe for concurrent use.
+type Store interface {
+	// Take takes a token from the key's bucket, if there is one, with the bucket having
+	// refilled at the limit's rate since it was last taken from. A key without a bucket
+	// starts with a full one.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Bucket is the state of a token bucket, which is all a Store needs to keep.
+// The zero value is a bucket which has never been taken from.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time // When Tokens was worked out. Zero means it's never been taken from.
+}
+
+// Take refills the bucket for the time since it was updated, and then takes a
+// token from it, if there is one.
+func (b *Bucket) Take(limit Limit, now time.Time) Result {
+	burst := float64(limit.Burst)
+	if b.Updated.IsZero() {
+		b.Tokens = burst
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+elapsed*limit.Rate)
+	}
+	b.Updated = now
+
+	result := Result{Limit: limit.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.Tokens) / limit.Rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.ResetAfter = secondsDuration((burst - b.Tokens) / limit.Rate)
+	return result
+}
+
+// Full is when the bucket will be full again, if it's not taken from.
+func (b *Bucket) Full(limit Limit) time.Time {
+	return b.Updated.Add(secondsDuration((float64(limit.Burst) - b.Tokens) / limit.Rate))
+}
+
+func secondsDuration(secs float64) time.Duration {
+	return time.Duration(math.Ceil(secs * float64(time.Second)))
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	limit := PerMinute(60, 3) // A token a second, three at once.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	take := func(key string) Result {
+		result, err := store.Take(ctx, key, limit, now)
+		if err != nil {
+			t.Fatalf("Failed taking a token: %v", err)
+		}
+		return result
+	}
+
+	fmt.Println("TEST RATE LIMIT: A full bucket allows the burst, and then no more")
+	for i := 2; i >= 0; i-- {
+		result := take("a")
+		if !result.Allowed || result.Remaining != i || result.Limit != 3 {
+			t.Fatalf("Expected to be allowed with %d remaining, got %+v", i, result)
+		}
+	}
+	result := take("a")
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter != time.Second || result.ResetAfter != 3*time.Second {
+		t.Fatalf("Expected not to be allowed for another second, got %+v", result)
+	}
+
+	fmt.Println("TEST RATE LIMIT: Other keys have their own buckets")
+	if result := take("b"); !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("Expected another key to be allowed, got %+v", result)
+	}
+
+	fmt.Println("TEST RATE LIMIT: The bucket refills at the rate")
+	now = now.Add(1500 * time.Millisecond)
+	if result := take("a"); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("Expected to be allowed after a token's time, got %+v", result)
+	}
+	result = take("a")
+	if result.Allowed || result.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("Expected to wait half a second for the next token, got %+v", result)
+	}
+
+	fmt.Println("TEST RATE LIMIT: The bucket refills no further than the burst")
+	now = now.Add(time.Hour)
+	for i := 2; i >= 0; i-- {
+		if result := take("a"); !result.Allowed || result.Remaining != i {
+			t.Fatalf("Expected to be allowed with %d remaining, got %+v", i, result)
+		}
+	}
+	if result := take("a"); result.Allowed {
+		t.Fatalf("Expected the burst to be all there is, got %+v", result)
+	}
+
+	fmt.Println("TEST RATE LIMIT: Full buckets are forgotten")
+	now = now.Add(time.Hour)
+	take("c")
+	if store.Len() != 1 {
+		t.Fatalf("Expected only the new bucket to be left, got %d buckets", store.Len())
+	}
+}
@@ -0,0 +1,55 @@
+// Package tracing is what notablyd's OpenTelemetry spans have in common: the tracer,
+// and the attributes which say who and what a span is about.
+//
+// Spans go to the global tracer provider, which drops them until notablyd sets up
+// a real one, so tracing costs next to nothing when it's turned off.
+package tracing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The instrumentation name of our spans.
+const Name = "notably"
+
+// The keys of our own span attributes.
+const (
+	UserKey   = attribute.Key("notably.user.hash")
+	NoteIDKey = attribute.Key("notably.note.id")
+	ResultKey = attribute.Key("notably.result")
+)
+
+// The values of the result attribute.
+const (
+	ResultOK          = "ok"
+	ResultNotFound    = "not_found"
+	ResultClientError = "client_error" // Other than not found.
+	ResultError       = "error"
+)
+
+// Tracer is the tracer for all our spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// User is the attribute for the user, which is a hash of their user ID, so that one
+// user's requests can be picked out without their email address being in the traces.
+func User(userID string) attribute.KeyValue {
+	sum := sha256.Sum256([]byte(userID))
+	return UserKey.String(hex.EncodeToString(sum[:8]))
+}
+
+// NoteID is the attribute for the note.
+func NoteID(noteID string) attribute.KeyValue {
+	return NoteIDKey.String(noteID)
+}
+
+// Result is the attribute for how it went, e.g. ResultOK.
+func Result(result string) attribute.KeyValue {
+	return ResultKey.String(result)
+}
@@ -0,0 +1,316 @@
+// Package webhooks delivers events to the URLs which users (and admins) have
+// registered for them. The events are put in an outbox in the store, in the same
+// write transactions as the changes they're about, and the Dispatcher takes them out
+// and POSTs them, as JSON, to the webhooks. A delivery which fails is tried again,
+// waiting twice as long each time, until it has been tried too many times, when it's
+// dead, and left in the delivery log for the webhook's owner to see, and retry.
+//
+// Each delivery is signed with the webhook's secret, so that the webhook can tell
+// that it came from us (see Sign and Verify).
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/metrics"
+)
+
+// The headers of a delivery, other than Content-Type.
+const (
+	SignatureHeader = "X-Notably-Signature" // See Sign.
+	EventHeader     = "X-Notably-Event"     // The event type, e.g. "note.created".
+	DeliveryHeader  = "X-Notably-Delivery"  // The delivery ID, which is the same for each attempt.
+)
+
+// The defaults of the Options.
+const (
+	DefaultMaxAttempts = 8
+	DefaultMinBackoff  = 10 * time.Second
+	DefaultMaxBackoff  = time.Hour
+	DefaultTimeout     = 10 * time.Second
+)
+
+const (
+	// How many deliveries are taken out of the outbox at once, and sent at the same time.
+	batchSize = 16
+
+	// How long to wait before looking in the outbox again, when it couldn't be read.
+	storeRetryInterval = 5 * time.Second
+
+	// How much of a webhook's response is read, so that the connection can be reused.
+	// The rest of it doesn't matter.
+	maxResponseBytes = 64 << 10
+
+	userAgent = "notablyd-webhooks"
+)
+
+// ErrPrivateAddress is the error of a delivery to a webhook on a loopback or private
+// network address, unless they're allowed, so that webhooks can't be used to poke
+// around the network we're on.
+var ErrPrivateAddress = errors.New("webhook address is not public")
+
+// ErrBadSignature is the error from Verify when the signature isn't right.
+var ErrBadSignature = errors.New("bad webhook signature")
+
+// Store is where the outbox is, e.g. a persistence.NotablyDB.
+type Store interface {
+	GetDueWebhookDeliveries(nowMillis int64, limit int) ([]*model.DueWebhookDelivery, int64, <-chan struct{}, error)
+	RecordWebhookAttempt(deliveryID string, attempt model.WebhookAttempt) (*model.WebhookDelivery, error)
+}
+
+// Options for delivering webhooks. The zero value has the defaults.
+type Options struct {
+	MaxAttempts int           // Before a delivery is dead. <= 0 means DefaultMaxAttempts.
+	MinBackoff  time.Duration // Before the first retry, doubling for each after. <= 0 means DefaultMinBackoff.
+	MaxBackoff  time.Duration // The longest between retries. <= 0 means DefaultMaxBackoff.
+	Timeout     time.Duration // For each attempt. <= 0 means DefaultTimeout.
+
+	// Whether webhooks can be on loopback and private network addresses, e.g. for testing.
+	AllowPrivateAddresses bool
+}
+
+// Dispatcher delivers the webhook deliveries in the store's outbox, as they become due.
+type Dispatcher struct {
+	store  Store
+	opts   Options
+	client *http.Client
+}
+
+// NewDispatcher returns a Dispatcher for the store's outbox.
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	opts.MaxBackoff = max(opts.MaxBackoff, opts.MinBackoff)
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !opts.AllowPrivateAddresses {
+		// The address is checked as it's connected to, after the name has been looked
+		// up, so that a name can't be pointed somewhere else after it was checked.
+		// A proxy would do the connecting itself, so there's none.
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkAddress}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+	client := &http.Client{
+		Transport: transport,
+		// A redirect is a failure, rather than being followed somewhere we haven't checked.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &Dispatcher{store: store, opts: opts, client: client}
+}
+
+// checkAddress is a net.Dialer Control function which refuses to connect to a
+// loopback or private network address.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+// Run delivers the deliveries as they become due, until the context is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	slog.Info("Delivering webhooks", "max_attempts", d.opts.MaxAttempts, "min_backoff", d.opts.MinBackoff,
+		"max_backoff", d.opts.MaxBackoff, "allow_private_addresses", d.opts.AllowPrivateAddresses)
+	for {
+		if ctx.Err() != nil {
+			// Checked first, since deliveries cut short by it aren't recorded, so they're
+			// still due, and there'd be no waiting for them.
+			slog.Info("Stopped delivering webhooks")
+			return
+		}
+
+		due, nextMillis, watch, err := d.store.GetDueWebhookDeliveries(time.Now().UnixMilli(), batchSize)
+		if err != nil {
+			slog.Error("Can't get webhook deliveries", "error", err.Error())
+			due, nextMillis, watch = nil, time.Now().Add(storeRetryInterval).UnixMilli(), nil
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range due {
+			wg.Add(1)
+			go func(delivery *model.DueWebhookDelivery) {
+				defer wg.Done()
+				d.deliver(ctx, delivery)
+			}(delivery)
+		}
+		wg.Wait()
+		if len(due) > 0 {
+			// Delivering them changed the outbox, and the watch, so there's no waiting.
+			continue
+		}
+
+		// Nothing's due, so wait for the next which will be, or for more.
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if nextMillis > 0 {
+			timer = time.NewTimer(time.Until(time.UnixMilli(nextMillis)))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped delivering webhooks")
+			return
+		case <-watch:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// deliver makes an attempt to send a delivery, and records how it went.
+func (d *Dispatcher) deliver(ctx context.Context, due *model.DueWebhookDelivery) {
+	delivery, webhook := due.Delivery, due.Webhook
+	attempt := model.WebhookAttempt{Status: model.WebhookDeliveryDelivered}
+	statusCode, err := d.send(ctx, delivery, webhook)
+	if ctx.Err() != nil {
+		return // Shutting down, which is no fault of the webhook's. It's tried again next time.
+	}
+	attempt.StatusCode = statusCode
+	if err != nil {
+		attempt.Error = err.Error()
+		if attempts := delivery.Attempts + 1; attempts >= d.opts.MaxAttempts {
+			attempt.Status = model.WebhookDeliveryDead
+		} else {
+			attempt.Status = model.WebhookDeliveryPending
+			attempt.NextAttemptMillis = time.Now().Add(d.backoff(attempts)).UnixMilli()
+		}
+	}
+
+	log := slog.With("webhook_id", webhook.WebhookID, "delivery_id", delivery.DeliveryID,
+		"event", delivery.Event.Type, "attempts", delivery.Attempts+1, "status", attempt.Status)
+	switch attempt.Status {
+	case model.WebhookDeliveryDelivered:
+		log.Debug("Delivered webhook", "status_code", statusCode)
+	case model.WebhookDeliveryPending:
+		log.Info("Webhook delivery failed, will retry", "error", attempt.Error)
+	default:
+		log.Warn("Webhook delivery failed, giving up", "error", attempt.Error)
+	}
+	metrics.ObserveWebhookAttempt(attempt.Status)
+
+	if _, err := d.store.RecordWebhookAttempt(delivery.DeliveryID, attempt); err != nil {
+		// Most likely the webhook has been deleted meanwhile, which is fine.
+		log.Debug("Can't record webhook delivery attempt", "error", err.Error())
+	}
+}
+
+// backoff is how long to wait after the given number of attempts, before the next.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.opts.MinBackoff
+	for i := 1; i < attempts && backoff < d.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.opts.MaxBackoff)
+}
+
+// send POSTs the delivery's event to the webhook, returning the status code of the
+// webhook's response, if there was one, and an error unless it was a 2xx.
+func (d *Dispatcher) send(ctx context.Context, delivery *model.WebhookDelivery, webhook *model.Webhook) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, fmt.Errorf("can't encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, time.Now(), body))
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.DeliveryID)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBytes))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign signs a delivery's body with the webhook's secret, as sent at the given time.
+// The signature is "t=<Unix timestamp>,v1=<hex HMAC-SHA256 of "<Unix timestamp>.<body>">".
+// The timestamp is signed too, so that an old delivery can't be sent again later.
+func Sign(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks a delivery's signature (the SignatureHeader), as received at the
+// given time. It must have been signed with the webhook's secret, within the
+// tolerance of then (<= 0 means any time at all).
+func Verify(secret, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			v1 = value
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: no timestamp", ErrBadSignature)
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, mac(secret, timestamp, body)) {
+		return fmt.Errorf("%w: not signed with the secret", ErrBadSignature)
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)).Abs(); tolerance > 0 && age > tolerance {
+		return fmt.Errorf("%w: signed %s from now", ErrBadSignature, age)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"notably/internal/model"
+	"notably/internal/platform/persistence"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+// receiver is a webhook, which checks the signatures, and fails as many deliveries as
+// it's told to before it starts taking them.
+type receiver struct {
+	t      *testing.T
+	secret string
+
+	mu     sync.Mutex
+	fails  int
+	events []model.WebhookEvent
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := Verify(rc.secret, r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != nil {
+		rc.t.Errorf("Expected a signed delivery, but got: %v", err)
+	}
+	var event model.WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.Type != r.Header.Get(EventHeader) || r.Header.Get(DeliveryHeader) == "" {
+		rc.t.Errorf("Expected an event, with its headers, but got %s: %v", body, err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.fails > 0 {
+		rc.fails--
+		fmt.Printf("TEST WEBHOOKS: Failing %s\n", body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Printf("TEST WEBHOOKS: Received %s\n", body)
+	rc.events = append(rc.events, event)
+}
+
+func (rc *receiver) received() []model.WebhookEvent {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]model.WebhookEvent(nil), rc.events...)
+}
+
+// setup opens a DB with a user, who has a webhook for the receiver, and starts delivering.
+func setup(t *testing.T, rc *receiver, opts Options) (db *persistence.NotablyDB, userID string, webhook *model.Webhook) {
+	db, err := persistence.Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	userID = "hooked@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding user: %v", err)
+	}
+
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	webhook, err = db.AddWebhook(userID, srv.URL+"/hook", nil)
+	if err != nil {
+		t.Fatalf("Failed adding webhook: %v", err)
+	}
+	rc.t, rc.secret = t, webhook.Secret
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go NewDispatcher(db, opts).Run(ctx)
+	return db, userID, webhook
+}
+
+// waitForDelivery waits for the webhook's latest delivery to have the given status.
+func waitForDelivery(t *testing.T, db *persistence.NotablyDB, userID, webhookID, status string) *model.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		page, err := db.GetWebhookDeliveriesPage(userID, webhookID, model.WebhookDeliveryListOptions{Limit: 1})
+		if err != nil {
+			t.Fatalf("Failed getting deliveries: %v", err)
+		}
+		if len(page.Deliveries) == 1 && page.Deliveries[0].Status == status {
+			fmt.Printf("TEST WEBHOOKS: Delivery %+v\n", *page.Deliveries[0])
+			return page.Deliveries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a %s delivery, but got %+v", status, page.Deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	rc := &receiver{fails: 2}
+	db, userID, webhook := setup(t, rc, Options{MaxAttempts: 5, MinBackoff: 10 * time.Millisecond, AllowPrivateAddresses: true})
+
+	note, err := db.AddNoteForUser(userID, "Deliver me")
+	if err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+
+	// It takes three goes.
+	delivery := waitForDelivery(t, db, userID, webhook.WebhookID, model.WebhookDeliveryDelivered)
+	if delivery.Attempts != 3 || delivery.LastStatusCode != http.StatusOK || delivery.LastError != "" {
+		t.Fatalf("Expected it delivered on the third attempt, but got %+v", *delivery)
+	}
+	events := rc.received()
+	if len(events) != 1 || events[0].Type != model.NoteChangeCreated || events[0].UserID != userID ||
+		events[0].Note == nil || events[0].Note.NoteID != note.NoteID || events[0].Note.Note != "Deliver me" {
+		t.Fatalf("Expected the note.created event, but got %+v", events)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	rc := &receiver{fails: 1000}
+	db, userID, webhook := setup(t, rc, Options{MaxAttempts: 3, MinBackoff: 10 * time.Millisecond, AllowPrivateAddresses: true})
+
+	if _, err := db.AddNoteForUser(userID, "Nobody wants me"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+
+	// It's given up on.
+	dead := waitForDelivery(t, db, userID, webhook.WebhookID, model.WebhookDeliveryDead)
+	if dead.Attempts != 3 || dead.LastStatusCode != http.StatusServiceUnavailable || !strings.Contains(dead.LastError, "503") {
+		t.Fatalf("Expected it dead after three attempts, but got %+v", *dead)
+	}
+
+	// Once the webhook is fixed, it can be retried.
+	rc.mu.Lock()
+	rc.fails = 0
+	rc.mu.Unlock()
+	if _, err := db.RetryWebhookDelivery(userID, webhook.WebhookID, dead.DeliveryID); err != nil {
+		t.Fatalf("Failed retrying delivery: %v", err)
+	}
+	delivery := waitForDelivery(t, db, userID, webhook.WebhookID, model.WebhookDeliveryDelivered)
+	if delivery.DeliveryID != dead.DeliveryID || delivery.Attempts != 1 || len(rc.received()) != 1 {
+		t.Fatalf("Expected the dead delivery delivered on retrying, but got %+v", *delivery)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	db, err := persistence.Open()
+	if err != nil {
+		t.Fatalf("Failed opening DB: %v", err)
+	}
+	userID := "hooked@testdomain.xyz"
+	if _, err := db.AddUser(userID, "cafed00d"); err != nil {
+		t.Fatalf("Failed adding user: %v", err)
+	}
+
+	// A webhook which never answers, so that the delivery is still being sent when we stop.
+	arrived := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body) // Without which, the request's context isn't done when the sender gives up.
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	webhook, err := db.AddWebhook(userID, srv.URL+"/hook", nil)
+	if err != nil {
+		t.Fatalf("Failed adding webhook: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		NewDispatcher(db, Options{AllowPrivateAddresses: true}).Run(ctx)
+		close(stopped)
+	}()
+	if _, err := db.AddNoteForUser(userID, "Too late"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the delivery to be sent")
+	}
+
+	// Stopping cuts the delivery short, and it's left for next time, without an attempt.
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the dispatcher to stop")
+	}
+	page, err := db.GetWebhookDeliveriesPage(userID, webhook.WebhookID, model.WebhookDeliveryListOptions{})
+	if err != nil {
+		t.Fatalf("Failed getting deliveries: %v", err)
+	}
+	if len(page.Deliveries) != 1 || page.Deliveries[0].Status != model.WebhookDeliveryPending || page.Deliveries[0].Attempts != 0 {
+		t.Fatalf("Expected the delivery still pending, with no attempts, but got %+v", page.Deliveries)
+	}
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	rc := &receiver{}
+	db, userID, webhook := setup(t, rc, Options{MaxAttempts: 1})
+
+	if _, err := db.AddNoteForUser(userID, "Keep out"); err != nil {
+		t.Fatalf("Failed adding note: %v", err)
+	}
+
+	// The receiver is on the loopback address, which isn't allowed.
+	dead := waitForDelivery(t, db, userID, webhook.WebhookID, model.WebhookDeliveryDead)
+	if !strings.Contains(dead.LastError, ErrPrivateAddress.Error()) || len(rc.received()) != 0 {
+		t.Fatalf("Expected the delivery to a private address refused, but got %+v", *dead)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	body := []byte(`{"type": "note.created"}`)
+	signedAt := time.Unix(1700000000, 0)
+	signature := Sign("s3cret", signedAt, body)
+	fmt.Printf("TEST WEBHOOKS: Signature %s\n", signature)
+	if !strings.HasPrefix(signature, "t=1700000000,v1=") {
+		t.Fatalf("Expected the signature to have the timestamp, but got %s", signature)
+	}
+
+	for _, tc := range []struct {
+		name, secret, signature string
+		body                    []byte
+		now                     time.Time
+		ok                      bool
+	}{
+		{"good", "s3cret", signature, body, signedAt.Add(time.Minute), true},
+		{"wrong secret", "wrong", signature, body, signedAt, false},
+		{"tampered body", "s3cret", signature, []byte(`{"type": "note.deleted"}`), signedAt, false},
+		{"too old", "s3cret", signature, body, signedAt.Add(time.Hour), false},
+		{"no timestamp", "s3cret", signature[strings.Index(signature, ",")+1:], body, signedAt, false},
+		{"garbage", "s3cret", "nonsense", body, signedAt, false},
+	} {
+		err := Verify(tc.secret, tc.signature, tc.body, 5*time.Minute, tc.now)
+		if tc.ok && err != nil {
+			t.Fatalf("%s: Expected the signature verified, but got: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("%s: Expected ErrBadSignature, but got: %v", tc.name, err)
+		}
+	}
+}
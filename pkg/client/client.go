@@ -0,0 +1,283 @@
+// Package client is the Go SDK for the Notably API.
+//
+// It talks to API v2, so the logged-in user always comes from the login session:
+//
+//	c, err := client.New("http://localhost:8080")
+//	...
+//	_, err = c.Login(ctx, "kartik@somewhere.com", "password")
+//	...
+//	note, err := c.CreateNote(ctx, "Buy milk")
+//	...
+//	it := c.Notes(ctx, client.ListOptions{Query: "milk"})
+//	for it.Next() {
+//		fmt.Println(it.Note().Note)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Errors from the API are *APIError values, which can be checked against the
+// sentinel errors in errors.go with errors.Is().
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The path prefix of the API version this client talks to.
+	apiPrefix = "/api/v2"
+
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// Client is a Notably API client. It is safe for concurrent use, although all
+// the goroutines using a Client share its login session.
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	bearerToken string
+	userAgent   string
+	maxRetries  int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// Option configures a Client. See the With... functions.
+type Option func(*Client)
+
+// WithHTTPClient makes the Client use the given HTTP client.
+// The login session is a cookie, so the HTTP client needs a cookie jar unless a
+// bearer token is used instead.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBearerToken makes the Client send "Authorization: Bearer <token>" with every
+// request. This is for when notablyd sits behind a gateway which authenticates
+// clients with bearer tokens; notablyd itself uses the login session cookie.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.bearerToken = token
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithRetries sets how many times a failed request is retried (0 turns retrying off),
+// and the bounds of the exponential backoff between attempts.
+// See shouldRetry() for which failures are retried.
+func WithRetries(maxRetries int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New creates a Client for the Notably server at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL '%s': %s", baseURL, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL '%s': scheme must be http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		userAgent:  "notably-go-client",
+		maxRetries: DefaultMaxRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.httpClient == nil {
+		jar, _ := cookiejar.New(nil) // Never fails without options.
+		c.httpClient = &http.Client{Jar: jar, Timeout: 30 * time.Second}
+	}
+
+	return c, nil
+}
+
+// request is everything needed to make (and remake, when retrying) an API request.
+type request struct {
+	method      string
+	path        string // Relative to the API prefix.
+	query       url.Values
+	body        interface{} // Marshalled to JSON, unless it is a []byte.
+	contentType string      // Defaults to JSON when there's a body.
+}
+
+// envelope is the shape of every successful API v2 response body.
+type envelope struct {
+	Data json.RawMessage `json:"data"`
+	Meta json.RawMessage `json:"meta"`
+}
+
+// do makes an API request, retrying if need be, and decodes the "data" and "meta"
+// of the response into data and meta, either of which may be nil.
+// Error responses are returned as an *APIError.
+func (c *Client) do(ctx context.Context, req request, data, meta interface{}) error {
+	var body []byte
+	switch b := req.body.(type) {
+	case nil:
+	case []byte:
+		body = b
+	default:
+		var err error
+		body, err = json.Marshal(b)
+		if err != nil {
+			return fmt.Errorf("error marshalling request body: %s", err.Error())
+		}
+	}
+	if body != nil && req.contentType == "" {
+		req.contentType = "application/json"
+	}
+
+	u := *c.baseURL
+	u.Path += apiPrefix + req.path
+	u.RawQuery = req.query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error creating request: %s", err.Error())
+		}
+		if body != nil {
+			httpReq.Header.Set("Content-Type", req.contentType)
+		}
+		httpReq.Header.Set("Accept", "application/json")
+		httpReq.Header.Set("User-Agent", c.userAgent)
+		if c.bearerToken != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+c.bearerToken)
+		}
+
+		resp, err := c.httpClient.Do(httpReq)
+		if attempt < c.maxRetries && c.shouldRetry(ctx, req.method, resp, err) {
+			wait := c.backoff(attempt, resp)
+			if resp != nil {
+				// Drain the body so the connection can be reused.
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		return decodeResponse(resp, data, meta)
+	}
+}
+
+// shouldRetry decides whether a request is worth trying again.
+// Rate limiting (429) means the request wasn't processed, so any request can be retried.
+// Network errors and gateway/unavailable errors might happen after the server has
+// done the work, so only idempotent requests are retried for those.
+func (c *Client) shouldRetry(ctx context.Context, method string, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	idempotent := method == http.MethodGet || method == http.MethodPut ||
+		method == http.MethodDelete || method == http.MethodHead
+	if err != nil {
+		return idempotent
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// backoff works out how long to wait before the next attempt: what the server asked
+// for with a Retry-After header, or else exponential backoff with jitter.
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			wait := time.Duration(secs) * time.Second
+			if wait > c.maxBackoff {
+				wait = c.maxBackoff
+			}
+			return wait
+		}
+	}
+
+	wait := c.minBackoff << attempt
+	if wait <= 0 || wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+	// Somewhere between half and all of it, so that clients don't retry in lockstep.
+	half := int64(wait / 2)
+	if half <= 0 {
+		return wait
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// decodeResponse decodes a response, closing its body.
+func decodeResponse(resp *http.Response, data, meta interface{}) error {
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %s", err.Error())
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp, respBody)
+	}
+	if resp.StatusCode == http.StatusNoContent || (data == nil && meta == nil) {
+		return nil
+	}
+
+	var env envelope
+	if err := json.Unmarshal(respBody, &env); err != nil {
+		return fmt.Errorf("error decoding response body: %s", err.Error())
+	}
+	if data != nil {
+		if err := json.Unmarshal(env.Data, data); err != nil {
+			return fmt.Errorf("error decoding response data: %s", err.Error())
+		}
+	}
+	if meta != nil && len(env.Meta) > 0 {
+		if err := json.Unmarshal(env.Meta, meta); err != nil {
+			return fmt.Errorf("error decoding response meta: %s", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"notably/cmd/notablyd/routes"
+)
+
+// To see the info messages, run as:
+//
+//	go test -test.v
+
+// newTestServer starts an in-process notablyd, and returns a client for it.
+func newTestServer(t *testing.T) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel) // Which stops the router's background work.
+	srv := httptest.NewServer(routes.NewRouter(routes.RouterConfig{Context: ctx}))
+	t.Cleanup(srv.Close)
+
+	// The login cookie is for "localhost", so the cookie jar won't hand it back to 127.0.0.1.
+	c, err := New(strings.Replace(srv.URL, "127.0.0.1", "localhost", 1))
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	userID := "testuser@testdomain.xyz"
+
+	//////////////////////// User subtests ////////////////////////
+	t.Run("User_Tests", func(t *testing.T) {
+		// Not logged in yet. Should error.
+		_, err := c.Me(ctx)
+		if !errors.Is(err, ErrNotLoggedIn) {
+			t.Fatalf("Expected ErrNotLoggedIn getting ourself before logging in, but got: %v", err)
+		}
+
+		user, err := c.Register(ctx, userID, "cafed00d")
+		if err != nil {
+			t.Fatalf("Failed registering a valid user: %v", err)
+		}
+		fmt.Println("TEST CLIENT: USER: Registered user:", user)
+
+		// Register the same user again. Should error.
+		_, err = c.Register(ctx, userID, "decafbad")
+		if !errors.Is(err, ErrUserExists) {
+			t.Fatalf("Expected ErrUserExists registering the same user again, but got: %v", err)
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+			t.Fatalf("Expected an *APIError with status 409, but got: %v", err)
+		}
+
+		// Log in with the wrong password. Should error.
+		_, err = c.Login(ctx, userID, "decafbad")
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Expected ErrInvalidCredentials logging in with the wrong password, but got: %v", err)
+		}
+
+		_, err = c.Login(ctx, userID, "cafed00d")
+		if err != nil {
+			t.Fatalf("Failed logging in a valid user: %v", err)
+		}
+		user, err = c.Me(ctx)
+		if err != nil {
+			t.Fatalf("Failed getting ourself after logging in: %v", err)
+		}
+		if user.UserID != userID {
+			t.Fatalf("Expected to be user '%s', but am '%s'", userID, user.UserID)
+		}
+		fmt.Println("TEST CLIENT: USER: Logged in as:", user)
+
+		usage, err := c.Usage(ctx)
+		if err != nil {
+			t.Fatalf("Failed getting our usage: %v", err)
+		}
+		if usage.UserID != userID || usage.Notes != 0 || usage.Bytes != 0 {
+			t.Fatalf("Expected no usage yet, but got: %+v", usage)
+		}
+	})
+
+	//////////////////////// Note subtests ////////////////////////
+	t.Run("Note_Tests", func(t *testing.T) {
+		note, err := c.CreateNote(ctx, "Buy milk")
+		if err != nil {
+			t.Fatalf("Failed creating a note: %v", err)
+		}
+		fmt.Println("TEST CLIENT: NOTE: Created note:", note)
+
+		got, err := c.GetNote(ctx, note.NoteID)
+		if err != nil || got.Note != "Buy milk" || got.NoteUserID != userID {
+			t.Fatalf("Failed getting the note we just created, got: %v, error: %v", got, err)
+		}
+
+		got, err = c.UpdateNote(ctx, note.NoteID, "Buy oat milk")
+		if err != nil || got.Note != "Buy oat milk" {
+			t.Fatalf("Failed updating the note, got: %v, error: %v", got, err)
+		}
+
+		got, err = c.PatchNote(ctx, note.NoteID, PatchTypeMerge, []byte(`{"note": "Buy soy milk"}`))
+		if err != nil || got.Note != "Buy soy milk" {
+			t.Fatalf("Failed patching the note, got: %v, error: %v", got, err)
+		}
+
+		// A patch which empties the note. Should error.
+		_, err = c.PatchNote(ctx, note.NoteID, PatchTypeJSON, []byte(`[{"op": "replace", "path": "/note", "value": ""}]`))
+		if !errors.Is(err, ErrInvalidNote) {
+			t.Fatalf("Expected ErrInvalidNote patching the note to be empty, but got: %v", err)
+		}
+
+		err = c.DeleteNote(ctx, note.NoteID)
+		if err != nil {
+			t.Fatalf("Failed deleting the note: %v", err)
+		}
+		_, err = c.GetNote(ctx, note.NoteID)
+		if !errors.Is(err, ErrNoteNotFound) {
+			t.Fatalf("Expected ErrNoteNotFound getting a deleted note, but got: %v", err)
+		}
+	})
+
+	//////////////////////// Paging subtests ////////////////////////
+	t.Run("Paging_Tests", func(t *testing.T) {
+		numNotes := 7
+		for i := 0; i < numNotes; i++ {
+			text := fmt.Sprintf("Note number %d", i)
+			if i%2 == 0 {
+				text += " has a MILK carton"
+			}
+			if _, err := c.CreateNote(ctx, text); err != nil {
+				t.Fatalf("Failed creating note %d: %v", i, err)
+			}
+		}
+
+		page, err := c.ListNotes(ctx, ListOptions{Limit: 3})
+		if err != nil {
+			t.Fatalf("Failed listing the first page of notes: %v", err)
+		}
+		if len(page.Notes) != 3 || page.TotalCount != numNotes || page.NextCursor == "" {
+			t.Fatalf("Expected a page of 3 of %d notes with a next cursor, but got %d of %d with cursor '%s'",
+				numNotes, len(page.Notes), page.TotalCount, page.NextCursor)
+		}
+
+		// Iterate through all the pages.
+		seen := make(map[string]bool)
+		it := c.Notes(ctx, ListOptions{Limit: 3})
+		for it.Next() {
+			seen[it.Note().NoteID] = true
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Failed iterating through the notes: %v", err)
+		}
+		if len(seen) != numNotes || it.TotalCount() != numNotes {
+			t.Fatalf("Expected to iterate through %d notes, but got %d (total count %d)",
+				numNotes, len(seen), it.TotalCount())
+		}
+		fmt.Println("TEST CLIENT: PAGING: Iterated through notes:", len(seen))
+
+		// Search. Should be case-insensitive.
+		found := 0
+		it = c.SearchNotes(ctx, "milk")
+		for it.Next() {
+			found++
+		}
+		if it.Err() != nil || found != 4 {
+			t.Fatalf("Expected to find 4 notes searching for 'milk', but found %d, error: %v", found, it.Err())
+		}
+
+		// A bad cursor. Should error.
+		it = c.Notes(ctx, ListOptions{Cursor: "zzz"})
+		if it.Next() || !errors.Is(it.Err(), ErrBadRequest) {
+			t.Fatalf("Expected ErrBadRequest iterating with a bad cursor, but got: %v", it.Err())
+		}
+
+		deleted, err := c.DeleteAllNotes(ctx)
+		if err != nil || deleted != numNotes {
+			t.Fatalf("Expected to delete %d notes, but deleted %d, error: %v", numNotes, deleted, err)
+		}
+	})
+
+	//////////////////////// Sync subtests ////////////////////////
+	t.Run("Sync_Tests", func(t *testing.T) {
+		// The first sync gets everything, including the note made offline.
+		first, err := c.Sync(ctx, "", []SyncChange{{ClientRef: "local-1", Note: "Made offline"}})
+		if err != nil {
+			t.Fatalf("Failed the first sync: %v", err)
+		}
+		fmt.Printf("TEST CLIENT: SYNC: First sync: %+v\n", *first)
+		if !first.Reset || len(first.Notes) != 1 || len(first.Results) != 1 || first.SyncToken == "" {
+			t.Fatalf("Expected a reset with the one note, but got: %+v", *first)
+		}
+		made := first.Results[0]
+		if made.Status != SyncStatusApplied || made.ClientRef != "local-1" || made.Note == nil {
+			t.Fatalf("Expected the offline note to be made, but got: %+v", *made)
+		}
+
+		// Edited elsewhere, and offline.
+		if _, err := c.UpdateNote(ctx, made.NoteID, "Edited online"); err != nil {
+			t.Fatalf("Failed updating the note: %v", err)
+		}
+		second, err := c.Sync(ctx, first.SyncToken, []SyncChange{
+			{NoteID: made.NoteID, BaseVersion: made.Note.Version, Note: "Edited offline"},
+			{Note: ""},
+		})
+		if err != nil {
+			t.Fatalf("Failed the second sync: %v", err)
+		}
+		fmt.Printf("TEST CLIENT: SYNC: Second sync: %+v\n", *second)
+		if copied := second.Results[0]; copied.Status != SyncStatusConflict || copied.Resolution != SyncResolutionCopied {
+			t.Fatalf("Expected the offline edit to be copied to a new note, but got: %+v", *copied)
+		}
+		if failed := second.Results[1]; failed.Status != SyncStatusFailed || failed.Code != "invalid_note" {
+			t.Fatalf("Expected the empty note to fail, but got: %+v", *failed)
+		}
+		if second.Reset || len(second.Notes) != 2 {
+			t.Fatalf("Expected the edited note and the copy, but got: %+v", *second)
+		}
+
+		// A made-up sync token. Should error.
+		if _, err := c.Sync(ctx, "nope", nil); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("Expected ErrBadRequest syncing with a bad sync token, but got: %v", err)
+		}
+
+		if _, err := c.DeleteAllNotes(ctx); err != nil {
+			t.Fatalf("Failed deleting the notes: %v", err)
+		}
+	})
+
+	t.Run("Logout_Tests", func(t *testing.T) {
+		if err := c.Logout(ctx); err != nil {
+			t.Fatalf("Failed logging out: %v", err)
+		}
+		_, err := c.CreateNote(ctx, "Too late")
+		if !errors.Is(err, ErrNotLoggedIn) {
+			t.Fatalf("Expected ErrNotLoggedIn creating a note after logging out, but got: %v", err)
+		}
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+
+	// Fails the first two requests, then succeeds.
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data": {"user_id": "testuser@testdomain.xyz", "creation_timestamp": 1}}`)
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithRetries(2, time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed creating client: %v", err)
+	}
+
+	// GETs are retried.
+	user, err := c.Me(ctx)
+	if err != nil || requests.Load() != 3 {
+		t.Fatalf("Expected to succeed on the 3rd request, but made %d requests, error: %v", requests.Load(), err)
+	}
+	fmt.Println("TEST CLIENT: RETRIES: Got user after retrying:", user)
+
+	// POSTs are not retried on a 503, since the server may have done the work.
+	requests.Store(0)
+	_, err = c.CreateNote(ctx, "Not retried")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || requests.Load() != 1 {
+		t.Fatalf("Expected a single request failing with a 503, but made %d requests, error: %v",
+			requests.Load(), err)
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The sentinel errors which an *APIError can be checked against with errors.Is(),
+// one for each problem code the API sends.
+var (
+	ErrBadRequest           = errors.New("bad request")
+	ErrMalformedBody        = errors.New("malformed request body")
+	ErrNotLoggedIn          = errors.New("not logged in")
+	ErrInvalidToken         = errors.New("invalid token")
+	ErrInvalidCredentials   = errors.New("invalid user ID or password")
+	ErrForbidden            = errors.New("forbidden")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrNoteNotFound         = errors.New("note not found")
+	ErrUserExists           = errors.New("user already exists")
+	ErrInvalidPatch         = errors.New("invalid patch")
+	ErrInvalidNote          = errors.New("invalid note")
+	ErrNoteTooLarge         = errors.New("note too large")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrWebhookNotFound      = errors.New("webhook not found")
+	ErrDeliveryNotFound     = errors.New("webhook delivery not found")
+	ErrImportNotFound       = errors.New("import not found")
+	ErrUploadTooLarge       = errors.New("upload too large")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrRateLimited          = errors.New("rate limited")
+	ErrInternal             = errors.New("internal server error")
+)
+
+// The problem codes of the API, and the sentinel errors they map to.
+var errorsByCode = map[string]error{
+	"bad_request":            ErrBadRequest,
+	"malformed_body":         ErrMalformedBody,
+	"not_logged_in":          ErrNotLoggedIn,
+	"invalid_token":          ErrInvalidToken,
+	"invalid_credentials":    ErrInvalidCredentials,
+	"forbidden":              ErrForbidden,
+	"user_not_found":         ErrUserNotFound,
+	"note_not_found":         ErrNoteNotFound,
+	"user_exists":            ErrUserExists,
+	"invalid_patch":          ErrInvalidPatch,
+	"invalid_note":           ErrInvalidNote,
+	"note_too_large":         ErrNoteTooLarge,
+	"quota_exceeded":         ErrQuotaExceeded,
+	"webhook_not_found":      ErrWebhookNotFound,
+	"delivery_not_found":     ErrDeliveryNotFound,
+	"import_not_found":       ErrImportNotFound,
+	"upload_too_large":       ErrUploadTooLarge,
+	"unsupported_media_type": ErrUnsupportedMediaType,
+	"rate_limited":           ErrRateLimited,
+	"internal_error":         ErrInternal,
+}
+
+// APIError is an error response from the API, which is an RFC 7807 problem details object.
+// StatusCode is always set; the rest may not be, if the response didn't come from
+// notablyd itself (e.g. a 502 from a proxy).
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	Instance   string `json:"instance"`
+	Code       string `json:"code"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("notably API error: %d %s", e.StatusCode, e.Title)
+	if e.Code != "" {
+		msg += fmt.Sprintf(" (%s)", e.Code)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Is lets errors.Is() match an APIError against the sentinel error for its problem code.
+func (e *APIError) Is(target error) bool {
+	sentinel, ok := errorsByCode[e.Code]
+	return ok && sentinel == target
+}
+
+// newAPIError builds an APIError from an error response.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil {
+		// Not problem details, so whatever it is goes into the detail.
+		apiErr = &APIError{Detail: string(body)}
+	}
+
+	apiErr.StatusCode = resp.StatusCode
+	if apiErr.Title == "" {
+		apiErr.Title = http.StatusText(resp.StatusCode)
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get("X-Request-ID")
+	}
+
+	return apiErr
+}
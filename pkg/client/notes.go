@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// The fields notes can be sorted by.
+	SortCreated = "created"
+	SortUpdated = "updated"
+
+	// The kinds of patch PatchNote() understands.
+	PatchTypeMerge = "application/merge-patch+json" // JSON Merge Patch, RFC 7396
+	PatchTypeJSON  = "application/json-patch+json"  // JSON Patch, RFC 6902
+)
+
+// Note is a note belonging to the logged-in user.
+type Note struct {
+	NoteID            string `json:"note_id"`
+	NoteUserID        string `json:"note_user_id"`
+	CreationTimestamp int64  `json:"creation_timestamp"` // Unix timestamp
+	UpdateTimestamp   int64  `json:"update_timestamp"`   // Unix timestamp
+	Note              string `json:"note"`
+	Version           int64  `json:"version"` // Goes up every time the note changes.
+}
+
+// ListOptions are for paging, sorting and filtering the list of notes.
+// The zero value gets the first page of all the notes, oldest first, with the
+// server's default page size.
+type ListOptions struct {
+	Limit         int    // Maximum number of notes in a page. <= 0 means the server default.
+	Cursor        string // NotePage.NextCursor of the previous page. Empty means the first page.
+	SortBy        string // SortCreated or SortUpdated. Empty means SortCreated.
+	Descending    bool   // Newest first instead of oldest first.
+	Query         string // Only notes whose text contains this, ignoring case.
+	CreatedAfter  int64  // Only notes created strictly after this Unix timestamp, if > 0.
+	CreatedBefore int64  // Only notes created strictly before this Unix timestamp, if > 0.
+}
+
+func (o ListOptions) values() url.Values {
+	query := url.Values{}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		query.Set("cursor", o.Cursor)
+	}
+	if o.SortBy != "" {
+		query.Set("sort", o.SortBy)
+	}
+	if o.Descending {
+		query.Set("order", "desc")
+	}
+	if o.Query != "" {
+		query.Set("q", o.Query)
+	}
+	if o.CreatedAfter > 0 {
+		query.Set("created_after", strconv.FormatInt(o.CreatedAfter, 10))
+	}
+	if o.CreatedBefore > 0 {
+		query.Set("created_before", strconv.FormatInt(o.CreatedBefore, 10))
+	}
+	return query
+}
+
+// NotePage is one page of notes.
+type NotePage struct {
+	Notes      []*Note
+	NextCursor string // Empty on the last page.
+	TotalCount int    // The number of notes matching the filters, across all pages.
+}
+
+// noteBody is the request body for creating and updating notes.
+type noteBody struct {
+	Note string `json:"note"`
+}
+
+// CreateNote adds a note for the logged-in user.
+func (c *Client) CreateNote(ctx context.Context, text string) (*Note, error) {
+	var note Note
+	err := c.do(ctx, request{method: http.MethodPost, path: "/notes", body: noteBody{Note: text}}, &note, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// GetNote gets one of the logged-in user's notes.
+func (c *Client) GetNote(ctx context.Context, noteID string) (*Note, error) {
+	var note Note
+	err := c.do(ctx, request{method: http.MethodGet, path: "/notes/" + url.PathEscape(noteID)}, &note, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// UpdateNote replaces the text of one of the logged-in user's notes.
+func (c *Client) UpdateNote(ctx context.Context, noteID, text string) (*Note, error) {
+	var note Note
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   "/notes/" + url.PathEscape(noteID),
+		body:   noteBody{Note: text},
+	}, &note, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// PatchNote applies a JSON Merge Patch or JSON Patch (see the PatchType constants)
+// to one of the logged-in user's notes.
+func (c *Client) PatchNote(ctx context.Context, noteID, patchType string, patch []byte) (*Note, error) {
+	var note Note
+	err := c.do(ctx, request{
+		method:      http.MethodPatch,
+		path:        "/notes/" + url.PathEscape(noteID),
+		body:        patch,
+		contentType: patchType,
+	}, &note, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+// DeleteNote deletes one of the logged-in user's notes.
+func (c *Client) DeleteNote(ctx context.Context, noteID string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/notes/" + url.PathEscape(noteID)}, nil, nil)
+}
+
+// DeleteAllNotes deletes all of the logged-in user's notes, returning how many there were.
+func (c *Client) DeleteAllNotes(ctx context.Context) (int, error) {
+	var deleted struct {
+		Deleted int `json:"deleted"`
+	}
+	err := c.do(ctx, request{method: http.MethodDelete, path: "/notes"}, &deleted, nil)
+	if err != nil {
+		return 0, err
+	}
+	return deleted.Deleted, nil
+}
+
+// ListNotes gets one page of the logged-in user's notes.
+// To go through all the pages, use Notes() instead.
+func (c *Client) ListNotes(ctx context.Context, opts ListOptions) (*NotePage, error) {
+	var page NotePage
+	var meta struct {
+		NextCursor string `json:"next_cursor"`
+		TotalCount int    `json:"total_count"`
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/notes", query: opts.values()}, &page.Notes, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	page.NextCursor = meta.NextCursor
+	page.TotalCount = meta.TotalCount
+	return &page, nil
+}
+
+// Notes returns an iterator over all of the logged-in user's notes matching the
+// list options, which fetches the pages as it goes. opts.Cursor is where it starts.
+func (c *Client) Notes(ctx context.Context, opts ListOptions) *NoteIterator {
+	return &NoteIterator{client: c, ctx: ctx, opts: opts}
+}
+
+// SearchNotes is Notes() for the notes containing query, ignoring case.
+func (c *Client) SearchNotes(ctx context.Context, query string) *NoteIterator {
+	return c.Notes(ctx, ListOptions{Query: query})
+}
+
+// NoteIterator goes through notes a page at a time. Use it like so:
+//
+//	for it.Next() {
+//		note := it.Note()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type NoteIterator struct {
+	client *Client
+	ctx    context.Context
+	opts   ListOptions
+
+	page       []*Note
+	next       int
+	note       *Note
+	lastPage   bool
+	totalCount int
+	err        error
+}
+
+// Next moves on to the next note, fetching the next page if need be.
+// It returns false when there are no more notes, or on error.
+func (it *NoteIterator) Next() bool {
+	for it.next >= len(it.page) {
+		if it.lastPage || it.err != nil {
+			it.note = nil
+			return false
+		}
+
+		page, err := it.client.ListNotes(it.ctx, it.opts)
+		if err != nil {
+			it.err = err
+			it.note = nil
+			return false
+		}
+		it.page, it.next = page.Notes, 0
+		it.totalCount = page.TotalCount
+		it.opts.Cursor = page.NextCursor
+		it.lastPage = page.NextCursor == ""
+	}
+
+	it.note = it.page[it.next]
+	it.next++
+	return true
+}
+
+// Note is the current note.
+func (it *NoteIterator) Note() *Note {
+	return it.note
+}
+
+// TotalCount is the number of notes the iterator goes through, as of the latest page fetched.
+func (it *NoteIterator) TotalCount() int {
+	return it.totalCount
+}
+
+// Err is the error which stopped the iteration, if any.
+func (it *NoteIterator) Err() error {
+	return it.err
+}
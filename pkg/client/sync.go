@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// The outcomes of a SyncChange.
+const (
+	SyncStatusApplied  = "applied"  // The change was made as asked.
+	SyncStatusConflict = "conflict" // The note changed since the base version. See the SyncResolutions.
+	SyncStatusFailed   = "failed"   // The change couldn't be made. See the result's Code.
+)
+
+// How a SyncStatusConflict was resolved. Nobody's text is thrown away.
+const (
+	SyncResolutionCopied    = "copied"    // The note was edited meanwhile, so the edit was saved as a new note.
+	SyncResolutionRecreated = "recreated" // The note was deleted meanwhile, so the edit was saved as a new note.
+	SyncResolutionKept      = "kept"      // The note was edited meanwhile, so it wasn't deleted.
+)
+
+// SyncChange is a change made to a note while offline. It creates a note when there's
+// no NoteID, deletes the note when Deleted is set, and otherwise replaces its text.
+type SyncChange struct {
+	ClientRef   string `json:"client_ref,omitempty"` // Our own name for the change, e.g. our ID of a new note.
+	NoteID      string `json:"note_id,omitempty"`
+	BaseVersion int64  `json:"base_version"` // The Version of the note which was changed.
+	Note        string `json:"note,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+}
+
+// SyncResult is what came of a SyncChange.
+type SyncResult struct {
+	ClientRef  string `json:"client_ref"`
+	NoteID     string `json:"note_id"` // The note it ended up as, e.g. a new note.
+	Status     string `json:"status"`
+	Resolution string `json:"resolution"` // For a SyncStatusConflict.
+	Note       *Note  `json:"note"`       // Nil if it's deleted, or the change failed.
+	Code       string `json:"code"`       // The problem code of a failure, e.g. "quota_exceeded".
+	Detail     string `json:"detail"`
+}
+
+// SyncedNote is a note which has changed since the last sync.
+type SyncedNote struct {
+	NoteID  string `json:"note_id"`
+	Version int64  `json:"version"`
+	Deleted bool   `json:"deleted"`
+	Note    *Note  `json:"note"` // Nil if it's deleted.
+}
+
+// SyncResponse is what a sync gets back.
+type SyncResponse struct {
+	Results []*SyncResult `json:"results"` // One for each change, in the same order.
+	Notes   []*SyncedNote `json:"notes"`
+	// Notes has all the notes, not only the changed ones, and any others are gone.
+	Reset     bool   `json:"reset"`
+	HasMore   bool   `json:"has_more"`   // There are more changes. Sync again straight away.
+	SyncToken string `json:"sync_token"` // For the next sync.
+}
+
+// Sync sends the changes made to the logged-in user's notes while offline, and gets
+// the changes to them since the sync which gave the sync token (empty for the first).
+func (c *Client) Sync(ctx context.Context, syncToken string, changes []SyncChange) (*SyncResponse, error) {
+	body := struct {
+		SyncToken string       `json:"sync_token"`
+		Changes   []SyncChange `json:"changes"`
+	}{syncToken, changes}
+	var resp SyncResponse
+	err := c.do(ctx, request{method: http.MethodPost, path: "/sync", body: body}, &resp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
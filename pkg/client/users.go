@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// User is a Notably user, as the API shows them.
+type User struct {
+	UserID            string `json:"user_id"`
+	CreationTimestamp int64  `json:"creation_timestamp"` // Unix timestamp
+}
+
+// Usage is how much a user is storing, and their quota.
+type Usage struct {
+	UserID string `json:"user_id"`
+	Notes  int    `json:"notes"`
+	Bytes  int64  `json:"bytes"` // Of note text, all told.
+	Quota  Quota  `json:"quota"`
+}
+
+// Quota limits how much a user can store. Zero means no limit.
+type Quota struct {
+	MaxNoteBytes  int64 `json:"max_note_bytes"`  // Of the text of one note.
+	MaxNotes      int   `json:"max_notes"`       // Per user.
+	MaxTotalBytes int64 `json:"max_total_bytes"` // Of the text of all of a user's notes.
+}
+
+// credentials is the request body for registering and logging in.
+type credentials struct {
+	ID       string `json:"id"`
+	Password string `json:"password"`
+}
+
+// Register registers a new user. The user ID must be an email address.
+// Registering does not log the user in.
+func (c *Client) Register(ctx context.Context, userID, password string) (*User, error) {
+	var user User
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/users",
+		body:   credentials{ID: userID, Password: password},
+	}, &user, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Login logs in a user, starting a login session which the Client uses from then on.
+// An unknown user and a wrong password both give ErrInvalidCredentials.
+func (c *Client) Login(ctx context.Context, userID, password string) (*User, error) {
+	var user User
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/sessions",
+		body:   credentials{ID: userID, Password: password},
+	}, &user, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Logout ends the login session.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/sessions"}, nil, nil)
+}
+
+// Me gets the details of the logged-in user.
+func (c *Client) Me(ctx context.Context) (*User, error) {
+	var user User
+	err := c.do(ctx, request{method: http.MethodGet, path: "/users/me"}, &user, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Usage gets how much the logged-in user is storing, and their quota. Going over the
+// quota is an ErrNoteTooLarge or ErrQuotaExceeded error.
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	var usage Usage
+	err := c.do(ctx, request{method: http.MethodGet, path: "/users/me/usage"}, &usage, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}